@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/pkositsyn/psi/internal/commands"
@@ -21,7 +20,13 @@ func init() {
 	rootCmd.AddCommand(commands.BobStep2Cmd)
 	rootCmd.AddCommand(commands.AliceStep1Cmd)
 	rootCmd.AddCommand(commands.AliceStep2Cmd)
+	rootCmd.AddCommand(commands.ServeCmd)
+	rootCmd.AddCommand(commands.ConnectCmd)
 	rootCmd.AddCommand(commands.ValidateCmd)
+	rootCmd.AddCommand(commands.PartyStep1Cmd)
+	rootCmd.AddCommand(commands.PartyReencryptCmd)
+	rootCmd.AddCommand(commands.PartyIntersectCmd)
+	commands.AddLogFormatFlag(rootCmd)
 }
 
 func Execute() {
@@ -29,7 +34,7 @@ func Execute() {
 	maxprocs.Adjust()
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		commands.ReportError(err)
 		os.Exit(1)
 	}
 }
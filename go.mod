@@ -2,9 +2,13 @@ module github.com/pkositsyn/psi
 
 go 1.25.5
 
-require github.com/spf13/cobra v1.8.1
+require (
+	filippo.io/nistec v0.0.4
+	github.com/spf13/cobra v1.8.1
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sys v0.36.0 // indirect
 )
@@ -2,17 +2,20 @@ package commands
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/pkositsyn/psi/internal/crypto"
 	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/manifest"
 	"github.com/pkositsyn/psi/internal/progress"
 	"github.com/pkositsyn/psi/internal/validation"
-	"github.com/pkositsyn/psi/internal/workerpool"
+	"github.com/pkositsyn/psi/pkg/psi"
 	"github.com/spf13/cobra"
 )
 
@@ -29,72 +32,262 @@ var (
 	aliceStep1OutECDHKey   string
 	aliceStep1OutEncBob    string
 	aliceStep1OutEncAlice  string
+	aliceStep1OutMapping   string
+	aliceStep1OutSumKey    string
+	aliceStep1OutSumPublic string
+	aliceStep1Mode         string
+	aliceStep1MemoryLimit  string
+	aliceStep1TempDir      string
 	aliceStep1BatchSize    int
+	aliceStep1Format       string
+	aliceStep1Points       string
+	aliceStep1OnInvalid    string
+	aliceStep1Rejects      string
+	aliceStep1Normalize    bool
+	aliceStep1Region       string
+	aliceStep1FoldGmail    bool
+	aliceStep1Duplicates   string
+	aliceStep1PadTo        int
+	aliceStep1PadBucket    int
+	aliceStep1Verifiable   bool
+	aliceStep1OutProof     string
+	aliceStep1InManifest   string
+	aliceStep1OutManifest  string
+	aliceStep1SignKey      string
+	aliceStep1PeerKey      string
+	aliceStep1NoManifest   bool
 )
 
 func init() {
 	AliceStep1Cmd.Flags().StringVar(&aliceStep1InputHMACKey, "in-hmac-key", "bob_hmac_key.txt", "Входной файл с HMAC ключом K от bob")
-	AliceStep1Cmd.Flags().StringVar(&aliceStep1InputEnc, "in-encrypted", "bob_encrypted.tsv.gz", "Входной файл H(phone_b)^B от bob")
-	AliceStep1Cmd.Flags().StringVar(&aliceStep1InputPuid, "in-auserid", "alice_data.tsv", "Входной файл с phone_a и a_user_id")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1InputEnc, "in-encrypted", "bob_encrypted.tsv.gz", "Входной файл H(id_b)^B от bob")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1InputPuid, "in-auserid", "alice_data.tsv", "Входной файл id_1 tab ... tab id_k tab a_user_id (колонки как у bob)")
 	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutECDHKey, "out-ecdh-key", "alice_ecdh_key.txt", "Выходной файл с ECDH ключом A (приватный)")
-	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutEncBob, "out-encrypted-bob", "bob_encrypted_a.tsv.gz", "Выходной файл H(phone_b)^B^A")
-	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutEncAlice, "out-encrypted-alice", "alice_encrypted.tsv.gz", "Выходной файл a_user_id <-> H(phone_a)^A")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutEncBob, "out-encrypted-bob", "bob_encrypted_a.tsv.gz", "Выходной файл H(id_b)^B^A")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutEncAlice, "out-encrypted-alice", "alice_encrypted.tsv.gz", "Выходной файл index <-> H(id_a)^A (для передачи)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutMapping, "out-mapping", "alice_mapping.tsv.gz", "Выходной файл index <-> a_user_id (приватный)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutSumKey, "out-sum-key", "alice_sum_key.txt", "Выходной файл с ключом расшифровки суммы (режим sum, приватный)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutSumPublic, "out-sum-public-key", "alice_sum_public_key.txt", "Выходной файл с открытым ключом для суммы (режим sum, для передачи)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1Mode, "mode", psi.ModeStandard, "Режим: cardinality - только размер пересечения, точки передаются без индексов в случайном порядке и маппинг не создается; sum - как cardinality, но последняя колонка входного файла - значение, сумму которого по пересечению узнает alice; для standard и labeled шаг 1 одинаков")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1Format, "transfer-format", string(io.FormatTSV), "Формат передаваемых файлов: tsv (TSV, сжатый gzip) или binary (компактный бинарный)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1Points, "point-encoding", crypto.PointUncompressed.String(), "Представление точек в передаваемых файлах: uncompressed (65 байт) или compressed (33 байта)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OnInvalid, "on-invalid", onInvalidFail, "Обработка строк с невалидным идентификатором или числом полей: fail - остановка, skip - пропуск, reject-file - пропуск с записью в --reject-output")
+	AliceStep1Cmd.Flags().BoolVar(&aliceStep1Normalize, "normalize", false, "Приводить идентификаторы к канонической форме перед проверкой: телефоны к E.164, email и maid к нижнему регистру")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1Region, "default-region", "RU", "Регион для номеров без кода страны при --normalize: RU, KZ, BY, UA, US, CA, GB")
+	AliceStep1Cmd.Flags().BoolVar(&aliceStep1FoldGmail, "fold-gmail", false, "При --normalize удалять точки и суффикс +tag в адресах gmail.com")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1Duplicates, "duplicates", string(psi.DuplicatesAll), duplicatesUsage)
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1Rejects, "reject-output", "alice_rejected.tsv", "Файл отклоненных строк: row tab причина tab исходные поля (приватный)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1MemoryLimit, "memory-limit", "", "Лимит памяти для перестановки строк на диске (например, 4G). По умолчанию строки переставляются в памяти")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1TempDir, "temp-dir", os.TempDir(), "Каталог для временных файлов перестановки")
+	AliceStep1Cmd.Flags().IntVar(&aliceStep1PadTo, "pad-to", 0, "Дополнить передаваемый файл фиктивными записями до указанного числа записей, чтобы скрыть размер множества")
+	AliceStep1Cmd.Flags().IntVar(&aliceStep1PadBucket, "pad-bucket", 0, "Дополнить передаваемый файл фиктивными записями до числа записей, кратного указанному")
+	AliceStep1Cmd.Flags().BoolVar(&aliceStep1Verifiable, "verifiable", false, "Приложить доказательства DLEQ того, что H(id_b)^B^A получены одним ключом A (режимы standard и labeled)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutProof, "out-proof", "alice_proof.txt", "Выходной файл с открытым ключом A и доказательствами DLEQ (с --verifiable, для передачи)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1InManifest, "in-manifest", "bob_step1_manifest.json", "Манифест сессии от bob, проверяется до чтения файлов bob")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1PeerKey, "peer-public-key", "", "Ожидаемый ключ подписи bob в hex, полученный по отдельному каналу. Без него принимается ключ из манифеста с предупреждением")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1OutManifest, "out-manifest", "alice_step1_manifest.json", "Выходной файл с подписанным манифестом сессии (для передачи)")
+	AliceStep1Cmd.Flags().StringVar(&aliceStep1SignKey, "out-sign-key", "alice_sign_key.txt", "Выходной файл с ключом подписи манифестов Ed25519 (приватный)")
+	AliceStep1Cmd.Flags().BoolVar(&aliceStep1NoManifest, "skip-manifest", false, skipManifestUsage)
 	AliceStep1Cmd.Flags().IntVar(&aliceStep1BatchSize, "batch-size", 128, "Размер батча для параллельной обработки")
+	addCompressionFlags(AliceStep1Cmd)
+}
+
+// keyIDTypes возвращает типы для файла ключа. Одна колонка phone не пишется
+// в файл, чтобы его могли прочитать прежние версии
+func keyIDTypes(idTypes []string) []string {
+	if slices.Equal(idTypes, []string{psi.IDTypePhone}) {
+		return nil
+	}
+	return idTypes
+}
+
+// idTypesString возвращает типы идентификаторов из файла ключа, пустой список означает phone
+func idTypesString(idTypes []string) string {
+	if len(idTypes) == 0 {
+		return psi.IDTypePhone
+	}
+	return strings.Join(idTypes, ",")
 }
 
 func runAliceStep1(cmd *cobra.Command, args []string) error {
-	keyK, err := crypto.LoadHMACKey(aliceStep1InputHMACKey)
+	if err := validateMode(aliceStep1Mode, psi.ModeStandard, psi.ModeLabeled, psi.ModeCardinality, psi.ModeSum); err != nil {
+		return err
+	}
+	if err := validateVerifiable(aliceStep1Verifiable, aliceStep1Mode); err != nil {
+		return err
+	}
+	sum := aliceStep1Mode == psi.ModeSum
+	// Режим sum передает точки так же, как cardinality
+	cardinality := aliceStep1Mode == psi.ModeCardinality || sum
+
+	memoryLimit, err := parseMemoryLimit(aliceStep1MemoryLimit)
+	if err != nil {
+		return err
+	}
+
+	format, err := io.ParseFormat(aliceStep1Format)
+	if err != nil {
+		return err
+	}
+
+	encoding, err := crypto.ParsePointEncoding(aliceStep1Points)
+	if err != nil {
+		return err
+	}
+
+	if aliceStep1Normalize {
+		if err := validation.ValidateRegion(aliceStep1Region); err != nil {
+			return err
+		}
+	}
+
+	files, err := newRecordFiles(
+		[]string{aliceStep1InputEnc, aliceStep1InputPuid},
+		[]string{aliceStep1OutEncBob, aliceStep1OutEncAlice, aliceStep1OutMapping, aliceStep1Rejects},
+	)
+	if err != nil {
+		return err
+	}
+	if aliceStep1Verifiable {
+		if err := requireFiles(aliceStep1InputEnc, aliceStep1OutEncBob); err != nil {
+			return err
+		}
+	}
+
+	// Файлы bob проверяются по манифесту до чтения, стандартный ввод - после
+	var bobManifest *manifest.Manifest
+	if !aliceStep1NoManifest {
+		bobKey, err := peerKey(aliceStep1PeerKey, "", aliceStep1InManifest)
+		if err != nil {
+			return err
+		}
+		bobManifest, err = loadManifest(aliceStep1InManifest, manifest.Expect{Step: stepBob1, PublicKey: bobKey},
+			manifestFile{artifactHMACKey, aliceStep1InputHMACKey},
+			manifestFile{artifactBobEncrypted, aliceStep1InputEnc},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	keyFile, err := crypto.LoadHMACKey(aliceStep1InputHMACKey)
 	if err != nil {
 		return fmt.Errorf("ошибка загрузки HMAC ключа K: %w", err)
 	}
+	version := keyFile.Version
 
-	keyA, err := crypto.GenerateECDHKey()
+	session, err := psi.NewAliceSession(psi.HMACKey(keyFile))
 	if err != nil {
-		return fmt.Errorf("ошибка генерации ECDH ключа A: %w", err)
+		return err
 	}
+	session.BatchSize = aliceStep1BatchSize
+	session.PointEncoding = encoding
+	session.MemoryLimit = memoryLimit
+	session.TempDir = aliceStep1TempDir
+	session.PadTo = aliceStep1PadTo
+	session.PadBucket = aliceStep1PadBucket
+
+	session.Normalize = aliceStep1Normalize
+	session.DefaultRegion = aliceStep1Region
+	session.FoldGmail = aliceStep1FoldGmail
+	session.Duplicates, err = psi.ParseDuplicatePolicy(aliceStep1Duplicates)
+	if err != nil {
+		return err
+	}
+
+	rejects, err := newRejectReport(files, aliceStep1OnInvalid, aliceStep1Rejects)
+	if err != nil {
+		return err
+	}
+	defer rejects.Close()
+	session.Reject = rejects.Reject()
 
-	if err := crypto.SaveECDHKey(aliceStep1OutECDHKey, keyA); err != nil {
+	if err := crypto.SaveECDHKey(aliceStep1OutECDHKey, session.ECDHKey); err != nil {
 		return fmt.Errorf("ошибка сохранения ECDH ключа A: %w", err)
 	}
 
-	bobReader, err := io.OpenTSVFile(aliceStep1InputEnc)
+	if sum {
+		session.SumKey, err = psi.GenerateSumKey()
+		if err != nil {
+			return fmt.Errorf("ошибка генерации ключа суммы: %w", err)
+		}
+		if err := crypto.SaveElGamalKey(aliceStep1OutSumKey, session.SumKey); err != nil {
+			return fmt.Errorf("ошибка сохранения ключа суммы: %w", err)
+		}
+		if err := crypto.SaveElGamalPublicKey(aliceStep1OutSumPublic, session.SumKey.PublicKey()); err != nil {
+			return fmt.Errorf("ошибка сохранения открытого ключа суммы: %w", err)
+		}
+	}
+
+	bobReader, err := files.open(aliceStep1InputEnc)
 	if err != nil {
 		return err
 	}
 	defer bobReader.Close()
+	if bobManifest != nil {
+		bobReader.SetRecords(bobManifest.Records(artifactBobEncrypted))
+	}
 
-	bobWriter, err := io.CreateTSVFile(aliceStep1OutEncBob)
+	bobWriter, err := files.create(aliceStep1OutEncBob, format, int(version))
 	if err != nil {
 		return err
 	}
 	defer bobWriter.Close()
 
-	aliceReader, err := io.OpenTSVFile(aliceStep1InputPuid)
+	aliceReader, err := files.open(aliceStep1InputPuid)
 	if err != nil {
 		return err
 	}
 	defer aliceReader.Close()
 
-	aliceWriter, err := io.CreateTSVFile(aliceStep1OutEncAlice)
+	aliceWriter, err := files.create(aliceStep1OutEncAlice, format, int(version))
 	if err != nil {
 		return err
 	}
 	defer aliceWriter.Close()
 
+	// В режиме cardinality маппинг не нужен и не создается
+	var mappingWriter *io.TSVWriter
+	if !cardinality {
+		mappingWriter, err = files.createTSV(aliceStep1OutMapping)
+		if err != nil {
+			return err
+		}
+		defer mappingWriter.Close()
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var wgProgress sync.WaitGroup
-	progress.TrackProgress(ctx, &wgProgress, "Прогресс обработки", aliceReader, bobReader)
+	progress.TrackProgress(ctx, &wgProgress, reporter, "Прогресс обработки", aliceReader, bobReader)
 
 	errChan := make(chan error, 2)
+	bobCounter := &recordCounter{TSVWriter: bobWriter}
+	aliceCounter := &recordCounter{TSVWriter: aliceWriter}
 
 	var wg sync.WaitGroup
 	wg.Go(func() {
-		errChan <- ProcessBobDataStep1(bobReader, bobWriter, keyA, aliceStep1BatchSize)
+		var err error
+		if cardinality {
+			_, err = session.ReencryptBobCardinality(bobReader, bobCounter)
+		} else {
+			_, err = session.ReencryptBob(bobReader, bobCounter)
+		}
+		errChan <- err
 	})
 
+	var stats psi.Stats
 	wg.Go(func() {
-		errChan <- ProcessAliceDataStep1(aliceReader, aliceWriter, keyK, keyA, aliceStep1BatchSize)
+		var err error
+		switch {
+		case sum:
+			stats, err = session.Step1Sum(aliceReader, aliceCounter)
+		case cardinality:
+			stats, err = session.Step1Cardinality(aliceReader, aliceCounter)
+		default:
+			stats, err = session.Step1(aliceReader, aliceCounter, mappingWriter)
+		}
+		errChan <- err
 	})
 
 	go func() {
@@ -110,207 +303,82 @@ func runAliceStep1(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	fmt.Fprintf(os.Stderr, "ECDH ключ A (приватный): %s\n", aliceStep1OutECDHKey)
-	fmt.Fprintf(os.Stderr, "H(phone_b)^B^A сохранен: %s\n", aliceStep1OutEncBob)
-	fmt.Fprintf(os.Stderr, "H(phone_a)^A сохранен: %s\n", aliceStep1OutEncAlice)
-
-	return nil
-}
-
-type bobDataTask struct {
-	index      string
-	encryptedB string
-}
-
-type bobDataResult struct {
-	index       string
-	encryptedBA string
-}
-
-func ProcessBobDataStep1(reader *io.TSVReader, writer *io.TSVWriter, keyA *crypto.ECDHKey, batchSize int) error {
-	handler := func(task bobDataTask) (bobDataResult, error) {
-		encryptedBA, err := crypto.ECDHApply(keyA, task.encryptedB)
-		if err != nil {
-			return bobDataResult{}, err
-		}
-
-		return bobDataResult{
-			index:       task.index,
-			encryptedBA: encryptedBA,
-		}, nil
+	if err := verifyStream(bobManifest, artifactBobEncrypted, aliceStep1InputEnc, bobReader); err != nil {
+		return err
 	}
 
-	pool := workerpool.New(handler)
-
-	var writeErr error
-	var wg sync.WaitGroup
-
-	wg.Go(func() {
-		for result := range pool.Results() {
-			if result.Error != nil {
-				if writeErr == nil {
-					writeErr = result.Error
-				}
-				continue
-			}
-			if writeErr == nil {
-				if err := writer.Write([]string{result.Value.index, result.Value.encryptedBA}); err != nil {
-					writeErr = err
-				}
-			}
-		}
-	})
+	if err := rejects.Close(); err != nil {
+		return fmt.Errorf("ошибка записи отклоненных строк: %w", err)
+	}
 
-	batch := make([]bobDataTask, 0, batchSize)
+	if err := bobWriter.Close(); err != nil {
+		return fmt.Errorf("ошибка финализации записи: %w", err)
+	}
+	if err := aliceWriter.Close(); err != nil {
+		return fmt.Errorf("ошибка финализации записи: %w", err)
+	}
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			pool.Close()
-			wg.Wait()
+	if aliceStep1Verifiable {
+		if err := proveFile(session.ECDHKey, aliceStep1InputEnc, aliceStep1OutEncBob, aliceStep1OutProof); err != nil {
 			return err
 		}
+	}
 
-		if len(record) < 2 {
-			pool.Close()
-			wg.Wait()
-			return fmt.Errorf("неверный формат записи")
-		}
-
-		batch = append(batch, bobDataTask{
-			index:      record[0],
-			encryptedB: record[1],
-		})
-
-		if len(batch) >= batchSize {
-			pool.Add(batch)
-			batch = make([]bobDataTask, 0, batchSize)
+	if bobManifest != nil {
+		if err := writeAliceStep1Manifest(bobManifest, version, bobCounter, aliceCounter); err != nil {
+			return err
 		}
 	}
 
-	if len(batch) > 0 {
-		pool.Add(batch)
+	result.add("records", "Обработано записей", stats.Records)
+	addPadding(stats)
+	rejects.Report()
+	addDuplicates(stats, session.Duplicates, keyFile.IDTypes)
+	result.add("protocol_version", "Версия протокола", version)
+	result.add("id_types", "Типы идентификаторов", idTypesString(keyFile.IDTypes))
+	result.output("alice_ecdh_key", "ECDH ключ A (приватный)", aliceStep1OutECDHKey)
+	result.output(artifactBobEncryptedA, "H(id_b)^B^A сохранен", aliceStep1OutEncBob)
+	result.output(artifactAliceEncrypted, "H(id_a)^A сохранен", aliceStep1OutEncAlice)
+	if !cardinality {
+		result.output("alice_mapping", "Маппинг a_user_id (приватный)", aliceStep1OutMapping)
 	}
-
-	pool.Close()
-	wg.Wait()
-
-	if writeErr != nil {
-		return writeErr
+	if sum {
+		result.output("alice_sum_key", "Ключ суммы (приватный)", aliceStep1OutSumKey)
+		result.output(artifactSumPublicKey, "Открытый ключ суммы (для передачи)", aliceStep1OutSumPublic)
 	}
+	result.report()
 
 	return nil
 }
 
-type aliceDataTask struct {
-	index   int
-	phone   string
-	aUserId string
-}
-
-type aliceDataResult struct {
-	index     int
-	aUserId   string
-	encrypted string
-}
-
-func ProcessAliceDataStep1(reader *io.TSVReader, writer *io.TSVWriter, keyK []byte, keyA *crypto.ECDHKey, batchSize int) error {
-	hmacPool := &sync.Pool{
-		New: func() any {
-			return hmac.New(sha256.New, keyK)
-		},
+// writeAliceStep1Manifest продолжает сессию bob и запоминает его ключ подписи:
+// bob-step2 проверяет, что alice приняла файлы именно от него
+func writeAliceStep1Manifest(bobManifest *manifest.Manifest, version psi.ProtocolVersion, bobCounter, aliceCounter *recordCounter) error {
+	_, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("ошибка генерации ключа подписи: %w", err)
 	}
-
-	handler := func(task aliceDataTask) (aliceDataResult, error) {
-		if err := validation.ValidateE164Phone(task.phone); err != nil {
-			return aliceDataResult{}, fmt.Errorf("строка %d: %w", task.index, err)
-		}
-
-		hashed := crypto.HMAC(hmacPool, keyK, []byte(task.phone))
-
-		encrypted, err := crypto.ECDHApply(keyA, hashed)
-		if err != nil {
-			return aliceDataResult{}, err
-		}
-
-		return aliceDataResult{
-			index:     task.index,
-			aUserId:   task.aUserId,
-			encrypted: encrypted,
-		}, nil
+	if err := crypto.SaveSigningKey(aliceStep1SignKey, signKey); err != nil {
+		return fmt.Errorf("ошибка сохранения ключа подписи: %w", err)
 	}
 
-	pool := workerpool.New(handler)
-
-	var writeErr error
-	var wg sync.WaitGroup
-
-	wg.Go(func() {
-		for result := range pool.Results() {
-			if result.Error != nil {
-				if writeErr == nil {
-					writeErr = result.Error
-				}
-				continue
-			}
-			if writeErr == nil {
-				if err := writer.Write([]string{
-					fmt.Sprintf("%d", result.Value.index),
-					result.Value.encrypted,
-					result.Value.aUserId,
-				}); err != nil {
-					writeErr = err
-				}
-			}
-		}
-	})
-
-	count := 0
-	batch := make([]aliceDataTask, 0, batchSize)
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			pool.Close()
-			wg.Wait()
+	m := manifest.New(bobManifest.SessionID, int(version), stepAlice1)
+	m.PeerPublicKey = bobManifest.PublicKey
+	if err := addRecords(m, artifactBobEncryptedA, aliceStep1OutEncBob, bobCounter); err != nil {
+		return err
+	}
+	if err := addRecords(m, artifactAliceEncrypted, aliceStep1OutEncAlice, aliceCounter); err != nil {
+		return err
+	}
+	if aliceStep1Verifiable {
+		if err := m.AddFile(artifactAliceProof, aliceStep1OutProof, 0); err != nil {
 			return err
 		}
-
-		if len(record) != 2 {
-			pool.Close()
-			wg.Wait()
-			return fmt.Errorf("неверный формат записи")
-		}
-
-		batch = append(batch, aliceDataTask{
-			index:   count,
-			phone:   record[0],
-			aUserId: record[1],
-		})
-		count++
-
-		if len(batch) >= batchSize {
-			pool.Add(batch)
-			batch = make([]aliceDataTask, 0, batchSize)
-		}
 	}
-
-	if len(batch) > 0 {
-		pool.Add(batch)
-	}
-
-	pool.Close()
-	wg.Wait()
-
-	if writeErr != nil {
-		return writeErr
+	if aliceStep1Mode == psi.ModeSum {
+		if err := m.AddFile(artifactSumPublicKey, aliceStep1OutSumPublic, 0); err != nil {
+			return err
+		}
 	}
-
-	return nil
+	return saveManifest(m, aliceStep1OutManifest, signKey)
 }
@@ -2,12 +2,17 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/pkositsyn/psi/internal/crypto"
 	"github.com/pkositsyn/psi/internal/io"
 	"github.com/pkositsyn/psi/internal/progress"
+	"github.com/pkositsyn/psi/pkg/psi"
 	"github.com/spf13/cobra"
 )
 
@@ -18,138 +23,258 @@ var AliceStep2Cmd = &cobra.Command{
 }
 
 var (
-	aliceStep2InputOriginal string
-	aliceStep2InputBob      string
-	aliceStep2Output        string
+	aliceStep2InputMapping string
+	aliceStep2InputHMACKey string
+	aliceStep2Priority     []string
+	aliceStep2InputBob     string
+	aliceStep2InputLabels  string
+	aliceStep2Output       string
+	aliceStep2OutputMode   string
+	aliceStep2Mode         string
+	aliceStep2MemoryLimit  string
+	aliceStep2TempDir      string
+	aliceStep2InputSumKey  string
+	aliceStep2InputSum     string
+	aliceStep2OutSum       string
+	aliceStep2MaxSum       uint64
+	aliceStep2Verifiable   bool
+	aliceStep2InputProof   string
+	aliceStep2InputEnc     string
+	aliceStep2OwnManifest  string
+	aliceStep2InManifest   string
+	aliceStep2OutManifest  string
+	aliceStep2SignKey      string
+	aliceStep2NoManifest   bool
 )
 
 func init() {
-	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputOriginal, "in-original", "alice_encrypted.tsv.gz", "Файл a_user_id <-> H(phone_a)^A из step1")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputMapping, "in-mapping", "alice_mapping.tsv.gz", "Файл index <-> a_user_id из step1 (или alice_encrypted.tsv.gz старого формата)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputMapping, "in-original", "alice_mapping.tsv.gz", "Устаревший синоним --in-mapping")
+	AliceStep2Cmd.Flags().MarkDeprecated("in-original", "используйте --in-mapping")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputHMACKey, "in-hmac-key", "bob_hmac_key.txt", "Файл с HMAC ключом K от bob (определяет колонки идентификаторов)")
+	AliceStep2Cmd.Flags().StringSliceVar(&aliceStep2Priority, "priority", nil, "Порядок типов идентификаторов при выборе совпадения через запятую, например phone,email. По умолчанию порядок колонок")
 	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputBob, "in-bob", "bob_final.tsv.gz", "Файл b_user_id <-> H(phone_a)^A^B от bob")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputLabels, "in-labels", "bob_labels.tsv.gz", "Файл с зашифрованными b_user_id от bob (режим labeled)")
 	AliceStep2Cmd.Flags().StringVar(&aliceStep2Output, "output", "alice_final.tsv", "Выходной файл a_user_id <-> b_user_id")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2OutputMode, "output-mode", string(psi.OutputMatched), "Какие записи писать в результат: matched - совпавшие, all - все, у несовпавших b_user_id пустой, unmatched - только несовпавшие (режимы standard и labeled)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2Mode, "mode", psi.ModeStandard, "Режим: standard, labeled или sum (должен совпадать с режимом bob-step2)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputSumKey, "in-sum-key", "alice_sum_key.txt", "Файл с ключом расшифровки суммы из step1 (режим sum)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputSum, "in-sum", "psi_sum_encrypted.txt", "Файл с зашифрованной суммой от bob (режим sum)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2OutSum, "out-sum", "psi_sum.txt", "Выходной файл с суммой значений пересечения (режим sum)")
+	AliceStep2Cmd.Flags().Uint64Var(&aliceStep2MaxSum, "max-sum", psi.DefaultMaxSum, "Верхняя граница суммы (режим sum). Время и память расшифровки растут как корень из границы")
+	AliceStep2Cmd.Flags().BoolVar(&aliceStep2Verifiable, "verifiable", false, "Проверить доказательства DLEQ от bob до обработки (режимы standard и labeled)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputProof, "in-proof", "bob_proof.txt", "Файл с доказательствами DLEQ от bob (с --verifiable)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InputEnc, "in-alice-enc", "alice_encrypted.tsv.gz", "Свой файл H(phone_a)^A из step1 для проверки доказательств (с --verifiable)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2OwnManifest, "in-own-manifest", "alice_step1_manifest.json", "Свой манифест из step1 (идентификатор сессии)")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2InManifest, "in-manifest", "bob_step2_manifest.json", "Манифест сессии от bob, проверяется до чтения файлов bob")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2SignKey, "in-sign-key", "alice_sign_key.txt", "Файл с ключом подписи манифестов из step1")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2OutManifest, "out-manifest", "alice_step2_manifest.json", "Выходной файл с подписанным манифестом результата")
+	AliceStep2Cmd.Flags().BoolVar(&aliceStep2NoManifest, "skip-manifest", false, skipManifestUsage)
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2MemoryLimit, "memory-limit", "", "Лимит памяти для сортировки на диске (например, 4G). По умолчанию данные загружаются в память")
+	AliceStep2Cmd.Flags().StringVar(&aliceStep2TempDir, "temp-dir", os.TempDir(), "Каталог для временных файлов сортировки")
+	addCompressionFlags(AliceStep2Cmd)
 }
 
 func runAliceStep2(cmd *cobra.Command, args []string) error {
-	bobData, err := loadBobFinalData(aliceStep2InputBob)
-	if err != nil {
-		return fmt.Errorf("ошибка загрузки данных от bob: %w", err)
+	if err := validateMode(aliceStep2Mode, psi.ModeStandard, psi.ModeLabeled, psi.ModeSum); err != nil {
+		return err
 	}
-
-	if err := createFinalMapping(aliceStep2InputOriginal, aliceStep2Output, bobData); err != nil {
-		return fmt.Errorf("ошибка создания финального маппинга: %w", err)
+	if err := validateVerifiable(aliceStep2Verifiable, aliceStep2Mode); err != nil {
+		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "Финальный маппинг сохранен: %s\n", aliceStep2Output)
-	return nil
-}
+	outputMode, err := psi.ParseOutputMode(aliceStep2OutputMode)
+	if err != nil {
+		return err
+	}
 
-type BobRecord struct {
-	EncryptedAB string
-	UserID      string
-}
+	out, err := aliceStep2Manifest()
+	if err != nil {
+		return err
+	}
 
-func LoadBobFinalData(reader *io.TSVReader) (map[string]BobRecord, error) {
-	result := make(map[string]BobRecord)
+	if aliceStep2Mode == psi.ModeSum {
+		return runAliceStep2Sum(out)
+	}
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
+	// Bob должен применить один ключ B ко всем записям, которые вернул
+	if aliceStep2Verifiable {
+		if err := verifyFile(aliceStep2InputProof, aliceStep2InputEnc, aliceStep2InputBob, false); err != nil {
+			return err
 		}
+	}
 
-		if len(record) < 3 {
-			continue
-		}
+	files, err := aliceStep2Files()
+	if err != nil {
+		return err
+	}
 
-		index := record[0]
-		encryptedAB := record[1]
-		bUserID := record[2]
+	keyK, err := crypto.LoadHMACKey(aliceStep2InputHMACKey)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки HMAC ключа K: %w", err)
+	}
 
-		result[index] = BobRecord{
-			EncryptedAB: encryptedAB,
-			UserID:      bUserID,
-		}
+	memoryLimit, err := parseMemoryLimit(aliceStep2MemoryLimit)
+	if err != nil {
+		return err
 	}
 
-	return result, nil
-}
+	bobReader, err := files.open(aliceStep2InputBob)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия данных от bob: %w", err)
+	}
+	defer bobReader.Close()
 
-func loadBobFinalData(filename string) (map[string]BobRecord, error) {
-	reader, err := io.OpenTSVFile(filename)
+	reader, err := files.open(aliceStep2InputMapping)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer reader.Close()
 
-	return LoadBobFinalData(reader)
-}
+	writer, err := files.createTSV(aliceStep2Output)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	counter := &recordCounter{TSVWriter: writer}
 
-func ProcessAliceStep2(reader *io.TSVReader, writer *io.TSVWriter, bobData map[string]BobRecord) (int, int, error) {
-	count := 0
-	matched := 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	progress.TrackProgress(ctx, &wg, reporter, "Прогресс обработки", reader)
+
+	session := psi.AliceSession{
+		HMACKey:      psi.HMACKey(keyK),
+		Priority:     aliceStep2Priority,
+		Output:       outputMode,
+		Step1Options: psi.Step1Options{MemoryLimit: memoryLimit, TempDir: aliceStep2TempDir},
+	}
+	var stats psi.Stats
+	var labelsReader *io.TSVReader
+
+	if aliceStep2Mode == psi.ModeLabeled {
+		labelsReader, err = files.open(aliceStep2InputLabels)
 		if err != nil {
-			return count, matched, err
+			return fmt.Errorf("ошибка открытия меток от bob: %w", err)
 		}
+		defer labelsReader.Close()
 
-		if len(record) < 3 {
-			return count, matched, fmt.Errorf("неверный формат записи")
+		stats, err = session.Step2Labeled(reader, bobReader, labelsReader, counter)
+	} else {
+		stats, err = session.Step2(reader, bobReader, counter)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка создания финального маппинга: %w", err)
+	}
+
+	if err := out.verifyStream(artifactBobFinal, aliceStep2InputBob, bobReader); err != nil {
+		return err
+	}
+	if labelsReader != nil {
+		if err := out.verifyStream(artifactBobLabels, aliceStep2InputLabels, labelsReader); err != nil {
+			return err
 		}
+	}
 
-		index := record[0]
-		aUserId := record[2]
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := out.addRecords(artifactAliceFinal, aliceStep2Output, counter); err != nil {
+		return err
+	}
+	if err := out.save(); err != nil {
+		return err
+	}
 
-		if br, found := bobData[index]; found && br.UserID != "" {
-			matched++
+	cancel()
+	wg.Wait()
+
+	result.add("records", "Обработано записей", stats.Records)
+	result.add("matched", "Совпадений", stats.Matched)
+	if len(keyK.IDTypes) > 1 {
+		result.add("matched_by", "Совпадений по типам", countsByType{idTypes: keyK.IDTypes, counts: stats.MatchedBy})
+	}
+	result.output(artifactAliceFinal, "Финальный маппинг сохранен", aliceStep2Output)
+	result.report()
+	return nil
+}
 
-			if err := writer.Write([]string{aUserId, br.UserID}); err != nil {
-				return count, matched, err
-			}
+// aliceStep2Files проверяет, что стандартные потоки не заняты файлами,
+// которые --verifiable читает повторно
+func aliceStep2Files() (recordFiles, error) {
+	inputs := []string{aliceStep2InputBob, aliceStep2InputMapping}
+	if aliceStep2Mode == psi.ModeLabeled {
+		inputs = append(inputs, aliceStep2InputLabels)
+	}
+
+	files, err := newRecordFiles(inputs, []string{aliceStep2Output})
+	if err != nil {
+		return recordFiles{}, err
+	}
+	if aliceStep2Verifiable {
+		if err := requireFiles(aliceStep2InputBob); err != nil {
+			return recordFiles{}, err
 		}
+	}
+	return files, nil
+}
+
+// aliceStep2Manifest проверяет манифест bob до чтения его файлов, файлы
+// из стандартного ввода проверяются после чтения
+func aliceStep2Manifest() (*stepManifest, error) {
+	if aliceStep2NoManifest {
+		return nil, nil
+	}
 
-		count++
+	var files []manifestFile
+	switch aliceStep2Mode {
+	case psi.ModeSum:
+		files = append(files, manifestFile{artifactSumEncrypted, aliceStep2InputSum})
+	case psi.ModeLabeled:
+		files = append(files, manifestFile{artifactBobFinal, aliceStep2InputBob}, manifestFile{artifactBobLabels, aliceStep2InputLabels})
+	default:
+		files = append(files, manifestFile{artifactBobFinal, aliceStep2InputBob})
+	}
+	if aliceStep2Verifiable {
+		files = append(files, manifestFile{artifactBobProof, aliceStep2InputProof})
 	}
 
-	return count, matched, nil
+	return continueSession(aliceStep2OwnManifest, aliceStep2SignKey, aliceStep2InManifest, "", stepBob2, stepAlice2, aliceStep2OutManifest, files...)
 }
 
-func createFinalMapping(originalFile, outputFile string, bobData map[string]BobRecord) error {
-	reader, err := io.OpenTSVFile(originalFile)
+// runAliceStep2Sum расшифровывает сумму значений пересечения от bob
+func runAliceStep2Sum(out *stepManifest) error {
+	sumKey, err := crypto.LoadElGamalKey(aliceStep2InputSumKey)
 	if err != nil {
-		return err
+		return fmt.Errorf("ошибка загрузки ключа суммы: %w", err)
 	}
-	defer reader.Close()
 
-	writer, err := io.CreateTSVFile(outputFile)
+	data, err := os.ReadFile(aliceStep2InputSum)
 	if err != nil {
-		return err
+		return fmt.Errorf("ошибка чтения суммы от bob: %w", err)
 	}
-	defer writer.Close()
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	var wg sync.WaitGroup
-	progress.TrackProgress(ctx, &wg, "Прогресс обработки", reader)
 
-	count, matched, err := ProcessAliceStep2(reader, writer, bobData)
+	session := psi.AliceSession{SumKey: sumKey}
+	sum, err := session.DecryptSum(strings.TrimSpace(string(data)), aliceStep2MaxSum)
+	if errors.Is(err, psi.ErrSumRange) {
+		return fmt.Errorf("%w, увеличьте --max-sum", err)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("ошибка расшифровки суммы: %w", err)
 	}
 
-	if err := writer.Close(); err != nil {
+	if err := os.WriteFile(aliceStep2OutSum, []byte(strconv.FormatUint(sum, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := out.add(artifactSum, aliceStep2OutSum, 0); err != nil {
+		return err
+	}
+	if err := out.save(); err != nil {
 		return err
 	}
 
-	cancel()
-	wg.Wait()
-
-	fmt.Fprintf(os.Stderr, "Обработано записей: %d, совпадений: %d\n", count, matched)
+	result.add("sum", "Сумма значений пересечения", sum)
+	result.output(artifactSum, "Результат сохранен", aliceStep2OutSum)
+	result.report()
 	return nil
 }
@@ -2,23 +2,24 @@ package commands
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"os"
 	"sync"
 
 	"github.com/pkositsyn/psi/internal/crypto"
 	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/manifest"
 	"github.com/pkositsyn/psi/internal/progress"
 	"github.com/pkositsyn/psi/internal/validation"
-	"github.com/pkositsyn/psi/internal/workerpool"
+	"github.com/pkositsyn/psi/pkg/psi"
 	"github.com/spf13/cobra"
 )
 
 var BobStep1Cmd = &cobra.Command{
 	Use:   "bob-step1",
-	Short: "Bob Step 1: генерация ключей и шифрование телефонов",
+	Short: "Bob Step 1: генерация ключей и шифрование идентификаторов",
 	RunE:  runBobStep1,
 }
 
@@ -27,54 +28,150 @@ var (
 	bobStep1OutHMACKey string
 	bobStep1OutECDHKey string
 	bobStep1OutEnc     string
+	bobStep1OutMapping string
 	bobStep1BatchSize  int
+	bobStep1Version    int
+	bobStep1Format     string
+	bobStep1Points     string
+	bobStep1OnInvalid  string
+	bobStep1Rejects    string
+	bobStep1Normalize  bool
+	bobStep1Region     string
+	bobStep1FoldGmail  bool
+	bobStep1Duplicates string
+	bobStep1IDTypes    []string
+	bobStep1MemLimit   string
+	bobStep1TempDir    string
+	bobStep1PadTo      int
+	bobStep1PadBucket  int
+	bobStep1Manifest   string
+	bobStep1SignKey    string
+	bobStep1NoManifest bool
 )
 
 func init() {
-	BobStep1Cmd.Flags().StringVarP(&bobStep1Input, "input", "i", "bob_data.tsv", "Входной TSV файл (phone tab b_user_id)")
+	BobStep1Cmd.Flags().StringVarP(&bobStep1Input, "input", "i", "bob_data.tsv", "Входной TSV файл (id_1 tab ... tab id_k tab b_user_id)")
 	BobStep1Cmd.Flags().StringVar(&bobStep1OutHMACKey, "out-hmac-key", "bob_hmac_key.txt", "Выходной файл с HMAC ключом K (для передачи)")
 	BobStep1Cmd.Flags().StringVar(&bobStep1OutECDHKey, "out-ecdh-key", "bob_ecdh_key.txt", "Выходной файл с ECDH ключом B (приватный)")
-	BobStep1Cmd.Flags().StringVarP(&bobStep1OutEnc, "out-encrypted", "e", "bob_encrypted.tsv.gz", "Выходной файл с index и H(phone)^B (для передачи)")
+	BobStep1Cmd.Flags().StringVarP(&bobStep1OutEnc, "out-encrypted", "e", "bob_encrypted.tsv.gz", "Выходной файл с index и H(id)^B (для передачи)")
+	BobStep1Cmd.Flags().StringVar(&bobStep1OutMapping, "out-mapping", "bob_mapping.tsv.gz", "Выходной файл index <-> b_user_id (приватный)")
 	BobStep1Cmd.Flags().IntVar(&bobStep1BatchSize, "batch-size", 128, "Размер батча для параллельной обработки")
+	BobStep1Cmd.Flags().StringVar(&bobStep1Format, "transfer-format", string(io.FormatTSV), "Формат передаваемых файлов: tsv (TSV, сжатый gzip) или binary (компактный бинарный)")
+	BobStep1Cmd.Flags().StringVar(&bobStep1Points, "point-encoding", crypto.PointUncompressed.String(), "Представление точек в передаваемых файлах: uncompressed (65 байт) или compressed (33 байта)")
+	BobStep1Cmd.Flags().StringSliceVar(&bobStep1IDTypes, "id-type", []string{psi.IDTypePhone}, "Типы колонок идентификаторов через запятую: phone, email, maid или raw (передаются alice вместе с ключом K)")
+	BobStep1Cmd.Flags().StringVar(&bobStep1OnInvalid, "on-invalid", onInvalidFail, "Обработка строк с невалидным идентификатором или числом полей: fail - остановка, skip - пропуск, reject-file - пропуск с записью в --reject-output")
+	BobStep1Cmd.Flags().BoolVar(&bobStep1Normalize, "normalize", false, "Приводить идентификаторы к канонической форме перед проверкой: телефоны к E.164, email и maid к нижнему регистру")
+	BobStep1Cmd.Flags().StringVar(&bobStep1Region, "default-region", "RU", "Регион для номеров без кода страны при --normalize: RU, KZ, BY, UA, US, CA, GB")
+	BobStep1Cmd.Flags().BoolVar(&bobStep1FoldGmail, "fold-gmail", false, "При --normalize удалять точки и суффикс +tag в адресах gmail.com")
+	BobStep1Cmd.Flags().StringVar(&bobStep1Duplicates, "duplicates", string(psi.DuplicatesAll), duplicatesUsage)
+	BobStep1Cmd.Flags().StringVar(&bobStep1Rejects, "reject-output", "bob_rejected.tsv", "Файл отклоненных строк: row tab причина tab исходные поля (приватный)")
+	BobStep1Cmd.Flags().StringVar(&bobStep1MemLimit, "memory-limit", "", "Лимит памяти для перестановки строк на диске (например, 4G). По умолчанию строки переставляются в памяти")
+	BobStep1Cmd.Flags().StringVar(&bobStep1TempDir, "temp-dir", os.TempDir(), "Каталог для временных файлов перестановки")
+	BobStep1Cmd.Flags().IntVar(&bobStep1PadTo, "pad-to", 0, "Дополнить передаваемый файл фиктивными записями до указанного числа записей, чтобы скрыть размер множества")
+	BobStep1Cmd.Flags().IntVar(&bobStep1PadBucket, "pad-bucket", 0, "Дополнить передаваемый файл фиктивными записями до числа записей, кратного указанному")
+	BobStep1Cmd.Flags().StringVar(&bobStep1Manifest, "out-manifest", "bob_step1_manifest.json", "Выходной файл с подписанным манифестом сессии (для передачи)")
+	BobStep1Cmd.Flags().StringVar(&bobStep1SignKey, "out-sign-key", "bob_sign_key.txt", "Выходной файл с ключом подписи манифестов Ed25519 (приватный)")
+	BobStep1Cmd.Flags().BoolVar(&bobStep1NoManifest, "skip-manifest", false, skipManifestUsage)
+	BobStep1Cmd.Flags().IntVar(&bobStep1Version, "protocol-version", int(crypto.LatestProtocolVersion), "Версия протокола: 1 - g^HMAC (устаревшая), 2 - hash_to_curve (RFC 9380), 3 - hash_to_curve с типом идентификатора")
+	addCompressionFlags(BobStep1Cmd)
 }
 
 func runBobStep1(cmd *cobra.Command, args []string) error {
-	keyK, err := crypto.GenerateHMACKey()
+	version := psi.ProtocolVersion(bobStep1Version)
+	if err := version.Validate(); err != nil {
+		return err
+	}
+
+	format, err := io.ParseFormat(bobStep1Format)
 	if err != nil {
-		return fmt.Errorf("ошибка генерации HMAC ключа: %w", err)
+		return err
 	}
 
-	keyB, err := crypto.GenerateECDHKey()
+	encoding, err := crypto.ParsePointEncoding(bobStep1Points)
 	if err != nil {
-		return fmt.Errorf("ошибка генерации ECDH ключа: %w", err)
+		return err
+	}
+
+	if err := psi.ValidateIDTypes(bobStep1IDTypes, version); err != nil {
+		return err
+	}
+
+	memoryLimit, err := parseMemoryLimit(bobStep1MemLimit)
+	if err != nil {
+		return err
+	}
+
+	files, err := newRecordFiles([]string{bobStep1Input}, []string{bobStep1OutEnc, bobStep1OutMapping, bobStep1Rejects})
+	if err != nil {
+		return err
+	}
+
+	if bobStep1Normalize {
+		if err := validation.ValidateRegion(bobStep1Region); err != nil {
+			return err
+		}
 	}
 
-	if err := crypto.SaveHMACKey(bobStep1OutHMACKey, keyK); err != nil {
+	session, err := psi.NewBobSession(version)
+	if err != nil {
+		return err
+	}
+	session.HMACKey.IDTypes = keyIDTypes(bobStep1IDTypes)
+	session.BatchSize = bobStep1BatchSize
+	session.PointEncoding = encoding
+	session.MemoryLimit = memoryLimit
+	session.TempDir = bobStep1TempDir
+	session.PadTo = bobStep1PadTo
+	session.PadBucket = bobStep1PadBucket
+
+	session.Normalize = bobStep1Normalize
+	session.DefaultRegion = bobStep1Region
+	session.FoldGmail = bobStep1FoldGmail
+	session.Duplicates, err = psi.ParseDuplicatePolicy(bobStep1Duplicates)
+	if err != nil {
+		return err
+	}
+
+	rejects, err := newRejectReport(files, bobStep1OnInvalid, bobStep1Rejects)
+	if err != nil {
+		return err
+	}
+	defer rejects.Close()
+	session.Reject = rejects.Reject()
+
+	if err := crypto.SaveHMACKey(bobStep1OutHMACKey, crypto.HMACKeyFile(session.HMACKey)); err != nil {
 		return fmt.Errorf("ошибка сохранения HMAC ключа: %w", err)
 	}
 
-	if err := crypto.SaveECDHKey(bobStep1OutECDHKey, keyB); err != nil {
+	if err := crypto.SaveECDHKey(bobStep1OutECDHKey, session.ECDHKey); err != nil {
 		return fmt.Errorf("ошибка сохранения ECDH ключа: %w", err)
 	}
 
-	reader, err := io.OpenTSVFile(bobStep1Input)
+	reader, err := files.open(bobStep1Input)
 	if err != nil {
 		return fmt.Errorf("ошибка открытия входного файла: %w", err)
 	}
 	defer reader.Close()
 
-	writer, err := io.CreateTSVFile(bobStep1OutEnc)
+	writer, err := files.create(bobStep1OutEnc, format, int(version))
 	if err != nil {
 		return fmt.Errorf("ошибка создания выходного файла: %w", err)
 	}
 	defer writer.Close()
 
+	mappingWriter, err := files.createTSV(bobStep1OutMapping)
+	if err != nil {
+		return err
+	}
+	defer mappingWriter.Close()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var wg sync.WaitGroup
-	progress.TrackProgress(ctx, &wg, "Прогресс обработки", reader)
+	progress.TrackProgress(ctx, &wg, reporter, "Прогресс обработки", reader)
 
-	count, err := ProcessBobStep1(reader, writer, keyK, keyB, bobStep1BatchSize)
+	counter := &recordCounter{TSVWriter: writer}
+	stats, err := session.Step1(reader, counter, mappingWriter)
 	if err != nil {
 		return err
 	}
@@ -82,119 +179,67 @@ func runBobStep1(cmd *cobra.Command, args []string) error {
 	if err := writer.Close(); err != nil {
 		return fmt.Errorf("ошибка финализации записи: %w", err)
 	}
+	if err := mappingWriter.Close(); err != nil {
+		return fmt.Errorf("ошибка финализации записи: %w", err)
+	}
+	if err := rejects.Close(); err != nil {
+		return fmt.Errorf("ошибка записи отклоненных строк: %w", err)
+	}
 
 	cancel()
 	wg.Wait()
 
-	fmt.Fprintf(os.Stderr, "Обработано записей: %d\n", count)
-	fmt.Fprintf(os.Stderr, "HMAC ключ K (для передачи): %s\n", bobStep1OutHMACKey)
-	fmt.Fprintf(os.Stderr, "ECDH ключ B (приватный): %s\n", bobStep1OutECDHKey)
-	fmt.Fprintf(os.Stderr, "Зашифрованные данные: %s\n", bobStep1OutEnc)
+	if !bobStep1NoManifest {
+		if err := writeBobStep1Manifest(version, counter); err != nil {
+			return err
+		}
+	}
 
-	return nil
-}
+	result.add("records", "Обработано записей", stats.Records)
+	addPadding(stats)
+	rejects.Report()
+	addDuplicates(stats, session.Duplicates, session.HMACKey.IDTypes)
+	result.add("protocol_version", "Версия протокола", version)
+	result.add("id_types", "Типы идентификаторов", idTypesString(session.HMACKey.IDTypes))
+	result.output(artifactHMACKey, "HMAC ключ K (для передачи)", bobStep1OutHMACKey)
+	result.output("bob_ecdh_key", "ECDH ключ B (приватный)", bobStep1OutECDHKey)
+	result.output(artifactBobEncrypted, "Зашифрованные данные", bobStep1OutEnc)
+	result.output("bob_mapping", "Маппинг b_user_id (приватный)", bobStep1OutMapping)
+	result.report()
 
-type bobStep1Task struct {
-	index int
-	phone string
-}
-
-type bobStep1Result struct {
-	index     int
-	encrypted string
+	return nil
 }
 
-func ProcessBobStep1(reader *io.TSVReader, writer *io.TSVWriter, keyK []byte, keyB *crypto.ECDHKey, batchSize int) (int, error) {
-	hmacPool := &sync.Pool{
-		New: func() any {
-			return hmac.New(sha256.New, keyK)
-		},
+// writeBobStep1Manifest начинает сессию: генерирует ее идентификатор и ключ
+// подписи bob, которым подписываются и манифесты step2
+func writeBobStep1Manifest(version psi.ProtocolVersion, counter *recordCounter) error {
+	sessionID, err := manifest.NewSessionID()
+	if err != nil {
+		return err
 	}
 
-	handler := func(task bobStep1Task) (bobStep1Result, error) {
-		if err := validation.ValidateE164Phone(task.phone); err != nil {
-			return bobStep1Result{}, fmt.Errorf("строка %d: %w", task.index, err)
-		}
-
-		hashed := crypto.HMAC(hmacPool, keyK, []byte(task.phone))
-
-		encrypted, err := crypto.ECDHApply(keyB, hashed)
-		if err != nil {
-			return bobStep1Result{}, fmt.Errorf("ошибка ECDH шифрования: %w", err)
-		}
-
-		return bobStep1Result{
-			index:     task.index,
-			encrypted: encrypted,
-		}, nil
+	_, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("ошибка генерации ключа подписи: %w", err)
 	}
-
-	pool := workerpool.New(handler)
-
-	var writeErr error
-	var wg sync.WaitGroup
-
-	wg.Go(func() {
-		for result := range pool.Results() {
-			if result.Error != nil {
-				if writeErr == nil {
-					writeErr = result.Error
-				}
-				continue
-			}
-			if writeErr == nil {
-				if err := writer.Write([]string{
-					fmt.Sprintf("%d", result.Value.index),
-					result.Value.encrypted,
-				}); err != nil {
-					writeErr = fmt.Errorf("ошибка записи: %w", err)
-				}
-			}
-		}
-	})
-
-	count := 0
-	batch := make([]bobStep1Task, 0, batchSize)
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			pool.Close()
-			wg.Wait()
-			return count, fmt.Errorf("ошибка чтения записи: %w", err)
-		}
-
-		if len(record) != 2 {
-			pool.Close()
-			wg.Wait()
-			return count, fmt.Errorf("неверный формат записи: ожидается 2 поля, получено %d", len(record))
-		}
-
-		batch = append(batch, bobStep1Task{
-			index: count,
-			phone: record[0],
-		})
-		count++
-
-		if len(batch) >= batchSize {
-			pool.Add(batch)
-			batch = make([]bobStep1Task, 0, batchSize)
-		}
+	if err := crypto.SaveSigningKey(bobStep1SignKey, signKey); err != nil {
+		return fmt.Errorf("ошибка сохранения ключа подписи: %w", err)
 	}
 
-	if len(batch) > 0 {
-		pool.Add(batch)
+	m := manifest.New(sessionID, int(version), stepBob1)
+	if err := m.AddFile(artifactHMACKey, bobStep1OutHMACKey, 0); err != nil {
+		return err
 	}
-
-	pool.Close()
-	wg.Wait()
-
-	if writeErr != nil {
-		return count, writeErr
+	if err := addRecords(m, artifactBobEncrypted, bobStep1OutEnc, counter); err != nil {
+		return err
 	}
+	return saveManifest(m, bobStep1Manifest, signKey)
+}
 
-	return count, nil
+// addPadding добавляет в итог число фиктивных записей шага 1. Статистика остальных
+// шагов их не учитывает: они не попадают в маппинг и не дают совпадений
+func addPadding(stats psi.Stats) {
+	if stats.Padded > 0 {
+		result.add("padded", "Добавлено фиктивных записей", stats.Padded)
+	}
 }
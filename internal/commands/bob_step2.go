@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"sync"
 
 	"github.com/pkositsyn/psi/internal/crypto"
 	"github.com/pkositsyn/psi/internal/io"
 	"github.com/pkositsyn/psi/internal/progress"
-	"github.com/pkositsyn/psi/internal/workerpool"
+	"github.com/pkositsyn/psi/pkg/psi"
 	"github.com/spf13/cobra"
 )
 
@@ -21,252 +22,392 @@ var BobStep2Cmd = &cobra.Command{
 
 var (
 	bobStep2InputECDHKey  string
-	bobStep2InputOriginal string
+	bobStep2InputHMACKey  string
+	bobStep2InputMapping  string
 	bobStep2InputAliceEnc string
 	bobStep2InputBobEnc   string
 	bobStep2Output        string
+	bobStep2OutputMode    string
+	bobStep2OutLabels     string
+	bobStep2OutCount      string
+	bobStep2InputSumKey   string
+	bobStep2OutSum        string
+	bobStep2Mode          string
 	bobStep2BatchSize     int
+	bobStep2MemoryLimit   string
+	bobStep2TempDir       string
+	bobStep2Format        string
+	bobStep2Points        string
+	bobStep2Verifiable    bool
+	bobStep2InputProof    string
+	bobStep2InputBobOrig  string
+	bobStep2OutProof      string
+	bobStep2OwnManifest   string
+	bobStep2InManifest    string
+	bobStep2OutManifest   string
+	bobStep2SignKey       string
+	bobStep2PeerKey       string
+	bobStep2NoManifest    bool
 )
 
 func init() {
 	BobStep2Cmd.Flags().StringVar(&bobStep2InputECDHKey, "in-ecdh-key", "bob_ecdh_key.txt", "Файл с ECDH ключом B")
-	BobStep2Cmd.Flags().StringVar(&bobStep2InputOriginal, "in-original", "bob_data.tsv", "Оригинальный входной файл (phone tab b_user_id)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2InputHMACKey, "in-hmac-key", "bob_hmac_key.txt", "Файл с HMAC ключом K из step1 (определяет колонки идентификаторов)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2InputMapping, "in-mapping", "bob_mapping.tsv.gz", "Файл index <-> b_user_id из step1")
 	BobStep2Cmd.Flags().StringVar(&bobStep2InputAliceEnc, "in-alice-enc", "alice_encrypted.tsv.gz", "Файл H(phone_a)^A от alice")
 	BobStep2Cmd.Flags().StringVar(&bobStep2InputBobEnc, "in-bob-enc", "bob_encrypted_a.tsv.gz", "Файл H(phone_b)^B^A от alice")
 	BobStep2Cmd.Flags().StringVar(&bobStep2Output, "output", "bob_final.tsv.gz", "Выходной файл b_user_id <-> H(phone_a)^A^B")
+	BobStep2Cmd.Flags().StringVar(&bobStep2OutLabels, "out-labels", "bob_labels.tsv.gz", "Выходной файл с зашифрованными b_user_id (режим labeled)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2OutCount, "out-cardinality", "psi_cardinality.txt", "Выходной файл с размером пересечения (режим cardinality)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2InputSumKey, "in-sum-public-key", "alice_sum_public_key.txt", "Файл с открытым ключом суммы от alice (режим sum)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2OutSum, "out-sum", "psi_sum_encrypted.txt", "Выходной файл с зашифрованной суммой значений пересечения (режим sum, для передачи)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2OutputMode, "output-mode", string(psi.OutputAll), "Какие записи alice писать в результат: all - все, у несовпавших b_user_id пустой, matched - только совпавшие (режим standard)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2Mode, "mode", psi.ModeStandard, "Режим: standard - bob вычисляет пересечение, labeled - пересечение вычисляет alice, cardinality - только размер пересечения, sum - размер пересечения и зашифрованная сумма значений alice")
+	BobStep2Cmd.Flags().StringVar(&bobStep2Format, "transfer-format", string(io.FormatTSV), "Формат передаваемых файлов: tsv (TSV, сжатый gzip) или binary (компактный бинарный)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2Points, "point-encoding", crypto.PointUncompressed.String(), "Представление точек в передаваемых файлах: uncompressed (65 байт) или compressed (33 байта)")
+	BobStep2Cmd.Flags().BoolVar(&bobStep2Verifiable, "verifiable", false, "Проверить доказательства DLEQ от alice до обработки и приложить свои доказательства к результату (режимы standard и labeled)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2InputProof, "in-proof", "alice_proof.txt", "Файл с доказательствами DLEQ от alice (с --verifiable)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2InputBobOrig, "in-bob-original", "bob_encrypted.tsv.gz", "Свой файл H(phone_b)^B из step1 для проверки доказательств (с --verifiable)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2OutProof, "out-proof", "bob_proof.txt", "Выходной файл с открытым ключом B и доказательствами DLEQ (с --verifiable, для передачи)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2OwnManifest, "in-own-manifest", "bob_step1_manifest.json", "Свой манифест из step1 (идентификатор сессии)")
+	BobStep2Cmd.Flags().StringVar(&bobStep2InManifest, "in-manifest", "alice_step1_manifest.json", "Манифест сессии от alice, проверяется до чтения файлов alice")
+	BobStep2Cmd.Flags().StringVar(&bobStep2PeerKey, "peer-public-key", "", "Ожидаемый ключ подписи alice в hex из итога alice-step1, полученный по отдельному каналу. Без него принимается ключ из манифеста с предупреждением")
+	BobStep2Cmd.Flags().StringVar(&bobStep2SignKey, "in-sign-key", "bob_sign_key.txt", "Файл с ключом подписи манифестов из step1")
+	BobStep2Cmd.Flags().StringVar(&bobStep2OutManifest, "out-manifest", "bob_step2_manifest.json", "Выходной файл с подписанным манифестом сессии (для передачи)")
+	BobStep2Cmd.Flags().BoolVar(&bobStep2NoManifest, "skip-manifest", false, skipManifestUsage)
 	BobStep2Cmd.Flags().IntVar(&bobStep2BatchSize, "batch-size", 128, "Размер батча для параллельной обработки")
+	BobStep2Cmd.Flags().StringVar(&bobStep2MemoryLimit, "memory-limit", "", "Лимит памяти для сортировки на диске (например, 4G). По умолчанию данные загружаются в память")
+	BobStep2Cmd.Flags().StringVar(&bobStep2TempDir, "temp-dir", os.TempDir(), "Каталог для временных файлов сортировки")
+	addCompressionFlags(BobStep2Cmd)
 }
 
 func runBobStep2(cmd *cobra.Command, args []string) error {
+	if err := validateMode(bobStep2Mode, psi.ModeStandard, psi.ModeLabeled, psi.ModeCardinality, psi.ModeSum); err != nil {
+		return err
+	}
+	if err := validateVerifiable(bobStep2Verifiable, bobStep2Mode); err != nil {
+		return err
+	}
+
+	outputMode, err := psi.ParseOutputMode(bobStep2OutputMode)
+	if err != nil {
+		return err
+	}
+	if err := outputMode.ValidateBob(bobStep2Mode == psi.ModeLabeled); err != nil {
+		return err
+	}
+
 	keyB, err := crypto.LoadECDHKey(bobStep2InputECDHKey)
 	if err != nil {
 		return fmt.Errorf("ошибка загрузки ECDH ключа B: %w", err)
 	}
 
-	bobEncMap, err := loadIndexedData(bobStep2InputBobEnc)
+	keyK, err := crypto.LoadHMACKey(bobStep2InputHMACKey)
 	if err != nil {
-		return fmt.Errorf("ошибка загрузки H(phone_b)^B^A: %w", err)
+		return fmt.Errorf("ошибка загрузки HMAC ключа K: %w", err)
 	}
 
-	originalData, err := loadOriginalData(bobStep2InputOriginal)
+	memoryLimit, err := parseMemoryLimit(bobStep2MemoryLimit)
 	if err != nil {
-		return fmt.Errorf("ошибка загрузки оригинальных данных: %w", err)
+		return err
 	}
 
-	if err := processAndMatch(keyB, bobStep2InputAliceEnc, bobStep2Output, bobEncMap, originalData, bobStep2BatchSize); err != nil {
-		return fmt.Errorf("ошибка обработки и маппинга: %w", err)
+	format, err := io.ParseFormat(bobStep2Format)
+	if err != nil {
+		return err
 	}
 
-	fmt.Fprintf(os.Stderr, "Результат сохранен: %s\n", bobStep2Output)
-	return nil
-}
+	encoding, err := crypto.ParsePointEncoding(bobStep2Points)
+	if err != nil {
+		return err
+	}
 
-func LoadIndexedData(reader *io.TSVReader) (map[string]string, error) {
-	result := make(map[string]string)
+	files, err := bobStep2Files()
+	if err != nil {
+		return err
+	}
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+	session := &psi.BobSession{
+		HMACKey:   psi.HMACKey(keyK),
+		ECDHKey:   keyB,
+		BatchSize: bobStep2BatchSize,
+		Step1Options: psi.Step1Options{
+			MemoryLimit:   memoryLimit,
+			TempDir:       bobStep2TempDir,
+			PointEncoding: encoding,
+		},
+		Output: outputMode,
+	}
+
+	out, err := bobStep2Manifest()
+	if err != nil {
+		return err
+	}
 
-		if len(record) < 2 {
-			continue
+	if bobStep2Mode == psi.ModeCardinality || bobStep2Mode == psi.ModeSum {
+		return runBobStep2Cardinality(session, files, out)
+	}
+
+	// Alice должна перешифровать каждую запись bob одним ключом A
+	if bobStep2Verifiable {
+		if err := verifyFile(bobStep2InputProof, bobStep2InputBobOrig, bobStep2InputBobEnc, true); err != nil {
+			return err
 		}
+	}
 
-		index := record[0]
-		value := record[1]
-		result[value] = index
+	mappingReader, err := files.open(bobStep2InputMapping)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия маппинга: %w", err)
 	}
+	defer mappingReader.Close()
 
-	return result, nil
-}
+	bobReader, err := files.open(bobStep2InputBobEnc)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия H(phone_b)^B^A: %w", err)
+	}
+	defer bobReader.Close()
 
-func loadIndexedData(filename string) (map[string]string, error) {
-	reader, err := io.OpenTSVFile(filename)
+	aliceReader, err := files.open(bobStep2InputAliceEnc)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer reader.Close()
+	defer aliceReader.Close()
 
-	return LoadIndexedData(reader)
-}
+	aliceReader.SetRecords(out.peerRecords(artifactAliceEncrypted))
+
+	// Версия протокола известна из заголовка, если alice прислала бинарный файл
+	version := aliceReader.ProtocolVersion()
+
+	writer, err := files.create(bobStep2Output, format, version)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
 
-func LoadOriginalData(reader *io.TSVReader) (map[string]string, error) {
-	result := make(map[string]string)
+	counter := &recordCounter{TSVWriter: writer}
 
-	index := 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	progress.TrackProgress(ctx, &wg, reporter, "Прогресс обработки", aliceReader)
+
+	if bobStep2Mode == psi.ModeLabeled {
+		labelsWriter, err := files.create(bobStep2OutLabels, format, version)
+		if err != nil {
+			return err
 		}
+		defer labelsWriter.Close()
+
+		labelsCounter := &recordCounter{TSVWriter: labelsWriter}
+		stats, err := session.Step2Labeled(mappingReader, bobReader, aliceReader, counter, labelsCounter)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("ошибка обработки: %w", err)
+		}
+		if err := verifyBobStep2Streams(out, bobReader, aliceReader); err != nil {
+			return err
 		}
 
-		if len(record) < 2 {
-			continue
+		if err := labelsWriter.Close(); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
 		}
 
-		bUserID := record[1]
-		result[fmt.Sprintf("%d", index)] = bUserID
-		index++
-	}
+		cancel()
+		wg.Wait()
 
-	return result, nil
-}
+		if err := writeBobStep2Manifest(out, session.LabelKey, counter, labelsCounter); err != nil {
+			return err
+		}
+
+		result.add("labels", "Записано меток", stats.Labels)
+		result.add("records", "Обработано записей", stats.Records)
+		result.output(artifactBobFinal, "Результат сохранен", bobStep2Output)
+		result.output(artifactBobLabels, "Метки сохранены", bobStep2OutLabels)
+		result.report()
+		return nil
+	}
 
-func loadOriginalData(filename string) (map[string]string, error) {
-	reader, err := io.OpenTSVFile(filename)
+	stats, err := session.Step2(mappingReader, bobReader, aliceReader, counter)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("ошибка обработки и маппинга: %w", err)
+	}
+	if err := verifyBobStep2Streams(out, bobReader, aliceReader); err != nil {
+		return err
 	}
-	defer reader.Close()
 
-	return LoadOriginalData(reader)
-}
+	if err := writer.Close(); err != nil {
+		return err
+	}
 
-type bobStep2Task struct {
-	index      string
-	encryptedA string
-}
+	cancel()
+	wg.Wait()
+
+	if err := writeBobStep2Manifest(out, keyB, counter, nil); err != nil {
+		return err
+	}
 
-type bobStep2Result struct {
-	index       string
-	encryptedAB string
-	bUserID     string
-	matched     bool
+	result.add("records", "Обработано записей", stats.Records)
+	result.add("matched", "Совпадений", stats.Matched)
+	result.output(artifactBobFinal, "Результат сохранен", bobStep2Output)
+	result.report()
+	return nil
 }
 
-func ProcessBobStep2(reader *io.TSVReader, writer *io.TSVWriter, keyB *crypto.ECDHKey, bobEncMap, originalData map[string]string, batchSize int) (int, int, error) {
-	handler := func(task bobStep2Task) (bobStep2Result, error) {
-		encryptedAB, err := crypto.ECDHApply(keyB, task.encryptedA)
-		if err != nil {
-			return bobStep2Result{}, err
-		}
+// bobStep2Files проверяет, что стандартные потоки не заняты файлами,
+// которые --verifiable читает повторно
+func bobStep2Files() (recordFiles, error) {
+	inputs := []string{bobStep2InputBobEnc, bobStep2InputAliceEnc}
+	var outputs []string
+	switch bobStep2Mode {
+	case psi.ModeStandard:
+		inputs = append(inputs, bobStep2InputMapping)
+		outputs = []string{bobStep2Output}
+	case psi.ModeLabeled:
+		inputs = append(inputs, bobStep2InputMapping)
+		outputs = []string{bobStep2Output, bobStep2OutLabels}
+	}
 
-		var bUserID string
-		matched := false
-		if bobIndex, found := bobEncMap[encryptedAB]; found {
-			if uid, ok := originalData[bobIndex]; ok {
-				bUserID = uid
-				matched = true
-			}
+	files, err := newRecordFiles(inputs, outputs)
+	if err != nil {
+		return recordFiles{}, err
+	}
+	if bobStep2Verifiable {
+		if err := requireFiles(bobStep2InputBobEnc, bobStep2InputAliceEnc, bobStep2Output); err != nil {
+			return recordFiles{}, err
 		}
-
-		return bobStep2Result{
-			index:       task.index,
-			encryptedAB: encryptedAB,
-			bUserID:     bUserID,
-			matched:     matched,
-		}, nil
 	}
+	return files, nil
+}
 
-	pool := workerpool.New(handler)
+// bobStep2Manifest проверяет манифест alice до чтения ее файлов. Файлы
+// из стандартного ввода проверяет verifyBobStep2Streams после чтения
+func bobStep2Manifest() (*stepManifest, error) {
+	if bobStep2NoManifest {
+		return nil, nil
+	}
 
-	var writeErr error
-	var wg sync.WaitGroup
-	matchedCount := 0
-
-	wg.Go(func() {
-		for result := range pool.Results() {
-			if result.Error != nil {
-				if writeErr == nil {
-					writeErr = result.Error
-				}
-				continue
-			}
-			if writeErr == nil {
-				if err := writer.Write([]string{result.Value.index, result.Value.encryptedAB, result.Value.bUserID}); err != nil {
-					writeErr = err
-				}
-				if result.Value.matched {
-					matchedCount++
-				}
-			}
-		}
-	})
+	files := []manifestFile{
+		{artifactBobEncryptedA, bobStep2InputBobEnc},
+		{artifactAliceEncrypted, bobStep2InputAliceEnc},
+	}
+	if bobStep2Verifiable {
+		files = append(files, manifestFile{artifactAliceProof, bobStep2InputProof})
+	}
+	if bobStep2Mode == psi.ModeSum {
+		files = append(files, manifestFile{artifactSumPublicKey, bobStep2InputSumKey})
+	}
 
-	count := 0
-	batch := make([]bobStep2Task, 0, batchSize)
+	return continueSession(bobStep2OwnManifest, bobStep2SignKey, bobStep2InManifest, bobStep2PeerKey, stepAlice1, stepBob2, bobStep2OutManifest, files...)
+}
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			pool.Close()
-			wg.Wait()
-			return count, matchedCount, err
-		}
+// verifyBobStep2Streams проверяет по манифесту файлы alice, прочитанные
+// из стандартного ввода
+func verifyBobStep2Streams(out *stepManifest, bobReader, aliceReader *io.TSVReader) error {
+	if err := out.verifyStream(artifactBobEncryptedA, bobStep2InputBobEnc, bobReader); err != nil {
+		return err
+	}
+	return out.verifyStream(artifactAliceEncrypted, bobStep2InputAliceEnc, aliceReader)
+}
 
-		if len(record) < 2 {
-			pool.Close()
-			wg.Wait()
-			return count, matchedCount, fmt.Errorf("неверный формат записи")
+// writeBobStep2Manifest строит доказательства DLEQ с --verifiable и пишет
+// манифест файлов для alice. key - ключ, которым зашифрован bob_final:
+// B, а в режиме labeled - B·C
+func writeBobStep2Manifest(out *stepManifest, key *crypto.ECDHKey, counter, labelsCounter *recordCounter) error {
+	if bobStep2Verifiable {
+		if err := proveFile(key, bobStep2InputAliceEnc, bobStep2Output, bobStep2OutProof); err != nil {
+			return err
 		}
+	}
 
-		batch = append(batch, bobStep2Task{
-			index:      record[0],
-			encryptedA: record[1],
-		})
-		count++
-
-		if len(batch) >= batchSize {
-			pool.Add(batch)
-			batch = make([]bobStep2Task, 0, batchSize)
+	if err := out.addRecords(artifactBobFinal, bobStep2Output, counter); err != nil {
+		return err
+	}
+	if labelsCounter != nil {
+		if err := out.addRecords(artifactBobLabels, bobStep2OutLabels, labelsCounter); err != nil {
+			return err
 		}
 	}
-
-	if len(batch) > 0 {
-		pool.Add(batch)
+	if bobStep2Verifiable {
+		if err := out.add(artifactBobProof, bobStep2OutProof, 0); err != nil {
+			return err
+		}
 	}
+	return out.save()
+}
 
-	pool.Close()
-	wg.Wait()
-
-	if writeErr != nil {
-		return count, matchedCount, writeErr
+// runBobStep2Cardinality считает размер пересечения, а в режиме sum и сумму
+// значений alice. Маппинг не нужен: точки без индексов нельзя сопоставить с записями
+func runBobStep2Cardinality(session *psi.BobSession, files recordFiles, out *stepManifest) error {
+	var sumKey *psi.SumPublicKey
+	if bobStep2Mode == psi.ModeSum {
+		var err error
+		sumKey, err = crypto.LoadElGamalPublicKey(bobStep2InputSumKey)
+		if err != nil {
+			return fmt.Errorf("ошибка загрузки открытого ключа суммы: %w", err)
+		}
 	}
 
-	return count, matchedCount, nil
-}
-
-func processAndMatch(keyB *crypto.ECDHKey, inputFile, outputFile string, bobEncMap, originalData map[string]string, batchSize int) error {
-	reader, err := io.OpenTSVFile(inputFile)
+	bobReader, err := files.open(bobStep2InputBobEnc)
 	if err != nil {
-		return err
+		return fmt.Errorf("ошибка открытия H(phone_b)^B^A: %w", err)
 	}
-	defer reader.Close()
+	defer bobReader.Close()
 
-	writer, err := io.CreateTSVFile(outputFile)
+	aliceReader, err := files.open(bobStep2InputAliceEnc)
 	if err != nil {
 		return err
 	}
-	defer writer.Close()
+	defer aliceReader.Close()
+	aliceReader.SetRecords(out.peerRecords(artifactAliceEncrypted))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var wg sync.WaitGroup
-	progress.TrackProgress(ctx, &wg, "Прогресс обработки", reader)
-
-	count, matched, err := ProcessBobStep2(reader, writer, keyB, bobEncMap, originalData, batchSize)
+	progress.TrackProgress(ctx, &wg, reporter, "Прогресс обработки", aliceReader)
+
+	var stats psi.Stats
+	var sum string
+	if sumKey != nil {
+		stats, sum, err = session.Step2Sum(bobReader, aliceReader, sumKey)
+	} else {
+		stats, err = session.Step2Cardinality(bobReader, aliceReader)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("ошибка подсчета пересечения: %w", err)
 	}
-
-	if err := writer.Close(); err != nil {
+	if err := verifyBobStep2Streams(out, bobReader, aliceReader); err != nil {
 		return err
 	}
 
 	cancel()
 	wg.Wait()
 
-	fmt.Fprintf(os.Stderr, "Обработано записей: %d, совпадений: %d\n", count, matched)
+	if err := os.WriteFile(bobStep2OutCount, []byte(strconv.Itoa(stats.Matched)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := out.add(artifactCardinality, bobStep2OutCount, 0); err != nil {
+		return err
+	}
+	if sumKey != nil {
+		if err := os.WriteFile(bobStep2OutSum, []byte(sum+"\n"), 0644); err != nil {
+			return err
+		}
+		if err := out.add(artifactSumEncrypted, bobStep2OutSum, 0); err != nil {
+			return err
+		}
+	}
+	if err := out.save(); err != nil {
+		return err
+	}
+
+	result.add("records", "Обработано записей", stats.Records)
+	result.add("matched", "Размер пересечения", stats.Matched)
+	result.output(artifactCardinality, "Результат сохранен", bobStep2OutCount)
+	if sumKey != nil {
+		result.output(artifactSumEncrypted, "Зашифрованная сумма сохранена", bobStep2OutSum)
+	}
+	result.report()
 	return nil
 }
@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+const duplicatesUsage = "Обработка идентификатора, который повторяется в нескольких строках: all - оставить все (совпадение дает все пары a_user_id - b_user_id), first - оставить первую строку, last - последнюю, error - остановка"
+
+// duplicatesReport - отчет шага 1 о повторах идентификаторов для итога
+type duplicatesReport struct {
+	IDs     int                 `json:"ids"`
+	Repeats int                 `json:"repeats"`
+	Dropped int                 `json:"dropped"`
+	Policy  psi.DuplicatePolicy `json:"policy"`
+	ByType  countsByType        `json:"by_type"`
+}
+
+func (r duplicatesReport) String() string {
+	text := fmt.Sprintf("%d (повторных вхождений: %d, политика %s", r.IDs, r.Repeats, r.Policy)
+	if r.Dropped > 0 {
+		text += fmt.Sprintf(", отброшено: %d", r.Dropped)
+	}
+	return text + ")" + r.ByType.String()
+}
+
+// addDuplicates добавляет в итог отчет шага 1 о повторах идентификаторов
+func addDuplicates(stats psi.Stats, policy psi.DuplicatePolicy, idTypes []string) {
+	report := stats.Duplicates
+	byType := countsByType{counts: report.ByType}
+	if len(idTypes) > 1 && report.IDs > 0 {
+		byType.idTypes = idTypes
+	}
+
+	if report.IDs > 0 {
+		reporter.Warn(fmt.Sprintf("повторяющихся идентификаторов: %d", report.IDs))
+	}
+	result.add("duplicates", "Повторяющихся идентификаторов", duplicatesReport{
+		IDs:     report.IDs,
+		Repeats: report.Repeats,
+		Dropped: report.Dropped,
+		Policy:  policy,
+		ByType:  byType,
+	})
+}
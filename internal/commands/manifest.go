@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/manifest"
+)
+
+// Роли файлов в манифестах. Не зависят от имен файлов, заданных флагами
+const (
+	artifactHMACKey        = "bob_hmac_key"
+	artifactBobEncrypted   = "bob_encrypted"
+	artifactBobEncryptedA  = "bob_encrypted_a"
+	artifactAliceEncrypted = "alice_encrypted"
+	artifactAliceProof     = "alice_proof"
+	artifactSumPublicKey   = "alice_sum_public_key"
+	artifactBobFinal       = "bob_final"
+	artifactBobLabels      = "bob_labels"
+	artifactBobProof       = "bob_proof"
+	artifactCardinality    = "psi_cardinality"
+	artifactSumEncrypted   = "psi_sum_encrypted"
+	artifactAliceFinal     = "alice_final"
+	artifactSum            = "psi_sum"
+)
+
+// Шаги в манифестах
+const (
+	stepBob1   = "bob-step1"
+	stepAlice1 = "alice-step1"
+	stepBob2   = "bob-step2"
+	stepAlice2 = "alice-step2"
+)
+
+const skipManifestUsage = "Не проверять и не создавать манифесты сессии (для работы со стороной на версии без манифестов)"
+
+// recordCounter считает записи для манифеста
+type recordCounter struct {
+	*io.TSVWriter
+	records int
+}
+
+func (c *recordCounter) Write(record []string) error {
+	c.records++
+	return c.TSVWriter.Write(record)
+}
+
+// addRecords добавляет в манифест m файл записей. SHA-256 стандартного
+// вывода посчитан при записи: перечитать вывод нельзя
+func addRecords(m *manifest.Manifest, name, filename string, counter *recordCounter) error {
+	if filename == io.Stdio {
+		m.AddSum(name, filename, counter.SHA256(), counter.records)
+		return nil
+	}
+	return m.AddFile(name, filename, counter.records)
+}
+
+// manifestFile - файл, который проверяется по манифесту
+type manifestFile struct {
+	name, filename string
+}
+
+// loadManifest проверяет подпись манифеста другой стороны, ожидания шага
+// и SHA-256 файлов до их чтения. Стандартный ввод до чтения проверить нельзя,
+// его проверяет verifyStream
+func loadManifest(filename string, expect manifest.Expect, files ...manifestFile) (*manifest.Manifest, error) {
+	m, err := manifest.Load(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка проверки манифеста: %w", err)
+	}
+	if err := m.Expect(expect); err != nil {
+		return nil, fmt.Errorf("манифест %s отклонен: %w", filename, err)
+	}
+	for _, file := range files {
+		if file.filename == io.Stdio {
+			continue
+		}
+		if err := m.VerifyFile(file.name, file.filename); err != nil {
+			return nil, fmt.Errorf("манифест %s отклонен: %w", filename, err)
+		}
+	}
+	return m, nil
+}
+
+// verifyStream проверяет по манифесту m файл роли name, прочитанный из
+// стандартного ввода, после его чтения. Выходные файлы шага к этому времени
+// записаны, но свой манифест для них не создается
+func verifyStream(m *manifest.Manifest, name, filename string, reader *io.TSVReader) error {
+	if m == nil || filename != io.Stdio {
+		return nil
+	}
+	sum, err := reader.SHA256()
+	if err != nil {
+		return err
+	}
+	if err := m.VerifySum(name, filename, sum); err != nil {
+		return fmt.Errorf("стандартный ввод отклонен: %w", err)
+	}
+	return nil
+}
+
+// peerKey возвращает ожидаемый ключ подписи другой стороны: из
+// --peer-public-key или запомненный на прошлом шаге pinned. Без них манифест
+// peerFilename принимается с любым ключом, и подделать его может любой,
+// кто видел файлы сессии, поэтому выводится предупреждение
+func peerKey(flag, pinned, peerFilename string) (string, error) {
+	if flag == "" {
+		if pinned == "" {
+			reporter.Warn(fmt.Sprintf("ключ подписи %s не проверяется: получите открытый ключ другой стороны по отдельному каналу и задайте --peer-public-key", peerFilename))
+		}
+		return pinned, nil
+	}
+
+	key, err := hex.DecodeString(flag)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("--peer-public-key: ожидается открытый ключ Ed25519 в hex")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func saveManifest(m *manifest.Manifest, filename string, key ed25519.PrivateKey) error {
+	if err := m.Save(filename, key); err != nil {
+		return fmt.Errorf("ошибка сохранения манифеста: %w", err)
+	}
+	result.add("session_id", "Сессия", m.SessionID)
+	result.add("public_key", "Ключ подписи манифестов (для --peer-public-key другой стороны)", m.PublicKey)
+	result.output("manifest", "Манифест сессии", filename)
+	return nil
+}
+
+// stepManifest - манифест, который шаг пишет после своих файлов. Нулевой
+// указатель означает --skip-manifest, методы тогда ничего не делают
+type stepManifest struct {
+	manifest *manifest.Manifest
+	peer     *manifest.Manifest
+	key      ed25519.PrivateKey
+	filename string
+}
+
+// continueSession загружает свой манифест предыдущего шага и ключ подписи,
+// проверяет манифест другой стороны peerFilename и готовит манифест шага step.
+// Манифест другой стороны должен относиться к той же сессии и шагу peerStep,
+// быть подписан ключом peerPublicKey или запомненным в своем манифесте
+// и создан в ответ на свои файлы
+func continueSession(ownFilename, signKeyFile, peerFilename, peerPublicKey, peerStep, step, filename string, files ...manifestFile) (*stepManifest, error) {
+	own, err := manifest.Load(ownFilename)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка проверки своего манифеста: %w", err)
+	}
+
+	signKey, err := crypto.LoadSigningKey(signKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.PublicKey(signKey) != own.PublicKey {
+		return nil, fmt.Errorf("%w: %s подписан не ключом %s", manifest.ErrMismatch, ownFilename, signKeyFile)
+	}
+
+	expected, err := peerKey(peerPublicKey, own.PeerPublicKey, peerFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := loadManifest(peerFilename, manifest.Expect{
+		Step:            peerStep,
+		SessionID:       own.SessionID,
+		ProtocolVersion: own.ProtocolVersion,
+		PublicKey:       expected,
+		PeerPublicKey:   own.PublicKey,
+	}, files...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := manifest.New(own.SessionID, own.ProtocolVersion, step)
+	m.PeerPublicKey = peer.PublicKey
+	return &stepManifest{manifest: m, peer: peer, key: signKey, filename: filename}, nil
+}
+
+// peerRecords возвращает число записей файла другой стороны из ее манифеста
+func (s *stepManifest) peerRecords(name string) int {
+	if s == nil {
+		return 0
+	}
+	return s.peer.Records(name)
+}
+
+func (s *stepManifest) add(name, filename string, records int) error {
+	if s == nil {
+		return nil
+	}
+	return s.manifest.AddFile(name, filename, records)
+}
+
+func (s *stepManifest) addRecords(name, filename string, counter *recordCounter) error {
+	if s == nil {
+		return nil
+	}
+	return addRecords(s.manifest, name, filename, counter)
+}
+
+func (s *stepManifest) verifyStream(name, filename string, reader *io.TSVReader) error {
+	if s == nil {
+		return nil
+	}
+	return verifyStream(s.peer, name, filename, reader)
+}
+
+func (s *stepManifest) save() error {
+	if s == nil {
+		return nil
+	}
+	return saveManifest(s.manifest, s.filename, s.key)
+}
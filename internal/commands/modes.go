@@ -0,0 +1,14 @@
+package commands
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+func validateMode(mode string, allowed ...string) error {
+	if !slices.Contains(allowed, mode) {
+		return fmt.Errorf("неизвестный режим %q: ожидается один из %s", mode, strings.Join(allowed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/progress"
+	"github.com/pkositsyn/psi/pkg/psi"
+	"github.com/spf13/cobra"
+)
+
+var PartyIntersectCmd = &cobra.Command{
+	Use:   "party-intersect",
+	Short: "Протокол для трех и более сторон: вычисление пересечения получателем",
+	RunE:  runPartyIntersect,
+}
+
+var (
+	partyIntersectInHMACKey string
+	partyIntersectInMapping string
+	partyIntersectInOwn     string
+	partyIntersectInOthers  []string
+	partyIntersectOutput    string
+)
+
+func init() {
+	PartyIntersectCmd.Flags().StringVar(&partyIntersectInHMACKey, "in-hmac-key", "party_hmac_key.txt", "Файл с HMAC ключом K из party-step1 (определяет колонки идентификаторов)")
+	PartyIntersectCmd.Flags().StringVar(&partyIntersectInMapping, "in-mapping", "party_mapping.tsv.gz", "Файл index <-> user_id из party-step1")
+	PartyIntersectCmd.Flags().StringVar(&partyIntersectInOwn, "in-own", "party_reencrypted.tsv.gz", "Свой набор, прошедший ключи всех сторон")
+	PartyIntersectCmd.Flags().StringSliceVar(&partyIntersectInOthers, "in-others", nil, "Наборы остальных сторон, прошедшие ключи всех сторон, через запятую")
+	PartyIntersectCmd.Flags().StringVar(&partyIntersectOutput, "output", "party_final.tsv", "Выходной файл с user_id пересечения (приватный)")
+	addCompressionFlags(PartyIntersectCmd)
+}
+
+func runPartyIntersect(cmd *cobra.Command, args []string) error {
+	if len(partyIntersectInOthers) == 0 {
+		return fmt.Errorf("не заданы наборы остальных сторон --in-others")
+	}
+
+	inputs := append([]string{partyIntersectInMapping, partyIntersectInOwn}, partyIntersectInOthers...)
+	files, err := newRecordFiles(inputs, []string{partyIntersectOutput})
+	if err != nil {
+		return err
+	}
+
+	keyK, err := crypto.LoadHMACKey(partyIntersectInHMACKey)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки HMAC ключа K: %w", err)
+	}
+	session := &psi.PartySession{HMACKey: psi.HMACKey(keyK)}
+
+	mappingReader, err := files.open(partyIntersectInMapping)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия маппинга: %w", err)
+	}
+	defer mappingReader.Close()
+
+	ownReader, err := files.open(partyIntersectInOwn)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия своего набора: %w", err)
+	}
+	defer ownReader.Close()
+
+	others := make([]psi.RecordReader, 0, len(partyIntersectInOthers))
+	progressReaders := []progress.Source{ownReader}
+	for _, filename := range partyIntersectInOthers {
+		reader, err := files.open(filename)
+		if err != nil {
+			return fmt.Errorf("ошибка открытия набора %s: %w", filename, err)
+		}
+		defer reader.Close()
+		others = append(others, reader)
+		progressReaders = append(progressReaders, reader)
+	}
+
+	writer, err := files.createTSV(partyIntersectOutput)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	progress.TrackProgress(ctx, &wg, reporter, "Прогресс обработки", progressReaders...)
+
+	stats, err := session.Intersect(ownReader, mappingReader, others, writer)
+	if err != nil {
+		return fmt.Errorf("ошибка вычисления пересечения: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	cancel()
+	wg.Wait()
+
+	result.add("parties", "Сторон", len(others)+1)
+	result.add("records", "Обработано записей", stats.Records)
+	result.add("matched", "Совпадений", stats.Matched)
+	result.output("party_final", "Результат сохранен", partyIntersectOutput)
+	result.report()
+	return nil
+}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/progress"
+	"github.com/pkositsyn/psi/pkg/psi"
+	"github.com/spf13/cobra"
+)
+
+var PartyReencryptCmd = &cobra.Command{
+	Use:   "party-reencrypt",
+	Short: "Протокол для трех и более сторон: применение своего ключа к набору другой стороны",
+	Long: `Сторона применяет свой ключ ECDH к набору, полученному от предыдущей стороны кольца,
+и передает результат следующей. Набор проходит через все стороны, кроме владельца,
+после чего передается получателю`,
+	RunE: runPartyReencrypt,
+}
+
+var (
+	partyReencryptInECDHKey string
+	partyReencryptInput     string
+	partyReencryptOutput    string
+	partyReencryptBatchSize int
+	partyReencryptFormat    string
+	partyReencryptPoints    string
+	partyReencryptMemLimit  string
+	partyReencryptTempDir   string
+)
+
+func init() {
+	PartyReencryptCmd.Flags().StringVar(&partyReencryptInECDHKey, "in-ecdh-key", "party_ecdh_key.txt", "Файл с ECDH ключом стороны из party-step1")
+	PartyReencryptCmd.Flags().StringVarP(&partyReencryptInput, "input", "i", "party_encrypted.tsv.gz", "Входной файл с набором от предыдущей стороны кольца")
+	PartyReencryptCmd.Flags().StringVarP(&partyReencryptOutput, "output", "o", "party_reencrypted.tsv.gz", "Выходной файл (для передачи следующей стороне кольца или получателю)")
+	PartyReencryptCmd.Flags().IntVar(&partyReencryptBatchSize, "batch-size", 128, "Размер батча для параллельной обработки")
+	PartyReencryptCmd.Flags().StringVar(&partyReencryptFormat, "transfer-format", string(io.FormatTSV), "Формат передаваемых файлов: tsv (TSV, сжатый gzip) или binary (компактный бинарный)")
+	PartyReencryptCmd.Flags().StringVar(&partyReencryptPoints, "point-encoding", crypto.PointUncompressed.String(), "Представление точек в передаваемых файлах: uncompressed (65 байт) или compressed (33 байта)")
+	PartyReencryptCmd.Flags().StringVar(&partyReencryptMemLimit, "memory-limit", "", "Лимит памяти для перемешивания точек на диске (например, 4G). По умолчанию точки перемешиваются в памяти")
+	PartyReencryptCmd.Flags().StringVar(&partyReencryptTempDir, "temp-dir", os.TempDir(), "Каталог для временных файлов перемешивания")
+	addCompressionFlags(PartyReencryptCmd)
+}
+
+func runPartyReencrypt(cmd *cobra.Command, args []string) error {
+	key, err := crypto.LoadECDHKey(partyReencryptInECDHKey)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки ECDH ключа: %w", err)
+	}
+
+	format, err := io.ParseFormat(partyReencryptFormat)
+	if err != nil {
+		return err
+	}
+
+	encoding, err := crypto.ParsePointEncoding(partyReencryptPoints)
+	if err != nil {
+		return err
+	}
+
+	memoryLimit, err := parseMemoryLimit(partyReencryptMemLimit)
+	if err != nil {
+		return err
+	}
+
+	files, err := newRecordFiles([]string{partyReencryptInput}, []string{partyReencryptOutput})
+	if err != nil {
+		return err
+	}
+
+	session := &psi.PartySession{
+		ECDHKey:   key,
+		BatchSize: partyReencryptBatchSize,
+		Step1Options: psi.Step1Options{
+			MemoryLimit:   memoryLimit,
+			TempDir:       partyReencryptTempDir,
+			PointEncoding: encoding,
+		},
+	}
+
+	reader, err := files.open(partyReencryptInput)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия входного файла: %w", err)
+	}
+	defer reader.Close()
+
+	writer, err := files.create(partyReencryptOutput, format, reader.ProtocolVersion())
+	if err != nil {
+		return fmt.Errorf("ошибка создания выходного файла: %w", err)
+	}
+	defer writer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	progress.TrackProgress(ctx, &wg, reporter, "Прогресс обработки", reader)
+
+	stats, err := session.Reencrypt(reader, writer)
+	if err != nil {
+		return fmt.Errorf("ошибка обработки данных: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("ошибка финализации записи: %w", err)
+	}
+
+	cancel()
+	wg.Wait()
+
+	result.add("records", "Обработано записей", stats.Records)
+	result.output("party_reencrypted", "Результат сохранен", partyReencryptOutput)
+	result.report()
+	return nil
+}
@@ -0,0 +1,241 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/progress"
+	"github.com/pkositsyn/psi/internal/validation"
+	"github.com/pkositsyn/psi/pkg/psi"
+	"github.com/spf13/cobra"
+)
+
+var PartyStep1Cmd = &cobra.Command{
+	Use:   "party-step1",
+	Short: "Протокол для трех и более сторон, шаг 1: шифрование идентификаторов стороны",
+	Long: `Каждая сторона шифрует свои идентификаторы общим ключом K и своим ключом ECDH.
+Получатель (--receiver) генерирует ключ K для остальных сторон и сохраняет приватный маппинг,
+остальные стороны загружают ключ K и передают точки без индексов в случайном порядке.
+Затем набор каждой стороны проходит по кольцу через все остальные стороны (party-reencrypt)
+и передается получателю, который вычисляет пересечение (party-intersect)`,
+	RunE: runPartyStep1,
+}
+
+var (
+	partyStep1Input      string
+	partyStep1Receiver   bool
+	partyStep1InHMACKey  string
+	partyStep1OutHMACKey string
+	partyStep1OutECDHKey string
+	partyStep1OutEnc     string
+	partyStep1OutMapping string
+	partyStep1BatchSize  int
+	partyStep1Version    int
+	partyStep1Format     string
+	partyStep1Points     string
+	partyStep1OnInvalid  string
+	partyStep1Rejects    string
+	partyStep1Normalize  bool
+	partyStep1Region     string
+	partyStep1FoldGmail  bool
+	partyStep1Duplicates string
+	partyStep1IDTypes    []string
+	partyStep1MemLimit   string
+	partyStep1TempDir    string
+	partyStep1PadTo      int
+	partyStep1PadBucket  int
+)
+
+func init() {
+	PartyStep1Cmd.Flags().StringVarP(&partyStep1Input, "input", "i", "party_data.tsv", "Входной TSV файл (id_1 tab ... tab id_k tab user_id)")
+	PartyStep1Cmd.Flags().BoolVar(&partyStep1Receiver, "receiver", false, "Сторона - получатель пересечения: генерирует ключ K и сохраняет приватный маппинг")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1InHMACKey, "in-hmac-key", "party_hmac_key.txt", "Входной файл с HMAC ключом K от получателя (без --receiver)")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1OutHMACKey, "out-hmac-key", "party_hmac_key.txt", "Выходной файл с HMAC ключом K (с --receiver, для передачи всем сторонам)")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1OutECDHKey, "out-ecdh-key", "party_ecdh_key.txt", "Выходной файл с ECDH ключом стороны (приватный)")
+	PartyStep1Cmd.Flags().StringVarP(&partyStep1OutEnc, "out-encrypted", "e", "party_encrypted.tsv.gz", "Выходной файл с H(id)^P (для передачи следующей стороне кольца)")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1OutMapping, "out-mapping", "party_mapping.tsv.gz", "Выходной файл index <-> user_id (с --receiver, приватный)")
+	PartyStep1Cmd.Flags().IntVar(&partyStep1BatchSize, "batch-size", 128, "Размер батча для параллельной обработки")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1Format, "transfer-format", string(io.FormatTSV), "Формат передаваемых файлов: tsv (TSV, сжатый gzip) или binary (компактный бинарный)")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1Points, "point-encoding", crypto.PointUncompressed.String(), "Представление точек в передаваемых файлах: uncompressed (65 байт) или compressed (33 байта)")
+	PartyStep1Cmd.Flags().StringSliceVar(&partyStep1IDTypes, "id-type", []string{psi.IDTypePhone}, "Типы колонок идентификаторов через запятую: phone, email, maid или raw (с --receiver, передаются вместе с ключом K)")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1OnInvalid, "on-invalid", onInvalidFail, "Обработка строк с невалидным идентификатором или числом полей: fail - остановка, skip - пропуск, reject-file - пропуск с записью в --reject-output")
+	PartyStep1Cmd.Flags().BoolVar(&partyStep1Normalize, "normalize", false, "Приводить идентификаторы к канонической форме перед проверкой: телефоны к E.164, email и maid к нижнему регистру")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1Region, "default-region", "RU", "Регион для номеров без кода страны при --normalize: RU, KZ, BY, UA, US, CA, GB")
+	PartyStep1Cmd.Flags().BoolVar(&partyStep1FoldGmail, "fold-gmail", false, "При --normalize удалять точки и суффикс +tag в адресах gmail.com")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1Duplicates, "duplicates", string(psi.DuplicatesAll), duplicatesUsage)
+	PartyStep1Cmd.Flags().StringVar(&partyStep1Rejects, "reject-output", "party_rejected.tsv", "Файл отклоненных строк: row tab причина tab исходные поля (приватный)")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1MemLimit, "memory-limit", "", "Лимит памяти для перестановки строк на диске (например, 4G). По умолчанию строки переставляются в памяти")
+	PartyStep1Cmd.Flags().StringVar(&partyStep1TempDir, "temp-dir", os.TempDir(), "Каталог для временных файлов перестановки")
+	PartyStep1Cmd.Flags().IntVar(&partyStep1PadTo, "pad-to", 0, "Дополнить передаваемый файл фиктивными записями до указанного числа записей, чтобы скрыть размер множества")
+	PartyStep1Cmd.Flags().IntVar(&partyStep1PadBucket, "pad-bucket", 0, "Дополнить передаваемый файл фиктивными записями до числа записей, кратного указанному")
+	PartyStep1Cmd.Flags().IntVar(&partyStep1Version, "protocol-version", int(crypto.LatestProtocolVersion), "Версия протокола (с --receiver): 1 - g^HMAC (устаревшая), 2 - hash_to_curve (RFC 9380), 3 - hash_to_curve с типом идентификатора")
+	addCompressionFlags(PartyStep1Cmd)
+}
+
+// loadPartyHMACKey генерирует ключ K получателя или загружает ключ K от получателя
+func loadPartyHMACKey() (psi.HMACKey, error) {
+	if !partyStep1Receiver {
+		keyFile, err := crypto.LoadHMACKey(partyStep1InHMACKey)
+		if err != nil {
+			return psi.HMACKey{}, fmt.Errorf("ошибка загрузки HMAC ключа K: %w", err)
+		}
+		return psi.HMACKey(keyFile), nil
+	}
+
+	version := psi.ProtocolVersion(partyStep1Version)
+	if err := version.Validate(); err != nil {
+		return psi.HMACKey{}, err
+	}
+	if err := psi.ValidateIDTypes(partyStep1IDTypes, version); err != nil {
+		return psi.HMACKey{}, err
+	}
+
+	hmacKey, err := psi.GenerateHMACKey(version)
+	if err != nil {
+		return psi.HMACKey{}, fmt.Errorf("ошибка генерации HMAC ключа: %w", err)
+	}
+	hmacKey.IDTypes = keyIDTypes(partyStep1IDTypes)
+
+	if err := crypto.SaveHMACKey(partyStep1OutHMACKey, crypto.HMACKeyFile(hmacKey)); err != nil {
+		return psi.HMACKey{}, fmt.Errorf("ошибка сохранения HMAC ключа: %w", err)
+	}
+	return hmacKey, nil
+}
+
+func runPartyStep1(cmd *cobra.Command, args []string) error {
+	format, err := io.ParseFormat(partyStep1Format)
+	if err != nil {
+		return err
+	}
+
+	encoding, err := crypto.ParsePointEncoding(partyStep1Points)
+	if err != nil {
+		return err
+	}
+
+	memoryLimit, err := parseMemoryLimit(partyStep1MemLimit)
+	if err != nil {
+		return err
+	}
+
+	if partyStep1Normalize {
+		if err := validation.ValidateRegion(partyStep1Region); err != nil {
+			return err
+		}
+	}
+
+	outputs := []string{partyStep1OutEnc, partyStep1Rejects}
+	if partyStep1Receiver {
+		outputs = append(outputs, partyStep1OutMapping)
+	}
+	files, err := newRecordFiles([]string{partyStep1Input}, outputs)
+	if err != nil {
+		return err
+	}
+
+	hmacKey, err := loadPartyHMACKey()
+	if err != nil {
+		return err
+	}
+
+	session, err := psi.NewPartySession(hmacKey)
+	if err != nil {
+		return err
+	}
+	session.BatchSize = partyStep1BatchSize
+	session.PointEncoding = encoding
+	session.MemoryLimit = memoryLimit
+	session.TempDir = partyStep1TempDir
+	session.PadTo = partyStep1PadTo
+	session.PadBucket = partyStep1PadBucket
+
+	session.Normalize = partyStep1Normalize
+	session.DefaultRegion = partyStep1Region
+	session.FoldGmail = partyStep1FoldGmail
+	session.Duplicates, err = psi.ParseDuplicatePolicy(partyStep1Duplicates)
+	if err != nil {
+		return err
+	}
+
+	rejects, err := newRejectReport(files, partyStep1OnInvalid, partyStep1Rejects)
+	if err != nil {
+		return err
+	}
+	defer rejects.Close()
+	session.Reject = rejects.Reject()
+
+	if err := crypto.SaveECDHKey(partyStep1OutECDHKey, session.ECDHKey); err != nil {
+		return fmt.Errorf("ошибка сохранения ECDH ключа: %w", err)
+	}
+
+	reader, err := files.open(partyStep1Input)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия входного файла: %w", err)
+	}
+	defer reader.Close()
+
+	writer, err := files.create(partyStep1OutEnc, format, int(hmacKey.Version))
+	if err != nil {
+		return fmt.Errorf("ошибка создания выходного файла: %w", err)
+	}
+	defer writer.Close()
+
+	// Маппинг нужен только получателю, остальные стороны передают точки без индексов
+	var mappingWriter *io.TSVWriter
+	var mapping psi.RecordWriter
+	if partyStep1Receiver {
+		mappingWriter, err = files.createTSV(partyStep1OutMapping)
+		if err != nil {
+			return err
+		}
+		defer mappingWriter.Close()
+		mapping = mappingWriter
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	progress.TrackProgress(ctx, &wg, reporter, "Прогресс обработки", reader)
+
+	stats, err := session.Step1(reader, writer, mapping)
+	if err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("ошибка финализации записи: %w", err)
+	}
+	if mappingWriter != nil {
+		if err := mappingWriter.Close(); err != nil {
+			return fmt.Errorf("ошибка финализации записи: %w", err)
+		}
+	}
+	if err := rejects.Close(); err != nil {
+		return fmt.Errorf("ошибка записи отклоненных строк: %w", err)
+	}
+
+	cancel()
+	wg.Wait()
+
+	result.add("records", "Обработано записей", stats.Records)
+	addPadding(stats)
+	rejects.Report()
+	addDuplicates(stats, session.Duplicates, hmacKey.IDTypes)
+	result.add("protocol_version", "Версия протокола", hmacKey.Version)
+	result.add("id_types", "Типы идентификаторов", idTypesString(hmacKey.IDTypes))
+	if partyStep1Receiver {
+		result.output("party_hmac_key", "HMAC ключ K (для передачи всем сторонам)", partyStep1OutHMACKey)
+	}
+	result.output("party_ecdh_key", "ECDH ключ (приватный)", partyStep1OutECDHKey)
+	result.output("party_encrypted", "Зашифрованные данные", partyStep1OutEnc)
+	if partyStep1Receiver {
+		result.output("party_mapping", "Маппинг user_id (приватный)", partyStep1OutMapping)
+	}
+	result.report()
+
+	return nil
+}
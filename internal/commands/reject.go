@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+// Обработка строк с невалидным идентификатором или числом полей (--on-invalid)
+const (
+	onInvalidFail       = "fail"
+	onInvalidSkip       = "skip"
+	onInvalidRejectFile = "reject-file"
+)
+
+// rejectReport считает пропущенные строки по причинам и в режиме
+// reject-file пишет их в TSV: row \t reason \t исходные поля
+type rejectReport struct {
+	writer        *io.TSVWriter
+	filename      string
+	invalidID     int
+	invalidRecord int
+}
+
+// newRejectReport возвращает nil для режима fail: строки не пропускаются
+func newRejectReport(files recordFiles, policy, filename string) (*rejectReport, error) {
+	if err := validateMode(policy, onInvalidFail, onInvalidSkip, onInvalidRejectFile); err != nil {
+		return nil, err
+	}
+
+	switch policy {
+	case onInvalidFail:
+		return nil, nil
+	case onInvalidSkip:
+		return &rejectReport{}, nil
+	}
+
+	writer, err := files.createTSV(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания файла отклоненных строк: %w", err)
+	}
+	return &rejectReport{writer: writer, filename: filename}, nil
+}
+
+// Reject возвращает RejectFunc для сессии или nil для режима fail
+func (r *rejectReport) Reject() psi.RejectFunc {
+	if r == nil {
+		return nil
+	}
+	return r.reject
+}
+
+func (r *rejectReport) reject(rowErr *psi.RowError, record []string) error {
+	if errors.Is(rowErr, psi.ErrInvalidRecord) {
+		r.invalidRecord++
+	} else {
+		r.invalidID++
+	}
+
+	if r.writer == nil {
+		return nil
+	}
+	return r.writer.Write(append([]string{strconv.Itoa(rowErr.Row), rowErr.Err.Error()}, record...))
+}
+
+func (r *rejectReport) Close() error {
+	if r == nil || r.writer == nil {
+		return nil
+	}
+	return r.writer.Close()
+}
+
+// rejectCounts - число пропущенных строк по причинам для итога
+type rejectCounts struct {
+	Rows          int `json:"rows"`
+	InvalidID     int `json:"invalid_id"`
+	InvalidRecord int `json:"invalid_record"`
+}
+
+func (c rejectCounts) String() string {
+	return fmt.Sprintf("%d (невалидный идентификатор: %d, неверное число полей: %d)", c.Rows, c.InvalidID, c.InvalidRecord)
+}
+
+// Report добавляет пропущенные строки в итог команды
+func (r *rejectReport) Report() {
+	if r == nil {
+		return
+	}
+
+	counts := rejectCounts{Rows: r.invalidID + r.invalidRecord, InvalidID: r.invalidID, InvalidRecord: r.invalidRecord}
+	if counts.Rows > 0 {
+		reporter.Warn(fmt.Sprintf("пропущено строк с ошибками: %d", counts.Rows))
+	}
+	result.add("rejected", "Пропущено строк", counts)
+	if r.writer != nil {
+		result.output("rejects", "Отклоненные строки", r.filename)
+	}
+}
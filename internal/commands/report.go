@@ -0,0 +1,81 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkositsyn/psi/internal/progress"
+	"github.com/spf13/cobra"
+)
+
+// Выполняется одна команда за запуск, поэтому reporter и итог команды общие
+var (
+	logFormat string
+	reporter  progress.Reporter = progress.NewTextReporter(os.Stderr)
+	result    summary
+)
+
+// AddLogFormatFlag добавляет cmd и ее подкомандам флаг --log-format
+// и выбирает по нему reporter перед запуском команды
+func AddLogFormatFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&logFormat, "log-format", progress.FormatText, "Формат сообщений в stderr: text - для терминала, json - события JSON lines (начало шага, прогресс, предупреждения, итог, ошибка) для систем сбора логов")
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		r, err := progress.NewReporter(logFormat, os.Stderr)
+		if err != nil {
+			return err
+		}
+		reporter = r
+
+		if logFormat == progress.FormatJSON {
+			// Ошибку выводит ReportError событием, справка по флагам в журнале не нужна
+			cmd.Root().SilenceErrors = true
+			cmd.Root().SilenceUsage = true
+		}
+		reporter.Start(cmd.Name())
+		return nil
+	}
+}
+
+// ReportError выводит ошибку команды
+func ReportError(err error) {
+	reporter.Error(err)
+}
+
+// summary собирает итог команды
+type summary struct {
+	progress.Summary
+}
+
+func (s *summary) add(key, label string, value any) {
+	s.Fields = append(s.Fields, progress.Field{Key: key, Label: label, Value: value})
+}
+
+// output добавляет созданный файл с ролью key
+func (s *summary) output(key, label, filename string) {
+	s.Outputs = append(s.Outputs, progress.Field{Key: key, Label: label, Value: filename})
+}
+
+func (s *summary) report() {
+	reporter.Summary(s.Summary)
+}
+
+// countsByType - счетчики по типам идентификаторов в порядке колонок.
+// В терминал выводится по строке на тип
+type countsByType struct {
+	idTypes []string
+	counts  map[string]int
+}
+
+func (c countsByType) String() string {
+	var b strings.Builder
+	for _, idType := range c.idTypes {
+		fmt.Fprintf(&b, "\n  %s: %d", idType, c.counts[idType])
+	}
+	return b.String()
+}
+
+func (c countsByType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.counts)
+}
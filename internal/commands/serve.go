@@ -0,0 +1,184 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/pkositsyn/psi/internal/transport"
+	"github.com/pkositsyn/psi/pkg/psi"
+	"github.com/spf13/cobra"
+)
+
+var ServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Выполнение протокола по сети: ожидание подключения другой стороны",
+	RunE:  runServe,
+}
+
+var ConnectCmd = &cobra.Command{
+	Use:   "connect",
+	Short: "Выполнение протокола по сети: подключение к другой стороне",
+	RunE:  runConnect,
+}
+
+const (
+	roleBob   = "bob"
+	roleAlice = "alice"
+)
+
+var (
+	networkRole      string
+	networkListen    string
+	networkAddr      string
+	networkCert      string
+	networkKey       string
+	networkCA        string
+	networkInput     string
+	networkOutput    string
+	networkMode      string
+	networkVersion   int
+	networkIDTypes   []string
+	networkPriority  []string
+	networkBatchSize int
+)
+
+func init() {
+	ServeCmd.Flags().StringVar(&networkListen, "listen", ":9443", "Адрес для ожидания подключения")
+	ConnectCmd.Flags().StringVar(&networkAddr, "addr", "", "Адрес другой стороны (host:port)")
+	ConnectCmd.MarkFlagRequired("addr")
+
+	for _, cmd := range []*cobra.Command{ServeCmd, ConnectCmd} {
+		cmd.Flags().StringVar(&networkRole, "role", "", "Роль в протоколе: bob или alice")
+		cmd.Flags().StringVar(&networkCert, "cert", "", "Сертификат TLS (PEM)")
+		cmd.Flags().StringVar(&networkKey, "key", "", "Приватный ключ сертификата TLS (PEM)")
+		cmd.Flags().StringVar(&networkCA, "ca", "", "CA для проверки сертификата другой стороны (PEM)")
+		cmd.Flags().StringVarP(&networkInput, "input", "i", "", "Входной TSV файл (по умолчанию bob_data.tsv или alice_data.tsv)")
+		cmd.Flags().StringVar(&networkOutput, "output", "alice_final.tsv", "Выходной файл a_user_id <-> b_user_id (роль alice)")
+		cmd.Flags().StringVar(&networkMode, "mode", psi.ModeStandard, "Режим: standard или labeled (должен совпадать у сторон)")
+		cmd.Flags().IntVar(&networkVersion, "protocol-version", int(psi.LatestProtocolVersion), "Версия протокола: для роли bob - используемая, для alice - минимальная, которую она примет от bob")
+		cmd.Flags().StringSliceVar(&networkIDTypes, "id-type", []string{psi.IDTypePhone}, "Типы колонок идентификаторов через запятую: phone, email, maid или raw (роль bob)")
+		cmd.Flags().StringSliceVar(&networkPriority, "priority", nil, "Порядок типов идентификаторов при выборе совпадения, по умолчанию порядок колонок (роль alice)")
+		cmd.Flags().IntVar(&networkBatchSize, "batch-size", 128, "Размер батча для параллельной обработки")
+
+		cmd.MarkFlagRequired("role")
+		cmd.MarkFlagRequired("cert")
+		cmd.MarkFlagRequired("key")
+		cmd.MarkFlagRequired("ca")
+	}
+}
+
+func validateNetworkFlags() error {
+	if networkRole != roleBob && networkRole != roleAlice {
+		return fmt.Errorf("неизвестная роль %q: ожидается bob или alice", networkRole)
+	}
+	if err := validateMode(networkMode, psi.ModeStandard, psi.ModeLabeled); err != nil {
+		return err
+	}
+	if networkInput == "" {
+		networkInput = networkRole + "_data.tsv"
+	}
+	if err := psi.ProtocolVersion(networkVersion).Validate(); err != nil {
+		return err
+	}
+	return psi.ValidateIDTypes(networkIDTypes, psi.ProtocolVersion(networkVersion))
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	if err := validateNetworkFlags(); err != nil {
+		return err
+	}
+
+	config, err := transport.LoadTLSConfig(networkCert, networkKey, networkCA, true)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", networkListen)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	reporter.Info(fmt.Sprintf("Ожидание подключения: %s", listener.Addr()))
+
+	conn, err := transport.Accept(listener, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return runNetworkRole(conn)
+}
+
+func runConnect(cmd *cobra.Command, args []string) error {
+	if err := validateNetworkFlags(); err != nil {
+		return err
+	}
+
+	config, err := transport.LoadTLSConfig(networkCert, networkKey, networkCA, false)
+	if err != nil {
+		return err
+	}
+
+	conn, err := transport.Dial(networkAddr, config)
+	if err != nil {
+		return fmt.Errorf("ошибка подключения к %s: %w", networkAddr, err)
+	}
+	defer conn.Close()
+
+	return runNetworkRole(conn)
+}
+
+func runNetworkRole(tr psi.Transport) error {
+	config := psi.NetworkConfig{
+		Mode:      networkMode,
+		Version:   psi.ProtocolVersion(networkVersion),
+		IDTypes:   keyIDTypes(networkIDTypes),
+		Priority:  networkPriority,
+		TempDir:   os.TempDir(),
+		BatchSize: networkBatchSize,
+	}
+
+	if networkRole == roleBob {
+		openInput := func() (psi.RecordReadCloser, error) {
+			return psi.OpenTSVFile(networkInput)
+		}
+
+		stats, err := psi.RunBobNetwork(tr, openInput, config)
+		if err != nil {
+			return err
+		}
+
+		result.add("records", "Обработано записей", stats.Records)
+		result.report()
+		return nil
+	}
+
+	input, err := psi.OpenTSVFile(networkInput)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия входного файла: %w", err)
+	}
+	defer input.Close()
+
+	output, err := psi.CreateTSVFile(networkOutput)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	stats, err := psi.RunAliceNetwork(tr, input, output, config)
+	if err != nil {
+		return err
+	}
+
+	if err := output.Close(); err != nil {
+		return err
+	}
+
+	result.add("records", "Обработано записей", stats.Records)
+	result.add("matched", "Совпадений", stats.Matched)
+	result.output(artifactAliceFinal, "Финальный маппинг сохранен", networkOutput)
+	result.report()
+	return nil
+}
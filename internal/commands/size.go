@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"", 1},
+}
+
+// parseSize разбирает размер вида 512M, 4GiB или 1024. Суффиксы двоичные
+func parseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	for _, unit := range sizeUnits {
+		number, ok := strings.CutSuffix(value, unit.suffix)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+		if err != nil || n < 0 {
+			break
+		}
+		return n * unit.size, nil
+	}
+
+	return 0, fmt.Errorf("неверный размер %q: ожидается число с суффиксом K, M, G или T", s)
+}
+
+// parseMemoryLimit возвращает 0 для пустого значения: данные загружаются в память
+func parseMemoryLimit(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	limit, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("--memory-limit: %w", err)
+	}
+	if limit == 0 {
+		return 0, fmt.Errorf("--memory-limit должен быть больше нуля")
+	}
+	return limit, nil
+}
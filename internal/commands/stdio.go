@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/spf13/cobra"
+)
+
+// Сжатие задается для всех файлов записей шага. Выполняется одна команда
+// за запуск, поэтому переменные флагов общие
+var (
+	inputCompression  string
+	outputCompression string
+)
+
+func addCompressionFlags(cmd *cobra.Command) {
+	addInputCompressionFlag(cmd)
+	cmd.Flags().StringVar(&outputCompression, "output-compression", string(io.CompressionAuto), "Сжатие выходных файлов записей: auto - gzip для суффикса .gz, none или gzip. Имя файла - означает стандартный вывод")
+}
+
+// addInputCompressionFlag добавляет только --input-compression для команд,
+// которые не пишут файлы записей
+func addInputCompressionFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&inputCompression, "input-compression", string(io.CompressionAuto), "Сжатие входных файлов записей: auto - по содержимому, none или gzip. Имя файла - означает стандартный ввод")
+}
+
+// recordFiles открывает и создает файлы записей шага с заданным сжатием.
+// Имя io.Stdio означает стандартный ввод или вывод
+type recordFiles struct {
+	input, output io.Compression
+}
+
+// newRecordFiles проверяет флаги сжатия и то, что стандартный ввод и вывод
+// заняты не более чем одним файлом каждый
+func newRecordFiles(inputs, outputs []string) (recordFiles, error) {
+	input, err := io.ParseCompression(inputCompression)
+	if err != nil {
+		return recordFiles{}, err
+	}
+	output, err := io.ParseCompression(outputCompression)
+	if err != nil {
+		return recordFiles{}, err
+	}
+
+	if stdioCount(inputs) > 1 {
+		return recordFiles{}, fmt.Errorf("из стандартного ввода можно читать только один файл")
+	}
+	if stdioCount(outputs) > 1 {
+		return recordFiles{}, fmt.Errorf("в стандартный вывод можно писать только один файл")
+	}
+	return recordFiles{input: input, output: output}, nil
+}
+
+func stdioCount(filenames []string) int {
+	count := 0
+	for _, filename := range filenames {
+		if filename == io.Stdio {
+			count++
+		}
+	}
+	return count
+}
+
+func (f recordFiles) open(filename string) (*io.TSVReader, error) {
+	return io.OpenInput(filename, f.input)
+}
+
+func (f recordFiles) create(filename string, format io.Format, version int) (*io.TSVWriter, error) {
+	return io.CreateOutput(filename, format, version, f.output)
+}
+
+// createTSV создает файл TSV, не передаваемый другой стороне
+func (f recordFiles) createTSV(filename string) (*io.TSVWriter, error) {
+	return io.CreateOutput(filename, io.FormatTSV, 0, f.output)
+}
+
+// requireFiles проверяет, что filenames - файлы: доказательства DLEQ
+// перечитывают файлы записей, а стандартный поток читается один раз
+func requireFiles(filenames ...string) error {
+	if slices.Contains(filenames, io.Stdio) {
+		return fmt.Errorf("режим --verifiable требует файлов: стандартный ввод и вывод нельзя прочитать повторно")
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package commands
 
 import (
 	"fmt"
-	"os"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/pkositsyn/psi/internal/io"
 	"github.com/spf13/cobra"
@@ -21,10 +23,16 @@ var (
 func init() {
 	ValidateCmd.Flags().StringVarP(&validateInput, "input", "i", "", "Входной файл для валидации")
 	ValidateCmd.MarkFlagRequired("input")
+	addInputCompressionFlag(ValidateCmd)
 }
 
 func runValidate(cmd *cobra.Command, args []string) error {
-	reader, err := io.OpenTSVFile(validateInput)
+	files, err := newRecordFiles([]string{validateInput}, nil)
+	if err != nil {
+		return err
+	}
+
+	reader, err := files.open(validateInput)
 	if err != nil {
 		return fmt.Errorf("ошибка открытия файла: %w", err)
 	}
@@ -46,12 +54,21 @@ func runValidate(cmd *cobra.Command, args []string) error {
 		count++
 	}
 
-	fmt.Fprintf(os.Stderr, "Файл валиден: %s\n", validateInput)
-	fmt.Fprintf(os.Stderr, "Всего записей: %d\n", count)
-	fmt.Fprintf(os.Stderr, "Распределение по количеству полей:\n")
-	for fields, cnt := range fieldCounts {
-		fmt.Fprintf(os.Stderr, "  %d полей: %d записей\n", fields, cnt)
-	}
+	reporter.Info("Файл валиден: " + validateInput)
+	result.add("records", "Всего записей", count)
+	result.add("fields", "Распределение по количеству полей", fieldDistribution(fieldCounts))
+	result.report()
 
 	return nil
 }
+
+// fieldDistribution - число записей по количеству полей
+type fieldDistribution map[int]int
+
+func (d fieldDistribution) String() string {
+	var b strings.Builder
+	for _, fields := range slices.Sorted(maps.Keys(d)) {
+		fmt.Fprintf(&b, "\n  %d полей: %d записей", fields, d[fields])
+	}
+	return b.String()
+}
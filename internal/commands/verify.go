@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+// validateVerifiable проверяет, что режим передает точки с индексами:
+// без них выходные точки нельзя сопоставить с входными
+func validateVerifiable(verifiable bool, mode string) error {
+	if verifiable && mode != psi.ModeStandard && mode != psi.ModeLabeled {
+		return fmt.Errorf("--verifiable поддерживается только в режимах %s и %s", psi.ModeStandard, psi.ModeLabeled)
+	}
+	return nil
+}
+
+// proveFile доказывает, что точки outputFile получены из точек inputFile
+// умножением на key, и сохраняет доказательства в proofFile
+func proveFile(key *crypto.ECDHKey, inputFile, outputFile, proofFile string) error {
+	input, err := io.OpenTSVFile(inputFile)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := io.OpenTSVFile(outputFile)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	proofs, err := psi.ProveEncryption(key, input, output)
+	if err != nil {
+		return fmt.Errorf("ошибка построения доказательств для %s: %w", outputFile, err)
+	}
+
+	if err := crypto.SaveDLEQProofs(proofFile, proofs); err != nil {
+		return fmt.Errorf("ошибка сохранения доказательств: %w", err)
+	}
+	result.output("proof", "Доказательства DLEQ (для передачи)", proofFile)
+	return nil
+}
+
+// verifyFile проверяет доказательства другой стороны для outputFile
+// до начала шага и отклоняет файл при подмене
+func verifyFile(proofFile, inputFile, outputFile string, complete bool) error {
+	proofs, err := crypto.LoadDLEQProofs(proofFile)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки доказательств: %w", err)
+	}
+
+	input, err := io.OpenTSVFile(inputFile)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := io.OpenTSVFile(outputFile)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	if err := psi.VerifyEncryption(proofs, input, output, complete); err != nil {
+		return fmt.Errorf("файл %s отклонен: точки изменены или зашифрованы разными ключами: %w", outputFile, err)
+	}
+	reporter.Info("Доказательства DLEQ проверены: " + outputFile)
+	return nil
+}
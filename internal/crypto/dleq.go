@@ -0,0 +1,266 @@
+package crypto
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"filippo.io/nistec"
+)
+
+// Доказательства Чаума-Педерсена (DLEQ) того, что все выходные точки получены
+// из входных умножением на один секретный скаляр k, открытый ключ которого kG.
+// Батч пар (X_i, Y_i) сводится к одной паре M = sum c_i X_i, Z = sum c_i Y_i
+// со случайными коэффициентами c_i, зависящими от всех пар батча: если хотя бы
+// одна пара получена другим скаляром, log_M(Z) != k с подавляющей вероятностью
+
+// ErrInvalidProof - доказательство не прошло проверку: данные изменены
+// или зашифрованы разными ключами
+var ErrInvalidProof = errors.New("доказательство DLEQ не прошло проверку")
+
+const (
+	dleqBatchDomain = "psi-dleq-batch-v1"
+	dleqDomain      = "psi-dleq-v1"
+)
+
+// PublicKey возвращает открытый ключ kG в сжатом представлении SEC1
+func (k *ECDHKey) PublicKey() []byte {
+	// Несжатая точка 0x04 || x || y, префикс сжатой определяется четностью y
+	uncompressed := k.privateKey.PublicKey().Bytes()
+	compressed := make([]byte, 33)
+	compressed[0] = 0x02 | uncompressed[64]&1
+	copy(compressed[1:], uncompressed[1:33])
+	return compressed
+}
+
+// ProveDLEQ доказывает, что outputs[i] = key * inputs[i] для всех i.
+// Точки передаются в hex в любом представлении SEC1. Доказательство - hex c || s
+func ProveDLEQ(key *ECDHKey, inputs, outputs []string) (string, error) {
+	public := key.PublicKey()
+	m, z, err := dleqCombine(public, inputs, outputs)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := randomScalar()
+	if err != nil {
+		return "", err
+	}
+	t1, err := nistec.NewP256Point().ScalarBaseMult(r.FillBytes(make([]byte, 32)))
+	if err != nil {
+		return "", err
+	}
+	t2, err := nistec.NewP256Point().ScalarMult(m, r.FillBytes(make([]byte, 32)))
+	if err != nil {
+		return "", err
+	}
+
+	c := dleqChallenge(public, m, z, t1, t2)
+
+	// s = r - c*k mod n
+	n := elliptic.P256().Params().N
+	s := new(big.Int).Mul(c, new(big.Int).SetBytes(key.scalar))
+	s.Sub(r, s).Mod(s, n)
+
+	return hex.EncodeToString(append(c.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)), nil
+}
+
+// VerifyDLEQ проверяет доказательство ProveDLEQ для открытого ключа public
+func VerifyDLEQ(public []byte, inputs, outputs []string, proof string) error {
+	proofBytes, err := hex.DecodeString(proof)
+	if err != nil || len(proofBytes) != 64 {
+		return fmt.Errorf("%w: ожидается доказательство из 64 байт в hex", ErrInvalidProof)
+	}
+
+	publicPoint, err := unmarshalPoint(public)
+	if err != nil {
+		return fmt.Errorf("ошибка разбора открытого ключа: %w", err)
+	}
+
+	m, z, err := dleqCombine(publicPoint.BytesCompressed(), inputs, outputs)
+	if err != nil {
+		return err
+	}
+
+	n := elliptic.P256().Params().N
+	c := new(big.Int).SetBytes(proofBytes[:32])
+	s := new(big.Int).SetBytes(proofBytes[32:])
+	if c.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return ErrInvalidProof
+	}
+
+	// t1 = sG + c*kG, t2 = sM + cZ
+	t1, err := nistec.NewP256Point().ScalarBaseMult(proofBytes[32:])
+	if err != nil {
+		return err
+	}
+	ck, err := nistec.NewP256Point().ScalarMult(publicPoint, proofBytes[:32])
+	if err != nil {
+		return err
+	}
+	t1.Add(t1, ck)
+
+	t2, err := nistec.NewP256Point().ScalarMult(m, proofBytes[32:])
+	if err != nil {
+		return err
+	}
+	cz, err := nistec.NewP256Point().ScalarMult(z, proofBytes[:32])
+	if err != nil {
+		return err
+	}
+	t2.Add(t2, cz)
+
+	if dleqChallenge(publicPoint.BytesCompressed(), m, z, t1, t2).Cmp(c) != 0 {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// dleqCombine вычисляет M = sum c_i X_i и Z = sum c_i Y_i. Коэффициенты
+// выводятся из хеша открытого ключа и всех пар, поэтому доказывающий
+// не может подобрать пары так, чтобы ошибки взаимно сократились
+func dleqCombine(public []byte, inputs, outputs []string) (*nistec.P256Point, *nistec.P256Point, error) {
+	if len(inputs) != len(outputs) {
+		return nil, nil, fmt.Errorf("%w: %d входных и %d выходных точек", ErrInvalidProof, len(inputs), len(outputs))
+	}
+
+	xs := make([]*nistec.P256Point, len(inputs))
+	ys := make([]*nistec.P256Point, len(outputs))
+	seed := sha256.New()
+	seed.Write([]byte(dleqBatchDomain))
+	seed.Write(public)
+	for i := range inputs {
+		var err error
+		if xs[i], err = decodePoint(inputs[i]); err != nil {
+			return nil, nil, err
+		}
+		if ys[i], err = decodePoint(outputs[i]); err != nil {
+			return nil, nil, err
+		}
+		seed.Write(xs[i].BytesCompressed())
+		seed.Write(ys[i].BytesCompressed())
+	}
+	seedBytes := seed.Sum(nil)
+
+	m := nistec.NewP256Point()
+	z := nistec.NewP256Point()
+	n := elliptic.P256().Params().N
+	for i := range xs {
+		var counter [8]byte
+		binary.BigEndian.PutUint64(counter[:], uint64(i))
+		h := sha256.Sum256(append(seedBytes, counter[:]...))
+		coefficient := new(big.Int).Mod(new(big.Int).SetBytes(h[:]), n).FillBytes(make([]byte, 32))
+
+		cx, err := nistec.NewP256Point().ScalarMult(xs[i], coefficient)
+		if err != nil {
+			return nil, nil, err
+		}
+		cy, err := nistec.NewP256Point().ScalarMult(ys[i], coefficient)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Add(m, cx)
+		z.Add(z, cy)
+	}
+
+	return m, z, nil
+}
+
+func dleqChallenge(public []byte, m, z, t1, t2 *nistec.P256Point) *big.Int {
+	h := sha256.New()
+	h.Write([]byte(dleqDomain))
+	h.Write(public)
+	for _, point := range []*nistec.P256Point{m, z, t1, t2} {
+		h.Write(point.BytesCompressed())
+	}
+	return new(big.Int).Mod(new(big.Int).SetBytes(h.Sum(nil)), elliptic.P256().Params().N)
+}
+
+func decodePoint(point string) (*nistec.P256Point, error) {
+	pointBytes, err := hex.DecodeString(point)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка декодирования hex: %w", err)
+	}
+	return unmarshalPoint(pointBytes)
+}
+
+// randomScalar возвращает случайный ненулевой скаляр меньше порядка группы
+func randomScalar() (*big.Int, error) {
+	n := elliptic.P256().Params().N
+	for {
+		r, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, err
+		}
+		if r.Sign() > 0 {
+			return r, nil
+		}
+	}
+}
+
+const (
+	publicKeyField = "public-key"
+	batchSizeField = "batch-size"
+)
+
+// DLEQProofs - доказательства для файла зашифрованных точек: открытый ключ
+// стороны и доказательства батчей по BatchSize записей в порядке файла
+type DLEQProofs struct {
+	PublicKey []byte
+	BatchSize int
+	Proofs    []string
+}
+
+// SaveDLEQProofs сохраняет доказательства для передачи второй стороне
+func SaveDLEQProofs(filename string, proofs DLEQProofs) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s=%s\n%s=%d\n", publicKeyField, hex.EncodeToString(proofs.PublicKey), batchSizeField, proofs.BatchSize)
+	for _, proof := range proofs.Proofs {
+		b.WriteString(proof)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(filename, []byte(b.String()), 0644)
+}
+
+func LoadDLEQProofs(filename string) (DLEQProofs, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return DLEQProofs{}, err
+	}
+
+	var proofs DLEQProofs
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		line = strings.TrimSpace(line)
+		name, value, ok := strings.Cut(line, "=")
+		switch {
+		case line == "":
+		case ok && name == publicKeyField:
+			proofs.PublicKey, err = hex.DecodeString(value)
+			if err != nil {
+				return DLEQProofs{}, fmt.Errorf("ошибка декодирования открытого ключа: %w", err)
+			}
+		case ok && name == batchSizeField:
+			proofs.BatchSize, err = strconv.Atoi(value)
+			if err != nil {
+				return DLEQProofs{}, fmt.Errorf("ошибка разбора размера батча: %w", err)
+			}
+		case !ok:
+			proofs.Proofs = append(proofs.Proofs, line)
+		default:
+			return DLEQProofs{}, fmt.Errorf("неизвестная строка в файле доказательств: %q", line)
+		}
+	}
+
+	if proofs.PublicKey == nil || proofs.BatchSize <= 0 {
+		return DLEQProofs{}, fmt.Errorf("в файле доказательств нет открытого ключа или размера батча")
+	}
+	return proofs, nil
+}
@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func dleqPairs(t *testing.T, key *ECDHKey, n int) ([]string, []string) {
+	t.Helper()
+
+	var inputs, outputs []string
+	for range n {
+		point, err := RandomPoint(PointUncompressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := ECDHApplyEncoded(key, point, PointCompressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, point)
+		outputs = append(outputs, encrypted)
+	}
+	return inputs, outputs
+}
+
+func TestDLEQ(t *testing.T) {
+	key, _ := GenerateECDHKey()
+	other, _ := GenerateECDHKey()
+	inputs, outputs := dleqPairs(t, key, 10)
+
+	proof, err := ProveDLEQ(key, inputs, outputs)
+	if err != nil {
+		t.Fatalf("ошибка построения доказательства: %v", err)
+	}
+	if err := VerifyDLEQ(key.PublicKey(), inputs, outputs, proof); err != nil {
+		t.Fatalf("верное доказательство отклонено: %v", err)
+	}
+
+	// Одна точка зашифрована другим ключом
+	tampered := slices.Clone(outputs)
+	tampered[3], _ = ECDHApply(other, inputs[3])
+	tamperedProof, err := ProveDLEQ(key, inputs, tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swapped := slices.Clone(outputs)
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+
+	tests := []struct {
+		name    string
+		public  []byte
+		outputs []string
+		proof   string
+	}{
+		{"чужой открытый ключ", other.PublicKey(), outputs, proof},
+		{"подмена точки", key.PublicKey(), tampered, proof},
+		{"доказательство для подмененной точки", key.PublicKey(), tampered, tamperedProof},
+		{"перестановка точек", key.PublicKey(), swapped, proof},
+		{"пропущенная точка", key.PublicKey(), outputs[:9], proof},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyDLEQ(tt.public, inputs[:len(tt.outputs)], tt.outputs, tt.proof); !errors.Is(err, ErrInvalidProof) {
+				t.Errorf("ожидается ErrInvalidProof, получено %v", err)
+			}
+		})
+	}
+}
+
+func TestDLEQProofsFile(t *testing.T) {
+	key, _ := GenerateECDHKey()
+	inputs, outputs := dleqPairs(t, key, 3)
+	proof, _ := ProveDLEQ(key, inputs, outputs)
+
+	filename := filepath.Join(t.TempDir(), "proof.txt")
+	proofs := DLEQProofs{PublicKey: key.PublicKey(), BatchSize: 3, Proofs: []string{proof, proof}}
+	if err := SaveDLEQProofs(filename, proofs); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadDLEQProofs(filename)
+	if err != nil {
+		t.Fatalf("ошибка загрузки: %v", err)
+	}
+	if !slices.Equal(loaded.PublicKey, proofs.PublicKey) || loaded.BatchSize != 3 || !slices.Equal(loaded.Proofs, proofs.Proofs) {
+		t.Errorf("загружено %+v, ожидалось %+v", loaded, proofs)
+	}
+}
@@ -5,12 +5,19 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
+
+	"filippo.io/nistec"
 )
 
+var ErrInvalidPoint = errors.New("невалидная точка на кривой")
+
 type ECDHKey struct {
 	privateKey *ecdh.PrivateKey
+	// scalar - копия privateKey.Bytes(), чтобы не копировать ключ при каждом умножении
+	scalar []byte
 }
 
 func GenerateECDHKey() (*ECDHKey, error) {
@@ -22,40 +29,153 @@ func GenerateECDHKey() (*ECDHKey, error) {
 
 	return &ECDHKey{
 		privateKey: privateKey,
+		scalar:     privateKey.Bytes(),
 	}, nil
 }
 
+// PointEncoding - представление точек, которые возвращает ECDHApply (SEC1)
+type PointEncoding int
+
+const (
+	// 65 байт: 0x04 || x || y
+	PointUncompressed PointEncoding = iota
+	// 33 байта: 0x02 или 0x03 по четности y || x
+	PointCompressed
+)
+
+func ParsePointEncoding(s string) (PointEncoding, error) {
+	switch s {
+	case "uncompressed":
+		return PointUncompressed, nil
+	case "compressed":
+		return PointCompressed, nil
+	default:
+		return 0, fmt.Errorf("неизвестное представление точек %q: ожидается uncompressed или compressed", s)
+	}
+}
+
+func (e PointEncoding) String() string {
+	if e == PointCompressed {
+		return "compressed"
+	}
+	return "uncompressed"
+}
+
+// ECDHApply возвращает точку в несжатом представлении
 func ECDHApply(key *ECDHKey, data string) (string, error) {
+	return ECDHApplyEncoded(key, data, PointUncompressed)
+}
+
+// ECDHApplyEncoded принимает 32 байта HMAC (версия 1) или точку в любом
+// представлении SEC1 и возвращает результат в представлении encoding.
+// Умножение на ключ выполняется за постоянное время через nistec: crypto/ecdh
+// возвращает только x-координату, а нужна точка целиком
+func ECDHApplyEncoded(key *ECDHKey, data string, encoding PointEncoding) (string, error) {
 	inputBytes, err := hex.DecodeString(data)
 	if err != nil {
 		return "", fmt.Errorf("ошибка декодирования hex: %w", err)
 	}
 
-	curve := elliptic.P256()
-	var x, y *big.Int
-
+	var point *nistec.P256Point
 	if len(inputBytes) == 32 {
-		x, y = curve.ScalarBaseMult(inputBytes)
-	} else if len(inputBytes) == 65 && inputBytes[0] == 0x04 {
-		x = new(big.Int).SetBytes(inputBytes[1:33])
-		y = new(big.Int).SetBytes(inputBytes[33:65])
-		
-		if !curve.IsOnCurve(x, y) {
-			return "", fmt.Errorf("невалидная точка на кривой")
-		}
+		// Скаляр, больший порядка группы, приводится по модулю порядка
+		point, err = nistec.NewP256Point().ScalarBaseMult(inputBytes)
 	} else {
-		return "", fmt.Errorf("неверный формат данных: ожидается 32 байта (HMAC) или 65 байт (точка на кривой), получено %d", len(inputBytes))
+		point, err = unmarshalPoint(inputBytes)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := point.ScalarMult(point, key.scalar); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(encodePoint(point, encoding)), nil
+}
+
+// RandomPoint возвращает случайную точку кривой в представлении encoding.
+// Такие точки неотличимы от зашифрованных идентификаторов и с пренебрежимо
+// малой вероятностью совпадают с ними
+func RandomPoint(encoding PointEncoding) (string, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	point, err := unmarshalPoint(key.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(encodePoint(point, encoding)), nil
+}
+
+// EncodePoint переводит точку в представление encoding, чтобы точки,
+// полученные от сторон с разными настройками, можно было сравнивать как строки
+func EncodePoint(point string, encoding PointEncoding) (string, error) {
+	if encoding.matches(point) {
+		return point, nil
 	}
 
-	rx, ry := curve.ScalarMult(x, y, key.privateKey.Bytes())
+	pointBytes, err := hex.DecodeString(point)
+	if err != nil {
+		return "", fmt.Errorf("ошибка декодирования hex: %w", err)
+	}
 
-	return hex.EncodeToString(elliptic.Marshal(curve, rx, ry)), nil
+	p, err := unmarshalPoint(pointBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(encodePoint(p, encoding)), nil
+}
+
+// matches проверяет только длину и префикс: точка в нужном представлении
+// возвращается без проверки принадлежности кривой
+func (e PointEncoding) matches(point string) bool {
+	if e == PointCompressed {
+		return len(point) == 2*33 && (point[:2] == "02" || point[:2] == "03")
+	}
+	return len(point) == 2*65 && point[:2] == "04"
+}
+
+func unmarshalPoint(data []byte) (*nistec.P256Point, error) {
+	// SetBytes принимает и точку на бесконечности, она для протокола невалидна
+	if !(len(data) == 65 && data[0] == 0x04) && !(len(data) == 33 && (data[0] == 0x02 || data[0] == 0x03)) {
+		return nil, fmt.Errorf("%w: ожидается 32 байта (HMAC), 33 или 65 байт (точка на кривой), получено %d", ErrInvalidPoint, len(data))
+	}
+
+	// SetBytes проверяет, что координаты меньше p и точка лежит на кривой
+	point, err := nistec.NewP256Point().SetBytes(data)
+	if err != nil {
+		return nil, ErrInvalidPoint
+	}
+	return point, nil
+}
+
+func encodePoint(point *nistec.P256Point, encoding PointEncoding) []byte {
+	if encoding == PointCompressed {
+		return point.BytesCompressed()
+	}
+	return point.Bytes()
+}
+
+func marshalPoint(x, y *big.Int) []byte {
+	return elliptic.Marshal(elliptic.P256(), x, y)
 }
 
 func (k *ECDHKey) Bytes() []byte {
 	return k.privateKey.Bytes()
 }
 
+// MultiplyKeys возвращает ключ a·b mod n: применить его к точке - то же, что
+// применить a, затем b. Скаляры перемножаются через big.Int не за постоянное
+// время, но это делается один раз за сессию, а не для каждой записи
+func MultiplyKeys(a, b *ECDHKey) (*ECDHKey, error) {
+	product := new(big.Int).Mul(new(big.Int).SetBytes(a.scalar), new(big.Int).SetBytes(b.scalar))
+	product.Mod(product, elliptic.P256().Params().N)
+	return NewECDHKeyFromBytes(product.FillBytes(make([]byte, 32)))
+}
+
 func NewECDHKeyFromBytes(keyBytes []byte) (*ECDHKey, error) {
 	curve := ecdh.P256()
 	privateKey, err := curve.NewPrivateKey(keyBytes)
@@ -65,5 +185,6 @@ func NewECDHKeyFromBytes(keyBytes []byte) (*ECDHKey, error) {
 
 	return &ECDHKey{
 		privateKey: privateKey,
+		scalar:     privateKey.Bytes(),
 	}, nil
 }
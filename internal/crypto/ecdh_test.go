@@ -2,6 +2,8 @@ package crypto
 
 import (
 	"encoding/hex"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -110,3 +112,210 @@ func TestECDHCommutativity(t *testing.T) {
 		t.Error("операция должна быть коммутативной: H^P^Y должно быть равно H^Y^P")
 	}
 }
+
+func TestMultiplyKeys(t *testing.T) {
+	keyP, _ := GenerateECDHKey()
+	keyY, _ := GenerateECDHKey()
+
+	hashed := HMAC(nil, []byte("test-hmac-key-32-bytes-padding!!"), []byte("+79001234567"))
+
+	encP, _ := ECDHApply(keyP, hashed)
+	encPY, _ := ECDHApply(keyY, encP)
+
+	keyPY, err := MultiplyKeys(keyP, keyY)
+	if err != nil {
+		t.Fatalf("ошибка умножения ключей: %v", err)
+	}
+
+	encProduct, err := ECDHApply(keyPY, hashed)
+	if err != nil {
+		t.Fatalf("ошибка применения произведения ключей: %v", err)
+	}
+	if encProduct != encPY {
+		t.Error("H^(P·Y) должно быть равно H^P^Y")
+	}
+}
+
+func TestECDHApplyCompressed(t *testing.T) {
+	keyP, _ := GenerateECDHKey()
+	keyY, _ := GenerateECDHKey()
+
+	hashed, err := HashToGroup(ProtocolV2, nil, []byte("test-hmac-key-32-bytes-padding!!"), "phone", []byte("+79001234567"))
+	if err != nil {
+		t.Fatalf("ошибка хеширования: %v", err)
+	}
+
+	encP, err := ECDHApply(keyP, hashed)
+	if err != nil {
+		t.Fatalf("ошибка применения P: %v", err)
+	}
+
+	encPCompressed, err := ECDHApplyEncoded(keyP, hashed, PointCompressed)
+	if err != nil {
+		t.Fatalf("ошибка применения P со сжатием: %v", err)
+	}
+	if len(encPCompressed) != 2*33 || (encPCompressed[:2] != "02" && encPCompressed[:2] != "03") {
+		t.Fatalf("ожидается сжатая точка, получено %s", encPCompressed)
+	}
+	if encPCompressed[2:] != encP[2:66] {
+		t.Error("сжатая точка должна содержать ту же координату x")
+	}
+
+	// Сжатый и несжатый вход дают одинаковый результат
+	encPY, err := ECDHApply(keyY, encP)
+	if err != nil {
+		t.Fatalf("ошибка применения Y: %v", err)
+	}
+	encPYFromCompressed, err := ECDHApply(keyY, encPCompressed)
+	if err != nil {
+		t.Fatalf("ошибка применения Y к сжатой точке: %v", err)
+	}
+	if encPY != encPYFromCompressed {
+		t.Error("результат не должен зависеть от представления входной точки")
+	}
+
+	normalized, err := EncodePoint(encPCompressed, PointUncompressed)
+	if err != nil {
+		t.Fatalf("ошибка распаковки точки: %v", err)
+	}
+	if normalized != encP {
+		t.Error("распакованная точка должна совпадать с несжатой")
+	}
+
+	compressed, err := EncodePoint(encP, PointCompressed)
+	if err != nil {
+		t.Fatalf("ошибка сжатия точки: %v", err)
+	}
+	if compressed != encPCompressed {
+		t.Error("сжатая точка должна совпадать с результатом ECDHApplyEncoded")
+	}
+}
+
+func TestECDHApplyInvalidCompressedPoint(t *testing.T) {
+	key, _ := GenerateECDHKey()
+
+	for name, point := range map[string]string{
+		// x = 1: 1 - 3 + b не является квадратом по модулю p
+		"не на кривой": "02" + strings.Repeat("00", 31) + "01",
+		// x = p
+		"x вне поля":       "03ffffffff00000001000000000000000000000000ffffffffffffffffffffffff",
+		"неверный префикс": "05" + strings.Repeat("11", 32),
+		"неверная длина":   "02" + strings.Repeat("11", 33),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ECDHApply(key, point); !errors.Is(err, ErrInvalidPoint) {
+				t.Errorf("ожидалась ErrInvalidPoint, получено %v", err)
+			}
+			if _, err := EncodePoint(point, PointUncompressed); !errors.Is(err, ErrInvalidPoint) {
+				t.Errorf("ожидалась ErrInvalidPoint при распаковке, получено %v", err)
+			}
+		})
+	}
+}
+
+// Значения получены реализацией на crypto/elliptic с big.Int, которую
+// заменило умножение через nistec: результат должен совпадать побайтно
+func TestECDHApplyKnownAnswers(t *testing.T) {
+	keyBytes, _ := hex.DecodeString("c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721")
+	key, err := NewECDHKeyFromBytes(keyBytes)
+	if err != nil {
+		t.Fatalf("ошибка создания ключа: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		input        string
+		uncompressed string
+		compressed   string
+	}{
+		{
+			name:         "v1",
+			input:        "4b1bdde279e9eabd3ea0e86a04f37e147242cbbcd0f42760558569f3226acff0",
+			uncompressed: "04a3314bf34095bdd0b1f1f3ce38c83a35b37bbbf971fde7851963c4e992a8b4cb29e784e0226827989716c1ff1ed0d32528f08e53cd230ba2cce2f250f8d75429",
+			compressed:   "03a3314bf34095bdd0b1f1f3ce38c83a35b37bbbf971fde7851963c4e992a8b4cb",
+		},
+		{
+			name:         "v1 четный y",
+			input:        "1c07f9c858de81c8425d7112cc67fb02e079cc515456d3d6101ab8dd6a9d6438",
+			uncompressed: "045314bc18f775655e5d29c5092a02ceb16720ae79aae308ad69d5cbe4780cf5747d1d1f30a7eb0fce0b60f8488b3b50a9a588d88d5e8b4fb2c29820241a25ea54",
+			compressed:   "025314bc18f775655e5d29c5092a02ceb16720ae79aae308ad69d5cbe4780cf574",
+		},
+		{
+			name:         "v1 скаляр больше порядка",
+			input:        strings.Repeat("ff", 32),
+			uncompressed: "04456089773b75ed65ac21637d481471d0ab8352551a45b71b687d310fe114e7f0e8e3b1e6ff5cc6ca13f7d2d5cd3a66710bfe1f7ee1e4b8703715590bb9280ff3",
+		},
+		{
+			// n + 1: результат равен публичному ключу
+			name:         "v1 скаляр n+1",
+			input:        "ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632552",
+			uncompressed: "0460fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb67903fe1008b8bc99a41ae9e95628bc64f2f1b20c2d7e9f5177a3c294d4462299",
+		},
+		{
+			name:         "v2",
+			input:        "041a50a1a4ab9c48522bbbd0307455668d1b03c13ab3ed6346f2c0234fec606ecd3fe5be102c81a7f4ed6ec1f4f6720134e6aaa2d7b3dfd7201e89ae2b1aebe9bb",
+			uncompressed: "048d11ea72cf54b34fac188bf790b02de0207c6e0ea9dfff4e92056b470f5d05b9eb5c6c6f208bbb4d0bb32fd542f0159c7eedc78526fafd83e73efd1e62ff12b9",
+			compressed:   "038d11ea72cf54b34fac188bf790b02de0207c6e0ea9dfff4e92056b470f5d05b9",
+		},
+		{
+			name:         "v2 четный y",
+			input:        "04740e7632d6d1d57b467151eab102b1f8e9d3e34356754884ca915201ab67d3b0422bdfd12f3219f4b55ac8e050666b2960d05332b5998bbc5a628ace433b232a",
+			uncompressed: "043efce0e5c5d67d52982bdb18941a2e8f98c5d8758010cae9b5e6c3eed92e36974726f0fdbd26786dd7432e67018bde2df8ca70435c43d415ee8a2be58cc884b8",
+			compressed:   "023efce0e5c5d67d52982bdb18941a2e8f98c5d8758010cae9b5e6c3eed92e3697",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			uncompressed, err := ECDHApply(key, tc.input)
+			if err != nil {
+				t.Fatalf("ошибка применения ключа: %v", err)
+			}
+			if uncompressed != tc.uncompressed {
+				t.Errorf("получено %s, ожидалось %s", uncompressed, tc.uncompressed)
+			}
+
+			if tc.compressed == "" {
+				return
+			}
+
+			compressed, err := ECDHApplyEncoded(key, tc.input, PointCompressed)
+			if err != nil {
+				t.Fatalf("ошибка применения ключа со сжатием: %v", err)
+			}
+			if compressed != tc.compressed {
+				t.Errorf("получено %s, ожидалось %s", compressed, tc.compressed)
+			}
+		})
+	}
+}
+
+func TestECDHApplyRejectsInfinity(t *testing.T) {
+	key, _ := GenerateECDHKey()
+
+	if _, err := ECDHApply(key, "00"); !errors.Is(err, ErrInvalidPoint) {
+		t.Errorf("ожидалась ErrInvalidPoint, получено %v", err)
+	}
+}
+
+func TestRandomPoint(t *testing.T) {
+	key, _ := GenerateECDHKey()
+
+	for _, encoding := range []PointEncoding{PointUncompressed, PointCompressed} {
+		first, err := RandomPoint(encoding)
+		if err != nil {
+			t.Fatalf("ошибка генерации точки: %v", err)
+		}
+		if !encoding.matches(first) {
+			t.Errorf("точка %s не в представлении %s", first, encoding)
+		}
+
+		second, _ := RandomPoint(encoding)
+		if first == second {
+			t.Error("случайные точки совпали")
+		}
+
+		// Фиктивные записи проходят шифрование как настоящие точки
+		if _, err := ECDHApply(key, first); err != nil {
+			t.Errorf("ошибка применения ключа к случайной точке: %v", err)
+		}
+	}
+}
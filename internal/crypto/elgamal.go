@@ -0,0 +1,238 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"filippo.io/nistec"
+)
+
+// Экспоненциальный ElGamal на P-256 для режима sum: значение m шифруется как
+// (rG, mG + rY). Сумма шифротекстов - шифротекст суммы значений, поэтому
+// bob складывает значения совпавших записей, не узнавая их. Расшифровка дает mG,
+// m находится перебором baby-step giant-step, поэтому сумма ограничена сверху
+
+// ErrSumRange - расшифрованная сумма больше верхней границы перебора
+var ErrSumRange = errors.New("сумма вне диапазона расшифровки")
+
+// ElGamalKey - приватный ключ стороны, которая расшифровывает сумму
+type ElGamalKey struct {
+	scalar []byte
+	// negScalar = n - scalar, чтобы вычитать scalar*C1 сложением
+	negScalar []byte
+	public    *ElGamalPublicKey
+}
+
+// ElGamalPublicKey - открытый ключ Y для шифрования значений и перешифрования суммы
+type ElGamalPublicKey struct {
+	point *nistec.P256Point
+}
+
+func GenerateElGamalKey() (*ElGamalKey, error) {
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewElGamalKeyFromBytes(privateKey.Bytes())
+}
+
+func NewElGamalKeyFromBytes(keyBytes []byte) (*ElGamalKey, error) {
+	privateKey, err := ecdh.P256().NewPrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания ElGamal ключа: %w", err)
+	}
+
+	point, err := nistec.NewP256Point().SetBytes(privateKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	scalar := privateKey.Bytes()
+	return &ElGamalKey{
+		scalar:    scalar,
+		negScalar: negateScalar(new(big.Int).SetBytes(scalar)),
+		public:    &ElGamalPublicKey{point: point},
+	}, nil
+}
+
+func (k *ElGamalKey) Bytes() []byte {
+	return k.scalar
+}
+
+func (k *ElGamalKey) PublicKey() *ElGamalPublicKey {
+	return k.public
+}
+
+// Bytes возвращает открытый ключ в сжатом представлении
+func (k *ElGamalPublicKey) Bytes() []byte {
+	return k.point.BytesCompressed()
+}
+
+func NewElGamalPublicKeyFromBytes(keyBytes []byte) (*ElGamalPublicKey, error) {
+	point, err := unmarshalPoint(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания открытого ElGamal ключа: %w", err)
+	}
+	return &ElGamalPublicKey{point: point}, nil
+}
+
+// Encrypt шифрует значение. Шифротекст - hex сжатых точек C1 || C2
+func (k *ElGamalPublicKey) Encrypt(value uint64) (string, error) {
+	c1, c2, err := k.encrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return encodeCiphertext(c1, c2), nil
+}
+
+func (k *ElGamalPublicKey) encrypt(value uint64) (*nistec.P256Point, *nistec.P256Point, error) {
+	r, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c1, err := nistec.NewP256Point().ScalarBaseMult(r.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c2, err := nistec.NewP256Point().ScalarMult(k.point, r.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := nistec.NewP256Point().ScalarBaseMult(uint64Scalar(value))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c1, c2.Add(c2, m), nil
+}
+
+// ElGamalSum складывает шифротексты. Нулевое значение не готово к работе,
+// используйте NewElGamalSum
+type ElGamalSum struct {
+	c1, c2 *nistec.P256Point
+}
+
+// NewElGamalSum возвращает пустую сумму
+func NewElGamalSum() *ElGamalSum {
+	return &ElGamalSum{c1: nistec.NewP256Point(), c2: nistec.NewP256Point()}
+}
+
+func (s *ElGamalSum) Add(ciphertext string) error {
+	c1, c2, err := decodeCiphertext(ciphertext)
+	if err != nil {
+		return err
+	}
+
+	s.c1.Add(s.c1, c1)
+	s.c2.Add(s.c2, c2)
+	return nil
+}
+
+// Ciphertext возвращает сумму, перешифрованную ключом key: иначе владелец
+// приватного ключа, зная случайности своих шифротекстов, мог бы определить,
+// какие из них вошли в сумму
+func (s *ElGamalSum) Ciphertext(key *ElGamalPublicKey) (string, error) {
+	c1, c2, err := key.encrypt(0)
+	if err != nil {
+		return "", err
+	}
+
+	c1.Add(c1, s.c1)
+	c2.Add(c2, s.c2)
+	return encodeCiphertext(c1, c2), nil
+}
+
+// Decrypt расшифровывает шифротекст значения или суммы не больше maxSum
+func (k *ElGamalKey) Decrypt(ciphertext string, maxSum uint64) (uint64, error) {
+	c1, c2, err := decodeCiphertext(ciphertext)
+	if err != nil {
+		return 0, err
+	}
+
+	// mG = C2 - x*C1
+	m, err := nistec.NewP256Point().ScalarMult(c1, k.negScalar)
+	if err != nil {
+		return 0, err
+	}
+	m.Add(m, c2)
+
+	return discreteLog(m, maxSum)
+}
+
+// discreteLog находит value <= maxSum, для которого value*G = point:
+// таблица j*G для j < step и не больше step шагов по -step*G
+func discreteLog(point *nistec.P256Point, maxSum uint64) (uint64, error) {
+	step := uint64(math.Sqrt(float64(maxSum))) + 1
+
+	table := make(map[string]uint64, step)
+	baby := nistec.NewP256Point()
+	generator := nistec.NewP256Point().SetGenerator()
+	for j := range step {
+		table[string(baby.BytesCompressed())] = j
+		baby.Add(baby, generator)
+	}
+
+	giant, err := nistec.NewP256Point().ScalarBaseMult(negateScalar(new(big.Int).SetUint64(step)))
+	if err != nil {
+		return 0, err
+	}
+
+	current := nistec.NewP256Point().Set(point)
+	for i := uint64(0); i <= maxSum/step; i++ {
+		if j, found := table[string(current.BytesCompressed())]; found {
+			if value := i*step + j; value <= maxSum {
+				return value, nil
+			}
+			break
+		}
+		current.Add(current, giant)
+	}
+
+	return 0, fmt.Errorf("%w: сумма больше %d", ErrSumRange, maxSum)
+}
+
+func encodeCiphertext(c1, c2 *nistec.P256Point) string {
+	return hex.EncodeToString(append(c1.BytesCompressed(), c2.BytesCompressed()...))
+}
+
+func decodeCiphertext(ciphertext string) (*nistec.P256Point, *nistec.P256Point, error) {
+	data, err := hex.DecodeString(ciphertext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка декодирования шифротекста: %w", err)
+	}
+	if len(data) != 2*33 {
+		return nil, nil, fmt.Errorf("%w: ожидается шифротекст из 66 байт, получено %d", ErrInvalidPoint, len(data))
+	}
+
+	c1, err := unmarshalPoint(data[:33])
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := unmarshalPoint(data[33:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+func uint64Scalar(value uint64) []byte {
+	scalar := make([]byte, 32)
+	binary.BigEndian.PutUint64(scalar[24:], value)
+	return scalar
+}
+
+// negateScalar возвращает n - scalar в 32 байтах, где n - порядок группы
+func negateScalar(scalar *big.Int) []byte {
+	n := elliptic.P256().Params().N
+	return new(big.Int).Mod(new(big.Int).Neg(scalar), n).FillBytes(make([]byte, 32))
+}
@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestElGamalSum(t *testing.T) {
+	key, err := GenerateElGamalKey()
+	if err != nil {
+		t.Fatalf("ошибка генерации ключа: %v", err)
+	}
+
+	sum := NewElGamalSum()
+	var expected uint64
+	for _, value := range []uint64{0, 1, 999, 123456, 7} {
+		ciphertext, err := key.PublicKey().Encrypt(value)
+		if err != nil {
+			t.Fatalf("ошибка шифрования: %v", err)
+		}
+
+		decrypted, err := key.Decrypt(ciphertext, 1<<20)
+		if err != nil || decrypted != value {
+			t.Errorf("расшифровано %d (%v), ожидалось %d", decrypted, err, value)
+		}
+
+		if err := sum.Add(ciphertext); err != nil {
+			t.Fatalf("ошибка сложения: %v", err)
+		}
+		expected += value
+	}
+
+	ciphertext, err := sum.Ciphertext(key.PublicKey())
+	if err != nil {
+		t.Fatalf("ошибка перешифрования: %v", err)
+	}
+	decrypted, err := key.Decrypt(ciphertext, 1<<20)
+	if err != nil || decrypted != expected {
+		t.Errorf("сумма %d (%v), ожидалось %d", decrypted, err, expected)
+	}
+
+	// Сумма больше границы перебора не расшифровывается
+	if _, err := key.Decrypt(ciphertext, 1000); !errors.Is(err, ErrSumRange) {
+		t.Errorf("ожидается ErrSumRange, получено %v", err)
+	}
+}
+
+func TestElGamalEmptySum(t *testing.T) {
+	key, _ := GenerateElGamalKey()
+
+	ciphertext, err := NewElGamalSum().Ciphertext(key.PublicKey())
+	if err != nil {
+		t.Fatalf("ошибка перешифрования: %v", err)
+	}
+	if decrypted, err := key.Decrypt(ciphertext, 100); err != nil || decrypted != 0 {
+		t.Errorf("пустая сумма расшифрована в %d (%v)", decrypted, err)
+	}
+}
+
+func TestElGamalKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := GenerateElGamalKey()
+
+	keyFile, publicFile := filepath.Join(dir, "key.txt"), filepath.Join(dir, "public.txt")
+	if err := SaveElGamalKey(keyFile, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveElGamalPublicKey(publicFile, key.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadElGamalKey(keyFile)
+	if err != nil {
+		t.Fatalf("ошибка загрузки ключа: %v", err)
+	}
+	public, err := LoadElGamalPublicKey(publicFile)
+	if err != nil {
+		t.Fatalf("ошибка загрузки открытого ключа: %v", err)
+	}
+
+	ciphertext, _ := public.Encrypt(42)
+	if decrypted, err := loaded.Decrypt(ciphertext, 100); err != nil || decrypted != 42 {
+		t.Errorf("расшифровано %d (%v), ожидалось 42", decrypted, err)
+	}
+}
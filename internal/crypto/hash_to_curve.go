@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// Реализация hash_to_curve для сьюта P256_XMD:SHA-256_SSWU_RO_ (RFC 9380).
+
+const (
+	hashToCurveDST   = "PSI-V2-with-P256_XMD:SHA-256_SSWU_RO_"
+	hashToCurveDSTV3 = "PSI-V3-with-P256_XMD:SHA-256_SSWU_RO_"
+)
+
+var (
+	sswuA = big.NewInt(-3)
+	sswuZ = big.NewInt(-10)
+)
+
+func HashToCurve(msg, dst []byte) (x, y *big.Int, err error) {
+	u, err := hashToField(msg, dst, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	curve := elliptic.P256()
+	x0, y0 := mapToCurveSSWU(u[0])
+	x1, y1 := mapToCurveSSWU(u[1])
+
+	// Кофактор P-256 равен 1, поэтому clear_cofactor не требуется
+	x, y = curve.Add(x0, y0, x1, y1)
+	return x, y, nil
+}
+
+func expandMessageXMD(msg, dst []byte, lenInBytes int) ([]byte, error) {
+	const bInBytes = sha256.Size
+	const sInBytes = sha256.BlockSize
+
+	ell := (lenInBytes + bInBytes - 1) / bInBytes
+	if ell > 255 || lenInBytes > 65535 || len(dst) > 255 {
+		return nil, errors.New("expand_message_xmd: недопустимые параметры")
+	}
+
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+
+	h := sha256.New()
+	h.Write(make([]byte, sInBytes))
+	h.Write(msg)
+	h.Write([]byte{byte(lenInBytes >> 8), byte(lenInBytes), 0})
+	h.Write(dstPrime)
+	b0 := h.Sum(nil)
+
+	h.Reset()
+	h.Write(b0)
+	h.Write([]byte{1})
+	h.Write(dstPrime)
+	bi := h.Sum(nil)
+
+	uniform := make([]byte, 0, ell*bInBytes)
+	uniform = append(uniform, bi...)
+
+	for i := 2; i <= ell; i++ {
+		tmp := make([]byte, bInBytes)
+		for j := range tmp {
+			tmp[j] = b0[j] ^ bi[j]
+		}
+		h.Reset()
+		h.Write(tmp)
+		h.Write([]byte{byte(i)})
+		h.Write(dstPrime)
+		bi = h.Sum(nil)
+		uniform = append(uniform, bi...)
+	}
+
+	return uniform[:lenInBytes], nil
+}
+
+func hashToField(msg, dst []byte, count int) ([]*big.Int, error) {
+	// L = ceil((ceil(log2(p)) + k) / 8), k = 128
+	const l = 48
+
+	p := elliptic.P256().Params().P
+	uniform, err := expandMessageXMD(msg, dst, count*l)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*big.Int, count)
+	for i := range result {
+		e := new(big.Int).SetBytes(uniform[i*l : (i+1)*l])
+		result[i] = e.Mod(e, p)
+	}
+	return result, nil
+}
+
+func mapToCurveSSWU(u *big.Int) (x, y *big.Int) {
+	params := elliptic.P256().Params()
+	p := params.P
+
+	mod := func(v *big.Int) *big.Int { return v.Mod(v, p) }
+	mul := func(a, b *big.Int) *big.Int { return mod(new(big.Int).Mul(a, b)) }
+	add := func(a, b *big.Int) *big.Int { return mod(new(big.Int).Add(a, b)) }
+	inv0 := func(a *big.Int) *big.Int {
+		if a.Sign() == 0 {
+			return new(big.Int)
+		}
+		return new(big.Int).ModInverse(a, p)
+	}
+	g := func(x *big.Int) *big.Int {
+		// g(x) = x^3 + A*x + B
+		x3 := mul(mul(x, x), x)
+		return add(add(x3, mul(sswuA, x)), params.B)
+	}
+
+	u2 := mul(u, u)
+	zu2 := mul(sswuZ, u2)
+
+	// tv1 = inv0(Z^2 * u^4 + Z * u^2)
+	tv1 := inv0(add(mul(zu2, zu2), zu2))
+
+	var x1 *big.Int
+	if tv1.Sign() == 0 {
+		// x1 = B / (Z * A)
+		x1 = mul(params.B, inv0(mul(sswuZ, sswuA)))
+	} else {
+		// x1 = (-B / A) * (1 + tv1)
+		negBDivA := mul(mod(new(big.Int).Neg(params.B)), inv0(mod(new(big.Int).Set(sswuA))))
+		x1 = mul(negBDivA, add(big.NewInt(1), tv1))
+	}
+
+	gx1 := g(x1)
+	if isSquare(gx1, p) {
+		x, y = x1, sqrt3mod4(gx1, p)
+	} else {
+		x = mul(zu2, x1)
+		y = sqrt3mod4(g(x), p)
+	}
+
+	if u.Bit(0) != y.Bit(0) {
+		y = mod(new(big.Int).Neg(y))
+	}
+
+	return x, y
+}
+
+func isSquare(a, p *big.Int) bool {
+	// Критерий Эйлера: a^((p-1)/2) ∈ {0, 1}
+	e := new(big.Int).Rsh(new(big.Int).Sub(p, big.NewInt(1)), 1)
+	r := new(big.Int).Exp(a, e, p)
+	return r.Sign() == 0 || r.Cmp(big.NewInt(1)) == 0
+}
+
+func sqrt3mod4(a, p *big.Int) *big.Int {
+	// Для p ≡ 3 (mod 4): sqrt(a) = a^((p+1)/4)
+	e := new(big.Int).Rsh(new(big.Int).Add(p, big.NewInt(1)), 2)
+	return new(big.Int).Exp(a, e, p)
+}
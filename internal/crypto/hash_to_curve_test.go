@@ -0,0 +1,136 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestExpandMessageXMD(t *testing.T) {
+	// RFC 9380, K.1: expand_message_xmd(SHA-256)
+	dst := []byte("QUUX-V01-CS02-with-expander-SHA256-128")
+
+	out, err := expandMessageXMD([]byte(""), dst, 0x20)
+	if err != nil {
+		t.Fatalf("ошибка expand_message_xmd: %v", err)
+	}
+
+	expected := "68a985b87eb6b46952128911f2a4412bbc302a9d759667f87f7a21d803f07235"
+	if got := hex.EncodeToString(out); got != expected {
+		t.Errorf("ожидается %s, получено %s", expected, got)
+	}
+}
+
+func TestHashToCurveVectors(t *testing.T) {
+	// RFC 9380, J.1.1: P256_XMD:SHA-256_SSWU_RO_
+	dst := []byte("QUUX-V01-CS02-with-P256_XMD:SHA-256_SSWU_RO_")
+
+	vectors := []struct {
+		msg string
+		x   string
+		y   string
+	}{
+		{
+			msg: "",
+			x:   "2c15230b26dbc6fc9a37051158c95b79656e17a1a920b11394ca91c44247d3e4",
+			y:   "8a7a74985cc5c776cdfe4b1f19884970453912e9d31528c060be9ab5c43e8415",
+		},
+		{
+			msg: "abc",
+			x:   "0bb8b87485551aa43ed54f009230450b492fead5f1cc91658775dac4a3388a0f",
+			y:   "5c41b3d0731a27a7b14bc0bf0ccded2d8751f83493404c84a88e71ffd424212e",
+		},
+		{
+			msg: "abcdef0123456789",
+			x:   "65038ac8f2b1def042a5df0b33b1f4eca6bff7cb0f9c6c1526811864e544ed80",
+			y:   "cad44d40a656e7aff4002a8de287abc8ae0482b5ae825822bb870d6df9b56ca3",
+		},
+	}
+
+	for _, v := range vectors {
+		x, y, err := HashToCurve([]byte(v.msg), dst)
+		if err != nil {
+			t.Fatalf("ошибка hash_to_curve(%q): %v", v.msg, err)
+		}
+
+		if got := fmt.Sprintf("%064x", x); got != v.x {
+			t.Errorf("hash_to_curve(%q).x: ожидается %s, получено %s", v.msg, v.x, got)
+		}
+		if got := fmt.Sprintf("%064x", y); got != v.y {
+			t.Errorf("hash_to_curve(%q).y: ожидается %s, получено %s", v.msg, v.y, got)
+		}
+	}
+}
+
+func TestHashToGroupCommutativity(t *testing.T) {
+	keyP, _ := GenerateECDHKey()
+	keyY, _ := GenerateECDHKey()
+
+	hmacKey := []byte("test-hmac-key-32-bytes-padding!!")
+	phone := []byte("+79001234567")
+
+	for _, version := range []ProtocolVersion{ProtocolV1, ProtocolV2, ProtocolV3} {
+		hashed, err := HashToGroup(version, nil, hmacKey, "phone", phone)
+		if err != nil {
+			t.Fatalf("v%d: ошибка хеширования: %v", version, err)
+		}
+
+		encP, _ := ECDHApply(keyP, hashed)
+		encPY, err := ECDHApply(keyY, encP)
+		if err != nil {
+			t.Fatalf("v%d: ошибка применения Y после P: %v", version, err)
+		}
+
+		encY, _ := ECDHApply(keyY, hashed)
+		encYP, err := ECDHApply(keyP, encY)
+		if err != nil {
+			t.Fatalf("v%d: ошибка применения P после Y: %v", version, err)
+		}
+
+		if encPY != encYP {
+			t.Errorf("v%d: операция должна быть коммутативной", version)
+		}
+	}
+
+	v1, _ := HashToGroup(ProtocolV1, nil, hmacKey, "phone", phone)
+	if v1 != HMAC(nil, hmacKey, phone) {
+		t.Error("v1 должна совпадать с исходной схемой g^HMAC")
+	}
+
+	if _, err := HashToGroup(ProtocolVersion(99), nil, hmacKey, "phone", phone); err == nil {
+		t.Error("ожидалась ошибка для неизвестной версии протокола")
+	}
+}
+
+func TestHashToGroupDomainSeparation(t *testing.T) {
+	hmacKey := []byte("test-hmac-key-32-bytes-padding!!")
+	value := []byte("6d92078a-8246-4ba4-ae5b-76104861e7dc")
+
+	maid, _ := HashToGroup(ProtocolV3, nil, hmacKey, "maid", value)
+	raw, _ := HashToGroup(ProtocolV3, nil, hmacKey, "raw", value)
+	if maid == raw {
+		t.Error("одинаковые значения разных типов не должны совпадать")
+	}
+
+	// Префикс длины не дает сдвинуть границу между типом и значением
+	ab, _ := HashToGroup(ProtocolV3, nil, hmacKey, "ab", []byte("c"))
+	a, _ := HashToGroup(ProtocolV3, nil, hmacKey, "a", []byte("bc"))
+	if ab == a {
+		t.Error("граница между типом и значением должна входить в хеш")
+	}
+
+	v2, _ := HashToGroup(ProtocolV2, nil, hmacKey, "phone", value)
+	v3, _ := HashToGroup(ProtocolV3, nil, hmacKey, "phone", value)
+	if v2 == v3 {
+		t.Error("хеши v2 и v3 не должны совпадать")
+	}
+
+	v2Raw, _ := HashToGroup(ProtocolV2, nil, hmacKey, "raw", value)
+	if v2 != v2Raw {
+		t.Error("v2 не должна учитывать тип идентификатора")
+	}
+
+	if _, err := HashToGroup(ProtocolV3, nil, hmacKey, "", value); err == nil {
+		t.Error("ожидалась ошибка для пустого типа идентификатора")
+	}
+}
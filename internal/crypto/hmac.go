@@ -19,6 +19,10 @@ func GenerateHMACKey() ([]byte, error) {
 }
 
 func HMAC(p *sync.Pool, key, data []byte) string {
+	return hex.EncodeToString(hmacSum(p, key, data))
+}
+
+func hmacSum(p *sync.Pool, key, data []byte) []byte {
 	var h hash.Hash
 	if p == nil {
 		h = hmac.New(sha256.New, key)
@@ -31,5 +35,5 @@ func HMAC(p *sync.Pool, key, data []byte) string {
 		h.Reset()
 		p.Put(h)
 	}
-	return hex.EncodeToString(sum)
+	return sum
 }
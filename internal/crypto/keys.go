@@ -1,30 +1,94 @@
 package crypto
 
 import (
+	"crypto/ed25519"
 	"encoding/hex"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 )
 
-func SaveHMACKey(filename string, hmacKey []byte) error {
-	encoded := hex.EncodeToString(hmacKey)
-	return os.WriteFile(filename, []byte(encoded), 0600)
+const (
+	protocolVersionField = "protocol-version"
+	idTypeField          = "id-type"
+)
+
+// HMACKeyFile - содержимое файла ключа K: ключ и параметры хеширования,
+// которые вторая сторона должна повторить
+type HMACKeyFile struct {
+	Key     []byte
+	Version ProtocolVersion
+	// IDTypes - типы идентификаторов в колонках входных данных, пустой для телефонов
+	IDTypes []string
 }
 
-func LoadHMACKey(filename string) ([]byte, error) {
+// SaveHMACKey сохраняет ключ K вместе с версией протокола и типом идентификатора,
+// чтобы вторая сторона хешировала свои данные тем же способом
+func SaveHMACKey(filename string, key HMACKeyFile) error {
+	return os.WriteFile(filename, EncodeHMACKey(key), 0600)
+}
+
+// LoadHMACKey читает ключ K. Файлы без версии протокола считаются ProtocolV1
+func LoadHMACKey(filename string) (HMACKeyFile, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		return nil, err
+		return HMACKeyFile{}, err
 	}
 
-	encoded := strings.TrimSpace(string(data))
-	hmacKey, err := hex.DecodeString(encoded)
+	return DecodeHMACKey(data)
+}
+
+// EncodeHMACKey пишет типы идентификаторов, только если они заданы. Ключ
+// ProtocolV1 для телефонов пишется без версии, одной строкой hex, чтобы его
+// читали прежние версии утилиты. Файлы остальных версий они не читают
+func EncodeHMACKey(key HMACKeyFile) []byte {
+	if key.Version == ProtocolV1 && len(key.IDTypes) == 0 {
+		return []byte(hex.EncodeToString(key.Key) + "\n")
+	}
+
+	encoded := fmt.Sprintf("%s\n%s=%d\n", hex.EncodeToString(key.Key), protocolVersionField, key.Version)
+	if len(key.IDTypes) > 0 {
+		encoded += fmt.Sprintf("%s=%s\n", idTypeField, strings.Join(key.IDTypes, ","))
+	}
+	return []byte(encoded)
+}
+
+func DecodeHMACKey(data []byte) (HMACKeyFile, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	hmacKey, err := hex.DecodeString(strings.TrimSpace(lines[0]))
 	if err != nil {
-		return nil, fmt.Errorf("ошибка декодирования HMAC ключа: %w", err)
+		return HMACKeyFile{}, fmt.Errorf("ошибка декодирования HMAC ключа: %w", err)
+	}
+
+	key := HMACKeyFile{Key: hmacKey, Version: ProtocolV1}
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		switch {
+		case ok && name == protocolVersionField:
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return HMACKeyFile{}, fmt.Errorf("ошибка разбора версии протокола: %w", err)
+			}
+			key.Version = ProtocolVersion(v)
+		case ok && name == idTypeField:
+			key.IDTypes = strings.Split(value, ",")
+		default:
+			return HMACKeyFile{}, fmt.Errorf("неизвестная строка в файле HMAC ключа: %q", line)
+		}
 	}
 
-	return hmacKey, nil
+	if err := key.Version.Validate(); err != nil {
+		return HMACKeyFile{}, err
+	}
+
+	return key, nil
 }
 
 func SaveECDHKey(filename string, ecdhKey *ECDHKey) error {
@@ -46,3 +110,52 @@ func LoadECDHKey(filename string) (*ECDHKey, error) {
 
 	return NewECDHKeyFromBytes(keyBytes)
 }
+
+func SaveElGamalKey(filename string, key *ElGamalKey) error {
+	return os.WriteFile(filename, []byte(hex.EncodeToString(key.Bytes())), 0600)
+}
+
+func LoadElGamalKey(filename string) (*ElGamalKey, error) {
+	keyBytes, err := loadHexKey(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ElGamal ключа: %w", err)
+	}
+	return NewElGamalKeyFromBytes(keyBytes)
+}
+
+// SaveElGamalPublicKey сохраняет открытый ключ для передачи второй стороне
+func SaveElGamalPublicKey(filename string, key *ElGamalPublicKey) error {
+	return os.WriteFile(filename, []byte(hex.EncodeToString(key.Bytes())), 0644)
+}
+
+func LoadElGamalPublicKey(filename string) (*ElGamalPublicKey, error) {
+	keyBytes, err := loadHexKey(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка декодирования открытого ElGamal ключа: %w", err)
+	}
+	return NewElGamalPublicKeyFromBytes(keyBytes)
+}
+
+func loadHexKey(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// SaveSigningKey сохраняет seed ключа Ed25519, которым сторона подписывает манифесты
+func SaveSigningKey(filename string, key ed25519.PrivateKey) error {
+	return os.WriteFile(filename, []byte(hex.EncodeToString(key.Seed())), 0600)
+}
+
+func LoadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	seed, err := loadHexKey(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ключа подписи: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("ошибка декодирования ключа подписи: ожидается %d байт, получено %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
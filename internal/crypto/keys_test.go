@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestHMACKeyFileVersion(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := GenerateHMACKey()
+
+	filename := filepath.Join(dir, "hmac_key.txt")
+	if err := SaveHMACKey(filename, HMACKeyFile{Key: key, Version: ProtocolV2}); err != nil {
+		t.Fatalf("ошибка сохранения ключа: %v", err)
+	}
+
+	loaded, err := LoadHMACKey(filename)
+	if err != nil {
+		t.Fatalf("ошибка загрузки ключа: %v", err)
+	}
+	if !bytes.Equal(loaded.Key, key) {
+		t.Error("загруженный ключ не совпадает с сохраненным")
+	}
+	if loaded.Version != ProtocolV2 {
+		t.Errorf("ожидается версия %d, получено %d", ProtocolV2, loaded.Version)
+	}
+	if loaded.IDTypes != nil {
+		t.Errorf("тип идентификатора не задан, получено %q", loaded.IDTypes)
+	}
+
+	data, _ := os.ReadFile(filename)
+	if bytes.Contains(data, []byte(idTypeField)) {
+		t.Error("тип по умолчанию не должен записываться в файл ключа")
+	}
+}
+
+func TestHMACKeyFileIDType(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hmac_key.txt")
+	key, _ := GenerateHMACKey()
+
+	if err := SaveHMACKey(filename, HMACKeyFile{Key: key, Version: ProtocolV3, IDTypes: []string{"phone", "email"}}); err != nil {
+		t.Fatalf("ошибка сохранения ключа: %v", err)
+	}
+
+	loaded, err := LoadHMACKey(filename)
+	if err != nil {
+		t.Fatalf("ошибка загрузки ключа: %v", err)
+	}
+	if loaded.Version != ProtocolV3 || !slices.Equal(loaded.IDTypes, []string{"phone", "email"}) {
+		t.Errorf("ожидается v3 и phone,email, получено v%d и %q", loaded.Version, loaded.IDTypes)
+	}
+}
+
+func TestHMACKeyFileLegacy(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hmac_key.txt")
+	if err := os.WriteFile(filename, []byte("00112233445566778899aabbccddeeff"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadHMACKey(filename)
+	if err != nil {
+		t.Fatalf("ошибка загрузки ключа: %v", err)
+	}
+	if loaded.Version != ProtocolV1 {
+		t.Errorf("файл без версии должен читаться как v1, получено %d", loaded.Version)
+	}
+}
+
+func TestHMACKeyFileV1WithoutVersion(t *testing.T) {
+	key, _ := GenerateHMACKey()
+
+	encoded := EncodeHMACKey(HMACKeyFile{Key: key, Version: ProtocolV1})
+	if bytes.Contains(encoded, []byte(protocolVersionField)) {
+		t.Errorf("ключ v1 должен записываться без версии, получено %q", encoded)
+	}
+
+	loaded, err := DecodeHMACKey(encoded)
+	if err != nil {
+		t.Fatalf("ошибка загрузки ключа: %v", err)
+	}
+	if !bytes.Equal(loaded.Key, key) || loaded.Version != ProtocolV1 {
+		t.Errorf("ожидается исходный ключ v1, получено v%d", loaded.Version)
+	}
+}
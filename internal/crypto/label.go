@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Метки для labeled-режима: b_user_id шифруется ключом, выведенным из
+// H(phone_b)^B^A^C, и находится по тегу от той же точки. C - одноразовый
+// секрет bob: точки H(phone_b)^B^A alice вычисляет сама на шаге 1, поэтому
+// без C она могла бы открыть все метки. Расшифровать метку может только
+// сторона, получившая равную точку H(phone_a)^A^B^C.
+
+const (
+	labelTagDomain = "psi-label-tag"
+	labelKeyDomain = "psi-label-key"
+)
+
+func LabelTag(point string) (string, error) {
+	digest, err := labelDigest(labelTagDomain, point)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest), nil
+}
+
+func EncryptLabel(point, label string) (string, error) {
+	aead, err := labelAEAD(point)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(label), nil)
+	return hex.EncodeToString(sealed), nil
+}
+
+func DecryptLabel(point, ciphertext string) (string, error) {
+	aead, err := labelAEAD(point)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := hex.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("ошибка декодирования метки: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("метка слишком короткая")
+	}
+
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	label, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", fmt.Errorf("ошибка расшифровки метки: %w", err)
+	}
+
+	return string(label), nil
+}
+
+func labelAEAD(point string) (cipher.AEAD, error) {
+	key, err := labelDigest(labelKeyDomain, point)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func labelDigest(domain, point string) ([]byte, error) {
+	// Ключ и тег не должны зависеть от представления точки
+	point, err := EncodePoint(point, PointUncompressed)
+	if err != nil {
+		return nil, err
+	}
+
+	pointBytes, err := hex.DecodeString(point)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка декодирования hex: %w", err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(domain))
+	h.Write(pointBytes)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"testing"
+)
+
+func TestLabelRoundTrip(t *testing.T) {
+	keyA, _ := GenerateECDHKey()
+	keyB, _ := GenerateECDHKey()
+
+	hashed, _ := HashToGroup(LatestProtocolVersion, nil, []byte("test-hmac-key-32-bytes-padding!!"), "phone", []byte("+79001234567"))
+	encB, _ := ECDHApply(keyB, hashed)
+	encBA, _ := ECDHApply(keyA, encB)
+	encA, _ := ECDHApply(keyA, hashed)
+	encAB, _ := ECDHApply(keyB, encA)
+
+	ciphertext, err := EncryptLabel(encBA, "b_user_001")
+	if err != nil {
+		t.Fatalf("ошибка шифрования метки: %v", err)
+	}
+
+	tagBA, _ := LabelTag(encBA)
+	tagAB, _ := LabelTag(encAB)
+	if tagBA != tagAB {
+		t.Fatal("теги для равных точек должны совпадать")
+	}
+
+	label, err := DecryptLabel(encAB, ciphertext)
+	if err != nil {
+		t.Fatalf("ошибка расшифровки метки: %v", err)
+	}
+	if label != "b_user_001" {
+		t.Errorf("ожидается b_user_001, получено %q", label)
+	}
+
+	other, _ := ECDHApply(keyB, encB)
+	if _, err := DecryptLabel(other, ciphertext); err == nil {
+		t.Error("метка не должна расшифровываться ключом от другой точки")
+	}
+}
@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand/v2"
+)
+
+func newChaCha8() (*mrand.ChaCha8, error) {
+	var seed [32]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	return mrand.NewChaCha8(seed), nil
+}
+
+// Shuffle переставляет элементы криптографически стойкой случайной перестановкой
+func Shuffle(n int, swap func(i, j int)) error {
+	rng, err := newChaCha8()
+	if err != nil {
+		return err
+	}
+
+	mrand.New(rng).Shuffle(n, swap)
+	return nil
+}
+
+// SortKeys выдает случайные 128-битные ключи в hex. Сортировка записей по таким
+// ключам дает случайную перестановку, не требуя держать все записи в памяти:
+// вероятность повтора ключа пренебрежимо мала
+type SortKeys struct {
+	rng *mrand.ChaCha8
+}
+
+func NewSortKeys() (*SortKeys, error) {
+	rng, err := newChaCha8()
+	if err != nil {
+		return nil, err
+	}
+	return &SortKeys{rng: rng}, nil
+}
+
+// Next возвращает следующий ключ. Не безопасен для конкурентного использования
+func (k *SortKeys) Next() string {
+	var key [16]byte
+	k.rng.Read(key[:])
+	return hex.EncodeToString(key[:])
+}
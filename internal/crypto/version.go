@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrUnsupportedVersion = errors.New("неподдерживаемая версия протокола")
+
+type ProtocolVersion int
+
+const (
+	// H(x) = g^HMAC_K(x)
+	ProtocolV1 ProtocolVersion = 1
+	// H(x) = hash_to_curve(HMAC_K(x)), RFC 9380
+	ProtocolV2 ProtocolVersion = 2
+	// H(x) = hash_to_curve(HMAC_K(len(type) || type || x)): тип идентификатора
+	// разделяет домены, значения разных типов не совпадают
+	ProtocolV3 ProtocolVersion = 3
+
+	LatestProtocolVersion = ProtocolV3
+)
+
+func (v ProtocolVersion) Validate() error {
+	if v < ProtocolV1 || v > LatestProtocolVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, v)
+	}
+	return nil
+}
+
+// DomainSeparated сообщает, входит ли тип идентификатора в хеш.
+// Версии без разделения доменов поддерживают только телефоны
+func (v ProtocolVersion) DomainSeparated() bool {
+	return v >= ProtocolV3
+}
+
+// HashToGroup вычисляет H(data) в представлении, которое принимает ECDHApply.
+// domain - тип идентификатора, учитывается начиная с ProtocolV3
+func HashToGroup(version ProtocolVersion, p *sync.Pool, key []byte, domain string, data []byte) (string, error) {
+	switch version {
+	case ProtocolV1:
+		return HMAC(p, key, data), nil
+	case ProtocolV2:
+		return hashToPoint(hmacSum(p, key, data), hashToCurveDST)
+	case ProtocolV3:
+		if domain == "" || len(domain) > 255 {
+			return "", fmt.Errorf("недопустимый тип идентификатора %q", domain)
+		}
+
+		input := make([]byte, 0, 1+len(domain)+len(data))
+		input = append(input, byte(len(domain)))
+		input = append(input, domain...)
+		input = append(input, data...)
+		return hashToPoint(hmacSum(p, key, input), hashToCurveDSTV3)
+	default:
+		return "", version.Validate()
+	}
+}
+
+func hashToPoint(msg []byte, dst string) (string, error) {
+	x, y, err := HashToCurve(msg, []byte(dst))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(marshalPoint(x, y)), nil
+}
@@ -0,0 +1,306 @@
+package extsort
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// Накладные расходы Go на запись: заголовок слайса и заголовки строк
+const (
+	recordOverhead = 24 + 24
+	fieldOverhead  = 16
+)
+
+// Не больше стольких прогонов сливается за один проход, чтобы не упереться
+// в лимит открытых файлов
+const maxMergeWidth = 128
+
+// Sorter сортирует записи, не держа в памяти больше memoryLimit байт:
+// при переполнении буфер сортируется и сбрасывается на диск отдельным
+// прогоном, а Sort сливает прогоны k-way слиянием
+type Sorter struct {
+	compare     func(a, b []string) int
+	memoryLimit int64
+	dir         string
+
+	buf  [][]string
+	size int64
+	runs []string
+}
+
+func New(dir string, memoryLimit int64, compare func(a, b []string) int) *Sorter {
+	return &Sorter{
+		compare:     compare,
+		memoryLimit: memoryLimit,
+		dir:         dir,
+	}
+}
+
+func recordSize(record []string) int64 {
+	size := int64(recordOverhead)
+	for _, field := range record {
+		size += int64(fieldOverhead + len(field))
+	}
+	return size
+}
+
+// Write добавляет запись. Слайс не должен изменяться после вызова
+func (s *Sorter) Write(record []string) error {
+	s.buf = append(s.buf, record)
+	s.size += recordSize(record)
+
+	if s.size >= s.memoryLimit {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *Sorter) spill() error {
+	slices.SortStableFunc(s.buf, s.compare)
+
+	name, err := s.writeRun(func(writer *io.TSVWriter) error {
+		for _, record := range s.buf {
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.runs = append(s.runs, name)
+	s.buf = nil
+	s.size = 0
+	return nil
+}
+
+func (s *Sorter) writeRun(write func(*io.TSVWriter) error) (string, error) {
+	file, err := os.CreateTemp(s.dir, "psi-sort-*.tsv")
+	if err != nil {
+		return "", fmt.Errorf("ошибка создания временного файла: %w", err)
+	}
+	name := file.Name()
+	file.Close()
+
+	writer, err := io.CreateTSVFile(name)
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+
+	if err := write(writer); err != nil {
+		writer.Close()
+		os.Remove(name)
+		return "", fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		os.Remove(name)
+		return "", fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+
+	return name, nil
+}
+
+// Sort завершает запись и возвращает записи в порядке compare.
+// Записи с равными ключами возвращаются в порядке добавления.
+// Close результата удаляет временные файлы
+func (s *Sorter) Sort() (io.RecordReadCloser, error) {
+	if len(s.runs) == 0 {
+		slices.SortStableFunc(s.buf, s.compare)
+		records := s.buf
+		s.buf = nil
+		return &sliceReader{records: records}, nil
+	}
+
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	for len(s.runs) > maxMergeWidth {
+		if err := s.mergeRuns(maxMergeWidth); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	merger, err := newMerger(s.runs, s.compare)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.runs = nil
+
+	return merger, nil
+}
+
+// mergeRuns сливает первые n прогонов в один новый
+func (s *Sorter) mergeRuns(n int) error {
+	merger, err := newMerger(s.runs[:n], s.compare)
+	if err != nil {
+		return err
+	}
+	defer merger.Close()
+
+	name, err := s.writeRun(func(writer *io.TSVWriter) error {
+		for {
+			record, err := merger.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Новый прогон содержит более ранние записи, поэтому идет первым:
+	// так сохраняется порядок добавления для равных ключей
+	s.runs = append([]string{name}, s.runs[n:]...)
+	return nil
+}
+
+// Close удаляет временные файлы, если Sort не был вызван или завершился ошибкой
+func (s *Sorter) Close() {
+	for _, name := range s.runs {
+		os.Remove(name)
+	}
+	s.runs = nil
+	s.buf = nil
+}
+
+type sliceReader struct {
+	records [][]string
+}
+
+func (r *sliceReader) Read() ([]string, error) {
+	if len(r.records) == 0 {
+		return nil, io.EOF
+	}
+	record := r.records[0]
+	r.records[0] = nil
+	r.records = r.records[1:]
+	return record, nil
+}
+
+func (r *sliceReader) Close() error {
+	r.records = nil
+	return nil
+}
+
+type runHead struct {
+	record []string
+	run    int
+}
+
+type runHeap struct {
+	heads   []runHead
+	compare func(a, b []string) int
+}
+
+func (h *runHeap) Len() int { return len(h.heads) }
+
+func (h *runHeap) Less(i, j int) bool {
+	if c := h.compare(h.heads[i].record, h.heads[j].record); c != 0 {
+		return c < 0
+	}
+	return h.heads[i].run < h.heads[j].run
+}
+
+func (h *runHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+
+func (h *runHeap) Push(x any) { h.heads = append(h.heads, x.(runHead)) }
+
+func (h *runHeap) Pop() any {
+	head := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return head
+}
+
+type merger struct {
+	names   []string
+	readers []*io.TSVReader
+	heap    *runHeap
+}
+
+func newMerger(names []string, compare func(a, b []string) int) (*merger, error) {
+	m := &merger{
+		names: slices.Clone(names),
+		heap:  &runHeap{compare: compare},
+	}
+
+	for i, name := range m.names {
+		reader, err := io.OpenTSVFile(name)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.readers = append(m.readers, reader)
+
+		if err := m.advance(i); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	heap.Init(m.heap)
+	return m, nil
+}
+
+func (m *merger) advance(run int) error {
+	record, err := m.readers[run].Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка чтения временного файла: %w", err)
+	}
+
+	m.heap.heads = append(m.heap.heads, runHead{record: record, run: run})
+	return nil
+}
+
+func (m *merger) Read() ([]string, error) {
+	if m.heap.Len() == 0 {
+		return nil, io.EOF
+	}
+
+	head := heap.Pop(m.heap).(runHead)
+
+	record, err := m.readers[head.run].Read()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("ошибка чтения временного файла: %w", err)
+	}
+	if err == nil {
+		heap.Push(m.heap, runHead{record: record, run: head.run})
+	}
+
+	return head.record, nil
+}
+
+func (m *merger) Close() error {
+	for _, reader := range m.readers {
+		reader.Close()
+	}
+	for _, name := range m.names {
+		os.Remove(name)
+	}
+	m.readers = nil
+	m.names = nil
+	return nil
+}
@@ -0,0 +1,97 @@
+package extsort
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+func compareFirst(a, b []string) int {
+	return cmp.Compare(a[0], b[0])
+}
+
+func sortAll(t *testing.T, dir string, memoryLimit int64, records [][]string) [][]string {
+	t.Helper()
+
+	sorter := New(dir, memoryLimit, compareFirst)
+	for _, record := range records {
+		if err := sorter.Write(slices.Clone(record)); err != nil {
+			t.Fatalf("ошибка записи: %v", err)
+		}
+	}
+
+	reader, err := sorter.Sort()
+	if err != nil {
+		t.Fatalf("ошибка сортировки: %v", err)
+	}
+	defer reader.Close()
+
+	var result [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ошибка чтения: %v", err)
+		}
+		result = append(result, record)
+	}
+
+	return result
+}
+
+func TestSort(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	records := make([][]string, 1000)
+	for i := range records {
+		// Ключи повторяются, второе поле проверяет стабильность
+		records[i] = []string{fmt.Sprintf("%03d", rng.Intn(100)), fmt.Sprintf("%d", i)}
+	}
+
+	expected := slices.Clone(records)
+	slices.SortStableFunc(expected, compareFirst)
+
+	for _, limit := range []int64{1 << 30, 4096, 1} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			dir := t.TempDir()
+
+			result := sortAll(t, dir, limit, records)
+			if !slices.EqualFunc(result, expected, slices.Equal) {
+				t.Error("результат отличается от сортировки в памяти")
+			}
+
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 0 {
+				t.Errorf("временные файлы не удалены: %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestSortEmpty(t *testing.T) {
+	if result := sortAll(t, t.TempDir(), 1, nil); len(result) != 0 {
+		t.Errorf("ожидается пустой результат, получено %d записей", len(result))
+	}
+}
+
+func TestCloseRemovesRuns(t *testing.T) {
+	dir := t.TempDir()
+
+	sorter := New(dir, 1, compareFirst)
+	for i := 0; i < 10; i++ {
+		sorter.Write([]string{fmt.Sprintf("%d", i)})
+	}
+	sorter.Close()
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("временные файлы не удалены: %d", len(entries))
+	}
+}
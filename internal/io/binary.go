@@ -0,0 +1,439 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strconv"
+
+	"filippo.io/nistec"
+)
+
+// Бинарный формат передачи:
+//
+//	magic "PSIB" | версия формата (1 байт) | версия протокола (1 байт) | число записей (uint64 BE)
+//	блоки: длина (uint32 BE) | CRC-32C данных (uint32 BE) | записи
+//	блок нулевой длины в конце файла
+//
+// Запись начинается со схемы: 0, если число и типы полей те же, что у предыдущей
+// записи, иначе число полей + 1 (uvarint) и байт типа на каждое поле. Затем идут
+// значения полей. Индексы хранятся неявно (предыдущее значение в колонке + 1) или
+// разностью с ним, точки - в сжатом виде SEC1 (33 байта), hex - байтами.
+// Чтение восстанавливает исходные строки полей без изменений
+
+var binaryMagic = []byte("PSIB")
+
+const (
+	binaryFormatVersion = 1
+	binaryHeaderSize    = 4 + 1 + 1 + 8
+	binaryCountOffset   = 6
+
+	// Число записей неизвестно, например при записи в поток
+	unknownCount = ^uint64(0)
+
+	binaryChunkSize    = 64 * 1024
+	maxBinaryChunkSize = 16 * 1024 * 1024
+)
+
+const (
+	fieldString byte = iota
+	fieldUvarint
+	fieldImplicitIndex
+	fieldDelta
+	fieldHex
+	fieldPoint
+)
+
+// Разность хранится только для индексов, при которых она не переполняет int64
+const maxDeltaIndex = 1 << 62
+
+var ErrCorrupted = errors.New("поврежденный бинарный файл")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const uncompressedPointHexLen = 2 * (1 + 2*32)
+
+type binaryEncoder struct {
+	w       io.Writer
+	at      io.WriterAt
+	version int
+
+	chunk   []byte
+	count   uint64
+	started bool
+	closed  bool
+
+	columns columnState
+	tags    []byte
+}
+
+// columnState хранит последний индекс в каждой колонке, изначально -1
+type columnState []int64
+
+func (c *columnState) prev(column int) int64 {
+	for len(*c) <= column {
+		*c = append(*c, -1)
+	}
+	return (*c)[column]
+}
+
+// newBinaryEncoder пишет в w. Если передан at, при закрытии в заголовок
+// записывается число записей
+func newBinaryEncoder(w io.Writer, at io.WriterAt, version int) *binaryEncoder {
+	return &binaryEncoder{
+		w:       w,
+		at:      at,
+		version: version,
+		chunk:   make([]byte, 0, binaryChunkSize),
+	}
+}
+
+func (e *binaryEncoder) writeHeader() error {
+	header := make([]byte, 0, binaryHeaderSize)
+	header = append(header, binaryMagic...)
+	header = append(header, binaryFormatVersion, byte(e.version))
+	header = binary.BigEndian.AppendUint64(header, unknownCount)
+
+	_, err := e.w.Write(header)
+	return err
+}
+
+func (e *binaryEncoder) Write(record []string) error {
+	if !e.started {
+		e.started = true
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	tags := make([]byte, len(record))
+	var payload []byte
+	for i, field := range record {
+		tags[i], payload = e.appendField(payload, i, field)
+	}
+
+	if bytes.Equal(tags, e.tags) && e.count > 0 {
+		e.chunk = append(e.chunk, 0)
+	} else {
+		e.chunk = binary.AppendUvarint(e.chunk, uint64(len(record))+1)
+		e.chunk = append(e.chunk, tags...)
+		e.tags = tags
+	}
+	e.chunk = append(e.chunk, payload...)
+	e.count++
+
+	if len(e.chunk) >= binaryChunkSize {
+		return e.writeChunk()
+	}
+	return nil
+}
+
+func (e *binaryEncoder) appendField(buf []byte, column int, field string) (byte, []byte) {
+	if n, ok := parseIndex(field); ok {
+		prev := e.columns.prev(column)
+		if n >= maxDeltaIndex {
+			e.columns[column] = -1
+			return fieldUvarint, binary.AppendUvarint(buf, n)
+		}
+
+		e.columns[column] = int64(n)
+		if int64(n) == prev+1 {
+			return fieldImplicitIndex, buf
+		}
+		return fieldDelta, binary.AppendVarint(buf, int64(n)-prev)
+	}
+
+	if compressed, ok := compressPoint(field); ok {
+		return fieldPoint, append(buf, compressed...)
+	}
+
+	if isLowerHex(field) {
+		buf = binary.AppendUvarint(buf, uint64(len(field)/2))
+		buf, _ = hex.AppendDecode(buf, []byte(field))
+		return fieldHex, buf
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(field)))
+	return fieldString, append(buf, field...)
+}
+
+// parseIndex принимает только десятичную запись, которую strconv вернет обратно без изменений
+func parseIndex(field string) (uint64, bool) {
+	if field == "" || len(field) > 20 || (field[0] == '0' && len(field) > 1) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(field, 10, 64)
+	return n, err == nil
+}
+
+func isLowerHex(field string) bool {
+	if field == "" || len(field)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func compressPoint(field string) ([]byte, bool) {
+	if len(field) != uncompressedPointHexLen || !isLowerHex(field) {
+		return nil, false
+	}
+
+	data, _ := hex.DecodeString(field)
+	// SetBytes проверяет, что точка лежит на кривой; 65 байт не могут
+	// кодировать точку на бесконечности
+	point, err := nistec.NewP256Point().SetBytes(data)
+	if err != nil {
+		return nil, false
+	}
+
+	return point.BytesCompressed(), true
+}
+
+func (e *binaryEncoder) writeChunk() error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(e.chunk)))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(e.chunk, crcTable))
+
+	if _, err := e.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(e.chunk); err != nil {
+		return err
+	}
+
+	e.chunk = e.chunk[:0]
+	return nil
+}
+
+func (e *binaryEncoder) Flush() error {
+	if len(e.chunk) == 0 {
+		return nil
+	}
+	return e.writeChunk()
+}
+
+// Close записывает последний блок и признак конца файла
+func (e *binaryEncoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	if !e.started {
+		e.started = true
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	if err := e.writeChunk(); err != nil {
+		return err
+	}
+
+	if e.at != nil {
+		var count [8]byte
+		binary.BigEndian.PutUint64(count[:], e.count)
+		if _, err := e.at.WriteAt(count[:], binaryCountOffset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isBinary(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(binaryMagic))
+	return err == nil && bytes.Equal(magic, binaryMagic)
+}
+
+type binaryDecoder struct {
+	r       *bufio.Reader
+	version int
+	count   uint64
+
+	chunk   []byte
+	chunks  int
+	ordinal uint64
+	done    bool
+
+	columns columnState
+	tags    []byte
+}
+
+func newBinaryDecoder(r *bufio.Reader) (*binaryDecoder, error) {
+	header := make([]byte, binaryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: неполный заголовок", ErrCorrupted)
+	}
+
+	if header[4] != binaryFormatVersion {
+		return nil, fmt.Errorf("неподдерживаемая версия бинарного формата: %d", header[4])
+	}
+
+	return &binaryDecoder{
+		r:       r,
+		version: int(header[5]),
+		count:   binary.BigEndian.Uint64(header[binaryCountOffset:]),
+	}, nil
+}
+
+func (d *binaryDecoder) nextChunk() error {
+	var header [8]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return fmt.Errorf("%w: файл обрезан после блока %d", ErrCorrupted, d.chunks)
+	}
+
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > maxBinaryChunkSize {
+		return fmt.Errorf("%w: блок %d слишком большой (%d байт)", ErrCorrupted, d.chunks, size)
+	}
+
+	if size == 0 {
+		d.done = true
+		if d.count != unknownCount && d.count != d.ordinal {
+			return fmt.Errorf("%w: в заголовке %d записей, прочитано %d", ErrCorrupted, d.count, d.ordinal)
+		}
+		return io.EOF
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(d.r, chunk); err != nil {
+		return fmt.Errorf("%w: файл обрезан в блоке %d", ErrCorrupted, d.chunks)
+	}
+
+	if crc32.Checksum(chunk, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return fmt.Errorf("%w: неверная контрольная сумма блока %d", ErrCorrupted, d.chunks)
+	}
+
+	d.chunk = chunk
+	d.chunks++
+	return nil
+}
+
+func (d *binaryDecoder) Read() ([]string, error) {
+	for len(d.chunk) == 0 {
+		if d.done {
+			return nil, io.EOF
+		}
+		if err := d.nextChunk(); err != nil {
+			return nil, err
+		}
+	}
+
+	record, err := d.decodeRecord()
+	if err != nil {
+		return nil, fmt.Errorf("%w: запись %d: %v", ErrCorrupted, d.ordinal, err)
+	}
+	d.ordinal++
+	return record, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(d.chunk)
+	if size <= 0 {
+		return 0, errors.New("неверный varint")
+	}
+	d.chunk = d.chunk[size:]
+	return n, nil
+}
+
+func (d *binaryDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.chunk)) {
+		return nil, errors.New("поле выходит за границу блока")
+	}
+	data := d.chunk[:n]
+	d.chunk = d.chunk[n:]
+	return data, nil
+}
+
+func (d *binaryDecoder) decodeRecord() ([]string, error) {
+	schema, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	if schema == 0 {
+		if d.tags == nil {
+			return nil, errors.New("нет схемы предыдущей записи")
+		}
+	} else {
+		tags, err := d.bytes(schema - 1)
+		if err != nil {
+			return nil, err
+		}
+		d.tags = slices.Clone(tags)
+	}
+
+	record := make([]string, len(d.tags))
+	for i, tag := range d.tags {
+		switch tag {
+		case fieldImplicitIndex, fieldDelta:
+			prev := d.columns.prev(i)
+			n := prev + 1
+			if tag == fieldDelta {
+				delta, size := binary.Varint(d.chunk)
+				if size <= 0 {
+					return nil, errors.New("неверный varint")
+				}
+				d.chunk = d.chunk[size:]
+				n = prev + delta
+			}
+			if n < 0 || n >= maxDeltaIndex {
+				return nil, errors.New("индекс вне допустимого диапазона")
+			}
+			d.columns[i] = n
+			record[i] = strconv.FormatInt(n, 10)
+		case fieldUvarint:
+			n, err := d.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			d.columns.prev(i)
+			d.columns[i] = -1
+			record[i] = strconv.FormatUint(n, 10)
+		case fieldPoint:
+			data, err := d.bytes(33)
+			if err != nil {
+				return nil, err
+			}
+			point, err := nistec.NewP256Point().SetBytes(data)
+			if err != nil {
+				return nil, errors.New("невалидная точка")
+			}
+			record[i] = hex.EncodeToString(point.Bytes())
+		case fieldHex, fieldString:
+			n, err := d.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			data, err := d.bytes(n)
+			if err != nil {
+				return nil, err
+			}
+			if tag == fieldHex {
+				record[i] = hex.EncodeToString(data)
+			} else {
+				record[i] = string(data)
+			}
+		default:
+			return nil, fmt.Errorf("неизвестный тип поля %d", tag)
+		}
+	}
+
+	return record, nil
+}
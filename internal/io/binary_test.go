@@ -0,0 +1,171 @@
+package io
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+func randomPoint(t *testing.T) string {
+	t.Helper()
+
+	scalar := make([]byte, 32)
+	rand.Read(scalar)
+	x, y := elliptic.P256().ScalarBaseMult(scalar)
+	return hex.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y))
+}
+
+func testRecords(t *testing.T) [][]string {
+	return [][]string{
+		{"0", randomPoint(t)},
+		{"7", randomPoint(t), "b_user_001"},
+		{"2", randomPoint(t), ""},
+		{"18446744073709551615", "00ff", "007", "-1", "ABCD", "abc"},
+		{"текст\tс табуляцией", "04" + randomPoint(t)[2:66]},
+		{},
+	}
+}
+
+func readAll(t *testing.T, reader *TSVReader) ([][]string, error) {
+	t.Helper()
+
+	var records [][]string
+	for {
+		record, err := reader.Read()
+		if err == EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	records := testRecords(t)
+
+	buf := &bufferCloser{}
+	writer := NewBinaryWriter(buf, 2)
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewTSVReader(NopResetter(&bufferCloser{*bytes.NewBuffer(buf.Bytes())}))
+	result, err := readAll(t, reader)
+	if err != nil {
+		t.Fatalf("ошибка чтения: %v", err)
+	}
+
+	if !slices.EqualFunc(result, records, slices.Equal) {
+		t.Errorf("записи отличаются:\n%q\n%q", result, records)
+	}
+	if reader.ProtocolVersion() != 2 {
+		t.Errorf("ожидается версия протокола 2, получено %d", reader.ProtocolVersion())
+	}
+}
+
+func TestBinaryFileSize(t *testing.T) {
+	dir := t.TempDir()
+
+	tsv, _ := CreateTSVFile(filepath.Join(dir, "points.tsv.gz"))
+	bin, _ := CreateFile(filepath.Join(dir, "points.psib"), FormatBinary, 2)
+	for i := 0; i < 10000; i++ {
+		// Параллельная обработка немного перемешивает индексы
+		record := []string{strconv.Itoa(i ^ 7), randomPoint(t)}
+		tsv.Write(record)
+		bin.Write(record)
+	}
+	tsv.Close()
+	bin.Close()
+
+	tsvInfo, _ := os.Stat(filepath.Join(dir, "points.tsv.gz"))
+	binInfo, _ := os.Stat(filepath.Join(dir, "points.psib"))
+	if binInfo.Size()*2 > tsvInfo.Size() {
+		t.Errorf("бинарный файл %d байт, TSV с gzip %d байт: ожидается сжатие больше чем вдвое", binInfo.Size(), tsvInfo.Size())
+	}
+}
+
+func TestBinaryFileDetection(t *testing.T) {
+	// Имя с суффиксом .gz не должно мешать определению формата
+	filename := filepath.Join(t.TempDir(), "bob_encrypted.tsv.gz")
+	records := testRecords(t)
+
+	writer, err := CreateFile(filename, FormatBinary, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		writer.Write(record)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenTSVFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if count := reader.Records(); count != len(records) {
+		t.Errorf("в заголовке ожидается %d записей, получено %d", len(records), count)
+	}
+
+	result, err := readAll(t, reader)
+	if err != nil {
+		t.Fatalf("ошибка чтения: %v", err)
+	}
+	if !slices.EqualFunc(result, records, slices.Equal) {
+		t.Error("записи отличаются после чтения файла")
+	}
+}
+
+func TestBinaryCorruption(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data.psib")
+
+	writer, _ := CreateTSVFile(filename)
+	for i := 0; i < 100; i++ {
+		writer.Write([]string{"0", randomPoint(t)})
+	}
+	writer.Close()
+
+	data, _ := os.ReadFile(filename)
+
+	corrupt := func(modify func([]byte) []byte) error {
+		buf := &bufferCloser{*bytes.NewBuffer(modify(slices.Clone(data)))}
+		_, err := readAll(t, NewTSVReader(NopResetter(buf)))
+		return err
+	}
+
+	cases := map[string]func([]byte) []byte{
+		"контрольная сумма": func(b []byte) []byte { b[binaryHeaderSize+20] ^= 1; return b },
+		"обрезанный файл":   func(b []byte) []byte { return b[:len(b)-20] },
+		"нет конца файла":   func(b []byte) []byte { return b[:len(b)-8] },
+		"число записей":     func(b []byte) []byte { b[binaryCountOffset+7]++; return b },
+	}
+
+	for name, modify := range cases {
+		if err := corrupt(modify); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: ожидалась ErrCorrupted, получено %v", name, err)
+		}
+	}
+}
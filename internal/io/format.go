@@ -0,0 +1,46 @@
+package io
+
+import "fmt"
+
+// Format - формат файлов, которые стороны передают друг другу
+type Format string
+
+const (
+	FormatTSV    Format = "tsv"
+	FormatBinary Format = "binary"
+)
+
+const binarySuffix = ".psib"
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatTSV, FormatBinary:
+		return Format(s), nil
+	default:
+		return "", fmt.Errorf("неизвестный формат %q: ожидается tsv или binary", s)
+	}
+}
+
+// Compression - сжатие файлов записей
+type Compression string
+
+const (
+	// CompressionAuto определяет сжатие входных файлов по magic-байтам,
+	// выходных - по суффиксу .gz. Стандартный вывод и бинарный формат не сжимаются
+	CompressionAuto Compression = "auto"
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+)
+
+func ParseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case CompressionAuto, CompressionNone, CompressionGzip:
+		return Compression(s), nil
+	default:
+		return "", fmt.Errorf("неизвестное сжатие %q: ожидается auto, none или gzip", s)
+	}
+}
+
+// Stdio - имя файла, которое означает стандартный ввод для входных файлов
+// и стандартный вывод для выходных
+const Stdio = "-"
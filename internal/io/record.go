@@ -0,0 +1,14 @@
+package io
+
+type RecordReader interface {
+	Read() ([]string, error)
+}
+
+type RecordWriter interface {
+	Write(record []string) error
+}
+
+type RecordReadCloser interface {
+	RecordReader
+	Close() error
+}
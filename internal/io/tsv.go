@@ -1,13 +1,19 @@
 package io
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"strings"
 	"sync/atomic"
+	"unicode"
 )
 
 var EOF = io.EOF
@@ -17,42 +23,134 @@ type ReadResetCloser interface {
 	Reset()
 }
 
+type recordDecoder interface {
+	Read() ([]string, error)
+}
+
+// TSVReader читает записи TSV или бинарного формата, формат определяется по magic-байтам
 type TSVReader struct {
-	reader *csv.Reader
+	reader recordDecoder
 	lc     atomic.Int64
 	rc     ReadResetCloser
+
+	// source считает байты файла или стандартного ввода до распаковки, size - размер файла
+	source  *countingFile
+	size    int64
+	records int
 }
 
 func NewTSVReader(rc ReadResetCloser) *TSVReader {
 	return &TSVReader{
-		reader: createCSVReader(rc),
+		reader: newDecoder(rc),
 		rc:     rc,
 	}
 }
 
+func newDecoder(r io.Reader) recordDecoder {
+	br := bufio.NewReader(r)
+	if !isBinary(br) {
+		return createCSVReader(br)
+	}
+
+	decoder, err := newBinaryDecoder(br)
+	if err != nil {
+		return errDecoder{err}
+	}
+	return decoder
+}
+
+type errDecoder struct {
+	err error
+}
+
+func (d errDecoder) Read() ([]string, error) {
+	return nil, d.err
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// OpenTSVFile открывает файл записей. Сжатие gzip и бинарный формат
+// определяются по magic-байтам
 func OpenTSVFile(filename string) (*TSVReader, error) {
+	return OpenInput(filename, CompressionAuto)
+}
+
+// OpenInput открывает файл записей, для имени Stdio - стандартный ввод.
+// Бинарный формат определяется по magic-байтам, сжатие gzip - тоже по ним
+// или задается compression. Стандартный ввод читается один раз, без перемотки,
+// и хешируется при чтении, см. SHA256
+func OpenInput(filename string, compression Compression) (*TSVReader, error) {
+	if filename == Stdio {
+		return openStdin(compression)
+	}
+
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	var reader ReadResetCloser = &fileResetter{file}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Размер именованного канала или устройства неизвестен
+	var size int64
+	if info.Mode().IsRegular() {
+		size = info.Size()
+	}
+
+	source := &countingFile{File: file}
+	var reader ReadResetCloser = source
 
-	if strings.HasSuffix(filename, ".gz") {
-		gzr, err := gzip.NewReader(file)
+	compressed := compression == CompressionGzip
+	if compression == CompressionAuto {
+		magic := make([]byte, len(gzipMagic))
+		n, _ := file.ReadAt(magic, 0)
+		compressed = n == len(magic) && bytes.Equal(magic, gzipMagic)
+	}
+	if compressed {
+		gzr, err := gzip.NewReader(source)
 		if err != nil {
 			file.Close()
 			return nil, err
 		}
-		reader = &gzipReadCloser{gzr, file}
+		reader = &gzipReadCloser{gzr, source}
+	}
+
+	r := NewTSVReader(reader)
+	r.source = source
+	r.size = size
+	return r, nil
+}
+
+func openStdin(compression Compression) (*TSVReader, error) {
+	source := &countingFile{File: os.Stdin, hash: sha256.New()}
+	br := bufio.NewReader(source)
+	// Стандартный ввод не закрывается вместе с читателем
+	var rc io.ReadCloser = io.NopCloser(br)
+
+	compressed := compression == CompressionGzip
+	if compression == CompressionAuto {
+		magic, _ := br.Peek(len(gzipMagic))
+		compressed = bytes.Equal(magic, gzipMagic)
+	}
+	if compressed {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		rc = &gzipStreamReadCloser{gzr, rc}
 	}
 
-	return NewTSVReader(reader), nil
+	r := NewTSVReader(NopResetter(rc))
+	r.source = source
+	return r, nil
 }
 
 type gzipReadCloser struct {
 	gzipReader *gzip.Reader
-	file       *os.File
+	file       *countingFile
 }
 
 func (g *gzipReadCloser) Read(p []byte) (int, error) {
@@ -60,7 +158,7 @@ func (g *gzipReadCloser) Read(p []byte) (int, error) {
 }
 
 func (g *gzipReadCloser) Reset() {
-	g.file.Seek(0, io.SeekStart)
+	g.file.Reset()
 	g.gzipReader.Reset(g.file)
 }
 
@@ -69,12 +167,28 @@ func (g *gzipReadCloser) Close() error {
 	return g.file.Close()
 }
 
-func createCSVReader(r io.Reader) *csv.Reader {
+func createCSVReader(r io.Reader) recordDecoder {
 	reader := csv.NewReader(r)
 	reader.Comma = '\t'
 	reader.LazyQuotes = true
-	reader.TrimLeadingSpace = true
-	return reader
+	// Число полей проверяют шаги протокола: строку с неверным числом полей
+	// можно пропустить, не останавливая чтение файла
+	reader.FieldsPerRecord = -1
+	return trimLeadingSpace{reader}
+}
+
+// trimLeadingSpace удаляет пробелы в начале полей. csv.Reader.TrimLeadingSpace
+// не подходит: при разделителе-табуляции он склеивает пустые поля со следующими
+type trimLeadingSpace struct {
+	reader *csv.Reader
+}
+
+func (t trimLeadingSpace) Read() ([]string, error) {
+	record, err := t.reader.Read()
+	for i, field := range record {
+		record[i] = strings.TrimLeftFunc(field, unicode.IsSpace)
+	}
+	return record, err
 }
 
 func (r *TSVReader) Read() ([]string, error) {
@@ -90,19 +204,80 @@ func (r *TSVReader) LinesRead() int {
 	return int(r.lc.Load())
 }
 
+// BytesRead возвращает число байтов, прочитанных из файла или стандартного
+// ввода до распаковки, 0 для других потоков
+func (r *TSVReader) BytesRead() int64 {
+	if r.source == nil {
+		return 0
+	}
+	return r.source.n.Load()
+}
+
+// Size возвращает размер файла или 0, если он неизвестен (для потоков)
+func (r *TSVReader) Size() int64 {
+	return r.size
+}
+
+// Records возвращает число записей, заданное SetRecords или записанное
+// в заголовок бинарного файла, или 0, если оно неизвестно
+func (r *TSVReader) Records() int {
+	if r.records > 0 {
+		return r.records
+	}
+	if decoder, ok := r.reader.(*binaryDecoder); ok && decoder.count != unknownCount {
+		return int(decoder.count)
+	}
+	return 0
+}
+
+// SHA256 дочитывает стандартный ввод до конца и возвращает SHA-256 всех его
+// байтов до распаковки. Файлы не хешируются: их можно проверить до чтения
+func (r *TSVReader) SHA256() (string, error) {
+	if r.source == nil || r.source.hash == nil {
+		return "", fmt.Errorf("SHA-256 при чтении считается только для стандартного ввода")
+	}
+	// countingFile встраивает *os.File, чей WriteTo читал бы мимо хеша
+	if _, err := io.Copy(io.Discard, struct{ io.Reader }{r.source}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(r.source.hash.Sum(nil)), nil
+}
+
+// SetRecords задает число записей, известное заранее, например из манифеста сессии
+func (r *TSVReader) SetRecords(records int) {
+	r.records = records
+}
+
 func (r *TSVReader) Reset() {
 	r.lc.Store(0)
 	r.rc.Reset()
-	r.reader = createCSVReader(r.rc)
+	r.reader = newDecoder(r.rc)
+}
+
+// ProtocolVersion возвращает версию протокола из заголовка бинарного файла
+// или 0, если она неизвестна
+func (r *TSVReader) ProtocolVersion() int {
+	if decoder, ok := r.reader.(*binaryDecoder); ok {
+		return decoder.version
+	}
+	return 0
 }
 
 func (r *TSVReader) Close() error {
 	return r.rc.Close()
 }
 
+type recordEncoder interface {
+	Write(record []string) error
+	Flush() error
+}
+
 type TSVWriter struct {
-	writer *csv.Writer
+	writer recordEncoder
 	wc     io.WriteCloser
+
+	// stdout хеширует записанное в стандартный вывод, nil для файлов
+	stdout *stdoutWriteCloser
 }
 
 func NewTSVWriter(wc io.WriteCloser) *TSVWriter {
@@ -112,33 +287,144 @@ func NewTSVWriter(wc io.WriteCloser) *TSVWriter {
 	}
 }
 
+// NewBinaryWriter пишет записи в бинарном формате. Если wc поддерживает
+// io.WriterAt, при закрытии в заголовок записывается число записей
+func NewBinaryWriter(wc io.WriteCloser, version int) *TSVWriter {
+	at, _ := wc.(io.WriterAt)
+	return &TSVWriter{
+		writer: newBinaryEncoder(wc, at, version),
+		wc:     wc,
+	}
+}
+
+// CreateFile создает файл записей в заданном формате. Бинарный формат не сжимается gzip
+func CreateFile(filename string, format Format, version int) (*TSVWriter, error) {
+	return CreateOutput(filename, format, version, CompressionAuto)
+}
+
+// CreateTSVFile создает TSV файл, сжатый gzip для суффикса .gz,
+// или файл бинарного формата для суффикса .psib
 func CreateTSVFile(filename string) (*TSVWriter, error) {
-	file, err := os.Create(filename)
+	return CreateOutput(filename, FormatTSV, 0, CompressionAuto)
+}
+
+// CreateOutput создает файл записей в заданном формате (для суффикса .psib -
+// бинарном), для имени Stdio пишет в стандартный вывод. С CompressionAuto
+// сжимается gzip только TSV в файле с суффиксом .gz. Число записей в заголовок
+// бинарного формата записывается только для несжатого файла
+func CreateOutput(filename string, format Format, version int, compression Compression) (*TSVWriter, error) {
+	if strings.HasSuffix(filename, binarySuffix) {
+		format = FormatBinary
+	}
+
+	stdout := &stdoutWriteCloser{hash: sha256.New()}
+	var writer io.WriteCloser = stdout
+	if filename != Stdio {
+		stdout = nil
+		file, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		writer = file
+	}
+
+	compressed := compression == CompressionGzip
+	if compression == CompressionAuto {
+		compressed = format != FormatBinary && strings.HasSuffix(filename, ".gz")
+	}
+	if compressed {
+		writer = &gzipWriteCloser{gzip.NewWriter(writer), writer}
+	}
+
+	var w *TSVWriter
+	if format == FormatBinary {
+		w = NewBinaryWriter(writer, version)
+	} else {
+		w = NewTSVWriter(writer)
+	}
+	w.stdout = stdout
+	return w, nil
+}
+
+// stdoutWriteCloser пишет в стандартный вывод, но не закрывает его.
+// Не реализует io.WriterAt: вывод может быть каналом. Записанное хешируется,
+// чтобы описать вывод в манифесте без повторного чтения
+type stdoutWriteCloser struct {
+	hash hash.Hash
+}
+
+func (w *stdoutWriteCloser) Write(p []byte) (int, error) {
+	n, err := os.Stdout.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (*stdoutWriteCloser) Close() error {
+	return nil
+}
+
+// OpenTSVStream читает сжатый gzip TSV из потока, который нельзя перемотать
+func OpenTSVStream(rc io.ReadCloser) (*TSVReader, error) {
+	gzr, err := gzip.NewReader(rc)
 	if err != nil {
+		rc.Close()
 		return nil, err
 	}
 
-	var writer io.WriteCloser = file
+	return NewTSVReader(NopResetter(&gzipStreamReadCloser{gzr, rc})), nil
+}
+
+// CreateTSVStream пишет в поток TSV, сжатый gzip
+func CreateTSVStream(wc io.WriteCloser) *TSVWriter {
+	return NewTSVWriter(&gzipWriteCloser{gzip.NewWriter(wc), wc})
+}
 
-	if strings.HasSuffix(filename, ".gz") {
-		gzw := gzip.NewWriter(file)
-		writer = &gzipWriteCloser{gzw, file}
-	}
+type gzipStreamReadCloser struct {
+	*gzip.Reader
+	rc io.ReadCloser
+}
 
-	return NewTSVWriter(writer), nil
+func (g *gzipStreamReadCloser) Close() error {
+	g.Reader.Close()
+	return g.rc.Close()
 }
 
-type fileResetter struct {
+// NopResetter оборачивает поток, который нельзя перемотать (например, сетевой)
+func NopResetter(rc io.ReadCloser) ReadResetCloser {
+	return nopResetter{rc}
+}
+
+type nopResetter struct {
+	io.ReadCloser
+}
+
+func (nopResetter) Reset() {}
+
+// countingFile считает прочитанные из файла байты для прогресса и,
+// если задан hash, хеширует их
+type countingFile struct {
 	*os.File
+	n    atomic.Int64
+	hash hash.Hash
 }
 
-func (f *fileResetter) Reset() {
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.n.Add(int64(n))
+	if f.hash != nil {
+		f.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+func (f *countingFile) Reset() {
 	f.Seek(0, io.SeekStart)
+	f.n.Store(0)
 }
 
 type gzipWriteCloser struct {
 	gzipWriter *gzip.Writer
-	file       *os.File
+	file       io.WriteCloser
 }
 
 func (g *gzipWriteCloser) Write(p []byte) (int, error) {
@@ -153,10 +439,22 @@ func (g *gzipWriteCloser) Close() error {
 	return g.file.Close()
 }
 
-func createCSVWriter(w io.Writer) *csv.Writer {
+func createCSVWriter(w io.Writer) *csvEncoder {
 	writer := csv.NewWriter(w)
 	writer.Comma = '\t'
-	return writer
+	return &csvEncoder{writer}
+}
+
+type csvEncoder struct {
+	*csv.Writer
+}
+
+func (e *csvEncoder) Flush() error {
+	e.Writer.Flush()
+	if err := e.Writer.Error(); err != nil {
+		return fmt.Errorf("ошибка записи CSV: %w", err)
+	}
+	return nil
 }
 
 func (w *TSVWriter) Write(record []string) error {
@@ -164,15 +462,25 @@ func (w *TSVWriter) Write(record []string) error {
 }
 
 func (w *TSVWriter) Flush() error {
-	w.writer.Flush()
-	if err := w.writer.Error(); err != nil {
-		return fmt.Errorf("ошибка записи CSV: %w", err)
+	return w.writer.Flush()
+}
+
+// SHA256 возвращает SHA-256 записанного в стандартный вывод после Close
+// или пустую строку для файла
+func (w *TSVWriter) SHA256() string {
+	if w.stdout == nil {
+		return ""
 	}
-	return nil
+	return hex.EncodeToString(w.stdout.hash.Sum(nil))
 }
 
 func (w *TSVWriter) Close() error {
-	if err := w.Flush(); err != nil {
+	if closer, ok := w.writer.(interface{ Close() error }); ok {
+		if err := closer.Close(); err != nil {
+			w.wc.Close()
+			return err
+		}
+	} else if err := w.Flush(); err != nil {
 		return err
 	}
 	return w.wc.Close()
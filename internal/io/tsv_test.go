@@ -0,0 +1,153 @@
+package io
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTSVEmptyFields(t *testing.T) {
+	reader := newDecoder(strings.NewReader("\tuser@example.com\tb1\n+79991234567\t\tb2\n  +79991234568\t  x\tb3\n"))
+
+	for _, expected := range [][]string{
+		{"", "user@example.com", "b1"},
+		{"+79991234567", "", "b2"},
+		{"+79991234568", "x", "b3"},
+	} {
+		record, err := reader.Read()
+		if err != nil {
+			t.Fatalf("ошибка чтения: %v", err)
+		}
+		if !slices.Equal(record, expected) {
+			t.Errorf("получено %q, ожидалось %q", record, expected)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	records := [][]string{{"0", "a"}, {"1", "b"}}
+
+	for _, tc := range []struct {
+		name        string
+		filename    string
+		format      Format
+		compression Compression
+		gzip        bool
+	}{
+		{name: "auto/gz", filename: "out.tsv.gz", format: FormatTSV, compression: CompressionAuto, gzip: true},
+		{name: "auto/plain", filename: "out.tsv", format: FormatTSV, compression: CompressionAuto},
+		{name: "auto/binary", filename: "out.tsv.gz", format: FormatBinary, compression: CompressionAuto},
+		{name: "none/gz", filename: "out.tsv.gz", format: FormatTSV, compression: CompressionNone},
+		{name: "gzip/plain", filename: "out.tsv", format: FormatTSV, compression: CompressionGzip, gzip: true},
+		{name: "gzip/binary", filename: "out.bin", format: FormatBinary, compression: CompressionGzip, gzip: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), tc.filename)
+			writer, err := CreateOutput(filename, tc.format, 3, tc.compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, record := range records {
+				if err := writer.Write(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed := bytes.HasPrefix(data, gzipMagic); compressed != tc.gzip {
+				t.Errorf("сжатие gzip: %t, ожидалось %t", compressed, tc.gzip)
+			}
+
+			for _, compression := range []Compression{CompressionAuto, tc.compression} {
+				if compression == CompressionAuto && !tc.gzip {
+					compression = CompressionNone
+				}
+				reader, err := OpenInput(filename, compression)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, expected := range records {
+					record, err := reader.Read()
+					if err != nil {
+						t.Fatalf("ошибка чтения с %s: %v", compression, err)
+					}
+					if !slices.Equal(record, expected) {
+						t.Errorf("получено %q, ожидалось %q", record, expected)
+					}
+				}
+				if _, err := reader.Read(); err != io.EOF {
+					t.Fatalf("ожидается конец файла, получено %v", err)
+				}
+				if size := int64(len(data)); reader.Size() != size || reader.BytesRead() != size {
+					t.Errorf("прочитано %d байт из %d, ожидается %d из %d", reader.BytesRead(), reader.Size(), size, size)
+				}
+				reader.Close()
+			}
+		})
+	}
+}
+
+func TestStdio(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip} {
+		t.Run(string(compression), func(t *testing.T) {
+			file, err := os.Create(filepath.Join(t.TempDir(), "stdio"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			stdin, stdout := os.Stdin, os.Stdout
+			defer func() { os.Stdin, os.Stdout = stdin, stdout }()
+
+			os.Stdout = file
+			writer, err := CreateOutput(Stdio, FormatTSV, 0, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.Write([]string{"0", "a"})
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			file.Seek(0, io.SeekStart)
+			os.Stdin = file
+			reader, err := OpenInput(Stdio, CompressionAuto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, err := reader.Read()
+			if err != nil || !slices.Equal(record, []string{"0", "a"}) {
+				t.Errorf("получено %q, %v", record, err)
+			}
+			if reader.Size() != 0 || reader.BytesRead() == 0 {
+				t.Errorf("размер %d, прочитано %d байт: размер стандартного ввода неизвестен, байты считаются", reader.Size(), reader.BytesRead())
+			}
+
+			// Хеш потока совпадает с хешем записанных байтов, даже если записи не дочитаны
+			data, err := os.ReadFile(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(data)
+			readSum, err := reader.SHA256()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := hex.EncodeToString(sum[:]); writer.SHA256() != expected || readSum != expected {
+				t.Errorf("SHA-256 вывода %s, ввода %s, ожидался %s", writer.SHA256(), readSum, expected)
+			}
+		})
+	}
+}
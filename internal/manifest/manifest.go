@@ -0,0 +1,228 @@
+// Package manifest связывает файлы одной сессии протокола. Каждый шаг пишет
+// манифест с идентификатором сессии, шагом, SHA-256 и числом записей своих
+// файлов и подписывает его ключом Ed25519. Следующий шаг проверяет манифест
+// до чтения файлов, поэтому файлы другой сессии или поврежденные файлы
+// отклоняются сразу. Потоки, которые нельзя перечитать, хешируются при
+// записи и чтении и проверяются после чтения
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrMismatch - манифест не подписан ожидаемой стороной, относится к другой
+// сессии или шагу, или файл не совпадает с описанным в манифесте
+var ErrMismatch = errors.New("файлы не соответствуют манифесту сессии")
+
+// Artifact описывает файл, созданный шагом. Name - роль файла в протоколе,
+// не зависящая от имени файла на диске, например bob_encrypted
+type Artifact struct {
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	SHA256  string `json:"sha256"`
+	Records int    `json:"records,omitempty"`
+}
+
+type Manifest struct {
+	SessionID       string    `json:"session_id"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Step            string    `json:"step"`
+	CreatedAt       time.Time `json:"created_at"`
+	// PublicKey - ключ Ed25519 стороны, создавшей манифест
+	PublicKey string `json:"public_key"`
+	// PeerPublicKey - ключ второй стороны, чьи файлы шаг принял на вход
+	PeerPublicKey string     `json:"peer_public_key,omitempty"`
+	Artifacts     []Artifact `json:"artifacts"`
+	Signature     string     `json:"signature,omitempty"`
+}
+
+// NewSessionID генерирует идентификатор сессии, его создает bob на первом шаге
+func NewSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func New(sessionID string, version int, step string) *Manifest {
+	return &Manifest{
+		SessionID:       sessionID,
+		ProtocolVersion: version,
+		Step:            step,
+		CreatedAt:       time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// AddFile добавляет файл filename с ролью name. records - число записей,
+// 0 для файлов ключей
+func (m *Manifest) AddFile(name, filename string, records int) error {
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return err
+	}
+	m.AddSum(name, filename, sum, records)
+	return nil
+}
+
+// AddSum добавляет файл с ролью name и SHA-256 sum, посчитанным при записи,
+// например для стандартного вывода
+func (m *Manifest) AddSum(name, filename, sum string, records int) {
+	m.Artifacts = append(m.Artifacts, Artifact{
+		Name:    name,
+		File:    filepath.Base(filename),
+		SHA256:  sum,
+		Records: records,
+	})
+}
+
+// Save подписывает манифест ключом key и сохраняет его
+func (m *Manifest) Save(filename string, key ed25519.PrivateKey) error {
+	m.PublicKey = PublicKey(key)
+	m.Signature = ""
+
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	m.Signature = hex.EncodeToString(ed25519.Sign(key, payload))
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// Load читает манифест и проверяет подпись ключом из манифеста. Что ключ
+// принадлежит ожидаемой стороне, проверяет Expect
+func Load(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("ошибка разбора манифеста %s: %w", filename, err)
+	}
+
+	publicKey, err := hex.DecodeString(m.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: некорректный ключ подписи в %s", ErrMismatch, filename)
+	}
+	signature, err := hex.DecodeString(m.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: некорректная подпись в %s", ErrMismatch, filename)
+	}
+
+	unsigned := m
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return nil, fmt.Errorf("%w: подпись %s не прошла проверку", ErrMismatch, filename)
+	}
+
+	return &m, nil
+}
+
+// Expect - ожидания шага, принимающего манифест. Пустые поля не проверяются
+type Expect struct {
+	SessionID       string
+	ProtocolVersion int
+	Step            string
+	PublicKey       string
+	PeerPublicKey   string
+}
+
+func (m *Manifest) Expect(expect Expect) error {
+	switch {
+	case expect.Step != "" && m.Step != expect.Step:
+		return fmt.Errorf("%w: манифест шага %s, ожидается %s", ErrMismatch, m.Step, expect.Step)
+	case expect.SessionID != "" && m.SessionID != expect.SessionID:
+		return fmt.Errorf("%w: сессия %s, ожидается %s", ErrMismatch, m.SessionID, expect.SessionID)
+	case expect.ProtocolVersion != 0 && m.ProtocolVersion != expect.ProtocolVersion:
+		return fmt.Errorf("%w: версия протокола %d, ожидается %d", ErrMismatch, m.ProtocolVersion, expect.ProtocolVersion)
+	case expect.PublicKey != "" && m.PublicKey != expect.PublicKey:
+		return fmt.Errorf("%w: манифест подписан ключом %s, ожидается %s", ErrMismatch, m.PublicKey, expect.PublicKey)
+	case expect.PeerPublicKey != "" && m.PeerPublicKey != expect.PeerPublicKey:
+		return fmt.Errorf("%w: шаг %s принял файлы стороны с ключом %s, ожидается %s", ErrMismatch, m.Step, m.PeerPublicKey, expect.PeerPublicKey)
+	}
+	return nil
+}
+
+// VerifyFile проверяет, что filename совпадает с файлом роли name
+func (m *Manifest) VerifyFile(name, filename string) error {
+	if _, err := m.artifact(name); err != nil {
+		return err
+	}
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return err
+	}
+	return m.VerifySum(name, filename, sum)
+}
+
+// VerifySum проверяет, что SHA-256 sum прочитанного файла filename совпадает
+// с файлом роли name
+func (m *Manifest) VerifySum(name, filename, sum string) error {
+	artifact, err := m.artifact(name)
+	if err != nil {
+		return err
+	}
+	if sum != artifact.SHA256 {
+		return fmt.Errorf("%w: SHA-256 файла %s не совпадает с %s из манифеста шага %s", ErrMismatch, filename, artifact.File, m.Step)
+	}
+	return nil
+}
+
+func (m *Manifest) artifact(name string) (Artifact, error) {
+	for _, artifact := range m.Artifacts {
+		if artifact.Name == name {
+			return artifact, nil
+		}
+	}
+	return Artifact{}, fmt.Errorf("%w: в манифесте шага %s нет файла %s", ErrMismatch, m.Step, name)
+}
+
+// Records возвращает число записей файла роли name или 0, если его нет в манифесте
+func (m *Manifest) Records(name string) int {
+	for _, artifact := range m.Artifacts {
+		if artifact.Name == name {
+			return artifact.Records
+		}
+	}
+	return 0
+}
+
+func fileSHA256(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PublicKey возвращает открытый ключ в представлении манифеста
+func PublicKey(key ed25519.PrivateKey) string {
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
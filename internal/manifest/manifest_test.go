@@ -0,0 +1,113 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeManifest(t *testing.T, dir string, key ed25519.PrivateKey) (string, string) {
+	t.Helper()
+
+	data := filepath.Join(dir, "bob_encrypted.tsv")
+	if err := os.WriteFile(data, []byte("0\tpoint0\n1\tpoint1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New("session", 3, "bob-step1")
+	if err := m.AddFile("bob_encrypted", data, 2); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "manifest.json")
+	if err := m.Save(filename, key); err != nil {
+		t.Fatal(err)
+	}
+	return filename, data
+}
+
+func TestManifest(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	filename, data := writeManifest(t, t.TempDir(), key)
+
+	m, err := Load(filename)
+	if err != nil {
+		t.Fatalf("ошибка загрузки: %v", err)
+	}
+	if m.SessionID != "session" || m.ProtocolVersion != 3 || len(m.Artifacts) != 1 || m.Artifacts[0].Records != 2 {
+		t.Errorf("загружено %+v", m)
+	}
+	if err := m.VerifyFile("bob_encrypted", data); err != nil {
+		t.Errorf("файл отклонен: %v", err)
+	}
+	expect := Expect{SessionID: "session", ProtocolVersion: 3, Step: "bob-step1", PublicKey: PublicKey(key)}
+	if err := m.Expect(expect); err != nil {
+		t.Errorf("манифест отклонен: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		expect Expect
+	}{
+		{"другая сессия", Expect{SessionID: "other"}},
+		{"другая версия", Expect{ProtocolVersion: 2}},
+		{"другой шаг", Expect{Step: "alice-step1"}},
+		{"чужой ключ", Expect{PublicKey: PublicKey(other)}},
+		{"другая вторая сторона", Expect{PeerPublicKey: PublicKey(other)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.Expect(tt.expect); !errors.Is(err, ErrMismatch) {
+				t.Errorf("ожидается ErrMismatch, получено %v", err)
+			}
+		})
+	}
+
+	t.Run("нет файла", func(t *testing.T) {
+		if err := m.VerifyFile("alice_encrypted", data); !errors.Is(err, ErrMismatch) {
+			t.Errorf("ожидается ErrMismatch, получено %v", err)
+		}
+	})
+
+	t.Run("хеш потока", func(t *testing.T) {
+		if err := m.VerifySum("bob_encrypted", "-", m.Artifacts[0].SHA256); err != nil {
+			t.Errorf("поток отклонен: %v", err)
+		}
+		if err := m.VerifySum("bob_encrypted", "-", strings.Repeat("0", 64)); !errors.Is(err, ErrMismatch) {
+			t.Errorf("ожидается ErrMismatch, получено %v", err)
+		}
+	})
+
+	t.Run("измененный файл", func(t *testing.T) {
+		if err := os.WriteFile(data, []byte("0\tpoint1\n1\tpoint0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.VerifyFile("bob_encrypted", data); !errors.Is(err, ErrMismatch) {
+			t.Errorf("ожидается ErrMismatch, получено %v", err)
+		}
+	})
+}
+
+func TestManifestSignature(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	filename, _ := writeManifest(t, t.TempDir(), key)
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(content), `"records": 2`, `"records": 3`, 1)
+	if tampered == string(content) {
+		t.Fatal("число записей не найдено в манифесте")
+	}
+	if err := os.WriteFile(filename, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(filename); !errors.Is(err, ErrMismatch) {
+		t.Errorf("ожидается ErrMismatch, получено %v", err)
+	}
+}
@@ -2,46 +2,90 @@ package progress
 
 import (
 	"context"
-	"fmt"
-	"os"
-	"strings"
 	"sync"
 	"time"
-
-	psio "github.com/pkositsyn/psi/internal/io"
 )
 
-type ReadResetCounter interface {
-	psio.ReadResetter
+// Source - источник записей, за чтением которого следит прогресс
+type Source interface {
 	LinesRead() int
+	// BytesRead и Size - прочитанные байты и размер файла до распаковки, 0 - размер неизвестен
+	BytesRead() int64
+	Size() int64
+	// Records - число записей, если оно известно из заголовка файла или манифеста, иначе 0
+	Records() int
 }
 
-func TrackProgress(ctx context.Context, wg *sync.WaitGroup, msg string, files ...ReadResetCounter) {
-	counters := make([]int, len(files))
-	var totalLines int
-	for _, file := range files {
-		totalLines += psio.LineCount(file)
-	}
+// Status - состояние обработки в момент измерения
+type Status struct {
+	Message string
+	Records int
+	// Rate - средняя скорость в записях в секунду
+	Rate float64
+	// Done - доля обработанного, ETA - оставшееся время. Известны, только если Known
+	Done  float64
+	ETA   time.Duration
+	Known bool
+}
+
+// TrackProgress раз в секунду передает reporter число прочитанных записей,
+// скорость и оставшееся время. Файлы не читаются заранее: доля обработанного
+// считается по записям, если их число известно для всех источников, иначе по
+// прочитанным байтам файлов. Для потоков без размера (стандартный ввод)
+// известны только прочитанное и скорость
+func TrackProgress(ctx context.Context, wg *sync.WaitGroup, reporter Reporter, msg string, sources ...Source) {
+	start := time.Now()
 
 	wg.Go(func() {
-		var curCounter int
 		for {
 			select {
 			case <-ctx.Done():
-				lineLen := len(fmt.Sprintf("\r%s: %d/%d", msg, curCounter, totalLines))
-				fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", lineLen))
+				reporter.EndProgress()
 				return
 			case <-time.After(time.Second):
 			}
 
-			for i, file := range files {
-				num := file.LinesRead()
-
-				curCounter += int(num) - counters[i]
-				counters[i] = int(num)
-			}
-
-			fmt.Fprintf(os.Stderr, "\r%s: %d/%d", msg, curCounter, totalLines)
+			reporter.Progress(measure(msg, sources, time.Since(start)))
 		}
 	})
 }
+
+func measure(msg string, sources []Source, elapsed time.Duration) Status {
+	status := Status{Message: msg}
+	for _, source := range sources {
+		status.Records += source.LinesRead()
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		status.Rate = float64(status.Records) / seconds
+	}
+
+	status.Done, status.Known = fraction(sources)
+	if status.Known && status.Done > 0 && status.Done < 1 {
+		status.ETA = time.Duration(float64(elapsed) * (1 - status.Done) / status.Done)
+	}
+	return status
+}
+
+// fraction возвращает долю обработанного по записям или байтам. ok = false,
+// если ни то ни другое неизвестно хотя бы для одного источника
+func fraction(sources []Source) (float64, bool) {
+	var lines, records int
+	var read, size int64
+	byRecords, bySize := true, true
+	for _, source := range sources {
+		lines += source.LinesRead()
+		records += source.Records()
+		read += source.BytesRead()
+		size += source.Size()
+		byRecords = byRecords && source.Records() > 0
+		bySize = bySize && source.Size() > 0
+	}
+
+	switch {
+	case byRecords:
+		return min(float64(lines)/float64(records), 1), true
+	case bySize:
+		return min(float64(read)/float64(size), 1), true
+	}
+	return 0, false
+}
@@ -0,0 +1,131 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSource struct {
+	lines, records int
+	read, size     int64
+}
+
+func (s testSource) LinesRead() int   { return s.lines }
+func (s testSource) Records() int     { return s.records }
+func (s testSource) BytesRead() int64 { return s.read }
+func (s testSource) Size() int64      { return s.size }
+
+func TestFraction(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sources []Source
+		done    float64
+		ok      bool
+	}{
+		{
+			name:    "records",
+			sources: []Source{testSource{lines: 25, records: 100, read: 90, size: 100}},
+			done:    0.25,
+			ok:      true,
+		},
+		{
+			name: "bytes",
+			// Число записей известно не для всех источников
+			sources: []Source{testSource{lines: 10, records: 100, read: 10, size: 100}, testSource{lines: 5, read: 50, size: 100}},
+			done:    0.3,
+			ok:      true,
+		},
+		{
+			name:    "stream",
+			sources: []Source{testSource{lines: 5, read: 50, size: 100}, testSource{lines: 5, read: 50}},
+		},
+		{
+			name:    "stream/records",
+			sources: []Source{testSource{lines: 5, records: 10, read: 50}},
+			done:    0.5,
+			ok:      true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			done, ok := fraction(tc.sources)
+			if ok != tc.ok || done != tc.done {
+				t.Errorf("получено %v, %t, ожидалось %v, %t", done, ok, tc.done, tc.ok)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	status := measure("Прогресс", []Source{testSource{lines: 250, records: 1000}}, 10*time.Second)
+	if expected := "Прогресс: 250, 25 записей/с, 25.0%, осталось 30s"; statusText(status) != expected {
+		t.Errorf("получено %q, ожидалось %q", statusText(status), expected)
+	}
+
+	status = measure("Прогресс", []Source{testSource{lines: 250}}, 10*time.Second)
+	if line := statusText(status); strings.Contains(line, "%") || strings.Contains(line, "осталось") {
+		t.Errorf("без размера и числа записей доля и время неизвестны: %q", line)
+	}
+}
+
+func TestJSONReporter(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := NewJSONReporter(&buf)
+	reporter.Start("bob-step1")
+	reporter.Progress(measure("Прогресс", []Source{testSource{lines: 250, records: 1000}}, 10*time.Second))
+	// Следующий прогресс раньше интервала не пишется
+	reporter.Progress(measure("Прогресс", []Source{testSource{lines: 260, records: 1000}}, 11*time.Second))
+	reporter.Warn("пропущено строк с ошибками: 1")
+	reporter.Summary(Summary{
+		Fields:  []Field{{Key: "records", Label: "Обработано записей", Value: 4}},
+		Outputs: []Field{{Key: "bob_encrypted", Label: "Зашифрованные данные", Value: "bob_encrypted.tsv.gz"}},
+	})
+	reporter.Error(errors.New("ошибка"))
+
+	var events []map[string]any
+	for line := range strings.Lines(buf.String()) {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("строка %q не JSON: %v", line, err)
+		}
+		if event["step"] != "bob-step1" || event["time"] == nil {
+			t.Errorf("нет шага или времени: %q", line)
+		}
+		delete(event, "time")
+		delete(event, "step")
+		events = append(events, event)
+	}
+
+	expected := []map[string]any{
+		{"event": "start"},
+		{"event": "progress", "message": "Прогресс", "records": 250.0, "rate": 25.0, "done": 0.25, "eta_seconds": 30.0},
+		{"event": "warning", "message": "пропущено строк с ошибками: 1"},
+		{"event": "summary", "stats": map[string]any{"records": 4.0}, "outputs": map[string]any{"bob_encrypted": "bob_encrypted.tsv.gz"}},
+		{"event": "error", "message": "ошибка"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("получены события %v, ожидались %v", events, expected)
+	}
+}
+
+func TestTextReporter(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := NewTextReporter(&buf)
+	reporter.Progress(Status{Message: "Прогресс", Records: 10})
+	reporter.Warn("пропущено строк с ошибками: 1")
+	reporter.Summary(Summary{
+		Fields:  []Field{{Key: "records", Label: "Обработано записей", Value: 4}},
+		Outputs: []Field{{Key: "bob_encrypted", Label: "Зашифрованные данные", Value: "bob_encrypted.tsv.gz"}},
+	})
+
+	// Строка прогресса стирается перед сообщением
+	text := buf.String()[strings.LastIndex(buf.String(), "\r")+1:]
+	expected := "Предупреждение: пропущено строк с ошибками: 1\nОбработано записей: 4\nЗашифрованные данные: bob_encrypted.tsv.gz\n"
+	if text != expected {
+		t.Errorf("получено %q, ожидалось %q", text, expected)
+	}
+}
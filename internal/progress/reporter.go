@@ -0,0 +1,228 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reporter выводит события команды: начало шага, прогресс, сообщения,
+// предупреждения, итог и ошибку
+type Reporter interface {
+	Start(step string)
+	Progress(status Status)
+	// EndProgress вызывается после последнего Progress
+	EndProgress()
+	Info(message string)
+	Warn(message string)
+	Summary(summary Summary)
+	Error(err error)
+}
+
+// Field - значение в итоге шага. Key - имя в JSON, Label - подпись для
+// терминала. Value выводится в терминал через fmt, в JSON - через encoding/json
+type Field struct {
+	Key   string
+	Label string
+	Value any
+}
+
+// Summary - итог шага: счетчики и параметры, затем созданные файлы
+type Summary struct {
+	Fields []Field
+	// Outputs - созданные файлы, Key - роль файла, Value - имя
+	Outputs []Field
+}
+
+// Форматы вывода событий (--log-format)
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// NewReporter создает Reporter формата format, пишущий в w
+func NewReporter(format string, w io.Writer) (Reporter, error) {
+	switch format {
+	case FormatText:
+		return NewTextReporter(w), nil
+	case FormatJSON:
+		return NewJSONReporter(w), nil
+	default:
+		return nil, fmt.Errorf("неизвестный формат вывода %q, допустимы %s и %s", format, FormatText, FormatJSON)
+	}
+}
+
+// TextReporter выводит события текстом для терминала. Прогресс
+// перерисовывается в одной строке через \r
+type TextReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// lineLen - длина строки прогресса на экране, 0 - строки нет
+	lineLen int
+}
+
+func NewTextReporter(w io.Writer) *TextReporter {
+	return &TextReporter{w: w}
+}
+
+func (r *TextReporter) Start(step string) {}
+
+func (r *TextReporter) Progress(status Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	line := statusText(status)
+	fmt.Fprint(r.w, "\r"+line+strings.Repeat(" ", max(r.lineLen-len(line), 0)))
+	r.lineLen = max(r.lineLen, len(line))
+}
+
+func statusText(status Status) string {
+	line := fmt.Sprintf("%s: %d, %.0f записей/с", status.Message, status.Records, status.Rate)
+	if !status.Known {
+		return line
+	}
+	line += fmt.Sprintf(", %.1f%%", status.Done*100)
+	if status.ETA > 0 {
+		line += fmt.Sprintf(", осталось %s", status.ETA.Round(time.Second))
+	}
+	return line
+}
+
+func (r *TextReporter) EndProgress() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clearLine()
+}
+
+// clearLine стирает строку прогресса, чтобы сообщение не смешалось с ней
+func (r *TextReporter) clearLine() {
+	if r.lineLen > 0 {
+		fmt.Fprintf(r.w, "\r%s\r", strings.Repeat(" ", r.lineLen))
+		r.lineLen = 0
+	}
+}
+
+func (r *TextReporter) Info(message string) {
+	r.println(message)
+}
+
+func (r *TextReporter) Warn(message string) {
+	r.println("Предупреждение: " + message)
+}
+
+func (r *TextReporter) Summary(summary Summary) {
+	for _, field := range summary.Fields {
+		r.println(fmt.Sprintf("%s: %v", field.Label, field.Value))
+	}
+	for _, output := range summary.Outputs {
+		r.println(fmt.Sprintf("%s: %v", output.Label, output.Value))
+	}
+}
+
+func (r *TextReporter) Error(err error) {
+	r.println(err.Error())
+}
+
+func (r *TextReporter) println(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clearLine()
+	fmt.Fprintln(r.w, line)
+}
+
+// JSONReporter пишет события JSON lines для систем сбора логов:
+// по объекту с полями time, event и step на строку
+type JSONReporter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	step    string
+	// lastProgress - время последнего события прогресса
+	lastProgress time.Time
+}
+
+// jsonProgressInterval - интервал событий прогресса. Прогресс измеряется
+// раз в секунду, но в журнал пишется реже
+const jsonProgressInterval = 10 * time.Second
+
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{encoder: json.NewEncoder(w)}
+}
+
+type jsonEvent struct {
+	Time    time.Time      `json:"time"`
+	Event   string         `json:"event"`
+	Step    string         `json:"step,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Records *int           `json:"records,omitempty"`
+	Rate    *float64       `json:"rate,omitempty"`
+	Done    *float64       `json:"done,omitempty"`
+	ETA     *float64       `json:"eta_seconds,omitempty"`
+	Stats   map[string]any `json:"stats,omitempty"`
+	Outputs map[string]any `json:"outputs,omitempty"`
+}
+
+func (r *JSONReporter) Start(step string) {
+	r.mu.Lock()
+	r.step = step
+	r.mu.Unlock()
+
+	r.write(jsonEvent{Event: "start"})
+}
+
+func (r *JSONReporter) Progress(status Status) {
+	r.mu.Lock()
+	now := time.Now()
+	skip := now.Sub(r.lastProgress) < jsonProgressInterval
+	if !skip {
+		r.lastProgress = now
+	}
+	r.mu.Unlock()
+	if skip {
+		return
+	}
+
+	event := jsonEvent{Event: "progress", Message: status.Message, Records: &status.Records, Rate: &status.Rate}
+	if status.Known {
+		event.Done = &status.Done
+		eta := status.ETA.Seconds()
+		event.ETA = &eta
+	}
+	r.write(event)
+}
+
+func (r *JSONReporter) EndProgress() {}
+
+func (r *JSONReporter) Info(message string) {
+	r.write(jsonEvent{Event: "info", Message: message})
+}
+
+func (r *JSONReporter) Warn(message string) {
+	r.write(jsonEvent{Event: "warning", Message: message})
+}
+
+func (r *JSONReporter) Summary(summary Summary) {
+	event := jsonEvent{Event: "summary", Stats: make(map[string]any), Outputs: make(map[string]any)}
+	for _, field := range summary.Fields {
+		event.Stats[field.Key] = field.Value
+	}
+	for _, output := range summary.Outputs {
+		event.Outputs[output.Key] = output.Value
+	}
+	r.write(event)
+}
+
+func (r *JSONReporter) Error(err error) {
+	r.write(jsonEvent{Event: "error", Message: err.Error()})
+}
+
+func (r *JSONReporter) write(event jsonEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event.Time = time.Now().UTC()
+	event.Step = r.step
+	r.encoder.Encode(event)
+}
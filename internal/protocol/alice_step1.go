@@ -0,0 +1,292 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/workerpool"
+)
+
+type bobDataTask struct {
+	index      string
+	encryptedB string
+}
+
+type bobDataResult struct {
+	index       string
+	encryptedBA string
+}
+
+func ProcessBobDataStep1(reader io.RecordReader, writer io.RecordWriter, keyA *crypto.ECDHKey, encoding crypto.PointEncoding, batchSize int) (int, error) {
+	return applyECDHKey(reader, writer, keyA, encoding, batchSize)
+}
+
+// applyECDHKey применяет ключ ко всем точкам файла index \t point, сохраняя индексы
+func applyECDHKey(reader io.RecordReader, writer io.RecordWriter, key *crypto.ECDHKey, encoding crypto.PointEncoding, batchSize int) (int, error) {
+	handler := func(task bobDataTask) (bobDataResult, error) {
+		encryptedBA, err := crypto.ECDHApplyEncoded(key, task.encryptedB, encoding)
+		if err != nil {
+			return bobDataResult{}, err
+		}
+
+		return bobDataResult{
+			index:       task.index,
+			encryptedBA: encryptedBA,
+		}, nil
+	}
+
+	pool := workerpool.New(handler)
+
+	var writeErr error
+	var wg sync.WaitGroup
+
+	wg.Go(func() {
+		for result := range pool.Results() {
+			if result.Error != nil {
+				if writeErr == nil {
+					writeErr = result.Error
+				}
+				continue
+			}
+			if writeErr == nil {
+				if err := writer.Write([]string{result.Value.index, result.Value.encryptedBA}); err != nil {
+					writeErr = err
+				}
+			}
+		}
+	})
+
+	count := 0
+	batch := make([]bobDataTask, 0, batchSize)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pool.Close()
+			wg.Wait()
+			return count, err
+		}
+
+		if len(record) < 2 {
+			pool.Close()
+			wg.Wait()
+			return count, fmt.Errorf("%w: ожидается 2 поля, получено %d", ErrInvalidRecord, len(record))
+		}
+
+		batch = append(batch, bobDataTask{
+			index:      record[0],
+			encryptedB: record[1],
+		})
+		count++
+
+		if len(batch) >= batchSize {
+			pool.Add(batch)
+			batch = make([]bobDataTask, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		pool.Add(batch)
+	}
+
+	pool.Close()
+	wg.Wait()
+
+	if writeErr != nil {
+		return count, writeErr
+	}
+
+	return count, nil
+}
+
+type aliceDataTask struct {
+	rowKey  string
+	column  int
+	idType  string
+	id      string
+	aUserId string
+}
+
+type aliceDataResult struct {
+	rowKey    string
+	column    int
+	aUserId   string
+	encrypted string
+}
+
+// ProcessAliceDataStep1 шифрует записи id_1 \t ... \t id_k \t a_user_id. Строки
+// переставляются случайным образом: в writer пишется index \t H(id_a)^A для
+// передачи bob, в mappingWriter - приватный маппинг index \t a_user_id для шага 2.
+// Возвращает количество прочитанных строк и добавленных фиктивных записей
+func ProcessAliceDataStep1(reader io.RecordReader, writer, mappingWriter io.RecordWriter, keyK []byte, keyA *crypto.ECDHKey, version crypto.ProtocolVersion, encoding crypto.PointEncoding, input InputConfig, config ExternalConfig, padding Padding, batchSize int) (int, int, error) {
+	if err := padding.validate(); err != nil {
+		return 0, 0, err
+	}
+
+	columns, err := LookupIDTypes(input.IDTypes, version)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	permutation, err := newRowPermutation(len(columns), config)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer permutation.close()
+
+	dups := newDuplicates(input.Duplicates, columns, config)
+	defer dups.close()
+
+	count, err := encryptAliceData(reader, keyK, keyA, version, encoding, input, batchSize, permutation.rowKey, dups, nil, func(result aliceDataResult) error {
+		return permutation.add(result.rowKey, result.column, result.encrypted, result.aUserId)
+	})
+	if err != nil {
+		return count, 0, err
+	}
+
+	if err := permutation.dropDuplicates(dups, input.DuplicateReport); err != nil {
+		return count, 0, err
+	}
+
+	padded, err := permutation.pad(padding, encoding)
+	if err != nil {
+		return count, 0, err
+	}
+
+	return count, padded, permutation.writeTo(writer, mappingWriter)
+}
+
+// encryptAliceData вычисляет H(id_a)^A для всех идентификаторов строк
+// и передает результаты в emit из одной горутины в произвольном порядке.
+// rowKey вызывается для каждой строки, ключ возвращается в результате
+// и передается в dups вместе с идентификаторами строки.
+// encryptUserID, если задана, заменяет a_user_id результатом в пуле
+func encryptAliceData(reader io.RecordReader, keyK []byte, keyA *crypto.ECDHKey, version crypto.ProtocolVersion, encoding crypto.PointEncoding, input InputConfig, batchSize int, rowKey func() string, dups *duplicates, encryptUserID func(string) (string, error), emit func(aliceDataResult) error) (int, error) {
+	columns, err := LookupIDTypes(input.IDTypes, version)
+	if err != nil {
+		return 0, err
+	}
+
+	hmacPool := &sync.Pool{
+		New: func() any {
+			return hmac.New(sha256.New, keyK)
+		},
+	}
+
+	handler := func(task aliceDataTask) (aliceDataResult, error) {
+		hashed, err := crypto.HashToGroup(version, hmacPool, keyK, task.idType, []byte(task.id))
+		if err != nil {
+			return aliceDataResult{}, err
+		}
+
+		encrypted, err := crypto.ECDHApplyEncoded(keyA, hashed, encoding)
+		if err != nil {
+			return aliceDataResult{}, err
+		}
+
+		aUserId := task.aUserId
+		if encryptUserID != nil {
+			aUserId, err = encryptUserID(aUserId)
+			if err != nil {
+				return aliceDataResult{}, err
+			}
+		}
+
+		return aliceDataResult{
+			rowKey:    task.rowKey,
+			column:    task.column,
+			aUserId:   aUserId,
+			encrypted: encrypted,
+		}, nil
+	}
+
+	pool := workerpool.New(handler)
+
+	var writeErr error
+	var wg sync.WaitGroup
+
+	wg.Go(func() {
+		for result := range pool.Results() {
+			if result.Error != nil {
+				if writeErr == nil {
+					writeErr = result.Error
+				}
+				continue
+			}
+			if writeErr == nil {
+				writeErr = emit(result.Value)
+			}
+		}
+	})
+
+	count := 0
+	batch := make([]aliceDataTask, 0, batchSize)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pool.Close()
+			wg.Wait()
+			return count, err
+		}
+
+		ids, rowErr := input.parseRecord(columns, count, record)
+		if rowErr != nil {
+			if err := input.Reject.handle(rowErr, record); err != nil {
+				pool.Close()
+				wg.Wait()
+				return count, err
+			}
+			count++
+			continue
+		}
+
+		key := rowKey()
+		if err := dups.add(count, key, ids); err != nil {
+			pool.Close()
+			wg.Wait()
+			return count, err
+		}
+		for j, id := range ids {
+			if id == "" {
+				continue
+			}
+			batch = append(batch, aliceDataTask{
+				rowKey:  key,
+				column:  j,
+				idType:  columns[j].Name,
+				id:      id,
+				aUserId: record[len(columns)],
+			})
+		}
+		count++
+
+		if len(batch) >= batchSize {
+			pool.Add(batch)
+			batch = make([]aliceDataTask, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		pool.Add(batch)
+	}
+
+	pool.Close()
+	wg.Wait()
+
+	if writeErr != nil {
+		return count, writeErr
+	}
+
+	return count, nil
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// BobRecord - запись bob_final. UserIDs пуст для несовпавших записей
+// и в режиме labeled, несколько b_user_id - повторы идентификатора у bob,
+// они приходят записями с одним индексом
+type BobRecord struct {
+	EncryptedAB string
+	UserIDs     []string
+}
+
+func LoadBobFinalData(reader io.RecordReader) (map[string]BobRecord, error) {
+	result := make(map[string]BobRecord)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(record) < 2 {
+			continue
+		}
+
+		index := record[0]
+		encryptedAB := record[1]
+
+		// В режиме labeled bob не передает b_user_id
+		bobRecord := result[index]
+		bobRecord.EncryptedAB = encryptedAB
+		for _, bUserID := range record[2:] {
+			if bUserID != "" {
+				bobRecord.UserIDs = append(bobRecord.UserIDs, bUserID)
+			}
+		}
+		result[index] = bobRecord
+	}
+
+	return result, nil
+}
+
+// ProcessAliceStep2 пишет a_user_id \t b_user_id для совпавших записей маппинга,
+// по записи на каждый b_user_id. Какие записи пишутся, задает режим вывода matcher.
+// Если у alice несколько колонок идентификаторов, совпадение строки выбирает matcher.
+// nil matcher означает одну колонку
+func ProcessAliceStep2(reader io.RecordReader, writer io.RecordWriter, bobData map[string]BobRecord, matcher *Matcher) (int, int, error) {
+	matcher = orSingleMatcher(matcher)
+
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		index, aUserId, err := parseAliceMappingRecord(record)
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		if br, found := bobData[index]; found && len(br.UserIDs) > 0 {
+			err = matcher.add(writer, index, aUserId, br.UserIDs...)
+		} else {
+			err = matcher.miss(writer, index, aUserId)
+		}
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		count++
+	}
+
+	err := matcher.flush(writer)
+	return count, matcher.matched, err
+}
+
+// parseAliceMappingRecord читает запись маппинга index \t a_user_id.
+// Для совместимости принимается и старый формат alice_encrypted: index \t H(phone_a)^A \t a_user_id
+func parseAliceMappingRecord(record []string) (string, string, error) {
+	switch len(record) {
+	case 2:
+		return record[0], record[1], nil
+	case 3:
+		return record[0], record[2], nil
+	default:
+		return "", "", fmt.Errorf("%w маппинга: ожидается 2 поля, получено %d", ErrInvalidRecord, len(record))
+	}
+}
+
+func LoadBobLabels(reader io.RecordReader) (map[string]string, error) {
+	result := make(map[string]string)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(record) < 2 {
+			return nil, fmt.Errorf("%w метки: ожидается 2 поля, получено %d", ErrInvalidRecord, len(record))
+		}
+
+		result[record[0]] = record[1]
+	}
+
+	return result, nil
+}
+
+// ProcessAliceStep2Labeled сопоставляет записи по тегам меток и расшифровывает
+// b_user_id ключом, выведенным из H(phone_a)^A^B
+func ProcessAliceStep2Labeled(reader io.RecordReader, writer io.RecordWriter, bobData map[string]BobRecord, labels map[string]string, matcher *Matcher) (int, int, error) {
+	matcher = orSingleMatcher(matcher)
+
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		index, aUserId, err := parseAliceMappingRecord(record)
+		if err != nil {
+			return count, matcher.matched, err
+		}
+		count++
+
+		br, found := bobData[index]
+		if !found {
+			if err := matcher.miss(writer, index, aUserId); err != nil {
+				return count, matcher.matched, err
+			}
+			continue
+		}
+
+		tag, err := crypto.LabelTag(br.EncryptedAB)
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		encryptedLabel, found := labels[tag]
+		if !found {
+			if err := matcher.miss(writer, index, aUserId); err != nil {
+				return count, matcher.matched, err
+			}
+			continue
+		}
+
+		label, err := crypto.DecryptLabel(br.EncryptedAB, encryptedLabel)
+		if err != nil {
+			return count, matcher.matched, fmt.Errorf("запись %s: %w", index, err)
+		}
+
+		if err := matcher.add(writer, index, aUserId, splitLabel(label)...); err != nil {
+			return count, matcher.matched, err
+		}
+	}
+
+	err := matcher.flush(writer)
+	return count, matcher.matched, err
+}
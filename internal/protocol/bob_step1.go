@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/workerpool"
+)
+
+type bobStep1Task struct {
+	rowKey  string
+	column  int
+	idType  string
+	id      string
+	bUserID string
+}
+
+type bobStep1Result struct {
+	rowKey    string
+	column    int
+	bUserID   string
+	encrypted string
+}
+
+// ProcessBobStep1 шифрует записи id_1 \t ... \t id_k \t b_user_id. Строки
+// переставляются случайным образом: в writer пишется index \t H(id_b)^B для
+// передачи alice, в mapping - приватный маппинг index \t b_user_id для шага 2.
+// Возвращает количество прочитанных строк и добавленных фиктивных записей
+func ProcessBobStep1(reader io.RecordReader, writer, mapping io.RecordWriter, keyK []byte, keyB *crypto.ECDHKey, version crypto.ProtocolVersion, encoding crypto.PointEncoding, input InputConfig, config ExternalConfig, padding Padding, batchSize int) (int, int, error) {
+	if err := padding.validate(); err != nil {
+		return 0, 0, err
+	}
+
+	columns, err := LookupIDTypes(input.IDTypes, version)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	permutation, err := newRowPermutation(len(columns), config)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer permutation.close()
+
+	dups := newDuplicates(input.Duplicates, columns, config)
+	defer dups.close()
+
+	hmacPool := &sync.Pool{
+		New: func() any {
+			return hmac.New(sha256.New, keyK)
+		},
+	}
+
+	handler := func(task bobStep1Task) (bobStep1Result, error) {
+		hashed, err := crypto.HashToGroup(version, hmacPool, keyK, task.idType, []byte(task.id))
+		if err != nil {
+			return bobStep1Result{}, fmt.Errorf("ошибка хеширования: %w", err)
+		}
+
+		encrypted, err := crypto.ECDHApplyEncoded(keyB, hashed, encoding)
+		if err != nil {
+			return bobStep1Result{}, fmt.Errorf("ошибка ECDH шифрования: %w", err)
+		}
+
+		return bobStep1Result{
+			rowKey:    task.rowKey,
+			column:    task.column,
+			bUserID:   task.bUserID,
+			encrypted: encrypted,
+		}, nil
+	}
+
+	pool := workerpool.New(handler)
+
+	var writeErr error
+	var wg sync.WaitGroup
+
+	wg.Go(func() {
+		for result := range pool.Results() {
+			if result.Error != nil {
+				if writeErr == nil {
+					writeErr = result.Error
+				}
+				continue
+			}
+			if writeErr == nil {
+				if err := permutation.add(result.Value.rowKey, result.Value.column, result.Value.encrypted, result.Value.bUserID); err != nil {
+					writeErr = fmt.Errorf("ошибка записи: %w", err)
+				}
+			}
+		}
+	})
+
+	count := 0
+	batch := make([]bobStep1Task, 0, batchSize)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pool.Close()
+			wg.Wait()
+			return count, 0, fmt.Errorf("ошибка чтения записи: %w", err)
+		}
+
+		ids, rowErr := input.parseRecord(columns, count, record)
+		if rowErr != nil {
+			if err := input.Reject.handle(rowErr, record); err != nil {
+				pool.Close()
+				wg.Wait()
+				return count, 0, err
+			}
+			count++
+			continue
+		}
+
+		rowKey := permutation.rowKey()
+		if err := dups.add(count, rowKey, ids); err != nil {
+			pool.Close()
+			wg.Wait()
+			return count, 0, err
+		}
+		for j, id := range ids {
+			if id == "" {
+				continue
+			}
+			batch = append(batch, bobStep1Task{
+				rowKey:  rowKey,
+				column:  j,
+				idType:  columns[j].Name,
+				id:      id,
+				bUserID: record[len(columns)],
+			})
+		}
+		count++
+
+		if len(batch) >= batchSize {
+			pool.Add(batch)
+			batch = make([]bobStep1Task, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		pool.Add(batch)
+	}
+
+	pool.Close()
+	wg.Wait()
+
+	if writeErr != nil {
+		return count, 0, writeErr
+	}
+
+	if err := permutation.dropDuplicates(dups, input.DuplicateReport); err != nil {
+		return count, 0, err
+	}
+
+	padded, err := permutation.pad(padding, encoding)
+	if err != nil {
+		return count, 0, err
+	}
+
+	if err := permutation.writeTo(writer, mapping); err != nil {
+		return count, padded, fmt.Errorf("ошибка записи: %w", err)
+	}
+
+	return count, padded, nil
+}
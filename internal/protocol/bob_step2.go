@@ -0,0 +1,335 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/workerpool"
+)
+
+// LoadIndexedData загружает точки index \t point в словарь point -> индексы.
+// Точки приводятся к несжатому представлению, как и ключи поиска в ProcessBobStep2.
+// Одинаковые точки у нескольких индексов - повторы идентификатора у bob,
+// оставленные политикой DuplicatesAll
+func LoadIndexedData(reader io.RecordReader) (map[string][]string, error) {
+	result := make(map[string][]string)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(record) < 2 {
+			continue
+		}
+
+		point, err := crypto.EncodePoint(record[1], crypto.PointUncompressed)
+		if err != nil {
+			return nil, err
+		}
+		result[point] = append(result[point], record[0])
+	}
+
+	return result, nil
+}
+
+// bobUserIDs возвращает b_user_id индексов точки. Индексы фиктивных записей
+// в маппинге отсутствуют и пропускаются
+func bobUserIDs(indices []string, originalData map[string]string) []string {
+	var result []string
+	for _, index := range indices {
+		if uid, ok := originalData[index]; ok {
+			result = append(result, uid)
+		}
+	}
+	return result
+}
+
+// LoadBobMapping загружает приватный маппинг шага 1 index \t b_user_id
+// в словарь index -> b_user_id
+func LoadBobMapping(reader io.RecordReader) (map[string]string, error) {
+	result := make(map[string]string)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		index, bUserID, err := parseBobMappingRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		result[index] = bUserID
+	}
+
+	return result, nil
+}
+
+// parseBobMappingRecord проверяет запись маппинга index \t b_user_id. Индекс
+// проверяется, чтобы вместо маппинга не был по ошибке передан исходный файл
+func parseBobMappingRecord(record []string) (string, string, error) {
+	if len(record) != 2 {
+		return "", "", fmt.Errorf("%w маппинга: ожидается 2 поля, получено %d", ErrInvalidRecord, len(record))
+	}
+	if _, _, ok := parseIDIndex(record[0], 1); !ok {
+		return "", "", fmt.Errorf("%w маппинга: некорректный индекс %q", ErrInvalidRecord, record[0])
+	}
+	return record[0], record[1], nil
+}
+
+type bobStep2Task struct {
+	index      string
+	encryptedA string
+}
+
+type bobStep2Result struct {
+	index       string
+	encryptedAB string
+	bUserIDs    []string
+}
+
+// ProcessBobStep2 пишет index \t H(phone_a)^A^B \t b_user_id для записей alice.
+// Если идентификатор есть в нескольких строках bob, запись повторяется подряд
+// для каждого их b_user_id, у несовпавших записей поле b_user_id пустое. С OutputMatched несовпавшие
+// записи не пишутся
+func ProcessBobStep2(reader io.RecordReader, writer io.RecordWriter, keyB *crypto.ECDHKey, bobEncMap map[string][]string, originalData map[string]string, encoding crypto.PointEncoding, output OutputMode, batchSize int) (int, int, error) {
+	handler := func(task bobStep2Task) (bobStep2Result, error) {
+		encryptedAB, err := crypto.ECDHApplyEncoded(keyB, task.encryptedA, encoding)
+		if err != nil {
+			return bobStep2Result{}, err
+		}
+
+		key, err := crypto.EncodePoint(encryptedAB, crypto.PointUncompressed)
+		if err != nil {
+			return bobStep2Result{}, err
+		}
+
+		return bobStep2Result{
+			index:       task.index,
+			encryptedAB: encryptedAB,
+			bUserIDs:    bobUserIDs(bobEncMap[key], originalData),
+		}, nil
+	}
+
+	pool := workerpool.New(handler)
+
+	var writeErr error
+	var wg sync.WaitGroup
+	matchedCount := 0
+
+	wg.Go(func() {
+		for result := range pool.Results() {
+			if result.Error != nil {
+				if writeErr == nil {
+					writeErr = result.Error
+				}
+				continue
+			}
+			if writeErr == nil {
+				matched := len(result.Value.bUserIDs) > 0
+				if output.writes(matched) {
+					writeErr = writeBobFinal(writer, result.Value.index, result.Value.encryptedAB, result.Value.bUserIDs)
+				}
+				if matched {
+					matchedCount++
+				}
+			}
+		}
+	})
+
+	count := 0
+	batch := make([]bobStep2Task, 0, batchSize)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pool.Close()
+			wg.Wait()
+			return count, matchedCount, err
+		}
+
+		if len(record) < 2 {
+			pool.Close()
+			wg.Wait()
+			return count, matchedCount, fmt.Errorf("%w: ожидается 2 поля, получено %d", ErrInvalidRecord, len(record))
+		}
+
+		batch = append(batch, bobStep2Task{
+			index:      record[0],
+			encryptedA: record[1],
+		})
+		count++
+
+		if len(batch) >= batchSize {
+			pool.Add(batch)
+			batch = make([]bobStep2Task, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		pool.Add(batch)
+	}
+
+	pool.Close()
+	wg.Wait()
+
+	if writeErr != nil {
+		return count, matchedCount, writeErr
+	}
+
+	return count, matchedCount, nil
+}
+
+// writeBobFinal пишет записи bob_final index \t point \t b_user_id, по одной
+// на каждый b_user_id, чтобы в записи всегда было три поля
+func writeBobFinal(writer io.RecordWriter, index, encryptedAB string, bUserIDs []string) error {
+	if len(bUserIDs) == 0 {
+		return writer.Write([]string{index, encryptedAB, ""})
+	}
+	for _, bUserID := range bUserIDs {
+		if err := writer.Write([]string{index, encryptedAB, bUserID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinLabel объединяет b_user_id точки в текст метки. Табуляции в b_user_id
+// нет: он приходит полем TSV
+func joinLabel(bUserIDs []string) string {
+	return strings.Join(bUserIDs, "\t")
+}
+
+func splitLabel(label string) []string {
+	return strings.Split(label, "\t")
+}
+
+type labelTask struct {
+	encryptedBA string
+	label       string
+	// length - длина метки-пустышки для фиктивной записи
+	length int
+	dummy  bool
+}
+
+// WriteBobLabels записывает в случайном порядке метки tag \t Enc(b_user_id),
+// где ключ и тег выводятся из H(phone_b)^B^A^C. Для фиктивных записей дополнения,
+// которых нет в маппинге, пишутся метки-пустышки, чтобы число меток не выдавало
+// размер множества. Несколько b_user_id одной точки шифруются в одной метке
+// через табуляцию. Возвращает число меток настоящих записей
+func WriteBobLabels(writer io.RecordWriter, bobEncMap map[string][]string, originalData map[string]string, keyC *crypto.ECDHKey, batchSize int) (int, error) {
+	tasks := make([]labelTask, 0, len(bobEncMap))
+	var dummies []string
+	lengths := make([]int, 0, len(originalData))
+
+	for encryptedBA, indices := range bobEncMap {
+		bUserIDs := bobUserIDs(indices, originalData)
+		if len(bUserIDs) == 0 {
+			dummies = append(dummies, encryptedBA)
+			continue
+		}
+		bUserID := joinLabel(bUserIDs)
+
+		tasks = append(tasks, labelTask{encryptedBA: encryptedBA, label: bUserID})
+		lengths = append(lengths, len(bUserID))
+	}
+	count := len(tasks)
+
+	for i, encryptedBA := range dummies {
+		// Длина берется у одной из настоящих меток
+		var length int
+		if len(lengths) > 0 {
+			length = lengths[i%len(lengths)]
+		}
+
+		tasks = append(tasks, labelTask{encryptedBA: encryptedBA, length: length, dummy: true})
+	}
+
+	handler := func(task labelTask) ([]string, error) {
+		point, err := crypto.ECDHApply(keyC, task.encryptedBA)
+		if err != nil {
+			return nil, err
+		}
+
+		tag, err := crypto.LabelTag(point)
+		if err != nil {
+			return nil, err
+		}
+
+		var encryptedLabel string
+		if task.dummy {
+			encryptedLabel, err = dummyLabel(point, task.length)
+		} else {
+			encryptedLabel, err = crypto.EncryptLabel(point, task.label)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{tag, encryptedLabel}, nil
+	}
+
+	pool := workerpool.New(handler)
+
+	labels := make([][]string, 0, len(tasks))
+	var labelErr error
+	var wg sync.WaitGroup
+
+	wg.Go(func() {
+		for result := range pool.Results() {
+			if result.Error != nil {
+				if labelErr == nil {
+					labelErr = result.Error
+				}
+				continue
+			}
+			labels = append(labels, result.Value)
+		}
+	})
+
+	for start := 0; start < len(tasks); start += batchSize {
+		pool.Add(tasks[start:min(start+batchSize, len(tasks))])
+	}
+
+	pool.Close()
+	wg.Wait()
+
+	if labelErr != nil {
+		return 0, labelErr
+	}
+
+	if err := crypto.Shuffle(len(labels), func(i, j int) {
+		labels[i], labels[j] = labels[j], labels[i]
+	}); err != nil {
+		return 0, err
+	}
+
+	for _, label := range labels {
+		if err := writer.Write(label); err != nil {
+			return 0, err
+		}
+	}
+
+	return count, nil
+}
+
+// ProcessBobStep2Labeled вычисляет H(phone_a)^A^B^C без сопоставления:
+// bob не узнает, какие записи alice попали в пересечение. keyBC - произведение
+// ключа B и одноразового ключа меток C, см. crypto.MultiplyKeys
+func ProcessBobStep2Labeled(reader io.RecordReader, writer io.RecordWriter, keyBC *crypto.ECDHKey, encoding crypto.PointEncoding, batchSize int) (int, error) {
+	return applyECDHKey(reader, writer, keyBC, encoding, batchSize)
+}
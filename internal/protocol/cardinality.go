@@ -0,0 +1,362 @@
+package protocol
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/extsort"
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// В режиме cardinality alice передает bob точки без индексов в случайном
+// порядке, а bob только считает совпадения. Ни одна из сторон не узнает,
+// какие записи попали в пересечение
+
+type recordWriterFunc func(record []string) error
+
+func (f recordWriterFunc) Write(record []string) error {
+	return f(record)
+}
+
+// unindexedReader читает записи point режима cardinality как записи
+// index \t point с пустым индексом, чтобы их обрабатывал applyECDHKey
+type unindexedReader struct {
+	reader io.RecordReader
+}
+
+func (r unindexedReader) Read() ([]string, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(record) != 1 {
+		return nil, fmt.Errorf("%w: в режиме cardinality ожидается 1 поле без индекса, получено %d", ErrModeMismatch, len(record))
+	}
+	return []string{"", record[0]}, nil
+}
+
+// pointShuffler собирает записи без индексов, первое поле которых - точка,
+// и выдает их в случайном порядке. При MemoryLimit > 0 записи сортируются на диске
+// по точке: точки зашифрованы секретным ключом, поэтому такой порядок не связан
+// с порядком записей так же, как случайная перестановка
+//
+// С duplicates последнее поле записей - номер строки, по которому
+// при выдаче отбрасываются повторы. В выходные записи он не попадает
+type pointShuffler struct {
+	records    [][]string
+	sorter     *extsort.Sorter
+	duplicates *duplicates
+}
+
+func newPointShuffler(config ExternalConfig) *pointShuffler {
+	if config.MemoryLimit > 0 {
+		return &pointShuffler{sorter: config.sorter(byFirst)}
+	}
+	return &pointShuffler{}
+}
+
+// pad добавляет к records настоящим записям фиктивные, созданные dummy,
+// и возвращает их число
+func (s *pointShuffler) pad(padding Padding, records int, dummy func() ([]string, error)) (int, error) {
+	dummies := padding.dummies(records)
+	for range dummies {
+		record, err := dummy()
+		if err != nil {
+			return 0, fmt.Errorf("ошибка генерации фиктивной записи: %w", err)
+		}
+		if s.duplicates != nil {
+			record = append(record, "")
+		}
+		if err := s.add(record); err != nil {
+			return 0, err
+		}
+	}
+	return dummies, nil
+}
+
+func (s *pointShuffler) add(record []string) error {
+	if s.sorter != nil {
+		return s.sorter.Write(record)
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+// Write принимает записи index \t point и отбрасывает индекс
+func (s *pointShuffler) Write(record []string) error {
+	return s.add(record[len(record)-1:])
+}
+
+func (s *pointShuffler) close() {
+	if s.sorter != nil {
+		s.sorter.Close()
+	}
+}
+
+func (s *pointShuffler) writeTo(writer io.RecordWriter) error {
+	if s.duplicates != nil {
+		out := writer
+		writer = recordWriterFunc(func(record []string) error {
+			if s.duplicates.skip(record[len(record)-1], 0) {
+				return nil
+			}
+			return out.Write(record[:len(record)-1])
+		})
+	}
+
+	if s.sorter == nil {
+		if err := crypto.Shuffle(len(s.records), func(i, j int) {
+			s.records[i], s.records[j] = s.records[j], s.records[i]
+		}); err != nil {
+			return err
+		}
+
+		for _, record := range s.records {
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sorted, err := s.sorter.Sort()
+	if err != nil {
+		return err
+	}
+	defer sorted.Close()
+
+	for {
+		record, err := sorted.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+}
+
+// newRowShuffler создает pointShuffler для строк входных данных шага 1
+// и, если задана политика повторов, duplicates
+func newRowShuffler(input InputConfig, version crypto.ProtocolVersion, config ExternalConfig) (*pointShuffler, *duplicates, error) {
+	columns, err := LookupIDTypes(input.IDTypes, version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shuffler := newPointShuffler(config)
+	shuffler.duplicates = newDuplicates(input.Duplicates, columns, config)
+	return shuffler, shuffler.duplicates, nil
+}
+
+// rowKey возвращает функцию ключей строк для encryptAliceData: номер строки,
+// если ищутся повторы, иначе пустой ключ
+func (s *pointShuffler) rowKey() func() string {
+	rows := 0
+	return func() string {
+		if s.duplicates == nil {
+			return ""
+		}
+		rows++
+		return strconv.Itoa(rows)
+	}
+}
+
+// keyed добавляет к записи ключ строки, если ищутся повторы
+func (s *pointShuffler) keyed(key string, record ...string) []string {
+	if s.duplicates != nil {
+		record = append(record, key)
+	}
+	return record
+}
+
+// dropDuplicates находит повторы после добавления всех строк и возвращает
+// число оставшихся настоящих записей из records
+func (s *pointShuffler) dropDuplicates(records int, report *DuplicateReport) (int, error) {
+	if err := s.duplicates.resolve(report); err != nil {
+		return records, err
+	}
+	return records - s.duplicates.droppedCount(), nil
+}
+
+// randomPointRecord создает фиктивную запись режима cardinality
+func randomPointRecord(encoding crypto.PointEncoding) func() ([]string, error) {
+	return func() ([]string, error) {
+		point, err := crypto.RandomPoint(encoding)
+		if err != nil {
+			return nil, err
+		}
+		return []string{point}, nil
+	}
+}
+
+// ProcessBobDataStep1Cardinality - вариант ProcessBobDataStep1 для режима
+// cardinality: H(phone_b)^B^A пишутся без индексов в случайном порядке,
+// чтобы bob не мог сопоставить их со своими записями
+func ProcessBobDataStep1Cardinality(reader io.RecordReader, writer io.RecordWriter, keyA *crypto.ECDHKey, encoding crypto.PointEncoding, config ExternalConfig, batchSize int) (int, error) {
+	shuffler := newPointShuffler(config)
+	count, err := applyECDHKey(reader, shuffler, keyA, encoding, batchSize)
+	if err != nil {
+		shuffler.close()
+		return count, err
+	}
+	return count, shuffler.writeTo(writer)
+}
+
+// ProcessAliceDataStep1Cardinality - вариант ProcessAliceDataStep1 для режима
+// cardinality: H(phone_a)^A пишутся без индексов в случайном порядке,
+// маппинг a_user_id не создается
+func ProcessAliceDataStep1Cardinality(reader io.RecordReader, writer io.RecordWriter, keyK []byte, keyA *crypto.ECDHKey, version crypto.ProtocolVersion, encoding crypto.PointEncoding, input InputConfig, config ExternalConfig, padding Padding, batchSize int) (int, int, error) {
+	if err := padding.validate(); err != nil {
+		return 0, 0, err
+	}
+
+	shuffler, dups, err := newRowShuffler(input, version, config)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dups.close()
+
+	records := 0
+	count, err := encryptAliceData(reader, keyK, keyA, version, encoding, input, batchSize, shuffler.rowKey(), dups, nil, func(result aliceDataResult) error {
+		records++
+		return shuffler.add(shuffler.keyed(result.rowKey, result.encrypted))
+	})
+	if err == nil {
+		records, err = shuffler.dropDuplicates(records, input.DuplicateReport)
+	}
+	if err != nil {
+		shuffler.close()
+		return count, 0, err
+	}
+
+	padded, err := shuffler.pad(padding, records, randomPointRecord(encoding))
+	if err != nil {
+		shuffler.close()
+		return count, 0, err
+	}
+	return count, padded, shuffler.writeTo(writer)
+}
+
+// LoadPointSet загружает точки режима cardinality в множество
+// в несжатом представлении
+func LoadPointSet(reader io.RecordReader) (map[string]struct{}, error) {
+	result := make(map[string]struct{})
+	reader = unindexedReader{reader}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		point, err := crypto.EncodePoint(record[1], crypto.PointUncompressed)
+		if err != nil {
+			return nil, err
+		}
+		result[point] = struct{}{}
+	}
+
+	return result, nil
+}
+
+// ProcessBobStep2Cardinality вычисляет H(phone_a)^A^B и считает, сколько
+// из них есть среди точек bobPoints. Точки alice нигде не сохраняются.
+// Возвращает число записей alice и размер пересечения
+func ProcessBobStep2Cardinality(reader io.RecordReader, keyB *crypto.ECDHKey, bobPoints map[string]struct{}, batchSize int) (int, int, error) {
+	return matchPoints(unindexedReader{reader}, keyB, bobPoints, batchSize, nil)
+}
+
+// matchPoints применяет ключ к точкам записей value \t point и передает
+// в onMatch, если она задана, записи value \t point, совпавшие с bobPoints.
+// Возвращает число записей и совпадений
+func matchPoints(reader io.RecordReader, keyB *crypto.ECDHKey, bobPoints map[string]struct{}, batchSize int, onMatch func(record []string) error) (int, int, error) {
+	matched := 0
+	count, err := applyECDHKey(reader, recordWriterFunc(func(record []string) error {
+		if _, found := bobPoints[record[1]]; !found {
+			return nil
+		}
+		matched++
+		if onMatch == nil {
+			return nil
+		}
+		return onMatch(record)
+	}), keyB, crypto.PointUncompressed, batchSize)
+	return count, matched, err
+}
+
+// ProcessBobStep2CardinalityExternal - вариант ProcessBobStep2Cardinality,
+// который вместо множества сортирует точки обеих сторон на диске и сливает их
+func ProcessBobStep2CardinalityExternal(reader io.RecordReader, bobEncrypted io.RecordReader, keyB *crypto.ECDHKey, config ExternalConfig, batchSize int) (int, int, error) {
+	return matchPointsExternal(unindexedReader{reader}, bobEncrypted, keyB, config, batchSize, nil)
+}
+
+// matchPointsExternal - вариант matchPoints, который сортирует точки обеих
+// сторон на диске и сливает их
+func matchPointsExternal(reader io.RecordReader, bobEncrypted io.RecordReader, keyB *crypto.ECDHKey, config ExternalConfig, batchSize int, onMatch func(record []string) error) (int, int, error) {
+	bobSorted, _, err := sortRecords(unindexedReader{bobEncrypted}, config.sorter(byFirst), func(record []string) ([]string, error) {
+		point, err := crypto.EncodePoint(record[1], crypto.PointUncompressed)
+		if err != nil {
+			return nil, err
+		}
+		return []string{point}, nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("ошибка сортировки H(phone_b)^B^A: %w", err)
+	}
+	defer bobSorted.Close()
+
+	// point \t value
+	aliceSorter := config.sorter(byFirst)
+	count, err := applyECDHKey(reader, recordWriterFunc(func(record []string) error {
+		return aliceSorter.Write([]string{record[1], record[0]})
+	}), keyB, crypto.PointUncompressed, batchSize)
+	if err != nil {
+		aliceSorter.Close()
+		return count, 0, err
+	}
+
+	aliceSorted, err := aliceSorter.Sort()
+	if err != nil {
+		return count, 0, err
+	}
+	defer aliceSorted.Close()
+
+	bobLookup := newSortedLookup(bobSorted, cmp.Compare[string])
+	matched := 0
+
+	for {
+		record, err := aliceSorted.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, matched, err
+		}
+
+		bobRecord, err := bobLookup.Find(record[0])
+		if err != nil {
+			return count, matched, err
+		}
+		if bobRecord == nil {
+			continue
+		}
+
+		matched++
+		if onMatch != nil {
+			if err := onMatch([]string{record[1], record[0]}); err != nil {
+				return count, matched, err
+			}
+		}
+	}
+
+	return count, matched, nil
+}
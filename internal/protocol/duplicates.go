@@ -0,0 +1,221 @@
+package protocol
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/pkositsyn/psi/internal/extsort"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/validation"
+)
+
+// DuplicatePolicy задает, что делать с идентификатором, который встречается
+// во входных данных шага 1 в нескольких строках. Повторы ищутся по колонкам
+// после нормализации: одинаковые значения разных типов повторами не считаются
+type DuplicatePolicy string
+
+const (
+	// DuplicatesAll оставляет все вхождения: у bob совпадение дает все b_user_id
+	// идентификатора, у alice совпадают все ее строки с ним
+	DuplicatesAll DuplicatePolicy = "all"
+	// DuplicatesFirst оставляет первое по порядку файла вхождение
+	DuplicatesFirst DuplicatePolicy = "first"
+	// DuplicatesLast оставляет последнее по порядку файла вхождение
+	DuplicatesLast DuplicatePolicy = "last"
+	// DuplicatesError останавливает шаг на первом повторе
+	DuplicatesError DuplicatePolicy = "error"
+)
+
+// ParseDuplicatePolicy проверяет название политики. Пустая строка означает DuplicatesAll
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(name); policy {
+	case "":
+		return DuplicatesAll, nil
+	case DuplicatesAll, DuplicatesFirst, DuplicatesLast, DuplicatesError:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("неизвестная политика повторов %q, допустимы %s, %s, %s и %s", name, DuplicatesAll, DuplicatesFirst, DuplicatesLast, DuplicatesError)
+	}
+}
+
+// DuplicateReport - отчет о повторах во входных данных шага 1
+type DuplicateReport struct {
+	// IDs - число идентификаторов, встретившихся больше одного раза
+	IDs int
+	// Repeats - число повторных вхождений, не считая первого
+	Repeats int
+	// Dropped - число вхождений, отброшенных политикой first или last
+	Dropped int
+	// ByType - число повторяющихся идентификаторов по типу
+	ByType map[string]int
+}
+
+// duplicates собирает идентификаторы строк шага 1 и после чтения всех строк
+// находит повторы. Строки переставляются, поэтому порядок файла сохраняется
+// в номере строки, а отброшенные вхождения запоминаются по ключу строки
+// перестановки и колонке. Идентификаторы хранятся в виде хешей и при
+// MemoryLimit > 0 сортируются на диске, в памяти остаются только отброшенные
+type duplicates struct {
+	policy  DuplicatePolicy
+	columns []validation.IDType
+	sorter  *extsort.Sorter
+	dropped map[string]struct{}
+}
+
+// newDuplicates возвращает nil, если политика не задана: повторы тогда
+// не ищутся и все вхождения остаются
+func newDuplicates(policy DuplicatePolicy, columns []validation.IDType, config ExternalConfig) *duplicates {
+	if policy == "" {
+		return nil
+	}
+
+	memoryLimit := int64(math.MaxInt64)
+	if config.MemoryLimit > 0 {
+		memoryLimit = max(config.MemoryLimit/4, 1)
+	}
+
+	return &duplicates{
+		policy:  policy,
+		columns: columns,
+		sorter:  extsort.New(config.TempDir, memoryLimit, byDigestRow),
+	}
+}
+
+// byDigestRow упорядочивает записи digest \t row \t key \t column по хешу,
+// затем по номеру строки
+func byDigestRow(a, b []string) int {
+	if c := cmp.Compare(a[0], b[0]); c != 0 {
+		return c
+	}
+	return compareIndex(a[1], b[1])
+}
+
+func duplicateKey(key string, column int) string {
+	return key + "\t" + strconv.Itoa(column)
+}
+
+// add учитывает идентификаторы ids строки row с ключом перестановки key.
+// Вызывается при чтении строк из одной горутины
+func (d *duplicates) add(row int, key string, ids []string) error {
+	if d == nil {
+		return nil
+	}
+
+	for column, id := range ids {
+		if id == "" {
+			continue
+		}
+
+		h := sha256.New()
+		h.Write([]byte(d.columns[column].Name))
+		h.Write([]byte{0})
+		h.Write([]byte(id))
+		digest := hex.EncodeToString(h.Sum(nil)[:16])
+
+		if err := d.sorter.Write([]string{digest, strconv.Itoa(row), key, strconv.Itoa(column)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve находит повторы, применяет политику и заполняет report, если он задан
+func (d *duplicates) resolve(report *DuplicateReport) error {
+	if d == nil {
+		return nil
+	}
+
+	sorted, err := d.sorter.Sort()
+	if err != nil {
+		return err
+	}
+	defer sorted.Close()
+
+	result := DuplicateReport{ByType: make(map[string]int)}
+	d.dropped = make(map[string]struct{})
+
+	var group [][]string
+	flush := func() error {
+		if len(group) < 2 {
+			return nil
+		}
+
+		column, _ := strconv.Atoi(group[0][3])
+		idType := d.columns[column].Name
+		result.IDs++
+		result.Repeats += len(group) - 1
+		result.ByType[idType]++
+
+		var drop [][]string
+		switch d.policy {
+		case DuplicatesError:
+			first, _ := strconv.Atoi(group[0][1])
+			row, _ := strconv.Atoi(group[1][1])
+			return &RowError{Row: row, Err: fmt.Errorf("%w: %s уже есть в строке %d", ErrDuplicateID, idType, first)}
+		case DuplicatesFirst:
+			drop = group[1:]
+		case DuplicatesLast:
+			drop = group[:len(group)-1]
+		}
+
+		for _, record := range drop {
+			column, _ := strconv.Atoi(record[3])
+			d.dropped[duplicateKey(record[2], column)] = struct{}{}
+		}
+		result.Dropped += len(drop)
+		return nil
+	}
+
+	for {
+		record, err := sorted.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(group) > 0 && group[0][0] != record[0] {
+			if err := flush(); err != nil {
+				return err
+			}
+			group = group[:0]
+		}
+		group = append(group, record)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if report != nil {
+		*report = result
+	}
+	return nil
+}
+
+// droppedCount возвращает число отброшенных вхождений
+func (d *duplicates) droppedCount() int {
+	if d == nil {
+		return 0
+	}
+	return len(d.dropped)
+}
+
+// skip сообщает, отброшено ли вхождение колонки column строки с ключом key
+func (d *duplicates) skip(key string, column int) bool {
+	if d == nil {
+		return false
+	}
+	_, found := d.dropped[duplicateKey(key, column)]
+	return found
+}
+
+func (d *duplicates) close() {
+	if d != nil {
+		d.sorter.Close()
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidRecord = errors.New("неверный формат записи")
+	ErrModeMismatch  = errors.New("режимы сторон не совпадают")
+	// ErrCardinalityColumns: без индексов совпадения нельзя свести к строкам,
+	// поэтому размер пересечения считается только для одной колонки
+	ErrCardinalityColumns = errors.New("режим cardinality поддерживает только одну колонку идентификаторов")
+	// ErrSumColumns: строка, совпавшая по нескольким идентификаторам,
+	// вошла бы в сумму несколько раз
+	ErrSumColumns   = errors.New("режим sum поддерживает только одну колонку идентификаторов")
+	ErrInvalidValue = errors.New("некорректное значение")
+	// ErrDuplicateID - повтор идентификатора при политике DuplicatesError
+	ErrDuplicateID = errors.New("идентификатор повторяется")
+)
+
+// RowError указывает на строку входного файла, которую не удалось обработать
+type RowError struct {
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("строка %d: %v", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// RejectFunc получает строку входных данных, не прошедшую проверку,
+// и ошибку с ее номером. Если RejectFunc вернула nil, строка пропускается
+type RejectFunc func(rowErr *RowError, record []string) error
+
+func (f RejectFunc) handle(rowErr *RowError, record []string) error {
+	if f == nil {
+		return rowErr
+	}
+	return f(rowErr, record)
+}
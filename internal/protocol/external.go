@@ -0,0 +1,583 @@
+package protocol
+
+import (
+	"cmp"
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/extsort"
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// Внешние варианты шагов 2 заменяют словари в памяти сортировкой на диске
+// и слиянием отсортированных потоков. Результат совпадает с вариантами в памяти
+// с точностью до порядка записей
+
+// ExternalConfig ограничивает память, которую занимают буферы сортировки
+type ExternalConfig struct {
+	MemoryLimit int64
+	TempDir     string
+}
+
+func (c ExternalConfig) sorter(compare func(a, b []string) int) *extsort.Sorter {
+	// Отсортированный без сброса на диск результат остается в памяти,
+	// поэтому одновременно живут до четырех буферов
+	return extsort.New(c.TempDir, max(c.MemoryLimit/4, 1), compare)
+}
+
+// compareIndex сравнивает неотрицательные десятичные индексы без разбора чисел
+func compareIndex(a, b string) int {
+	if c := cmp.Compare(len(a), len(b)); c != 0 {
+		return c
+	}
+	return cmp.Compare(a, b)
+}
+
+func byIndex(a, b []string) int {
+	return compareIndex(a[0], b[0])
+}
+
+func byFirst(a, b []string) int {
+	return cmp.Compare(a[0], b[0])
+}
+
+func bySecond(a, b []string) int {
+	return cmp.Compare(a[1], b[1])
+}
+
+// sortRecords сортирует записи reader, преобразованные convert. Записи, для
+// которых convert вернул nil, пропускаются. Возвращает число прочитанных записей
+func sortRecords(reader io.RecordReader, sorter *extsort.Sorter, convert func([]string) ([]string, error)) (io.RecordReadCloser, int, error) {
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sorter.Close()
+			return nil, count, err
+		}
+		count++
+
+		record, err = convert(record)
+		if err != nil {
+			sorter.Close()
+			return nil, count, err
+		}
+		if record == nil {
+			continue
+		}
+
+		if err := sorter.Write(record); err != nil {
+			sorter.Close()
+			return nil, count, err
+		}
+	}
+
+	sorted, err := sorter.Sort()
+	return sorted, count, err
+}
+
+// sortedLookup ищет записи по ключу в первом поле в потоке, отсортированном
+// по этому ключу. Ключи запросов должны идти в неубывающем порядке
+type sortedLookup struct {
+	reader  io.RecordReader
+	compare func(a, b string) int
+	group   [][]string
+	next    []string
+	err     error
+}
+
+func newSortedLookup(reader io.RecordReader, compare func(a, b string) int) *sortedLookup {
+	l := &sortedLookup{reader: reader, compare: compare}
+	l.next, l.err = reader.Read()
+	return l
+}
+
+// Find возвращает запись с ключом key или nil, если ее нет.
+// При повторах ключа, как и при загрузке в словарь, побеждает последняя запись
+func (l *sortedLookup) Find(key string) ([]string, error) {
+	group, err := l.FindAll(key)
+	if len(group) == 0 {
+		return nil, err
+	}
+	return group[len(group)-1], nil
+}
+
+// FindAll возвращает все записи с ключом key в порядке потока
+func (l *sortedLookup) FindAll(key string) ([][]string, error) {
+	for l.err == nil && l.compare(l.next[0], key) <= 0 {
+		if len(l.group) > 0 && l.compare(l.group[0][0], l.next[0]) != 0 {
+			l.group = nil
+		}
+		l.group = append(l.group, l.next)
+		l.next, l.err = l.reader.Read()
+	}
+	if l.err != nil && l.err != io.EOF {
+		return nil, l.err
+	}
+
+	if len(l.group) > 0 && l.compare(l.group[0][0], key) == 0 {
+		return l.group, nil
+	}
+	return nil, nil
+}
+
+// joinBobData соединяет H(phone_b)^B^A с b_user_id из маппинга bob по индексу
+// и передает пары point, b_user_id в emit. Точки фиктивных записей, которых нет
+// в маппинге, передаются в emitDummy, если она задана. Как и LoadIndexedData,
+// пропускает неполные записи H(phone_b)^B^A
+func joinBobData(bobEncrypted, mapping io.RecordReader, config ExternalConfig, emit func(point, bUserID string) error, emitDummy func(point string) error) error {
+	mappingSorted, _, err := sortRecords(mapping, config.sorter(byIndex), func(record []string) ([]string, error) {
+		index, bUserID, err := parseBobMappingRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		return []string{index, bUserID}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка сортировки маппинга: %w", err)
+	}
+	defer mappingSorted.Close()
+
+	sorted, _, err := sortRecords(bobEncrypted, config.sorter(byIndex), func(record []string) ([]string, error) {
+		if len(record) < 2 {
+			return nil, nil
+		}
+		return record[:2], nil
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка сортировки H(phone_b)^B^A: %w", err)
+	}
+	defer sorted.Close()
+
+	mappingLookup := newSortedLookup(mappingSorted, compareIndex)
+
+	for {
+		record, err := sorted.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mappingRecord, err := mappingLookup.Find(record[0])
+		if err != nil {
+			return err
+		}
+		if mappingRecord == nil {
+			if emitDummy != nil {
+				if err := emitDummy(record[1]); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := emit(record[1], mappingRecord[1]); err != nil {
+			return err
+		}
+	}
+}
+
+// ProcessBobStep2External - вариант ProcessBobStep2, который вместо словарей
+// сортирует H(phone_b)^B^A и H(phone_a)^A^B на диске и сливает их
+func ProcessBobStep2External(reader io.RecordReader, writer io.RecordWriter, keyB *crypto.ECDHKey, bobEncrypted, mapping io.RecordReader, config ExternalConfig, encoding crypto.PointEncoding, output OutputMode, batchSize int) (int, int, error) {
+	// Точки alice сравниваются как строки, поэтому приводятся к представлению bob
+	bobSorter := config.sorter(byFirst)
+	err := joinBobData(bobEncrypted, mapping, config, func(point, bUserID string) error {
+		point, err := crypto.EncodePoint(point, encoding)
+		if err != nil {
+			return err
+		}
+		return bobSorter.Write([]string{point, bUserID})
+	}, nil)
+	if err != nil {
+		bobSorter.Close()
+		return 0, 0, err
+	}
+
+	bobSorted, err := bobSorter.Sort()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer bobSorted.Close()
+
+	aliceSorter := config.sorter(bySecond)
+	count, err := applyECDHKey(reader, aliceSorter, keyB, encoding, batchSize)
+	if err != nil {
+		aliceSorter.Close()
+		return count, 0, err
+	}
+
+	aliceSorted, err := aliceSorter.Sort()
+	if err != nil {
+		return count, 0, err
+	}
+	defer aliceSorted.Close()
+
+	bobLookup := newSortedLookup(bobSorted, cmp.Compare[string])
+	matched := 0
+
+	for {
+		record, err := aliceSorted.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, matched, err
+		}
+
+		bobRecords, err := bobLookup.FindAll(record[1])
+		if err != nil {
+			return count, matched, err
+		}
+
+		var bUserIDs []string
+		for _, bobRecord := range bobRecords {
+			bUserIDs = append(bUserIDs, bobRecord[1])
+		}
+		if len(bUserIDs) > 0 {
+			matched++
+		}
+		if !output.writes(len(bUserIDs) > 0) {
+			continue
+		}
+
+		if err := writeBobFinal(writer, record[0], record[1], bUserIDs); err != nil {
+			return count, matched, err
+		}
+	}
+
+	return count, matched, nil
+}
+
+// WriteBobLabelsExternal - вариант WriteBobLabels без словарей. Метки
+// записываются в порядке тегов: теги - значения SHA-256, поэтому такой порядок
+// не связан с порядком записей bob так же, как случайная перестановка
+func WriteBobLabelsExternal(writer io.RecordWriter, bobEncrypted, mapping io.RecordReader, keyC *crypto.ECDHKey, config ExternalConfig, batchSize int) (int, error) {
+	// Ключ C применяется параллельно до сортировки по индексу: дальше
+	// записи обрабатываются по одной
+	labelSorter := config.sorter(byIndex)
+	if _, err := applyECDHKey(bobEncrypted, labelSorter, keyC, crypto.PointUncompressed, batchSize); err != nil {
+		labelSorter.Close()
+		return 0, fmt.Errorf("ошибка вычисления H(phone_b)^B^A^C: %w", err)
+	}
+	labelPoints, err := labelSorter.Sort()
+	if err != nil {
+		return 0, err
+	}
+	defer labelPoints.Close()
+
+	// Настоящие записи сортируются как tag \t point \t b_user_id и шифруются
+	// после сортировки, чтобы b_user_id одной точки попали в одну метку.
+	// Метки фиктивных записей сортируются готовыми, из двух полей. Длина
+	// пустышки берется у предыдущей настоящей метки: записи идут в порядке
+	// индексов, то есть в порядке случайной перестановки шага 1. Пустышки
+	// до первой настоящей метки ждут ее длину
+	sorter := config.sorter(byFirst)
+	length := -1
+	var pending []string
+
+	writeDummy := func(point string) error {
+		tag, err := crypto.LabelTag(point)
+		if err != nil {
+			return err
+		}
+
+		encryptedLabel, err := dummyLabel(point, max(length, 0))
+		if err != nil {
+			return err
+		}
+
+		return sorter.Write([]string{tag, encryptedLabel})
+	}
+
+	err = joinBobData(labelPoints, mapping, config, func(point, bUserID string) error {
+		tag, err := crypto.LabelTag(point)
+		if err != nil {
+			return err
+		}
+
+		length = len(bUserID)
+		for _, dummy := range pending {
+			if err := writeDummy(dummy); err != nil {
+				return err
+			}
+		}
+		pending = nil
+
+		return sorter.Write([]string{tag, point, bUserID})
+	}, func(point string) error {
+		if length < 0 {
+			pending = append(pending, point)
+			return nil
+		}
+		return writeDummy(point)
+	})
+	if err == nil {
+		for _, dummy := range pending {
+			if err = writeDummy(dummy); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		sorter.Close()
+		return 0, err
+	}
+
+	sorted, err := sorter.Sort()
+	if err != nil {
+		return 0, err
+	}
+	defer sorted.Close()
+
+	// Одинаковые точки дают одинаковые теги, их b_user_id идут в одну метку
+	count := 0
+	var group [][]string
+	flush := func() error {
+		if len(group) == 0 {
+			return nil
+		}
+
+		bUserIDs := make([]string, len(group))
+		for i, record := range group {
+			bUserIDs[i] = record[2]
+		}
+		encryptedLabel, err := crypto.EncryptLabel(group[0][1], joinLabel(bUserIDs))
+		if err != nil {
+			return err
+		}
+
+		tag := group[0][0]
+		group = nil
+		count++
+		return writer.Write([]string{tag, encryptedLabel})
+	}
+
+	for {
+		record, err := sorted.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if len(group) > 0 && group[0][0] != record[0] {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+
+		if len(record) == 2 {
+			if err := writer.Write(record); err != nil {
+				return count, err
+			}
+			continue
+		}
+		group = append(group, record)
+	}
+
+	return count, flush()
+}
+
+func sortAliceMapping(reader io.RecordReader, config ExternalConfig) (io.RecordReadCloser, int, error) {
+	return sortRecords(reader, config.sorter(byIndex), func(record []string) ([]string, error) {
+		index, aUserId, err := parseAliceMappingRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		return []string{index, aUserId}, nil
+	})
+}
+
+// sortBobFinal сортирует bob_final по индексу, оставляя поля начиная с field:
+// 1 - точку, 2 - b_user_id. Записи с несколькими b_user_id повторяют индекс
+func sortBobFinal(reader io.RecordReader, config ExternalConfig, field int) (io.RecordReadCloser, error) {
+	sorted, _, err := sortRecords(reader, config.sorter(byIndex), func(record []string) ([]string, error) {
+		if len(record) < 2 {
+			return nil, nil
+		}
+
+		if len(record) <= field {
+			return []string{record[0], ""}, nil
+		}
+		return append([]string{record[0]}, record[field:]...), nil
+	})
+	return sorted, err
+}
+
+// ProcessAliceStep2External - вариант ProcessAliceStep2, который сливает
+// маппинг и данные bob, отсортированные по индексу на диске
+func ProcessAliceStep2External(reader io.RecordReader, writer io.RecordWriter, bobFinal io.RecordReader, config ExternalConfig, matcher *Matcher) (int, int, error) {
+	matcher = orSingleMatcher(matcher)
+
+	bobSorted, err := sortBobFinal(bobFinal, config, 2)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ошибка сортировки данных от bob: %w", err)
+	}
+	defer bobSorted.Close()
+
+	mappingSorted, count, err := sortAliceMapping(reader, config)
+	if err != nil {
+		return count, 0, err
+	}
+	defer mappingSorted.Close()
+
+	bobLookup := newSortedLookup(bobSorted, compareIndex)
+
+	for {
+		record, err := mappingSorted.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		// Идентификаторы строки идут подряд, поэтому предыдущие строки уже решены
+		if err := matcher.flushBefore(writer, record[0]); err != nil {
+			return count, matcher.matched, err
+		}
+
+		bobRecords, err := bobLookup.FindAll(record[0])
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		var bUserIDs []string
+		for _, bobRecord := range bobRecords {
+			for _, bUserID := range bobRecord[1:] {
+				if bUserID != "" {
+					bUserIDs = append(bUserIDs, bUserID)
+				}
+			}
+		}
+		if len(bUserIDs) > 0 {
+			err = matcher.add(writer, record[0], record[1], bUserIDs...)
+		} else {
+			err = matcher.miss(writer, record[0], record[1])
+		}
+		if err != nil {
+			return count, matcher.matched, err
+		}
+	}
+
+	err = matcher.flush(writer)
+	return count, matcher.matched, err
+}
+
+// ProcessAliceStep2LabeledExternal - вариант ProcessAliceStep2Labeled без словарей:
+// записи alice соединяются с bob_final по индексу, затем с метками по тегу.
+// При нескольких колонках идентификаторов совпадения до выбора по приоритету
+// хранятся в памяти, так как после сортировки по тегу строки alice перемешаны,
+// а в режимах вывода all и unmatched - и строки без совпадения
+func ProcessAliceStep2LabeledExternal(reader io.RecordReader, writer io.RecordWriter, bobFinal, labels io.RecordReader, config ExternalConfig, matcher *Matcher) (int, int, error) {
+	matcher = orSingleMatcher(matcher)
+
+	labelsSorted, _, err := sortRecords(labels, config.sorter(byFirst), func(record []string) ([]string, error) {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("%w метки: ожидается 2 поля, получено %d", ErrInvalidRecord, len(record))
+		}
+		return record[:2], nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("ошибка сортировки меток от bob: %w", err)
+	}
+	defer labelsSorted.Close()
+
+	bobSorted, err := sortBobFinal(bobFinal, config, 1)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ошибка сортировки данных от bob: %w", err)
+	}
+	defer bobSorted.Close()
+
+	mappingSorted, count, err := sortAliceMapping(reader, config)
+	if err != nil {
+		return count, 0, err
+	}
+	defer mappingSorted.Close()
+
+	// tag \t H(phone_a)^A^B \t a_user_id \t index для записей, которые есть у bob
+	tagSorter := config.sorter(byFirst)
+	bobLookup := newSortedLookup(bobSorted, compareIndex)
+	for {
+		record, err := mappingSorted.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tagSorter.Close()
+			return count, 0, err
+		}
+
+		bobRecord, err := bobLookup.Find(record[0])
+		if err != nil {
+			tagSorter.Close()
+			return count, 0, err
+		}
+		if bobRecord == nil {
+			if err := matcher.miss(writer, record[0], record[1]); err != nil {
+				tagSorter.Close()
+				return count, 0, err
+			}
+			continue
+		}
+
+		tag, err := crypto.LabelTag(bobRecord[1])
+		if err != nil {
+			tagSorter.Close()
+			return count, 0, err
+		}
+
+		if err := tagSorter.Write([]string{tag, bobRecord[1], record[1], record[0]}); err != nil {
+			tagSorter.Close()
+			return count, 0, err
+		}
+	}
+
+	tagSorted, err := tagSorter.Sort()
+	if err != nil {
+		return count, 0, err
+	}
+	defer tagSorted.Close()
+
+	labelLookup := newSortedLookup(labelsSorted, cmp.Compare[string])
+
+	for {
+		record, err := tagSorted.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		label, err := labelLookup.Find(record[0])
+		if err != nil {
+			return count, matcher.matched, err
+		}
+		if label == nil {
+			if err := matcher.miss(writer, record[3], record[2]); err != nil {
+				return count, matcher.matched, err
+			}
+			continue
+		}
+
+		bUserIDs, err := crypto.DecryptLabel(record[1], label[1])
+		if err != nil {
+			return count, matcher.matched, err
+		}
+
+		if err := matcher.add(writer, record[3], record[2], splitLabel(bUserIDs)...); err != nil {
+			return count, matcher.matched, err
+		}
+	}
+
+	err = matcher.flush(writer)
+	return count, matcher.matched, err
+}
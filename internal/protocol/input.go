@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/validation"
+)
+
+// InputConfig задает обработку исходных записей id_1 \t ... \t id_k \t user_id на шаге 1
+type InputConfig struct {
+	// IDTypes - типы идентификаторов в колонках из реестра validation, по умолчанию
+	// одна колонка phone. Тип входит в хеш идентификатора начиная с ProtocolV3
+	IDTypes []string
+	// Normalize приводит идентификатор к канонической форме его типа перед проверкой.
+	// Если не задана, идентификатор уже должен быть в канонической форме
+	Normalize func(idType validation.IDType, id string) (string, error)
+	// Reject получает невалидные строки. Если не задана,
+	// обработка останавливается на первой из них
+	Reject RejectFunc
+	// UserID, если задана, проверяет последнее поле записи.
+	// В режиме sum в нем вместо user_id передается значение
+	UserID func(userID string) error
+	// Duplicates - политика для идентификаторов, повторяющихся в нескольких
+	// строках. Если не задана, повторы не ищутся и остаются все вхождения
+	Duplicates DuplicatePolicy
+	// DuplicateReport, если задан, заполняется отчетом о повторах
+	DuplicateReport *DuplicateReport
+}
+
+// LookupIDTypes находит типы колонок и проверяет, что версия протокола их
+// поддерживает: до ProtocolV3 тип не входит в хеш и разрешена одна колонка phone.
+// Пустой список означает одну колонку phone
+func LookupIDTypes(names []string, version crypto.ProtocolVersion) ([]validation.IDType, error) {
+	if len(names) == 0 {
+		names = []string{validation.IDTypePhone}
+	}
+
+	columns := make([]validation.IDType, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		idType, err := validation.LookupIDType(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[idType.Name] {
+			return nil, fmt.Errorf("тип идентификатора %s указан дважды", idType.Name)
+		}
+		seen[idType.Name] = true
+		columns = append(columns, idType)
+	}
+
+	if (len(columns) > 1 || columns[0].Name != validation.IDTypePhone) && !version.DomainSeparated() {
+		return nil, fmt.Errorf("%w: типы идентификаторов %v требуют версию протокола %d или новее",
+			crypto.ErrUnsupportedVersion, names, crypto.ProtocolV3)
+	}
+	return columns, nil
+}
+
+// parseRecord проверяет запись и возвращает идентификаторы по колонкам для хеширования.
+// При нескольких колонках пустое значение означает, что идентификатора этого типа
+// нет, но хотя бы один должен быть. Проверка выполняется при чтении, а не в пуле,
+// чтобы строки отклонялись в порядке файла
+func (c InputConfig) parseRecord(columns []validation.IDType, row int, record []string) ([]string, *RowError) {
+	if len(record) != len(columns)+1 {
+		return nil, &RowError{Row: row, Err: fmt.Errorf("%w: ожидается %d поля, получено %d", ErrInvalidRecord, len(columns)+1, len(record))}
+	}
+
+	ids := make([]string, len(columns))
+	present := 0
+	for j, idType := range columns {
+		id := record[j]
+		if id == "" && len(columns) > 1 {
+			continue
+		}
+
+		if c.Normalize != nil {
+			normalized, err := c.Normalize(idType, id)
+			if err != nil {
+				return nil, &RowError{Row: row, Err: err}
+			}
+			id = normalized
+		}
+
+		if err := idType.Validate(id); err != nil {
+			return nil, &RowError{Row: row, Err: err}
+		}
+		ids[j] = id
+		present++
+	}
+
+	if present == 0 {
+		return nil, &RowError{Row: row, Err: validation.ErrEmptyID}
+	}
+
+	if c.UserID != nil {
+		if err := c.UserID(record[len(columns)]); err != nil {
+			return nil, &RowError{Row: row, Err: err}
+		}
+	}
+	return ids, nil
+}
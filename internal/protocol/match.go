@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/validation"
+)
+
+// idIndex кодирует строку и колонку идентификатора в индекс шага 1.
+// При одной колонке индекс совпадает с номером строки, как в прежних версиях
+func idIndex(row, column, columns int) int {
+	return row*columns + column
+}
+
+// parseIDIndex раскладывает индекс шага 1 на строку и колонку.
+// ok = false для индексов, которые шаг 1 не мог выдать
+func parseIDIndex(index string, columns int) (row, column int, ok bool) {
+	n, err := strconv.Atoi(index)
+	if err != nil || n < 0 || strconv.Itoa(n) != index {
+		return 0, 0, false
+	}
+	return n / columns, n % columns, true
+}
+
+// Matcher выбирает для строки alice одно совпадение, если строка совпала
+// по нескольким идентификаторам: побеждает тип с наивысшим приоритетом.
+// При одной колонке записи пишутся сразу в формате a_user_id \t b_user_id,
+// при нескольких - после обработки всех записей строки в формате
+// a_user_id \t b_user_id \t тип идентификатора. Строки без совпадения
+// пишутся с пустыми b_user_id и типом, если их оставляет режим вывода
+type Matcher struct {
+	idTypes []string
+	output  OutputMode
+	// rank[column] - позиция типа колонки в порядке приоритета
+	rank    []int
+	pending map[int]candidate
+	matched int
+	// MatchedBy - число совпавших строк по типу идентификатора, давшего совпадение
+	MatchedBy map[string]int
+}
+
+// candidate - выбранное совпадение строки. Пустой bUserIDs означает,
+// что у строки пока нет совпадений
+type candidate struct {
+	column   int
+	aUserID  string
+	bUserIDs []string
+}
+
+// NewMatcher создает Matcher для колонок idTypes (пустой список - одна колонка phone).
+// priority задает порядок типов, по умолчанию порядок колонок. Типы, которых
+// нет в priority, идут после перечисленных в порядке колонок. output задает,
+// какие строки пишутся, по умолчанию только совпавшие
+func NewMatcher(idTypes, priority []string, output OutputMode) (*Matcher, error) {
+	if output == "" {
+		output = OutputMatched
+	}
+
+	if len(idTypes) == 0 {
+		idTypes = []string{validation.IDTypePhone}
+	}
+
+	for _, name := range priority {
+		if !slices.Contains(idTypes, name) {
+			return nil, fmt.Errorf("тип %q из порядка приоритета отсутствует среди типов идентификаторов %v", name, idTypes)
+		}
+	}
+
+	rank := make([]int, len(idTypes))
+	for column, name := range idTypes {
+		if i := slices.Index(priority, name); i >= 0 {
+			rank[column] = i
+		} else {
+			rank[column] = len(priority) + column
+		}
+	}
+
+	return &Matcher{
+		idTypes:   idTypes,
+		output:    output,
+		rank:      rank,
+		pending:   make(map[int]candidate),
+		MatchedBy: make(map[string]int),
+	}, nil
+}
+
+func orSingleMatcher(m *Matcher) *Matcher {
+	if m != nil {
+		return m
+	}
+	m, _ = NewMatcher(nil, nil, OutputMatched)
+	return m
+}
+
+func (m *Matcher) multi() bool {
+	return len(m.idTypes) > 1
+}
+
+// add учитывает запись маппинга index \t a_user_id, совпавшую с b_user_id.
+// Если идентификатор есть в нескольких строках bob, пишется запись на каждый b_user_id
+func (m *Matcher) add(writer io.RecordWriter, index, aUserID string, bUserIDs ...string) error {
+	row, column, ok := parseIDIndex(index, len(m.idTypes))
+	if !m.multi() {
+		m.matched++
+		m.MatchedBy[m.idTypes[0]]++
+		if !m.output.writes(true) {
+			return nil
+		}
+		for _, bUserID := range bUserIDs {
+			if err := writer.Write([]string{aUserID, bUserID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("%w маппинга: некорректный индекс %q", ErrInvalidRecord, index)
+	}
+
+	if current, found := m.pending[row]; found && len(current.bUserIDs) > 0 && m.rank[current.column] <= m.rank[column] {
+		return nil
+	}
+	m.pending[row] = candidate{column: column, aUserID: aUserID, bUserIDs: bUserIDs}
+	return nil
+}
+
+// miss учитывает запись маппинга index \t a_user_id без совпадения. При
+// нескольких колонках строка пишется без совпадения, только если ни один
+// ее идентификатор не совпал
+func (m *Matcher) miss(writer io.RecordWriter, index, aUserID string) error {
+	if !m.output.writes(false) {
+		return nil
+	}
+	if !m.multi() {
+		return writer.Write([]string{aUserID, ""})
+	}
+
+	row, _, ok := parseIDIndex(index, len(m.idTypes))
+	if !ok {
+		return fmt.Errorf("%w маппинга: некорректный индекс %q", ErrInvalidRecord, index)
+	}
+	if _, found := m.pending[row]; !found {
+		m.pending[row] = candidate{aUserID: aUserID}
+	}
+	return nil
+}
+
+// flushBefore записывает выбранные совпадения строк до row. Используется,
+// когда маппинг отсортирован по индексу и строки с меньшим номером уже не встретятся
+func (m *Matcher) flushBefore(writer io.RecordWriter, index string) error {
+	if !m.multi() || len(m.pending) == 0 {
+		return nil
+	}
+
+	row, _, ok := parseIDIndex(index, len(m.idTypes))
+	if !ok {
+		return nil
+	}
+	return m.write(writer, func(r int) bool { return r < row })
+}
+
+// flush записывает все оставшиеся совпадения в порядке строк
+func (m *Matcher) flush(writer io.RecordWriter) error {
+	return m.write(writer, func(int) bool { return true })
+}
+
+func (m *Matcher) write(writer io.RecordWriter, ready func(row int) bool) error {
+	rows := make([]int, 0, len(m.pending))
+	for row := range m.pending {
+		if ready(row) {
+			rows = append(rows, row)
+		}
+	}
+	slices.Sort(rows)
+
+	for _, row := range rows {
+		c := m.pending[row]
+		delete(m.pending, row)
+
+		if len(c.bUserIDs) == 0 {
+			if err := writer.Write([]string{c.aUserID, "", ""}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		idType := m.idTypes[c.column]
+		m.matched++
+		m.MatchedBy[idType]++
+		if !m.output.writes(true) {
+			continue
+		}
+		for _, bUserID := range c.bUserIDs {
+			if err := writer.Write([]string{c.aUserID, bUserID, idType}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
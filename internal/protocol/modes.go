@@ -0,0 +1,8 @@
+package protocol
+
+const (
+	ModeStandard    = "standard"
+	ModeLabeled     = "labeled"
+	ModeCardinality = "cardinality"
+	ModeSum         = "sum"
+)
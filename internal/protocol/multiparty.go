@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// Протокол для трех и более сторон. Все стороны хешируют данные общим ключом K
+// и шифруют своим ключом ECDH. Набор каждой стороны проходит по кольцу через
+// все остальные стороны, каждая применяет к нему свой ключ. Благодаря
+// коммутативности ECDH наборы, прошедшие все ключи, сравниваются напрямую.
+//
+// Пересечение вычисляет назначенный получатель: его набор передается с индексами,
+// чтобы сопоставить результат с приватным маппингом, наборы остальных сторон -
+// без индексов в случайном порядке, как в режиме cardinality.
+//
+// Наборы остальных сторон получатель получает по отдельности, поэтому он узнает
+// пересечение своего набора с любым подмножеством из них и пересечения их между
+// собой, а не только пересечение всех наборов
+
+// peekReader возвращает прочитанную заранее запись перед остальными
+type peekReader struct {
+	first  []string
+	reader io.RecordReader
+}
+
+func (r *peekReader) Read() ([]string, error) {
+	if r.first != nil {
+		record := r.first
+		r.first = nil
+		return record, nil
+	}
+	return r.reader.Read()
+}
+
+// ProcessPartyReencrypt применяет ключ стороны к набору другой стороны.
+// Набор получателя index \t point сохраняет индексы, наборы остальных сторон
+// point перемешиваются заново, чтобы следующая сторона не связала записи
+// с записями предыдущего шага. Возвращает число записей
+func ProcessPartyReencrypt(reader io.RecordReader, writer io.RecordWriter, key *crypto.ECDHKey, encoding crypto.PointEncoding, config ExternalConfig, batchSize int) (int, error) {
+	first, err := reader.Read()
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	reader = &peekReader{first: first, reader: reader}
+
+	if len(first) != 1 {
+		return applyECDHKey(reader, writer, key, encoding, batchSize)
+	}
+
+	shuffler := newPointShuffler(config)
+	count, err := applyECDHKey(unindexedReader{reader}, shuffler, key, encoding, batchSize)
+	if err != nil {
+		shuffler.close()
+		return count, err
+	}
+	return count, shuffler.writeTo(writer)
+}
+
+// ProcessPartyIntersect находит записи получателя, которые есть во всех наборах
+// остальных сторон. own - набор получателя index \t point, прошедший все ключи,
+// mapping - его приватный маппинг index \t user_id, others - наборы остальных
+// сторон, прошедшие все ключи. В writer пишется user_id совпавших строк, строка
+// с несколькими совпавшими идентификаторами пишется один раз. columns - число
+// колонок идентификаторов. Возвращает число записей own и совпавших строк.
+// Пишется только пересечение всех наборов, но по тем же others получатель
+// может вычислить и любое попарное
+func ProcessPartyIntersect(own, mapping io.RecordReader, others []io.RecordReader, writer io.RecordWriter, columns int) (int, int, error) {
+	if len(others) == 0 {
+		return 0, 0, fmt.Errorf("нужен хотя бы один набор другой стороны")
+	}
+
+	// В памяти хранится не больше первого набора: следующие только сужают его
+	common, err := LoadPointSet(others[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("набор стороны 1: %w", err)
+	}
+	for i, other := range others[1:] {
+		common, err = filterPointSet(other, common)
+		if err != nil {
+			return 0, 0, fmt.Errorf("набор стороны %d: %w", i+2, err)
+		}
+	}
+
+	rows := make(map[int]bool)
+	count := 0
+	for {
+		record, err := own.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, 0, err
+		}
+		if len(record) != 2 {
+			return count, 0, fmt.Errorf("%w: в наборе получателя ожидается 2 поля, получено %d", ErrModeMismatch, len(record))
+		}
+		count++
+
+		point, err := crypto.EncodePoint(record[1], crypto.PointUncompressed)
+		if err != nil {
+			return count, 0, err
+		}
+		if _, found := common[point]; !found {
+			continue
+		}
+
+		row, _, ok := parseIDIndex(record[0], columns)
+		if !ok {
+			return count, 0, fmt.Errorf("%w: некорректный индекс %q", ErrInvalidRecord, record[0])
+		}
+		rows[row] = false
+	}
+
+	matched := 0
+	for {
+		record, err := mapping.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, matched, err
+		}
+
+		index, userID, err := parseBobMappingRecord(record)
+		if err != nil {
+			return count, matched, err
+		}
+
+		row, _, _ := parseIDIndex(index, columns)
+		if written, found := rows[row]; !found || written {
+			continue
+		}
+		rows[row] = true
+		matched++
+
+		if err := writer.Write([]string{userID}); err != nil {
+			return count, matched, err
+		}
+	}
+
+	return count, matched, nil
+}
+
+// filterPointSet оставляет точки set, которые есть среди точек reader
+func filterPointSet(reader io.RecordReader, set map[string]struct{}) (map[string]struct{}, error) {
+	result := make(map[string]struct{})
+	reader = unindexedReader{reader}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		point, err := crypto.EncodePoint(record[1], crypto.PointUncompressed)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := set[point]; found {
+			result[point] = struct{}{}
+		}
+	}
+
+	return result, nil
+}
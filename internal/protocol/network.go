@@ -0,0 +1,333 @@
+package protocol
+
+import (
+	"fmt"
+	goio "io"
+	"os"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/transport"
+)
+
+// Имена потоков сетевого режима в порядке их передачи
+const (
+	streamHMACKey        = "bob_hmac_key"
+	streamMode           = "mode"
+	streamBobEncrypted   = "bob_encrypted"
+	streamBobEncryptedA  = "bob_encrypted_a"
+	streamAliceEncrypted = "alice_encrypted"
+	streamBobLabels      = "bob_labels"
+	streamBobFinal       = "bob_final"
+)
+
+// RunBobNetwork выполняет bob-step1 и bob-step2 через transport.
+// openInput открывает файл id \t b_user_id. Типы колонок идентификаторов
+// idTypes передаются alice вместе с ключом K.
+// Возвращает количество зашифрованных записей bob
+func RunBobNetwork(tr transport.Transport, openInput func() (io.RecordReadCloser, error), version crypto.ProtocolVersion, idTypes []string, mode string, batchSize int) (int, error) {
+	count, err := runBobNetwork(tr, openInput, version, idTypes, mode, batchSize)
+	if err != nil {
+		tr.Fail(err)
+	}
+	return count, err
+}
+
+func runBobNetwork(tr transport.Transport, openInput func() (io.RecordReadCloser, error), version crypto.ProtocolVersion, idTypes []string, mode string, batchSize int) (int, error) {
+	keyK, err := crypto.GenerateHMACKey()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка генерации HMAC ключа: %w", err)
+	}
+
+	keyB, err := crypto.GenerateECDHKey()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка генерации ECDH ключа: %w", err)
+	}
+
+	if err := sendBytes(tr, streamHMACKey, crypto.EncodeHMACKey(crypto.HMACKeyFile{Key: keyK, Version: version, IDTypes: idTypes})); err != nil {
+		return 0, err
+	}
+	if err := sendBytes(tr, streamMode, []byte(mode)); err != nil {
+		return 0, err
+	}
+
+	// Ответ alice читается параллельно с отправкой, иначе при заполнении
+	// буферов соединения обе стороны заблокируются на записи
+	type bobEncResult struct {
+		data map[string][]string
+		err  error
+	}
+	bobEncCh := make(chan bobEncResult, 1)
+	go func() {
+		reader, err := receiveTSV(tr, streamBobEncryptedA)
+		if err != nil {
+			bobEncCh <- bobEncResult{err: err}
+			return
+		}
+		defer reader.Close()
+
+		data, err := LoadIndexedData(reader)
+		bobEncCh <- bobEncResult{data, err}
+	}()
+
+	input, err := openInput()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка открытия входного файла: %w", err)
+	}
+	defer input.Close()
+
+	writer, err := sendTSV(tr, streamBobEncrypted)
+	if err != nil {
+		return 0, err
+	}
+
+	// Маппинг index -> b_user_id нужен только для шага 2 и остается в памяти
+	mapping := make(map[string]string)
+	mappingWriter := recordWriterFunc(func(record []string) error {
+		mapping[record[0]] = record[1]
+		return nil
+	})
+
+	count, _, err := ProcessBobStep1(input, writer, mappingWriter, keyK, keyB, version, crypto.PointUncompressed, InputConfig{IDTypes: idTypes}, ExternalConfig{}, Padding{}, batchSize)
+	if err != nil {
+		return count, err
+	}
+	if err := writer.Close(); err != nil {
+		return count, err
+	}
+
+	bobEnc := <-bobEncCh
+	if bobEnc.err != nil {
+		return count, fmt.Errorf("ошибка загрузки H(phone_b)^B^A: %w", bobEnc.err)
+	}
+
+	aliceReader, err := receiveTSV(tr, streamAliceEncrypted)
+	if err != nil {
+		return count, err
+	}
+	defer aliceReader.Close()
+
+	// Одноразовый ключ меток C: без него alice открыла бы метки по точкам
+	// H(phone_b)^B^A, которые сама вычислила на шаге 1
+	var keyBC *crypto.ECDHKey
+	if mode == ModeLabeled {
+		keyC, err := crypto.GenerateECDHKey()
+		if err != nil {
+			return count, fmt.Errorf("ошибка генерации ключа меток: %w", err)
+		}
+		keyBC, err = crypto.MultiplyKeys(keyB, keyC)
+		if err != nil {
+			return count, fmt.Errorf("ошибка генерации ключа меток: %w", err)
+		}
+
+		labelsWriter, err := sendTSV(tr, streamBobLabels)
+		if err != nil {
+			return count, err
+		}
+		if _, err := WriteBobLabels(labelsWriter, bobEnc.data, mapping, keyC, batchSize); err != nil {
+			return count, err
+		}
+		if err := labelsWriter.Close(); err != nil {
+			return count, err
+		}
+	}
+
+	finalWriter, err := sendTSV(tr, streamBobFinal)
+	if err != nil {
+		return count, err
+	}
+
+	if mode == ModeLabeled {
+		_, err = ProcessBobStep2Labeled(aliceReader, finalWriter, keyBC, crypto.PointUncompressed, batchSize)
+	} else {
+		_, _, err = ProcessBobStep2(aliceReader, finalWriter, keyB, bobEnc.data, mapping, crypto.PointUncompressed, OutputAll, batchSize)
+	}
+	if err != nil {
+		return count, err
+	}
+
+	return count, finalWriter.Close()
+}
+
+// RunAliceNetwork выполняет alice-step1 и alice-step2 через transport.
+// Маппинг index <-> a_user_id хранится во временном файле в tempDir.
+// priority - порядок типов идентификаторов при выборе совпадения строки.
+// Версию протокола выбирает bob, alice отказывается от версий ниже minVersion
+func RunAliceNetwork(tr transport.Transport, input io.RecordReader, output io.RecordWriter, mode string, minVersion crypto.ProtocolVersion, priority []string, tempDir string, batchSize int) (int, int, error) {
+	count, matched, err := runAliceNetwork(tr, input, output, mode, minVersion, priority, tempDir, batchSize)
+	if err != nil {
+		tr.Fail(err)
+	}
+	return count, matched, err
+}
+
+func runAliceNetwork(tr transport.Transport, input io.RecordReader, output io.RecordWriter, mode string, minVersion crypto.ProtocolVersion, priority []string, tempDir string, batchSize int) (int, int, error) {
+	keyData, err := receiveBytes(tr, streamHMACKey)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	key, err := crypto.DecodeHMACKey(keyData)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Иначе bob мог бы незаметно перевести alice на устаревший g^HMAC
+	if key.Version < minVersion {
+		return 0, 0, fmt.Errorf("%w: bob предлагает версию %d, минимальная допустимая %d", crypto.ErrUnsupportedVersion, key.Version, minVersion)
+	}
+
+	matcher, err := NewMatcher(key.IDTypes, priority, OutputMatched)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	peerMode, err := receiveBytes(tr, streamMode)
+	if err != nil {
+		return 0, 0, err
+	}
+	if string(peerMode) != mode {
+		return 0, 0, fmt.Errorf("%w: у bob %q, у alice %q", ErrModeMismatch, peerMode, mode)
+	}
+
+	keyA, err := crypto.GenerateECDHKey()
+	if err != nil {
+		return 0, 0, fmt.Errorf("ошибка генерации ECDH ключа A: %w", err)
+	}
+
+	bobReader, err := receiveTSV(tr, streamBobEncrypted)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer bobReader.Close()
+
+	bobWriter, err := sendTSV(tr, streamBobEncryptedA)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := ProcessBobDataStep1(bobReader, bobWriter, keyA, crypto.PointUncompressed, batchSize); err != nil {
+		return 0, 0, err
+	}
+	if err := bobWriter.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	type bobFinalResult struct {
+		data   map[string]BobRecord
+		labels map[string]string
+		err    error
+	}
+	bobFinalCh := make(chan bobFinalResult, 1)
+	go func() {
+		var result bobFinalResult
+		if mode == ModeLabeled {
+			result.labels, result.err = receiveLabels(tr)
+			if result.err != nil {
+				bobFinalCh <- result
+				return
+			}
+		}
+
+		reader, err := receiveTSV(tr, streamBobFinal)
+		if err != nil {
+			result.err = err
+			bobFinalCh <- result
+			return
+		}
+		defer reader.Close()
+
+		result.data, result.err = LoadBobFinalData(reader)
+		bobFinalCh <- result
+	}()
+
+	mappingFile, err := os.CreateTemp(tempDir, "alice_mapping-*.tsv.gz")
+	if err != nil {
+		return 0, 0, err
+	}
+	mappingFile.Close()
+	defer os.Remove(mappingFile.Name())
+
+	mappingWriter, err := io.CreateTSVFile(mappingFile.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer mappingWriter.Close()
+
+	aliceWriter, err := sendTSV(tr, streamAliceEncrypted)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, _, err := ProcessAliceDataStep1(input, aliceWriter, mappingWriter, key.Key, keyA, key.Version, crypto.PointUncompressed, InputConfig{IDTypes: key.IDTypes}, ExternalConfig{TempDir: tempDir}, Padding{}, batchSize); err != nil {
+		return 0, 0, err
+	}
+	if err := aliceWriter.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err := mappingWriter.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	bobFinal := <-bobFinalCh
+	if bobFinal.err != nil {
+		return 0, 0, fmt.Errorf("ошибка загрузки данных от bob: %w", bobFinal.err)
+	}
+
+	mappingReader, err := io.OpenTSVFile(mappingFile.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer mappingReader.Close()
+
+	if mode == ModeLabeled {
+		return ProcessAliceStep2Labeled(mappingReader, output, bobFinal.data, bobFinal.labels, matcher)
+	}
+	return ProcessAliceStep2(mappingReader, output, bobFinal.data, matcher)
+}
+
+func receiveLabels(tr transport.Transport) (map[string]string, error) {
+	reader, err := receiveTSV(tr, streamBobLabels)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return LoadBobLabels(reader)
+}
+
+func sendTSV(tr transport.Transport, name string) (*io.TSVWriter, error) {
+	stream, err := tr.Send(name)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия потока %s: %w", name, err)
+	}
+	return io.CreateTSVStream(stream), nil
+}
+
+func receiveTSV(tr transport.Transport, name string) (*io.TSVReader, error) {
+	stream, err := tr.Receive(name)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения потока %s: %w", name, err)
+	}
+	return io.OpenTSVStream(stream)
+}
+
+func sendBytes(tr transport.Transport, name string, data []byte) error {
+	stream, err := tr.Send(name)
+	if err != nil {
+		return fmt.Errorf("ошибка открытия потока %s: %w", name, err)
+	}
+	if _, err := stream.Write(data); err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+func receiveBytes(tr transport.Transport, name string) ([]byte, error) {
+	stream, err := tr.Receive(name)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения потока %s: %w", name, err)
+	}
+	defer stream.Close()
+
+	return goio.ReadAll(stream)
+}
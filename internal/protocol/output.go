@@ -0,0 +1,54 @@
+package protocol
+
+import "fmt"
+
+// OutputMode задает, какие записи шага 2 попадают в результат. Пустое значение
+// означает поведение по умолчанию стороны: bob пишет все записи alice,
+// alice - только совпавшие
+type OutputMode string
+
+const (
+	// OutputMatched оставляет только совпавшие записи
+	OutputMatched OutputMode = "matched"
+	// OutputAll оставляет все записи, у несовпавших b_user_id пустой
+	OutputAll OutputMode = "all"
+	// OutputUnmatched оставляет только записи без совпадения с пустым b_user_id
+	OutputUnmatched OutputMode = "unmatched"
+)
+
+// ParseOutputMode проверяет название режима вывода
+func ParseOutputMode(name string) (OutputMode, error) {
+	switch mode := OutputMode(name); mode {
+	case "", OutputMatched, OutputAll, OutputUnmatched:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("неизвестный режим вывода %q, допустимы %s, %s и %s", name, OutputMatched, OutputAll, OutputUnmatched)
+	}
+}
+
+// ValidateBob проверяет режим вывода шага 2 bob. По bob_final alice находит
+// совпадения, поэтому bob не может оставить только несовпавшие записи, а в
+// режиме labeled совпадения ему неизвестны и он пишет все записи
+func (m OutputMode) ValidateBob(labeled bool) error {
+	switch {
+	case m == OutputUnmatched:
+		return fmt.Errorf("режим вывода %s доступен только alice: без совпавших записей bob_final alice не найдет пересечение", m)
+	case m == OutputMatched && labeled:
+		return fmt.Errorf("режим вывода %s недоступен bob в режиме labeled: совпадения находит alice", m)
+	}
+	return nil
+}
+
+// writes сообщает, пишется ли запись с совпадением matched. Пустой режим
+// пишет все записи, как bob по умолчанию
+func (m OutputMode) writes(matched bool) bool {
+	switch m {
+	case OutputAll:
+		return true
+	case OutputUnmatched:
+		return !matched
+	case OutputMatched:
+		return matched
+	}
+	return true
+}
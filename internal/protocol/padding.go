@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+)
+
+// Padding дополняет передаваемый файл шага 1 фиктивными записями со случайными
+// точками кривой, чтобы число записей не выдавало размер множества. Фиктивные
+// записи не попадают в приватный маппинг, поэтому шаг 2 их не сопоставляет,
+// а совпасть с чужой точкой случайная точка может лишь с пренебрежимо малой
+// вероятностью
+type Padding struct {
+	// To - минимальное число передаваемых записей
+	To int
+	// Bucket округляет число передаваемых записей вверх до кратного
+	Bucket int
+}
+
+func (p Padding) validate() error {
+	if p.To < 0 || p.Bucket < 0 {
+		return fmt.Errorf("размер дополнения не может быть отрицательным: до %d, кратно %d", p.To, p.Bucket)
+	}
+	return nil
+}
+
+// dummies возвращает число фиктивных записей для records настоящих
+func (p Padding) dummies(records int) int {
+	target := records
+	if p.Bucket > 0 {
+		target = (records + p.Bucket - 1) / p.Bucket * p.Bucket
+	}
+	target = max(target, p.To)
+	return target - records
+}
+
+// dummyLabel шифрует метку фиктивной записи. Длина совпадает с длиной
+// настоящего b_user_id, чтобы метки не различались по размеру
+func dummyLabel(point string, length int) (string, error) {
+	return crypto.EncryptLabel(point, string(make([]byte, length)))
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/extsort"
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// rowPermutation переставляет строки входных данных шага 1 случайным образом
+// и нумерует их заново, чтобы порядок и индексы передаваемых файлов не выдавали
+// порядок исходного файла. Идентификаторы строки получают индексы
+// idIndex(новая строка, колонка) и остаются соседними.
+//
+// Каждой строке выдается случайный ключ, записи сортируются по ключу в памяти
+// или, при MemoryLimit > 0, на диске. Перестановка известна только владельцу
+// данных: передаваемый файл получает index \t point, приватный маппинг -
+// index \t user_id, по которому шаг 2 сопоставляет результат.
+// Фиктивные записи дополнения переставляются вместе с настоящими
+// и в маппинг не пишутся
+type rowPermutation struct {
+	keys       *crypto.SortKeys
+	sorter     *extsort.Sorter
+	columns    int
+	records    int
+	duplicates *duplicates
+}
+
+func newRowPermutation(columns int, config ExternalConfig) (*rowPermutation, error) {
+	keys, err := crypto.NewSortKeys()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка генерации перестановки: %w", err)
+	}
+
+	memoryLimit := int64(math.MaxInt64)
+	if config.MemoryLimit > 0 {
+		memoryLimit = max(config.MemoryLimit/4, 1)
+	}
+
+	return &rowPermutation{
+		keys:    keys,
+		sorter:  extsort.New(config.TempDir, memoryLimit, byRowKey),
+		columns: columns,
+	}, nil
+}
+
+// byRowKey упорядочивает записи key \t column \t point [\t user_id] по ключу строки, затем по колонке
+func byRowKey(a, b []string) int {
+	if c := cmp.Compare(a[0], b[0]); c != 0 {
+		return c
+	}
+	return compareIndex(a[1], b[1])
+}
+
+// rowKey выдает ключ для очередной строки. Вызывается при чтении строк
+// из одной горутины
+func (p *rowPermutation) rowKey() string {
+	return p.keys.Next()
+}
+
+func (p *rowPermutation) add(key string, column int, point, userID string) error {
+	p.records++
+	return p.sorter.Write([]string{key, strconv.Itoa(column), point, userID})
+}
+
+// dropDuplicates находит повторы идентификаторов и исключает из перестановки
+// вхождения, отброшенные политикой. Вызывается после добавления всех строк
+func (p *rowPermutation) dropDuplicates(dups *duplicates, report *DuplicateReport) error {
+	if err := dups.resolve(report); err != nil {
+		return err
+	}
+	p.duplicates = dups
+	p.records -= dups.droppedCount()
+	return nil
+}
+
+// pad добавляет фиктивные записи после всех настоящих. Фиктивные строки
+// заполняют колонки так же, как строки со всеми идентификаторами.
+// Возвращает число добавленных записей
+func (p *rowPermutation) pad(padding Padding, encoding crypto.PointEncoding) (int, error) {
+	dummies := padding.dummies(p.records)
+	for added := 0; added < dummies; {
+		key := p.keys.Next()
+		for column := 0; column < p.columns && added < dummies; column++ {
+			point, err := crypto.RandomPoint(encoding)
+			if err != nil {
+				return added, fmt.Errorf("ошибка генерации фиктивной записи: %w", err)
+			}
+			if err := p.sorter.Write([]string{key, strconv.Itoa(column), point}); err != nil {
+				return added, err
+			}
+			added++
+		}
+	}
+	return dummies, nil
+}
+
+func (p *rowPermutation) close() {
+	p.sorter.Close()
+}
+
+// writeTo пишет записи в порядке перестановки: index \t point в writer
+// и, кроме фиктивных, index \t user_id в mapping
+func (p *rowPermutation) writeTo(writer, mapping io.RecordWriter) error {
+	sorted, err := p.sorter.Sort()
+	if err != nil {
+		return err
+	}
+	defer sorted.Close()
+
+	row := -1
+	var prevKey string
+	for {
+		record, err := sorted.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		column, err := strconv.Atoi(record[1])
+		if err != nil {
+			return err
+		}
+		// Отброшенные повторы не получают индекс, чтобы в нумерации не было пропусков
+		if p.duplicates.skip(record[0], column) {
+			continue
+		}
+
+		if row < 0 || record[0] != prevKey {
+			row++
+			prevKey = record[0]
+		}
+		index := strconv.Itoa(idIndex(row, column, p.columns))
+
+		if err := writer.Write([]string{index, record[2]}); err != nil {
+			return err
+		}
+		if len(record) < 4 {
+			continue
+		}
+		if err := mapping.Write([]string{index, record[3]}); err != nil {
+			return err
+		}
+	}
+}
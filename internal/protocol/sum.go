@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// Режим sum продолжает режим cardinality: alice передает вместе с каждой точкой
+// значение, зашифрованное ее открытым ключом ElGamal. Bob складывает значения
+// совпавших записей и возвращает один шифротекст: alice узнает только сумму,
+// bob - только размер пересечения
+
+// ParseSumValue разбирает значение записи alice: неотрицательное целое,
+// например сумму покупок в копейках
+func ParseSumValue(value string) (uint64, error) {
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q: ожидается неотрицательное целое", ErrInvalidValue, value)
+	}
+	return v, nil
+}
+
+// sumReader читает записи point \t Enc(value) режима sum как записи index \t point:
+// шифротекст передается в поле индекса, которое applyECDHKey сохраняет без изменений
+type sumReader struct {
+	reader io.RecordReader
+}
+
+func (r sumReader) Read() ([]string, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(record) != 2 {
+		return nil, fmt.Errorf("%w: в режиме sum ожидается 2 поля, получено %d", ErrModeMismatch, len(record))
+	}
+	if _, _, ok := parseIDIndex(record[0], 1); ok {
+		return nil, fmt.Errorf("%w: в режиме sum записи передаются без индексов", ErrModeMismatch)
+	}
+	return []string{record[1], record[0]}, nil
+}
+
+// ProcessAliceDataStep1Sum - вариант ProcessAliceDataStep1Cardinality для режима
+// sum: последнее поле входных записей - значение, в writer пишутся
+// H(id_a)^A \t Enc(value) без индексов в случайном порядке
+func ProcessAliceDataStep1Sum(reader io.RecordReader, writer io.RecordWriter, keyK []byte, keyA *crypto.ECDHKey, sumKey *crypto.ElGamalPublicKey, version crypto.ProtocolVersion, encoding crypto.PointEncoding, input InputConfig, config ExternalConfig, padding Padding, batchSize int) (int, int, error) {
+	if err := padding.validate(); err != nil {
+		return 0, 0, err
+	}
+
+	input.UserID = func(value string) error {
+		_, err := ParseSumValue(value)
+		return err
+	}
+
+	encryptValue := func(value string) (string, error) {
+		v, err := ParseSumValue(value)
+		if err != nil {
+			return "", err
+		}
+		return sumKey.Encrypt(v)
+	}
+
+	shuffler, dups, err := newRowShuffler(input, version, config)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dups.close()
+
+	records := 0
+	count, err := encryptAliceData(reader, keyK, keyA, version, encoding, input, batchSize, shuffler.rowKey(), dups, encryptValue, func(result aliceDataResult) error {
+		records++
+		return shuffler.add(shuffler.keyed(result.rowKey, result.encrypted, result.aUserId))
+	})
+	if err == nil {
+		records, err = shuffler.dropDuplicates(records, input.DuplicateReport)
+	}
+	if err != nil {
+		shuffler.close()
+		return count, 0, err
+	}
+
+	// Фиктивные записи несут шифротекст нуля и не отличаются от настоящих
+	padded, err := shuffler.pad(padding, records, func() ([]string, error) {
+		point, err := crypto.RandomPoint(encoding)
+		if err != nil {
+			return nil, err
+		}
+		value, err := sumKey.Encrypt(0)
+		if err != nil {
+			return nil, err
+		}
+		return []string{point, value}, nil
+	})
+	if err != nil {
+		shuffler.close()
+		return count, 0, err
+	}
+	return count, padded, shuffler.writeTo(writer)
+}
+
+// ProcessBobStep2Sum вычисляет H(phone_a)^A^B и складывает значения записей alice,
+// точки которых есть среди bobPoints. Возвращает число записей alice, размер
+// пересечения и сумму, перешифрованную открытым ключом alice sumKey
+func ProcessBobStep2Sum(reader io.RecordReader, keyB *crypto.ECDHKey, sumKey *crypto.ElGamalPublicKey, bobPoints map[string]struct{}, batchSize int) (int, int, string, error) {
+	sum := crypto.NewElGamalSum()
+	count, matched, err := matchPoints(sumReader{reader}, keyB, bobPoints, batchSize, func(record []string) error {
+		return sum.Add(record[0])
+	})
+	if err != nil {
+		return count, matched, "", err
+	}
+
+	ciphertext, err := sum.Ciphertext(sumKey)
+	return count, matched, ciphertext, err
+}
+
+// ProcessBobStep2SumExternal - вариант ProcessBobStep2Sum, который вместо
+// множества сортирует точки обеих сторон на диске и сливает их
+func ProcessBobStep2SumExternal(reader io.RecordReader, bobEncrypted io.RecordReader, keyB *crypto.ECDHKey, sumKey *crypto.ElGamalPublicKey, config ExternalConfig, batchSize int) (int, int, string, error) {
+	sum := crypto.NewElGamalSum()
+	count, matched, err := matchPointsExternal(sumReader{reader}, bobEncrypted, keyB, config, batchSize, func(record []string) error {
+		return sum.Add(record[0])
+	})
+	if err != nil {
+		return count, matched, "", err
+	}
+
+	ciphertext, err := sum.Ciphertext(sumKey)
+	return count, matched, ciphertext, err
+}
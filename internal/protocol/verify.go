@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+)
+
+// В проверяемом режиме сторона, которая применяет свой ключ к точкам другой
+// стороны, прикладывает к результату доказательства DLEQ. Другая сторона
+// проверяет их в начале следующего шага: подмена точек или разные ключи
+// для разных строк обнаруживаются до вычисления пересечения
+
+// DLEQBatchSize - число записей в одном доказательстве. Доказательство занимает
+// 64 байта, проверка батча - две операции на запись
+const DLEQBatchSize = 4096
+
+// ProveEncryption строит доказательства того, что точки output (index \t point ...)
+// получены из точек input с тем же индексом умножением на key. Доказываются
+// записи output в порядке файла
+func ProveEncryption(input, output io.RecordReader, key *crypto.ECDHKey) (crypto.DLEQProofs, error) {
+	proofs := crypto.DLEQProofs{PublicKey: key.PublicKey(), BatchSize: DLEQBatchSize}
+	err := encryptionPairs(input, output, DLEQBatchSize, false, func(inputs, outputs []string) error {
+		proof, err := crypto.ProveDLEQ(key, inputs, outputs)
+		if err != nil {
+			return err
+		}
+		proofs.Proofs = append(proofs.Proofs, proof)
+		return nil
+	})
+	return proofs, err
+}
+
+// VerifyEncryption проверяет доказательства ProveEncryption. complete требует,
+// чтобы в output была каждая запись input: так проверяется перешифрование всего
+// набора, а не только совпавших записей
+func VerifyEncryption(input, output io.RecordReader, proofs crypto.DLEQProofs, complete bool) error {
+	batch := 0
+	err := encryptionPairs(input, output, proofs.BatchSize, complete, func(inputs, outputs []string) error {
+		if batch >= len(proofs.Proofs) {
+			return fmt.Errorf("%w: нет доказательства для батча %d", crypto.ErrInvalidProof, batch+1)
+		}
+		if err := crypto.VerifyDLEQ(proofs.PublicKey, inputs, outputs, proofs.Proofs[batch]); err != nil {
+			return fmt.Errorf("батч %d (записи с %d): %w", batch+1, batch*proofs.BatchSize+1, err)
+		}
+		batch++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if batch != len(proofs.Proofs) {
+		return fmt.Errorf("%w: доказательств %d, батчей %d", crypto.ErrInvalidProof, len(proofs.Proofs), batch)
+	}
+	return nil
+}
+
+// encryptionPairs сопоставляет записи output с записями input по индексу
+// и передает пары точек в handle батчами по batchSize
+func encryptionPairs(input, output io.RecordReader, batchSize int, complete bool, handle func(inputs, outputs []string) error) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("%w: некорректный размер батча %d", crypto.ErrInvalidProof, batchSize)
+	}
+
+	points, err := loadPointsByIndex(input)
+	if err != nil {
+		return err
+	}
+
+	inputs := make([]string, 0, batchSize)
+	outputs := make([]string, 0, batchSize)
+	flush := func() error {
+		if len(inputs) == 0 {
+			return nil
+		}
+		err := handle(inputs, outputs)
+		inputs, outputs = inputs[:0], outputs[:0]
+		return err
+	}
+
+	var lastIndex, lastPoint string
+	for {
+		record, err := output.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 2 {
+			return fmt.Errorf("%w: ожидается не менее 2 полей, получено %d", ErrInvalidRecord, len(record))
+		}
+
+		// Запись с тем же индексом и точкой подряд - еще один b_user_id
+		// в bob_final, точка уже в батче
+		if record[0] == lastIndex && record[1] == lastPoint {
+			continue
+		}
+		lastIndex, lastPoint = record[0], record[1]
+
+		// Индекс удаляется, чтобы повтор записи в другом месте считался подменой
+		point, found := points[record[0]]
+		if !found {
+			return fmt.Errorf("%w: индекс %q отсутствует в исходном файле или повторяется", crypto.ErrInvalidProof, record[0])
+		}
+		delete(points, record[0])
+
+		inputs = append(inputs, point)
+		outputs = append(outputs, record[1])
+		if len(inputs) == batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if complete && len(points) > 0 {
+		return fmt.Errorf("%w: в файле нет %d записей исходного файла", crypto.ErrInvalidProof, len(points))
+	}
+	return nil
+}
+
+// loadPointsByIndex загружает точки index \t point в словарь index -> point
+func loadPointsByIndex(reader io.RecordReader) (map[string]string, error) {
+	result := make(map[string]string)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != 2 {
+			return nil, fmt.Errorf("%w: ожидается index и точка, получено %d полей", ErrModeMismatch, len(record))
+		}
+		result[record[0]] = record[1]
+	}
+
+	return result, nil
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// LoadTLSConfig настраивает взаимную TLS-аутентификацию: своя пара cert/key
+// и CA, которым должен быть подписан сертификат другой стороны
+func LoadTLSConfig(certFile, keyFile, caFile string, server bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки сертификата: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("в файле %s нет сертификатов CA", caFile)
+	}
+
+	return NewTLSConfig(cert, pool, server), nil
+}
+
+func NewTLSConfig(cert tls.Certificate, ca *x509.CertPool, server bool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+
+	if server {
+		config.ClientCAs = ca
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.RootCAs = ca
+	}
+
+	return config
+}
+
+// Accept ждет одно подключение и завершает TLS-рукопожатие
+func Accept(listener net.Listener, config *tls.Config) (*Conn, error) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ошибка TLS-рукопожатия: %w", err)
+	}
+
+	return NewConn(tlsConn), nil
+}
+
+func Dial(addr string, config *tls.Config) (*Conn, error) {
+	tlsConn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, fmt.Errorf("ошибка TLS-рукопожатия: %w", err)
+	}
+
+	return NewConn(tlsConn), nil
+}
@@ -0,0 +1,249 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Transport передает именованные потоки между сторонами протокола.
+// Потоки в каждом направлении идут строго последовательно: следующий Send
+// возможен только после Close предыдущего, а Receive ожидает потоки в том же
+// порядке, в котором их отправляет другая сторона
+type Transport interface {
+	Send(name string) (io.WriteCloser, error)
+	Receive(name string) (io.ReadCloser, error)
+	// Fail сообщает другой стороне об ошибке, прерывая ее текущий Receive
+	Fail(err error)
+	Close() error
+}
+
+const (
+	frameStreamStart byte = iota + 1
+	frameData
+	frameStreamEnd
+	frameError
+)
+
+const (
+	chunkSize    = 64 * 1024
+	maxFrameSize = 4 * chunkSize
+)
+
+var ErrStreamInProgress = errors.New("предыдущий поток еще не закрыт")
+
+// RemoteError - ошибка, полученная от другой стороны
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("ошибка на другой стороне: %s", e.Message)
+}
+
+type Conn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	w       *bufio.Writer
+	sending bool
+
+	r *bufio.Reader
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn: conn,
+		w:    bufio.NewWriterSize(conn, chunkSize+8),
+		r:    bufio.NewReaderSize(conn, chunkSize+8),
+	}
+}
+
+func (c *Conn) writeFrame(kind byte, payload []byte, flush bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(payload); err != nil {
+		return err
+	}
+	if flush {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("слишком большой фрейм: %d байт", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	if header[0] == frameError {
+		return 0, nil, &RemoteError{Message: string(payload)}
+	}
+
+	return header[0], payload, nil
+}
+
+func (c *Conn) Send(name string) (io.WriteCloser, error) {
+	c.writeMu.Lock()
+	if c.sending {
+		c.writeMu.Unlock()
+		return nil, ErrStreamInProgress
+	}
+	c.sending = true
+	c.writeMu.Unlock()
+
+	if err := c.writeFrame(frameStreamStart, []byte(name), false); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{conn: c, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (c *Conn) Receive(name string) (io.ReadCloser, error) {
+	kind, payload, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	if kind != frameStreamStart {
+		return nil, fmt.Errorf("ожидалось начало потока %q, получен фрейм типа %d", name, kind)
+	}
+	if string(payload) != name {
+		return nil, fmt.Errorf("ожидался поток %q, получен %q", name, payload)
+	}
+
+	return &streamReader{conn: c}, nil
+}
+
+func (c *Conn) Fail(err error) {
+	c.writeFrame(frameError, []byte(err.Error()), true)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+type streamWriter struct {
+	conn   *Conn
+	buf    []byte
+	closed bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), chunkSize-len(s.buf))
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(s.buf) == chunkSize {
+			if err := s.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (s *streamWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	err := s.conn.writeFrame(frameData, s.buf, false)
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.conn.writeFrame(frameStreamEnd, nil, true); err != nil {
+		return err
+	}
+
+	s.conn.writeMu.Lock()
+	s.conn.sending = false
+	s.conn.writeMu.Unlock()
+	return nil
+}
+
+type streamReader struct {
+	conn *Conn
+	buf  []byte
+	done bool
+	err  error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+
+		kind, payload, err := s.conn.readFrame()
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+
+		switch kind {
+		case frameData:
+			s.buf = payload
+		case frameStreamEnd:
+			s.done = true
+		default:
+			s.err = fmt.Errorf("неожиданный фрейм типа %d внутри потока", kind)
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Close дочитывает поток до конца, чтобы следующий Receive начался с границы потока
+func (s *streamReader) Close() error {
+	_, err := io.Copy(io.Discard, s)
+	return err
+}
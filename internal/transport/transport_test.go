@@ -0,0 +1,138 @@
+package transport_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkositsyn/psi/internal/transport"
+	"github.com/pkositsyn/psi/internal/transport/transporttest"
+)
+
+func TestStreamsInOrder(t *testing.T) {
+	server, client := transporttest.Pipe(t, transporttest.NewCertificates(t))
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 50000)
+
+	go func() {
+		for _, stream := range []struct {
+			name string
+			data []byte
+		}{{"first", []byte("hello")}, {"empty", nil}, {"large", large}} {
+			w, err := server.Send(stream.name)
+			if err != nil {
+				t.Errorf("ошибка открытия потока: %v", err)
+				return
+			}
+			w.Write(stream.data)
+			w.Close()
+		}
+	}()
+
+	for _, expected := range []struct {
+		name string
+		data []byte
+	}{{"first", []byte("hello")}, {"empty", nil}, {"large", large}} {
+		r, err := client.Receive(expected.name)
+		if err != nil {
+			t.Fatalf("ошибка получения потока %s: %v", expected.name, err)
+		}
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ошибка чтения потока %s: %v", expected.name, err)
+		}
+		r.Close()
+
+		if !bytes.Equal(data, expected.data) {
+			t.Errorf("поток %s: получено %d байт, ожидалось %d", expected.name, len(data), len(expected.data))
+		}
+	}
+}
+
+func TestStreamNameMismatch(t *testing.T) {
+	server, client := transporttest.Pipe(t, transporttest.NewCertificates(t))
+
+	go func() {
+		w, _ := server.Send("other")
+		w.Close()
+	}()
+
+	if _, err := client.Receive("expected"); err == nil {
+		t.Fatal("ожидалась ошибка при несовпадении имени потока")
+	}
+}
+
+func TestSendWhileStreamOpen(t *testing.T) {
+	server, _ := transporttest.Pipe(t, transporttest.NewCertificates(t))
+
+	if _, err := server.Send("first"); err != nil {
+		t.Fatalf("ошибка открытия потока: %v", err)
+	}
+
+	if _, err := server.Send("second"); !errors.Is(err, transport.ErrStreamInProgress) {
+		t.Fatalf("ожидалась ErrStreamInProgress, получено %v", err)
+	}
+}
+
+func TestRemoteFailure(t *testing.T) {
+	server, client := transporttest.Pipe(t, transporttest.NewCertificates(t))
+
+	go func() {
+		w, _ := server.Send("data")
+		w.Write([]byte("partial"))
+		server.Fail(errors.New("неверный формат записи"))
+	}()
+
+	r, err := client.Receive("data")
+	if err != nil {
+		t.Fatalf("ошибка получения потока: %v", err)
+	}
+
+	_, err = io.ReadAll(r)
+
+	var remote *transport.RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("ожидалась RemoteError, получено %v", err)
+	}
+	if !strings.Contains(remote.Message, "неверный формат записи") {
+		t.Errorf("неожиданное сообщение: %q", remote.Message)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	certs := transporttest.NewCertificates(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := transport.Accept(listener, transport.NewTLSConfig(certs.Server, certs.CA, true))
+		errCh <- err
+	}()
+
+	config := transport.NewTLSConfig(certs.Client, certs.CA, false)
+	config.Certificates = []tls.Certificate{}
+
+	conn, err := transport.Dial(listener.Addr().String(), config)
+	if err == nil {
+		// В TLS 1.3 клиент может узнать об отказе только при первом чтении
+		_, err = conn.Receive("any")
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("клиент без сертификата не должен подключиться")
+	}
+
+	if err := <-errCh; err == nil {
+		t.Error("сервер должен отклонить клиента без сертификата")
+	}
+}
@@ -0,0 +1,119 @@
+package transporttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkositsyn/psi/internal/transport"
+)
+
+type Certificates struct {
+	CA     *x509.CertPool
+	Server tls.Certificate
+	Client tls.Certificate
+}
+
+// NewCertificates выпускает CA и подписанные им сертификаты сервера и клиента для 127.0.0.1
+func NewCertificates(t testing.TB) *Certificates {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ошибка генерации ключа CA: %v", err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "psi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("ошибка создания CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("ошибка генерации ключа: %v", err)
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("ошибка создания сертификата: %v", err)
+		}
+
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	return &Certificates{
+		CA:     pool,
+		Server: issue(2, "bob", x509.ExtKeyUsageServerAuth),
+		Client: issue(3, "alice", x509.ExtKeyUsageClientAuth),
+	}
+}
+
+// Pipe устанавливает TLS-соединение через loopback и возвращает обе стороны
+func Pipe(t testing.TB, certs *Certificates) (server, client *transport.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ошибка открытия порта: %v", err)
+	}
+	defer listener.Close()
+
+	type accepted struct {
+		conn *transport.Conn
+		err  error
+	}
+	ch := make(chan accepted, 1)
+	go func() {
+		conn, err := transport.Accept(listener, transport.NewTLSConfig(certs.Server, certs.CA, true))
+		ch <- accepted{conn, err}
+	}()
+
+	client, err = transport.Dial(listener.Addr().String(), transport.NewTLSConfig(certs.Client, certs.CA, false))
+	if err != nil {
+		t.Fatalf("ошибка подключения: %v", err)
+	}
+
+	result := <-ch
+	if result.err != nil {
+		t.Fatalf("ошибка принятия подключения: %v", result.err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		result.conn.Close()
+	})
+
+	return result.conn, client
+}
@@ -0,0 +1,43 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidEmail = errors.New("некорректный email")
+
+var emailRegex = regexp.MustCompile(`^[a-z0-9!#$%&'*+/=?^_{|}~.-]+@[a-z0-9](?:[a-z0-9-]*[a-z0-9])?(?:\.[a-z0-9](?:[a-z0-9-]*[a-z0-9])?)+$`)
+
+// gmailDomains - домены, в которых точки и +tag в имени не различают ящики
+var gmailDomains = map[string]bool{"gmail.com": true, "googlemail.com": true}
+
+// ValidateEmail проверяет email в канонической форме: нижний регистр, без пробелов
+func ValidateEmail(email string) error {
+	if !emailRegex.MatchString(email) || strings.Contains(email, "..") {
+		return fmt.Errorf("%w: '%s' (ожидается адрес в нижнем регистре без пробелов)", ErrInvalidEmail, email)
+	}
+	return nil
+}
+
+// NormalizeEmail удаляет пробелы по краям и приводит адрес к нижнему регистру.
+// С FoldGmail адреса gmail.com и googlemail.com сводятся к одному ящику:
+// из имени удаляются точки и суффикс после +
+func NormalizeEmail(email string, opts NormalizeOptions) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(email))
+
+	if opts.FoldGmail {
+		local, domain, ok := strings.Cut(normalized, "@")
+		if ok && gmailDomains[domain] {
+			local, _, _ = strings.Cut(local, "+")
+			normalized = strings.ReplaceAll(local, ".", "") + "@gmail.com"
+		}
+	}
+
+	if err := ValidateEmail(normalized); err != nil {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidEmail, email)
+	}
+	return normalized, nil
+}
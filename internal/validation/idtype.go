@@ -0,0 +1,110 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrUnknownIDType = errors.New("неизвестный тип идентификатора")
+	ErrEmptyID       = errors.New("пустой идентификатор")
+)
+
+// Встроенные типы идентификаторов
+const (
+	IDTypePhone = "phone"
+	IDTypeEmail = "email"
+	IDTypeMAID  = "maid"
+	IDTypeRaw   = "raw"
+)
+
+// NormalizeOptions - параметры нормализации, общие для всех типов.
+// Тип использует только относящиеся к нему поля
+type NormalizeOptions struct {
+	// DefaultRegion - регион для телефонов без кода страны
+	DefaultRegion string
+	// FoldGmail убирает точки и суффикс +tag в адресах gmail.com
+	FoldGmail bool
+}
+
+// IDType описывает тип идентификатора. Name входит в хеш идентификатора,
+// поэтому значения разных типов не совпадают даже при одинаковой записи
+type IDType struct {
+	Name string
+	// Normalize приводит значение к канонической форме
+	Normalize func(value string, opts NormalizeOptions) (string, error)
+	// Validate проверяет, что значение уже в канонической форме
+	Validate func(value string) error
+}
+
+var (
+	idTypesMu sync.RWMutex
+	idTypes   = map[string]IDType{}
+)
+
+func init() {
+	RegisterIDType(IDType{
+		Name: IDTypePhone,
+		Normalize: func(value string, opts NormalizeOptions) (string, error) {
+			return NormalizePhone(value, opts.DefaultRegion)
+		},
+		Validate: ValidateE164Phone,
+	})
+	RegisterIDType(IDType{Name: IDTypeEmail, Normalize: NormalizeEmail, Validate: ValidateEmail})
+	RegisterIDType(IDType{Name: IDTypeMAID, Normalize: NormalizeMAID, Validate: ValidateMAID})
+	RegisterIDType(IDType{Name: IDTypeRaw, Normalize: normalizeRaw, Validate: validateRaw})
+}
+
+// RegisterIDType добавляет тип идентификатора или заменяет тип с тем же именем
+func RegisterIDType(t IDType) {
+	if t.Name == "" || len(t.Name) > 255 || t.Normalize == nil || t.Validate == nil {
+		panic(fmt.Sprintf("validation: некорректный тип идентификатора %q", t.Name))
+	}
+
+	idTypesMu.Lock()
+	defer idTypesMu.Unlock()
+	idTypes[t.Name] = t
+}
+
+// LookupIDType возвращает зарегистрированный тип. Пустое имя означает phone
+func LookupIDType(name string) (IDType, error) {
+	if name == "" {
+		name = IDTypePhone
+	}
+
+	idTypesMu.RLock()
+	defer idTypesMu.RUnlock()
+
+	t, ok := idTypes[name]
+	if !ok {
+		return IDType{}, fmt.Errorf("%w %q", ErrUnknownIDType, name)
+	}
+	return t, nil
+}
+
+// IDTypeNames возвращает имена зарегистрированных типов по алфавиту
+func IDTypeNames() []string {
+	idTypesMu.RLock()
+	defer idTypesMu.RUnlock()
+
+	names := make([]string, 0, len(idTypes))
+	for name := range idTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// raw - уже подготовленные идентификаторы (например, хеши), сравниваются как есть
+func normalizeRaw(value string, _ NormalizeOptions) (string, error) {
+	return value, validateRaw(value)
+}
+
+func validateRaw(value string) error {
+	if value == "" {
+		return ErrEmptyID
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package validation
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		email    string
+		fold     bool
+		expected string
+	}{
+		{"user@example.com", false, "user@example.com"},
+		{"  User.Name@Example.COM ", false, "user.name@example.com"},
+		{"first.last+promo@gmail.com", false, "first.last+promo@gmail.com"},
+		{"First.Last+promo@Gmail.com", true, "firstlast@gmail.com"},
+		{"f.i.r.s.t@googlemail.com", true, "first@gmail.com"},
+		{"first.last+promo@example.com", true, "first.last+promo@example.com"},
+	}
+
+	for _, c := range cases {
+		normalized, err := NormalizeEmail(c.email, NormalizeOptions{FoldGmail: c.fold})
+		if err != nil {
+			t.Errorf("%q: неожиданная ошибка: %v", c.email, err)
+			continue
+		}
+		if normalized != c.expected {
+			t.Errorf("%q: получено %s, ожидалось %s", c.email, normalized, c.expected)
+		}
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	for _, email := range []string{"", "user", "user@", "@example.com", "user@localhost", "User@example.com", " user@example.com", "a..b@example.com", "user@-example.com"} {
+		if err := ValidateEmail(email); !errors.Is(err, ErrInvalidEmail) {
+			t.Errorf("%q: ожидалась ErrInvalidEmail, получено %v", email, err)
+		}
+	}
+}
+
+func TestNormalizeMAID(t *testing.T) {
+	cases := []struct {
+		maid     string
+		expected string
+	}{
+		{"6d92078a-8246-4ba4-ae5b-76104861e7dc", "6d92078a-8246-4ba4-ae5b-76104861e7dc"},
+		{" 6D92078A-8246-4BA4-AE5B-76104861E7DC ", "6d92078a-8246-4ba4-ae5b-76104861e7dc"},
+		{"6d92078a82464ba4ae5b76104861e7dc", "6d92078a-8246-4ba4-ae5b-76104861e7dc"},
+	}
+
+	for _, c := range cases {
+		normalized, err := NormalizeMAID(c.maid, NormalizeOptions{})
+		if err != nil {
+			t.Errorf("%q: неожиданная ошибка: %v", c.maid, err)
+			continue
+		}
+		if normalized != c.expected {
+			t.Errorf("%q: получено %s, ожидалось %s", c.maid, normalized, c.expected)
+		}
+	}
+
+	for _, maid := range []string{"", "6d92078a-8246-4ba4-ae5b", "6d92078a-8246-4ba4-ae5b-76104861e7dz", zeroMAID} {
+		if _, err := NormalizeMAID(maid, NormalizeOptions{}); !errors.Is(err, ErrInvalidMAID) {
+			t.Errorf("%q: ожидалась ErrInvalidMAID, получено %v", maid, err)
+		}
+	}
+}
+
+func TestLookupIDType(t *testing.T) {
+	phone, err := LookupIDType("")
+	if err != nil || phone.Name != IDTypePhone {
+		t.Fatalf("пустое имя должно означать phone, получено %q, %v", phone.Name, err)
+	}
+
+	if _, err := LookupIDType("passport"); !errors.Is(err, ErrUnknownIDType) {
+		t.Errorf("ожидалась ErrUnknownIDType, получено %v", err)
+	}
+
+	raw, _ := LookupIDType(IDTypeRaw)
+	if err := raw.Validate(""); !errors.Is(err, ErrEmptyID) {
+		t.Errorf("raw: ожидалась ErrEmptyID, получено %v", err)
+	}
+
+	names := IDTypeNames()
+	for _, name := range []string{IDTypePhone, IDTypeEmail, IDTypeMAID, IDTypeRaw} {
+		if !slices.Contains(names, name) {
+			t.Errorf("тип %s не зарегистрирован: %v", name, names)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidMAID = errors.New("некорректный рекламный идентификатор")
+
+var maidRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// zeroMAID возвращают устройства с отключенным отслеживанием, он не идентифицирует пользователя
+const zeroMAID = "00000000-0000-0000-0000-000000000000"
+
+// ValidateMAID проверяет рекламный идентификатор устройства (IDFA, GAID)
+// в канонической форме: UUID в нижнем регистре
+func ValidateMAID(maid string) error {
+	if !maidRegex.MatchString(maid) {
+		return fmt.Errorf("%w: '%s' (ожидается UUID в нижнем регистре)", ErrInvalidMAID, maid)
+	}
+	if maid == zeroMAID {
+		return fmt.Errorf("%w: '%s' (отслеживание отключено)", ErrInvalidMAID, maid)
+	}
+	return nil
+}
+
+// NormalizeMAID приводит идентификатор к нижнему регистру и добавляет дефисы,
+// если он записан 32 hex-символами подряд
+func NormalizeMAID(maid string, _ NormalizeOptions) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(maid))
+	if len(normalized) == 32 && !strings.Contains(normalized, "-") {
+		normalized = normalized[:8] + "-" + normalized[8:12] + "-" + normalized[12:16] + "-" + normalized[16:20] + "-" + normalized[20:]
+	}
+
+	if err := ValidateMAID(normalized); err != nil {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidMAID, maid)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,124 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnknownRegion = errors.New("неизвестный регион")
+
+// phoneFormatting - символы, которые NormalizePhone удаляет из номера
+const phoneFormatting = " \u00a0-()./"
+
+// region описывает национальный формат номеров страны
+type region struct {
+	countryCode string
+	// trunkPrefix - префикс междугородной связи внутри страны (8 в России)
+	trunkPrefix string
+	// intlPrefix - префикс выхода на международную связь (810 в России)
+	intlPrefix string
+	// nationalLength - число цифр национального номера без префиксов
+	nationalLength int
+}
+
+var regions = map[string]region{
+	"RU": {countryCode: "7", trunkPrefix: "8", intlPrefix: "810", nationalLength: 10},
+	"KZ": {countryCode: "7", trunkPrefix: "8", intlPrefix: "810", nationalLength: 10},
+	"BY": {countryCode: "375", trunkPrefix: "80", intlPrefix: "810", nationalLength: 9},
+	"UA": {countryCode: "380", trunkPrefix: "0", intlPrefix: "00", nationalLength: 9},
+	"US": {countryCode: "1", trunkPrefix: "1", intlPrefix: "011", nationalLength: 10},
+	"CA": {countryCode: "1", trunkPrefix: "1", intlPrefix: "011", nationalLength: 10},
+	"GB": {countryCode: "44", trunkPrefix: "0", intlPrefix: "00", nationalLength: 10},
+}
+
+// ValidateRegion проверяет, что регион поддерживается NormalizePhone
+func ValidateRegion(code string) error {
+	if code == "" {
+		return nil
+	}
+	if _, ok := regions[strings.ToUpper(code)]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownRegion, code)
+	}
+	return nil
+}
+
+// NormalizePhone удаляет из номера форматирование (пробелы, скобки, дефисы,
+// точки) и приводит его к E.164. Номер без + считается международным, если
+// начинается с префикса выхода на международную связь региона или 00, иначе
+// национальным номером defaultRegion с префиксом междугородной связи, кодом
+// страны или без них. Пустой defaultRegion разрешает только международные номера
+func NormalizePhone(phone, defaultRegion string) (string, error) {
+	digits, international, ok := stripFormatting(phone)
+	if !ok {
+		return "", fmt.Errorf("%w: '%s' (недопустимые символы)", ErrInvalidPhone, phone)
+	}
+
+	var normalized string
+	if international {
+		normalized = "+" + digits
+	} else {
+		var err error
+		normalized, err = normalizeNational(digits, defaultRegion)
+		if err != nil {
+			return "", fmt.Errorf("%w: '%s' (%v)", ErrInvalidPhone, phone, err)
+		}
+	}
+
+	if err := ValidateE164Phone(normalized); err != nil {
+		return "", fmt.Errorf("%w: '%s' -> '%s' (ожидается формат +[код страны][номер], всего 7-15 цифр)", ErrInvalidPhone, phone, normalized)
+	}
+	return normalized, nil
+}
+
+// stripFormatting оставляет только цифры. international - номер начинался с +
+func stripFormatting(phone string) (digits string, international, ok bool) {
+	phone = strings.TrimSpace(phone)
+	if rest, found := strings.CutPrefix(phone, "+"); found {
+		phone = rest
+		international = true
+	}
+
+	var b strings.Builder
+	b.Grow(len(phone))
+	for _, r := range phone {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case strings.ContainsRune(phoneFormatting, r):
+		default:
+			return "", false, false
+		}
+	}
+
+	return b.String(), international, b.Len() > 0
+}
+
+func normalizeNational(digits, defaultRegion string) (string, error) {
+	if rest, found := strings.CutPrefix(digits, "00"); found {
+		return "+" + rest, nil
+	}
+
+	if defaultRegion == "" {
+		return "", errors.New("номер без кода страны, регион по умолчанию не задан")
+	}
+	r, ok := regions[strings.ToUpper(defaultRegion)]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownRegion, defaultRegion)
+	}
+
+	if rest, found := strings.CutPrefix(digits, r.intlPrefix); found && len(digits) != len(r.trunkPrefix)+r.nationalLength {
+		return "+" + rest, nil
+	}
+
+	switch {
+	case len(digits) == r.nationalLength:
+		return "+" + r.countryCode + digits, nil
+	case len(digits) == len(r.trunkPrefix)+r.nationalLength && strings.HasPrefix(digits, r.trunkPrefix):
+		return "+" + r.countryCode + digits[len(r.trunkPrefix):], nil
+	case len(digits) == len(r.countryCode)+r.nationalLength && strings.HasPrefix(digits, r.countryCode):
+		return "+" + digits, nil
+	}
+
+	return "", fmt.Errorf("ожидается национальный номер региона %s из %d цифр", strings.ToUpper(defaultRegion), r.nationalLength)
+}
@@ -0,0 +1,76 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	cases := []struct {
+		phone    string
+		region   string
+		expected string
+	}{
+		{"+79991234567", "RU", "+79991234567"},
+		{"+7 999 123 45 67", "RU", "+79991234567"},
+		{"+7 (999) 123-45-67", "", "+79991234567"},
+		{"8 (999) 123-45-67", "RU", "+79991234567"},
+		{"89991234567", "RU", "+79991234567"},
+		{"79991234567", "RU", "+79991234567"},
+		{"9991234567", "RU", "+79991234567"},
+		{" 8-999-123-45-67 ", "ru", "+79991234567"},
+		{"8 10 44 20 7946 0958", "RU", "+442079460958"},
+		{"0044 20 7946 0958", "RU", "+442079460958"},
+		{"020 7946 0958", "GB", "+442079460958"},
+		{"(202) 555-0123", "US", "+12025550123"},
+		{"1 202 555 0123", "US", "+12025550123"},
+		{"8 029 123 45 67", "BY", "+375291234567"},
+		{"8 0 29 123.45.67", "BY", "+375291234567"},
+		{"067 123 4567", "UA", "+380671234567"},
+	}
+
+	for _, c := range cases {
+		normalized, err := NormalizePhone(c.phone, c.region)
+		if err != nil {
+			t.Errorf("%q (%s): неожиданная ошибка: %v", c.phone, c.region, err)
+			continue
+		}
+		if normalized != c.expected {
+			t.Errorf("%q (%s): получено %s, ожидалось %s", c.phone, c.region, normalized, c.expected)
+		}
+	}
+}
+
+func TestNormalizePhoneInvalid(t *testing.T) {
+	cases := []struct {
+		phone  string
+		region string
+	}{
+		{"", "RU"},
+		{"phone", "RU"},
+		{"+7 999 abc", "RU"},
+		{"8 (999) 123-45", "RU"},
+		{"999123456789", "RU"},
+		{"89991234567", ""},
+		{"+0123456789", "RU"},
+		{"+", "RU"},
+	}
+
+	for _, c := range cases {
+		if normalized, err := NormalizePhone(c.phone, c.region); !errors.Is(err, ErrInvalidPhone) {
+			t.Errorf("%q (%s): ожидалась ErrInvalidPhone, получено %q, %v", c.phone, c.region, normalized, err)
+		}
+	}
+}
+
+func TestValidateRegion(t *testing.T) {
+	for _, region := range []string{"", "RU", "us"} {
+		if err := ValidateRegion(region); err != nil {
+			t.Errorf("регион %q должен поддерживаться: %v", region, err)
+		}
+	}
+
+	if err := ValidateRegion("XX"); !errors.Is(err, ErrUnknownRegion) {
+		t.Errorf("ожидалась ErrUnknownRegion, получено %v", err)
+	}
+}
@@ -1,15 +1,18 @@
 package validation
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 )
 
+var ErrInvalidPhone = errors.New("телефон не соответствует стандарту E.164")
+
 var e164Regex = regexp.MustCompile(`^\+[1-9]\d{6,14}$`)
 
 func ValidateE164Phone(phone string) error {
 	if !e164Regex.MatchString(phone) {
-		return fmt.Errorf("телефон '%s' не соответствует стандарту E.164 (ожидается формат +[код страны][номер], всего 7-15 цифр)", phone)
+		return fmt.Errorf("%w: '%s' (ожидается формат +[код страны][номер], всего 7-15 цифр)", ErrInvalidPhone, phone)
 	}
 	return nil
 }
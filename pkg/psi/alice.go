@@ -0,0 +1,190 @@
+package psi
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/protocol"
+)
+
+// AliceSession хранит ключи alice. Step2 и Step2Labeled ключи не используют
+// и могут вызываться на нулевой сессии
+type AliceSession struct {
+	HMACKey HMACKey
+	ECDHKey *ECDHKey
+	// BatchSize - размер батча для параллельной обработки, по умолчанию 128
+	BatchSize int
+	Step1Options
+	// SumKey - ключ режима sum: Step1Sum шифрует значения его открытым ключом,
+	// DecryptSum расшифровывает сумму. Если не задан, Step1Sum генерирует его
+	SumKey *SumKey
+	// Priority - порядок типов из HMACKey.IDTypes, в котором Step2 выбирает
+	// совпадение для строки с несколькими совпавшими идентификаторами.
+	// По умолчанию порядок колонок
+	Priority []string
+	// Output задает, какие строки пишут Step2 и Step2Labeled: по умолчанию
+	// только совпавшие, OutputAll - все строки с пустым b_user_id у несовпавших,
+	// OutputUnmatched - только несовпавшие
+	Output OutputMode
+}
+
+// NewAliceSession принимает ключ K от bob и генерирует ключ A
+func NewAliceSession(hmacKey HMACKey) (*AliceSession, error) {
+	if err := hmacKey.Version.Validate(); err != nil {
+		return nil, err
+	}
+
+	ecdhKey, err := GenerateECDHKey()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка генерации ECDH ключа A: %w", err)
+	}
+
+	return &AliceSession{HMACKey: hmacKey, ECDHKey: ecdhKey}, nil
+}
+
+func (s *AliceSession) batchSize() int {
+	if s.BatchSize > 0 {
+		return s.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// ReencryptBob шифрует ключом A данные bob: index \t H(phone_b)^B -> index \t H(phone_b)^B^A
+func (s *AliceSession) ReencryptBob(bobEncrypted RecordReader, output RecordWriter) (Stats, error) {
+	count, err := protocol.ProcessBobDataStep1(bobEncrypted, output, s.ECDHKey, s.PointEncoding, s.batchSize())
+	return Stats{Records: count}, err
+}
+
+// Step1 шифрует записи id \t a_user_id с типом идентификатора из HMACKey.
+// Строки переставляются случайным образом и нумеруются заново: в output
+// пишется index \t H(id_a)^A для передачи bob, в mapping - приватный маппинг
+// index \t a_user_id для Step2. Может выполняться параллельно с ReencryptBob
+func (s *AliceSession) Step1(input RecordReader, output, mapping RecordWriter) (Stats, error) {
+	var stats Stats
+	config, err := s.inputConfig(s.HMACKey.IDTypes, &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	count, padded, err := protocol.ProcessAliceDataStep1(input, output, mapping, s.HMACKey.Key, s.ECDHKey, s.HMACKey.Version, s.PointEncoding, config, s.external(), s.padding(), s.batchSize())
+	stats.Records = count
+	stats.Padded = padded
+	return stats, err
+}
+
+// ReencryptBobCardinality - вариант ReencryptBob для режима cardinality:
+// H(phone_b)^B^A пишутся без индексов в случайном порядке
+func (s *AliceSession) ReencryptBobCardinality(bobEncrypted RecordReader, output RecordWriter) (Stats, error) {
+	count, err := protocol.ProcessBobDataStep1Cardinality(bobEncrypted, output, s.ECDHKey, s.PointEncoding, s.external(), s.batchSize())
+	return Stats{Records: count}, err
+}
+
+// Step1Cardinality - вариант Step1 для режима cardinality: H(id_a)^A пишутся
+// без индексов в случайном порядке, маппинг a_user_id не создается.
+// Поддерживается только одна колонка идентификаторов
+func (s *AliceSession) Step1Cardinality(input RecordReader, output RecordWriter) (Stats, error) {
+	if len(s.HMACKey.IDTypes) > 1 {
+		return Stats{}, ErrCardinalityColumns
+	}
+
+	var stats Stats
+	config, err := s.inputConfig(s.HMACKey.IDTypes, &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	count, padded, err := protocol.ProcessAliceDataStep1Cardinality(input, output, s.HMACKey.Key, s.ECDHKey, s.HMACKey.Version, s.PointEncoding, config, s.external(), s.padding(), s.batchSize())
+	stats.Records = count
+	stats.Padded = padded
+	return stats, err
+}
+
+// Step1Sum - вариант Step1Cardinality для режима sum: последнее поле входных
+// записей - неотрицательное целое значение вместо a_user_id. В output пишутся
+// H(id_a)^A \t Enc(value) без индексов в случайном порядке, значения шифруются
+// открытым ключом SumKey. Поддерживается только одна колонка идентификаторов
+func (s *AliceSession) Step1Sum(input RecordReader, output RecordWriter) (Stats, error) {
+	if len(s.HMACKey.IDTypes) > 1 {
+		return Stats{}, ErrSumColumns
+	}
+
+	if s.SumKey == nil {
+		sumKey, err := GenerateSumKey()
+		if err != nil {
+			return Stats{}, fmt.Errorf("ошибка генерации ключа суммы: %w", err)
+		}
+		s.SumKey = sumKey
+	}
+
+	var stats Stats
+	config, err := s.inputConfig(s.HMACKey.IDTypes, &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	count, padded, err := protocol.ProcessAliceDataStep1Sum(input, output, s.HMACKey.Key, s.ECDHKey, s.SumKey.PublicKey(), s.HMACKey.Version, s.PointEncoding, config, s.external(), s.padding(), s.batchSize())
+	stats.Records = count
+	stats.Padded = padded
+	return stats, err
+}
+
+// DecryptSum расшифровывает ключом SumKey сумму, которую вернул BobSession.Step2Sum.
+// maxSum - верхняя граница суммы, 0 означает DefaultMaxSum
+func (s *AliceSession) DecryptSum(ciphertext string, maxSum uint64) (uint64, error) {
+	if s.SumKey == nil {
+		return 0, errors.New("не задан ключ суммы SumKey")
+	}
+	if maxSum == 0 {
+		maxSum = DefaultMaxSum
+	}
+	return s.SumKey.Decrypt(ciphertext, maxSum)
+}
+
+// Step2 сопоставляет маппинг из Step1 с результатом bob и пишет a_user_id \t b_user_id.
+// При нескольких колонках идентификаторов для каждой строки выбирается одно
+// совпадение согласно Priority и третьим полем пишется тип, который его дал
+func (s *AliceSession) Step2(mapping, bobFinal RecordReader, output RecordWriter) (Stats, error) {
+	matcher, err := protocol.NewMatcher(s.HMACKey.IDTypes, s.Priority, s.Output)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if s.MemoryLimit > 0 {
+		count, matched, err := protocol.ProcessAliceStep2External(mapping, output, bobFinal, s.external(), matcher)
+		return Stats{Records: count, Matched: matched, MatchedBy: matcher.MatchedBy}, err
+	}
+
+	bobData, err := protocol.LoadBobFinalData(bobFinal)
+	if err != nil {
+		return Stats{}, fmt.Errorf("ошибка загрузки данных от bob: %w", err)
+	}
+
+	count, matched, err := protocol.ProcessAliceStep2(mapping, output, bobData, matcher)
+	return Stats{Records: count, Matched: matched, MatchedBy: matcher.MatchedBy}, err
+}
+
+// Step2Labeled - вариант Step2 для режима labeled: b_user_id расшифровываются из меток bob
+func (s *AliceSession) Step2Labeled(mapping, bobFinal, labels RecordReader, output RecordWriter) (Stats, error) {
+	matcher, err := protocol.NewMatcher(s.HMACKey.IDTypes, s.Priority, s.Output)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if s.MemoryLimit > 0 {
+		count, matched, err := protocol.ProcessAliceStep2LabeledExternal(mapping, output, bobFinal, labels, s.external(), matcher)
+		return Stats{Records: count, Matched: matched, MatchedBy: matcher.MatchedBy}, err
+	}
+
+	bobData, err := protocol.LoadBobFinalData(bobFinal)
+	if err != nil {
+		return Stats{}, fmt.Errorf("ошибка загрузки данных от bob: %w", err)
+	}
+
+	bobLabels, err := protocol.LoadBobLabels(labels)
+	if err != nil {
+		return Stats{}, fmt.Errorf("ошибка загрузки меток от bob: %w", err)
+	}
+
+	count, matched, err := protocol.ProcessAliceStep2Labeled(mapping, output, bobData, bobLabels, matcher)
+	return Stats{Records: count, Matched: matched, MatchedBy: matcher.MatchedBy}, err
+}
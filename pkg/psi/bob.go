@@ -0,0 +1,196 @@
+package psi
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/protocol"
+)
+
+const defaultBatchSize = 128
+
+// BobSession хранит ключи bob между шагами протокола.
+// Ключи можно сохранить после Step1 и восстановить для Step2 в другом процессе
+type BobSession struct {
+	HMACKey HMACKey
+	ECDHKey *ECDHKey
+	// BatchSize - размер батча для параллельной обработки, по умолчанию 128
+	BatchSize int
+	Step1Options
+	// Output задает, какие записи alice пишет Step2: по умолчанию все,
+	// OutputMatched оставляет только совпавшие. Step2Labeled пишет все записи
+	Output OutputMode
+	// LabelKey - ключ B·C, которым Step2Labeled шифрует output. C - одноразовый
+	// ключ меток, Step2Labeled генерирует его заново. Нужен для ProveEncryption
+	// результата Step2Labeled
+	LabelKey *ECDHKey
+}
+
+// NewBobSession генерирует ключи K и B для новой сессии
+func NewBobSession(version ProtocolVersion) (*BobSession, error) {
+	if err := version.Validate(); err != nil {
+		return nil, err
+	}
+
+	hmacKey, err := GenerateHMACKey(version)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка генерации HMAC ключа: %w", err)
+	}
+
+	ecdhKey, err := GenerateECDHKey()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка генерации ECDH ключа: %w", err)
+	}
+
+	return &BobSession{HMACKey: hmacKey, ECDHKey: ecdhKey}, nil
+}
+
+func (s *BobSession) batchSize() int {
+	if s.BatchSize > 0 {
+		return s.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// columns - число колонок идентификаторов во входных данных
+func (s *BobSession) columns() int {
+	return max(len(s.HMACKey.IDTypes), 1)
+}
+
+// Step1 шифрует записи id \t b_user_id в index \t H(id)^B для передачи alice.
+// Строки переставляются случайным образом и нумеруются заново, в mapping
+// пишется приватный маппинг index \t b_user_id для Step2.
+// Типы идентификаторов задает HMACKey.IDTypes
+func (s *BobSession) Step1(input RecordReader, output, mapping RecordWriter) (Stats, error) {
+	var stats Stats
+	config, err := s.inputConfig(s.HMACKey.IDTypes, &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	count, padded, err := protocol.ProcessBobStep1(input, output, mapping, s.HMACKey.Key, s.ECDHKey, s.HMACKey.Version, s.PointEncoding, config, s.external(), s.padding(), s.batchSize())
+	stats.Records = count
+	stats.Padded = padded
+	return stats, err
+}
+
+// Step2 вычисляет пересечение. mapping - маппинг index \t b_user_id из Step1,
+// bobEncrypted - H(phone_b)^B^A и aliceEncrypted - H(phone_a)^A от alice.
+// В output пишется index \t H(phone_a)^A^B \t b_user_id для передачи alice
+func (s *BobSession) Step2(mapping, bobEncrypted, aliceEncrypted RecordReader, output RecordWriter) (Stats, error) {
+	if err := s.Output.ValidateBob(false); err != nil {
+		return Stats{}, err
+	}
+
+	if s.MemoryLimit > 0 {
+		count, matched, err := protocol.ProcessBobStep2External(aliceEncrypted, output, s.ECDHKey, bobEncrypted, mapping, s.external(), s.PointEncoding, s.Output, s.batchSize())
+		return Stats{Records: count, Matched: matched}, err
+	}
+
+	bobEncMap, mappingData, err := loadBobStep2Data(mapping, bobEncrypted)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	count, matched, err := protocol.ProcessBobStep2(aliceEncrypted, output, s.ECDHKey, bobEncMap, mappingData, s.PointEncoding, s.Output, s.batchSize())
+	return Stats{Records: count, Matched: matched}, err
+}
+
+// Step2Labeled - вариант Step2 для режима labeled: в labels пишутся
+// зашифрованные b_user_id, а в output - index \t H(phone_a)^A^B^C без сопоставления
+func (s *BobSession) Step2Labeled(mapping, bobEncrypted, aliceEncrypted RecordReader, output, labels RecordWriter) (Stats, error) {
+	if err := s.Output.ValidateBob(true); err != nil {
+		return Stats{}, err
+	}
+
+	// Метки выводятся из H(phone_b)^B^A^C: точки H(phone_b)^B^A alice
+	// вычисляет сама и без C открыла бы метки телефонов, которых у нее нет
+	keyC, err := GenerateECDHKey()
+	if err != nil {
+		return Stats{}, fmt.Errorf("ошибка генерации ключа меток: %w", err)
+	}
+	s.LabelKey, err = crypto.MultiplyKeys(s.ECDHKey, keyC)
+	if err != nil {
+		return Stats{}, fmt.Errorf("ошибка генерации ключа меток: %w", err)
+	}
+
+	labelsCount, err := s.writeLabels(mapping, bobEncrypted, labels, keyC)
+	if err != nil {
+		return Stats{}, fmt.Errorf("ошибка создания меток: %w", err)
+	}
+
+	count, err := protocol.ProcessBobStep2Labeled(aliceEncrypted, output, s.LabelKey, s.PointEncoding, s.batchSize())
+	return Stats{Records: count, Labels: labelsCount}, err
+}
+
+// Step2Cardinality считает размер пересечения в режиме cardinality.
+// bobEncrypted - H(phone_b)^B^A и aliceEncrypted - H(phone_a)^A от alice без индексов.
+// Совпавшие записи не сохраняются, в Stats.Matched - размер пересечения
+func (s *BobSession) Step2Cardinality(bobEncrypted, aliceEncrypted RecordReader) (Stats, error) {
+	if s.columns() > 1 {
+		return Stats{}, ErrCardinalityColumns
+	}
+
+	if s.MemoryLimit > 0 {
+		count, matched, err := protocol.ProcessBobStep2CardinalityExternal(aliceEncrypted, bobEncrypted, s.ECDHKey, s.external(), s.batchSize())
+		return Stats{Records: count, Matched: matched}, err
+	}
+
+	bobPoints, err := protocol.LoadPointSet(bobEncrypted)
+	if err != nil {
+		return Stats{}, fmt.Errorf("ошибка загрузки H(phone_b)^B^A: %w", err)
+	}
+
+	count, matched, err := protocol.ProcessBobStep2Cardinality(aliceEncrypted, s.ECDHKey, bobPoints, s.batchSize())
+	return Stats{Records: count, Matched: matched}, err
+}
+
+// Step2Sum складывает значения совпавших записей в режиме sum. bobEncrypted -
+// H(phone_b)^B^A и aliceEncrypted - H(phone_a)^A \t Enc(value) от alice без индексов.
+// Возвращает сумму, зашифрованную открытым ключом alice sumKey, для передачи alice.
+// В Stats.Matched - размер пересечения
+func (s *BobSession) Step2Sum(bobEncrypted, aliceEncrypted RecordReader, sumKey *SumPublicKey) (Stats, string, error) {
+	if s.columns() > 1 {
+		return Stats{}, "", ErrSumColumns
+	}
+
+	if s.MemoryLimit > 0 {
+		count, matched, sum, err := protocol.ProcessBobStep2SumExternal(aliceEncrypted, bobEncrypted, s.ECDHKey, sumKey, s.external(), s.batchSize())
+		return Stats{Records: count, Matched: matched}, sum, err
+	}
+
+	bobPoints, err := protocol.LoadPointSet(bobEncrypted)
+	if err != nil {
+		return Stats{}, "", fmt.Errorf("ошибка загрузки H(phone_b)^B^A: %w", err)
+	}
+
+	count, matched, sum, err := protocol.ProcessBobStep2Sum(aliceEncrypted, s.ECDHKey, sumKey, bobPoints, s.batchSize())
+	return Stats{Records: count, Matched: matched}, sum, err
+}
+
+func (s *BobSession) writeLabels(mapping, bobEncrypted RecordReader, labels RecordWriter, keyC *ECDHKey) (int, error) {
+	if s.MemoryLimit > 0 {
+		return protocol.WriteBobLabelsExternal(labels, bobEncrypted, mapping, keyC, s.external(), s.batchSize())
+	}
+
+	bobEncMap, mappingData, err := loadBobStep2Data(mapping, bobEncrypted)
+	if err != nil {
+		return 0, err
+	}
+
+	return protocol.WriteBobLabels(labels, bobEncMap, mappingData, keyC, s.batchSize())
+}
+
+func loadBobStep2Data(mapping, bobEncrypted RecordReader) (map[string][]string, map[string]string, error) {
+	bobEncMap, err := protocol.LoadIndexedData(bobEncrypted)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка загрузки H(phone_b)^B^A: %w", err)
+	}
+
+	mappingData, err := protocol.LoadBobMapping(mapping)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка загрузки маппинга: %w", err)
+	}
+
+	return bobEncMap, mappingData, nil
+}
@@ -0,0 +1,82 @@
+package psi
+
+import (
+	"github.com/pkositsyn/psi/internal/crypto"
+)
+
+// ECDHKey - приватный ключ стороны на кривой P-256. Не передается другой стороне
+type ECDHKey = crypto.ECDHKey
+
+func GenerateECDHKey() (*ECDHKey, error) {
+	return crypto.GenerateECDHKey()
+}
+
+// NewECDHKey восстанавливает ключ из ECDHKey.Bytes
+func NewECDHKey(keyBytes []byte) (*ECDHKey, error) {
+	return crypto.NewECDHKeyFromBytes(keyBytes)
+}
+
+// HMACKey - общий ключ K, который bob передает alice вместе с версией протокола
+// и типами идентификаторов
+type HMACKey struct {
+	Key     []byte
+	Version ProtocolVersion
+	// IDTypes - типы колонок идентификаторов во входных данных обеих сторон.
+	// Пустой список означает одну колонку IDTypePhone
+	IDTypes []string
+}
+
+func GenerateHMACKey(version ProtocolVersion) (HMACKey, error) {
+	if err := version.Validate(); err != nil {
+		return HMACKey{}, err
+	}
+
+	key, err := crypto.GenerateHMACKey()
+	if err != nil {
+		return HMACKey{}, err
+	}
+
+	return HMACKey{Key: key, Version: version}, nil
+}
+
+// MarshalText кодирует ключ в формате файла bob_hmac_key.txt
+func (k HMACKey) MarshalText() ([]byte, error) {
+	if err := k.Version.Validate(); err != nil {
+		return nil, err
+	}
+	return crypto.EncodeHMACKey(crypto.HMACKeyFile(k)), nil
+}
+
+func (k *HMACKey) UnmarshalText(data []byte) error {
+	key, err := crypto.DecodeHMACKey(data)
+	if err != nil {
+		return err
+	}
+
+	*k = HMACKey(key)
+	return nil
+}
+
+// SumKey - ключ ElGamal alice для режима sum. Открытый ключ передается bob,
+// приватный остается у alice для расшифровки суммы
+type SumKey = crypto.ElGamalKey
+
+type SumPublicKey = crypto.ElGamalPublicKey
+
+// DefaultMaxSum - граница суммы для DecryptSum по умолчанию. Время и память
+// расшифровки растут как корень из границы
+const DefaultMaxSum = 1 << 36
+
+func GenerateSumKey() (*SumKey, error) {
+	return crypto.GenerateElGamalKey()
+}
+
+// NewSumKey восстанавливает ключ из SumKey.Bytes
+func NewSumKey(keyBytes []byte) (*SumKey, error) {
+	return crypto.NewElGamalKeyFromBytes(keyBytes)
+}
+
+// NewSumPublicKey восстанавливает открытый ключ из SumPublicKey.Bytes
+func NewSumPublicKey(keyBytes []byte) (*SumPublicKey, error) {
+	return crypto.NewElGamalPublicKeyFromBytes(keyBytes)
+}
@@ -0,0 +1,79 @@
+package psi
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkositsyn/psi/internal/protocol"
+	"github.com/pkositsyn/psi/internal/transport"
+)
+
+// Transport передает именованные потоки между сторонами протокола
+type Transport = transport.Transport
+
+type RemoteError = transport.RemoteError
+
+// NewTransport создает Transport поверх установленного соединения.
+// Аутентификацию сторон (например, взаимный TLS) обеспечивает вызывающий
+func NewTransport(conn net.Conn) Transport {
+	return transport.NewConn(conn)
+}
+
+type NetworkConfig struct {
+	// Mode - ModeStandard или ModeLabeled, должен совпадать у сторон
+	Mode string
+	// Version выбирает bob, alice получает ее вместе с ключом K. Для alice
+	// Version - минимальная версия, которую она примет от bob: более старую
+	// RunAliceNetwork отклоняет с ErrUnsupportedVersion. По умолчанию
+	// LatestProtocolVersion у обеих сторон
+	Version ProtocolVersion
+	// IDTypes - типы колонок идентификаторов во входных данных, выбирает bob
+	IDTypes []string
+	// Priority - порядок типов при выборе совпадения строки alice
+	Priority []string
+	// TempDir - каталог для приватного маппинга alice, по умолчанию os.TempDir()
+	TempDir   string
+	BatchSize int
+}
+
+func (c NetworkConfig) withDefaults() (NetworkConfig, error) {
+	if c.Mode == "" {
+		c.Mode = ModeStandard
+	}
+	if c.Mode != ModeStandard && c.Mode != ModeLabeled {
+		return c, fmt.Errorf("неизвестный режим %q", c.Mode)
+	}
+	if c.Version == 0 {
+		c.Version = LatestProtocolVersion
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	return c, c.Version.Validate()
+}
+
+// RunBobNetwork выполняет оба шага bob. openInput открывает записи
+// id \t b_user_id, маппинг b_user_id для шага 2 хранится в памяти
+func RunBobNetwork(tr Transport, openInput func() (RecordReadCloser, error), config NetworkConfig) (Stats, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return Stats{}, err
+	}
+	if err := ValidateIDTypes(config.IDTypes, config.Version); err != nil {
+		return Stats{}, err
+	}
+
+	count, err := protocol.RunBobNetwork(tr, openInput, config.Version, config.IDTypes, config.Mode, config.BatchSize)
+	return Stats{Records: count}, err
+}
+
+// RunAliceNetwork выполняет оба шага alice и пишет в output a_user_id \t b_user_id
+func RunAliceNetwork(tr Transport, input RecordReader, output RecordWriter, config NetworkConfig) (Stats, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	count, matched, err := protocol.RunAliceNetwork(tr, input, output, config.Mode, config.Version, config.Priority, config.TempDir, config.BatchSize)
+	return Stats{Records: count, Matched: matched}, err
+}
@@ -0,0 +1,84 @@
+package psi
+
+import (
+	"fmt"
+
+	"github.com/pkositsyn/psi/internal/protocol"
+)
+
+// PartySession хранит ключи стороны протокола для трех и более сторон.
+// Все стороны используют общий ключ K и каждая - свой ключ ECDH. Набор каждой
+// стороны после Step1 проходит по кольцу через все остальные стороны,
+// каждая применяет к нему Reencrypt. Получатель вызывает Intersect для
+// своего набора и наборов остальных сторон, прошедших все ключи.
+// Наборы остальных сторон получатель видит по отдельности и может вычислить
+// любое их попарное пересечение, а не только пересечение всех сторон
+type PartySession struct {
+	HMACKey HMACKey
+	ECDHKey *ECDHKey
+	// BatchSize - размер батча для параллельной обработки, по умолчанию 128
+	BatchSize int
+	Step1Options
+}
+
+// NewPartySession принимает общий ключ K и генерирует ключ ECDH стороны.
+// Ключ K создает одна из сторон через GenerateHMACKey и передает остальным
+func NewPartySession(hmacKey HMACKey) (*PartySession, error) {
+	if err := hmacKey.Version.Validate(); err != nil {
+		return nil, err
+	}
+
+	ecdhKey, err := GenerateECDHKey()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка генерации ECDH ключа: %w", err)
+	}
+
+	return &PartySession{HMACKey: hmacKey, ECDHKey: ecdhKey}, nil
+}
+
+func (s *PartySession) batchSize() int {
+	if s.BatchSize > 0 {
+		return s.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// Step1 шифрует записи id \t user_id ключом стороны. Если mapping задан, сторона -
+// получатель: строки переставляются и нумеруются заново, в output пишется
+// index \t H(id)^P, в mapping - приватный маппинг index \t user_id для Intersect.
+// Иначе в output пишутся H(id)^P без индексов в случайном порядке
+func (s *PartySession) Step1(input RecordReader, output, mapping RecordWriter) (Stats, error) {
+	var stats Stats
+	config, err := s.inputConfig(s.HMACKey.IDTypes, &stats)
+	if err != nil {
+		return stats, err
+	}
+
+	var count, padded int
+	if mapping != nil {
+		count, padded, err = protocol.ProcessBobStep1(input, output, mapping, s.HMACKey.Key, s.ECDHKey, s.HMACKey.Version, s.PointEncoding, config, s.external(), s.padding(), s.batchSize())
+	} else {
+		count, padded, err = protocol.ProcessAliceDataStep1Cardinality(input, output, s.HMACKey.Key, s.ECDHKey, s.HMACKey.Version, s.PointEncoding, config, s.external(), s.padding(), s.batchSize())
+	}
+	stats.Records = count
+	stats.Padded = padded
+	return stats, err
+}
+
+// Reencrypt применяет ключ стороны к набору другой стороны. Набор получателя
+// сохраняет индексы, наборы остальных сторон перемешиваются заново
+func (s *PartySession) Reencrypt(input RecordReader, output RecordWriter) (Stats, error) {
+	count, err := protocol.ProcessPartyReencrypt(input, output, s.ECDHKey, s.PointEncoding, s.external(), s.batchSize())
+	return Stats{Records: count}, err
+}
+
+// Intersect вычисляет пересечение на стороне получателя. own - набор получателя
+// и others - наборы остальных сторон, прошедшие ключи всех сторон, mapping -
+// маппинг index \t user_id из Step1. В output пишутся user_id строк, один из
+// идентификаторов которых есть во всех наборах. Ключи сессии не используются,
+// кроме HMACKey.IDTypes
+func (s *PartySession) Intersect(own, mapping RecordReader, others []RecordReader, output RecordWriter) (Stats, error) {
+	columns := max(len(s.HMACKey.IDTypes), 1)
+	count, matched, err := protocol.ProcessPartyIntersect(own, mapping, others, output, columns)
+	return Stats{Records: count, Matched: matched}, err
+}
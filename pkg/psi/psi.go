@@ -0,0 +1,298 @@
+// Package psi реализует протокол Private Set Intersection на основе
+// HMAC-SHA256 и ECDH P-256 для встраивания в сервисы без вызова CLI.
+//
+// Bob и alice выполняют шаги через BobSession и AliceSession, обмениваясь
+// файлами TSV (или любыми RecordReader/RecordWriter), либо запускают
+// протокол целиком по сети через RunBobNetwork и RunAliceNetwork
+package psi
+
+import (
+	goio "io"
+
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/protocol"
+	"github.com/pkositsyn/psi/internal/validation"
+)
+
+type ProtocolVersion = crypto.ProtocolVersion
+
+const (
+	ProtocolV1            = crypto.ProtocolV1
+	ProtocolV2            = crypto.ProtocolV2
+	ProtocolV3            = crypto.ProtocolV3
+	LatestProtocolVersion = crypto.LatestProtocolVersion
+)
+
+// PointEncoding - представление точек в данных для другой стороны.
+// Точки принимаются в любом представлении, поэтому стороны выбирают его независимо
+type PointEncoding = crypto.PointEncoding
+
+const (
+	PointUncompressed = crypto.PointUncompressed
+	// PointCompressed почти вдвое сокращает размер точек ценой вычисления
+	// квадратного корня при каждой распаковке
+	PointCompressed = crypto.PointCompressed
+)
+
+const (
+	// ModeStandard - пересечение вычисляет bob и передает alice b_user_id совпавших записей
+	ModeStandard = protocol.ModeStandard
+	// ModeLabeled - пересечение вычисляет alice, bob не узнает совпавшие записи
+	ModeLabeled = protocol.ModeLabeled
+	// ModeCardinality - стороны узнают только размер пересечения: alice
+	// передает точки без индексов в случайном порядке, bob считает совпадения
+	ModeCardinality = protocol.ModeCardinality
+	// ModeSum - как ModeCardinality, но alice передает с каждой точкой значение,
+	// зашифрованное ее ключом SumKey, а bob возвращает зашифрованную сумму
+	// значений совпавших записей
+	ModeSum = protocol.ModeSum
+)
+
+var (
+	ErrInvalidRecord      = protocol.ErrInvalidRecord
+	ErrModeMismatch       = protocol.ErrModeMismatch
+	ErrCardinalityColumns = protocol.ErrCardinalityColumns
+	ErrSumColumns         = protocol.ErrSumColumns
+	ErrInvalidValue       = protocol.ErrInvalidValue
+	ErrDuplicateID        = protocol.ErrDuplicateID
+	ErrSumRange           = crypto.ErrSumRange
+	ErrInvalidProof       = crypto.ErrInvalidProof
+	ErrInvalidPhone       = validation.ErrInvalidPhone
+	ErrInvalidEmail       = validation.ErrInvalidEmail
+	ErrInvalidMAID        = validation.ErrInvalidMAID
+	ErrEmptyID            = validation.ErrEmptyID
+	ErrUnknownIDType      = validation.ErrUnknownIDType
+	ErrUnknownRegion      = validation.ErrUnknownRegion
+	ErrInvalidPoint       = crypto.ErrInvalidPoint
+	ErrUnsupportedVersion = crypto.ErrUnsupportedVersion
+)
+
+// RowError указывает номер строки входных данных (с нуля), на которой
+// остановилась обработка. Причину можно проверить через errors.Is
+type RowError = protocol.RowError
+
+// RejectFunc получает строку входных данных Step1 с невалидным телефоном или
+// неверным числом полей. Если RejectFunc вернула nil, строка пропускается,
+// иначе Step1 завершается с возвращенной ошибкой
+type RejectFunc = protocol.RejectFunc
+
+// RecordReader возвращает записи по одной и io.EOF в конце данных
+type RecordReader = io.RecordReader
+
+type RecordWriter = io.RecordWriter
+
+type RecordReadCloser = io.RecordReadCloser
+
+type (
+	TSVReader = io.TSVReader
+	TSVWriter = io.TSVWriter
+)
+
+// NewTSVReader читает несжатый TSV или бинарный формат
+func NewTSVReader(r goio.Reader) *TSVReader {
+	return io.NewTSVReader(io.NopResetter(goio.NopCloser(r)))
+}
+
+// NewTSVWriter пишет несжатый TSV. Close сбрасывает буфер, но не закрывает w
+func NewTSVWriter(w goio.Writer) *TSVWriter {
+	return io.NewTSVWriter(nopWriteCloser{w})
+}
+
+// NewBinaryWriter пишет записи в компактном бинарном формате.
+// Close записывает конец данных, но не закрывает w
+func NewBinaryWriter(w goio.Writer, version ProtocolVersion) *TSVWriter {
+	return io.NewBinaryWriter(nopWriteCloser{w}, int(version))
+}
+
+// OpenTSVFile открывает файл записей. Сжатие gzip и бинарный формат
+// определяются по содержимому файла
+func OpenTSVFile(filename string) (*TSVReader, error) {
+	return io.OpenTSVFile(filename)
+}
+
+// CreateTSVFile создает TSV файл, сжатый gzip для суффикса .gz,
+// или файл бинарного формата для суффикса .psib
+func CreateTSVFile(filename string) (*TSVWriter, error) {
+	return io.CreateTSVFile(filename)
+}
+
+// Format - формат файлов, которые стороны передают друг другу.
+// Читатели определяют формат автоматически
+type Format = io.Format
+
+const (
+	FormatTSV    = io.FormatTSV
+	FormatBinary = io.FormatBinary
+)
+
+// CreateFile создает файл записей в заданном формате. Версия протокола
+// сохраняется в заголовке бинарного файла
+func CreateFile(filename string, format Format, version ProtocolVersion) (*TSVWriter, error) {
+	return io.CreateFile(filename, format, int(version))
+}
+
+type nopWriteCloser struct {
+	goio.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Stats - результат шага протокола
+type Stats struct {
+	// Records - количество обработанных записей
+	Records int
+	// Matched - количество совпадений, если шаг вычисляет пересечение
+	Matched int
+	// Labels - количество записанных меток в режиме labeled без меток фиктивных записей
+	Labels int
+	// Padded - количество фиктивных записей, добавленных Step1 для дополнения
+	Padded int
+	// Rejected - количество пропущенных через RejectFunc строк, они входят в Records
+	Rejected int
+	// MatchedBy - число совпадений alice по типу идентификатора, который их дал
+	MatchedBy map[string]int
+	// Duplicates - отчет Step1 о повторах идентификаторов, если задана политика
+	Duplicates DuplicateReport
+}
+
+// DuplicatePolicy задает обработку идентификатора, который встречается
+// во входных данных Step1 в нескольких строках
+type DuplicatePolicy = protocol.DuplicatePolicy
+
+const (
+	// DuplicatesAll оставляет все вхождения: в режимах standard и labeled
+	// результат alice содержит все пары a_user_id - b_user_id повторов
+	DuplicatesAll = protocol.DuplicatesAll
+	// DuplicatesFirst оставляет первое вхождение в порядке входных данных
+	DuplicatesFirst = protocol.DuplicatesFirst
+	// DuplicatesLast оставляет последнее вхождение в порядке входных данных
+	DuplicatesLast = protocol.DuplicatesLast
+	// DuplicatesError завершает Step1 с ErrDuplicateID
+	DuplicatesError = protocol.DuplicatesError
+)
+
+// ParseDuplicatePolicy проверяет название политики. Пустая строка означает DuplicatesAll
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	return protocol.ParseDuplicatePolicy(name)
+}
+
+// DuplicateReport - число повторяющихся идентификаторов, их повторных
+// вхождений и вхождений, отброшенных политикой
+type DuplicateReport = protocol.DuplicateReport
+
+// OutputMode задает, какие записи пишет Step2: bob по умолчанию пишет все
+// записи alice, alice - только совпавшие
+type OutputMode = protocol.OutputMode
+
+const (
+	// OutputMatched оставляет только совпавшие записи
+	OutputMatched = protocol.OutputMatched
+	// OutputAll оставляет все записи, у несовпавших b_user_id пустой.
+	// Результат alice содержит строку на каждый a_user_id
+	OutputAll = protocol.OutputAll
+	// OutputUnmatched оставляет только записи без совпадения, доступен alice
+	OutputUnmatched = protocol.OutputUnmatched
+)
+
+// ParseOutputMode проверяет название режима вывода. Пустая строка означает
+// режим стороны по умолчанию
+func ParseOutputMode(name string) (OutputMode, error) {
+	return protocol.ParseOutputMode(name)
+}
+
+// NormalizePhone удаляет форматирование и приводит телефон к E.164.
+// Национальные номера без кода страны разбираются по правилам defaultRegion
+// (например, RU: 8 (999) 123-45-67 -> +79991234567)
+func NormalizePhone(phone, defaultRegion string) (string, error) {
+	return validation.NormalizePhone(phone, defaultRegion)
+}
+
+// Типы идентификаторов. Начиная с ProtocolV3 тип входит в хеш, поэтому
+// одинаковые значения разных типов не совпадают
+const (
+	IDTypePhone = validation.IDTypePhone
+	IDTypeEmail = validation.IDTypeEmail
+	IDTypeMAID  = validation.IDTypeMAID
+	IDTypeRaw   = validation.IDTypeRaw
+)
+
+// ValidateIDTypes проверяет, что типы колонок идентификаторов зарегистрированы,
+// не повторяются и поддерживаются версией протокола
+func ValidateIDTypes(names []string, version ProtocolVersion) error {
+	_, err := protocol.LookupIDTypes(names, version)
+	return err
+}
+
+// Step1Options - параметры обработки данных, общие для BobSession,
+// AliceSession и PartySession. Сессии встраивают их, поэтому поля задаются
+// прямо у сессии, например session.PadTo
+type Step1Options struct {
+	// MemoryLimit > 0 включает сортировку на диске в TempDir вместо загрузки
+	// данных в память: для перестановки строк в Step1, в Step2 bob и alice
+	// и в Reencrypt. Ограничивает размер буферов сортировки в байтах
+	MemoryLimit int64
+	TempDir     string
+	// PointEncoding - представление точек в выходных данных, по умолчанию несжатое
+	PointEncoding PointEncoding
+	// PadTo и PadBucket дополняют выходные данные Step1 фиктивными записями
+	// со случайными точками до не менее PadTo записей и до кратного PadBucket,
+	// чтобы их число не выдавало размер множества. Следующие шаги фиктивные
+	// записи не сопоставляют
+	PadTo     int
+	PadBucket int
+	// Reject, если задана, получает невалидные строки входных данных Step1
+	// вместо остановки на первой из них
+	Reject RejectFunc
+	// Normalize включает приведение идентификаторов к канонической форме
+	// их типа перед проверкой и хешированием: телефонов к E.164 с регионом
+	// DefaultRegion, email к нижнему регистру (FoldGmail дополнительно
+	// сводит адреса gmail.com к одному ящику)
+	Normalize     bool
+	DefaultRegion string
+	FoldGmail     bool
+	// Duplicates - политика для идентификаторов, повторяющихся в нескольких
+	// строках входных данных Step1. Если не задана, остаются все вхождения
+	// и отчет о повторах не строится
+	Duplicates DuplicatePolicy
+}
+
+func (o *Step1Options) external() protocol.ExternalConfig {
+	return protocol.ExternalConfig{MemoryLimit: o.MemoryLimit, TempDir: o.TempDir}
+}
+
+func (o *Step1Options) padding() protocol.Padding {
+	return protocol.Padding{To: o.PadTo, Bucket: o.PadBucket}
+}
+
+// inputConfig собирает обработку входных записей Step1 с колонками idTypes.
+// RejectFunc вызывается из одной горутины в порядке строк, поэтому счетчик
+// без синхронизации
+func (o *Step1Options) inputConfig(idTypes []string, stats *Stats) (protocol.InputConfig, error) {
+	config := protocol.InputConfig{IDTypes: idTypes, Duplicates: o.Duplicates}
+	if o.Duplicates != "" {
+		config.DuplicateReport = &stats.Duplicates
+	}
+
+	if o.Normalize {
+		if err := validation.ValidateRegion(o.DefaultRegion); err != nil {
+			return config, err
+		}
+		opts := validation.NormalizeOptions{DefaultRegion: o.DefaultRegion, FoldGmail: o.FoldGmail}
+		config.Normalize = func(idType validation.IDType, id string) (string, error) {
+			return idType.Normalize(id, opts)
+		}
+	}
+
+	if reject := o.Reject; reject != nil {
+		config.Reject = func(rowErr *RowError, record []string) error {
+			if err := reject(rowErr, record); err != nil {
+				return err
+			}
+			stats.Rejected++
+			return nil
+		}
+	}
+
+	return config, nil
+}
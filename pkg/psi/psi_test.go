@@ -0,0 +1,1212 @@
+package psi_test
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+const (
+	bobInput   = "+79991234567\tb_user_001\n+79991234568\tb_user_002\n+79991234569\tb_user_003\n+79991234570\tb_user_004\n"
+	aliceInput = "+79991234567\ta_user_id_123\n+79991234570\ta_user_id_456\n+79991234569\ta_user_id_789\n+79990000000\ta_user_id_000\n"
+)
+
+var expected = map[string]string{
+	"a_user_id_123": "b_user_001",
+	"a_user_id_456": "b_user_004",
+	"a_user_id_789": "b_user_003",
+}
+
+type buffer struct {
+	strings.Builder
+	writer *psi.TSVWriter
+}
+
+func newBuffer() *buffer {
+	b := &buffer{}
+	b.writer = psi.NewTSVWriter(&b.Builder)
+	return b
+}
+
+func (b *buffer) reader(t *testing.T) *psi.TSVReader {
+	t.Helper()
+	if err := b.writer.Close(); err != nil {
+		t.Fatalf("ошибка записи: %v", err)
+	}
+	return psi.NewTSVReader(strings.NewReader(b.String()))
+}
+
+func input(data string) *psi.TSVReader {
+	return psi.NewTSVReader(strings.NewReader(data))
+}
+
+func TestSessions(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		mode        string
+		bobPoints   psi.PointEncoding
+		alicePoints psi.PointEncoding
+		memoryLimit int64
+	}{
+		{name: "standard", mode: psi.ModeStandard},
+		{name: "labeled", mode: psi.ModeLabeled},
+		{name: "standard/compressed", mode: psi.ModeStandard, bobPoints: psi.PointCompressed, alicePoints: psi.PointCompressed},
+		{name: "standard/mixed-points", mode: psi.ModeStandard, bobPoints: psi.PointCompressed},
+		{name: "standard/mixed-points-external", mode: psi.ModeStandard, alicePoints: psi.PointCompressed, memoryLimit: 1 << 20},
+		{name: "labeled/mixed-points", mode: psi.ModeLabeled, alicePoints: psi.PointCompressed},
+		{name: "labeled/mixed-points-external", mode: psi.ModeLabeled, bobPoints: psi.PointCompressed, memoryLimit: 1 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mode := tc.mode
+
+			bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob.PointEncoding = tc.bobPoints
+			bob.MemoryLimit = tc.memoryLimit
+			bob.TempDir = t.TempDir()
+
+			bobEncrypted, bobMapping := newBuffer(), newBuffer()
+			if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, bobMapping.writer); err != nil {
+				t.Fatalf("bob step1: %v", err)
+			}
+
+			// Ключ K передается alice в текстовом виде
+			keyText, err := bob.HMACKey.MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hmacKey psi.HMACKey
+			if err := hmacKey.UnmarshalText(keyText); err != nil {
+				t.Fatal(err)
+			}
+
+			alice, err := psi.NewAliceSession(hmacKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice.PointEncoding = tc.alicePoints
+			alice.MemoryLimit = tc.memoryLimit
+			alice.TempDir = t.TempDir()
+
+			bobEncryptedA := newBuffer()
+			if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+				t.Fatalf("alice reencrypt: %v", err)
+			}
+
+			aliceEncrypted, mapping := newBuffer(), newBuffer()
+			if _, err := alice.Step1(input(aliceInput), aliceEncrypted.writer, mapping.writer); err != nil {
+				t.Fatalf("alice step1: %v", err)
+			}
+
+			bobFinal, output := newBuffer(), newBuffer()
+			var stats psi.Stats
+			if mode == psi.ModeLabeled {
+				labels := newBuffer()
+				if _, err := bob.Step2Labeled(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer, labels.writer); err != nil {
+					t.Fatalf("bob step2: %v", err)
+				}
+				stats, err = alice.Step2Labeled(mapping.reader(t), bobFinal.reader(t), labels.reader(t), output.writer)
+			} else {
+				if _, err := bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+					t.Fatalf("bob step2: %v", err)
+				}
+				stats, err = alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer)
+			}
+			if err != nil {
+				t.Fatalf("alice step2: %v", err)
+			}
+
+			if stats.Records != 4 || stats.Matched != 3 {
+				t.Errorf("ожидается 4 записи и 3 совпадения, получено %+v", stats)
+			}
+
+			reader := output.reader(t)
+			found := 0
+			for {
+				record, err := reader.Read()
+				if err != nil {
+					break
+				}
+				if expected[record[0]] != record[1] {
+					t.Errorf("неверное совпадение %s -> %s", record[0], record[1])
+				}
+				found++
+			}
+			if found != len(expected) {
+				t.Errorf("ожидается %d совпадений, получено %d", len(expected), found)
+			}
+		})
+	}
+}
+
+func TestInvalidPhoneRowError(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bob.Step1(input("+79991234567\tb1\n89991234568\tb2\n"), newBuffer().writer, newBuffer().writer)
+
+	var rowErr *psi.RowError
+	if !errors.As(err, &rowErr) {
+		t.Fatalf("ожидалась RowError, получено %v", err)
+	}
+	if rowErr.Row != 1 {
+		t.Errorf("ожидается строка 1, получено %d", rowErr.Row)
+	}
+	if !errors.Is(err, psi.ErrInvalidPhone) {
+		t.Errorf("ожидалась ErrInvalidPhone, получено %v", err)
+	}
+}
+
+func TestInvalidPhoneFirstRow(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.BatchSize = 4
+
+	// Ошибка должна указывать на первую невалидную строку независимо
+	// от порядка обработки батчей
+	var data strings.Builder
+	for i := range 100 {
+		if i == 37 || i == 90 {
+			data.WriteString("invalid\tb\n")
+			continue
+		}
+		fmt.Fprintf(&data, "+7999%07d\tb_%d\n", i, i)
+	}
+
+	_, err = bob.Step1(input(data.String()), newBuffer().writer, newBuffer().writer)
+
+	var rowErr *psi.RowError
+	if !errors.As(err, &rowErr) || rowErr.Row != 37 {
+		t.Errorf("ожидалась ошибка в строке 37, получено %v", err)
+	}
+}
+
+func TestRejectInvalidRows(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type rejected struct {
+		row    int
+		record []string
+	}
+	var bobRejected, aliceRejected []rejected
+	bob.Reject = func(rowErr *psi.RowError, record []string) error {
+		bobRejected = append(bobRejected, rejected{rowErr.Row, record})
+		return nil
+	}
+
+	// Пропущенные строки не должны сдвигать индексы следующих строк bob
+	bobData := "+79991234567\tb_user_001\n89991234568\tb_user_002\nbroken\n+79991234569\tb_user_003\n+79991234570\tb_user_004\n"
+	aliceData := "+79991234567\ta_user_id_123\n+7 999 123 45 70\ta_bad\n+79991234570\ta_user_id_456\n+79991234569\ta_user_id_789\n"
+
+	bobEncrypted, bobMapping := newBuffer(), newBuffer()
+	stats, err := bob.Step1(input(bobData), bobEncrypted.writer, bobMapping.writer)
+	if err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+	if stats.Records != 5 || stats.Rejected != 2 {
+		t.Errorf("ожидается 5 записей и 2 пропущенные, получено %+v", stats)
+	}
+
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Reject = func(rowErr *psi.RowError, record []string) error {
+		aliceRejected = append(aliceRejected, rejected{rowErr.Row, record})
+		return nil
+	}
+
+	bobEncryptedA := newBuffer()
+	if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+		t.Fatalf("alice reencrypt: %v", err)
+	}
+
+	aliceEncrypted, mapping := newBuffer(), newBuffer()
+	if _, err := alice.Step1(input(aliceData), aliceEncrypted.writer, mapping.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+
+	bobFinal, output := newBuffer(), newBuffer()
+	if _, err := bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+		t.Fatalf("bob step2: %v", err)
+	}
+	if _, err := alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer); err != nil {
+		t.Fatalf("alice step2: %v", err)
+	}
+
+	reader := output.reader(t)
+	found := 0
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			break
+		}
+		if expected[record[0]] != record[1] {
+			t.Errorf("неверное совпадение %s -> %s", record[0], record[1])
+		}
+		found++
+	}
+	if found != len(expected) {
+		t.Errorf("ожидается %d совпадений, получено %d", len(expected), found)
+	}
+
+	if len(bobRejected) != 2 || bobRejected[0].row != 1 || bobRejected[1].row != 2 || bobRejected[1].record[0] != "broken" {
+		t.Errorf("неверные пропущенные строки bob: %v", bobRejected)
+	}
+	if len(aliceRejected) != 1 || aliceRejected[0].row != 1 {
+		t.Errorf("неверные пропущенные строки alice: %v", aliceRejected)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Normalize = true
+	bob.DefaultRegion = "RU"
+
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Normalize = true
+	alice.DefaultRegion = "RU"
+
+	bobEncrypted, bobMapping := newBuffer(), newBuffer()
+	if _, err := bob.Step1(input("8 (999) 123-45-67\tb_user_001\n+7 999 123 45 70\tb_user_004\n"), bobEncrypted.writer, bobMapping.writer); err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+
+	bobEncryptedA := newBuffer()
+	if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+		t.Fatalf("alice reencrypt: %v", err)
+	}
+
+	aliceEncrypted, mapping := newBuffer(), newBuffer()
+	if _, err := alice.Step1(input("+79991234567\ta_user_id_123\n79991234570\ta_user_id_456\n"), aliceEncrypted.writer, mapping.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+
+	bobFinal, output := newBuffer(), newBuffer()
+	if _, err := bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+		t.Fatalf("bob step2: %v", err)
+	}
+
+	stats, err := alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer)
+	if err != nil {
+		t.Fatalf("alice step2: %v", err)
+	}
+	if stats.Matched != 2 {
+		t.Errorf("ожидается 2 совпадения после нормализации, получено %d", stats.Matched)
+	}
+}
+
+func TestNormalizeUnknownRegion(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Normalize = true
+	bob.DefaultRegion = "XX"
+
+	if _, err := bob.Step1(input(bobInput), newBuffer().writer, newBuffer().writer); !errors.Is(err, psi.ErrUnknownRegion) {
+		t.Errorf("ожидалась ErrUnknownRegion, получено %v", err)
+	}
+}
+
+func TestEmailIDType(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.HMACKey.IDTypes = []string{psi.IDTypeEmail}
+	bob.Normalize = true
+	bob.FoldGmail = true
+
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Normalize = true
+	alice.FoldGmail = true
+
+	bobInput := " First.Last+promo@Gmail.com\tb_user_001\nuser@example.com\tb_user_004\n"
+
+	bobEncrypted, bobMapping := newBuffer(), newBuffer()
+	if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, bobMapping.writer); err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+
+	bobEncryptedA := newBuffer()
+	if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+		t.Fatalf("alice reencrypt: %v", err)
+	}
+
+	aliceEncrypted, mapping := newBuffer(), newBuffer()
+	if _, err := alice.Step1(input("firstlast@googlemail.com\ta_user_id_123\nUSER@example.com\ta_user_id_456\n"), aliceEncrypted.writer, mapping.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+
+	bobFinal, output := newBuffer(), newBuffer()
+	if _, err := bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+		t.Fatalf("bob step2: %v", err)
+	}
+
+	stats, err := alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer)
+	if err != nil {
+		t.Fatalf("alice step2: %v", err)
+	}
+	if stats.Matched != 2 {
+		t.Errorf("ожидается 2 совпадения после нормализации email, получено %d", stats.Matched)
+	}
+}
+
+func TestStep1Permutation(t *testing.T) {
+	const rows = 64
+	var data strings.Builder
+	for i := range rows {
+		fmt.Fprintf(&data, "+7999%07d\tb%d\n", i, i)
+	}
+
+	for _, memoryLimit := range []int64{0, 1024} {
+		t.Run(fmt.Sprintf("memory-limit=%d", memoryLimit), func(t *testing.T) {
+			bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob.MemoryLimit = memoryLimit
+			bob.TempDir = t.TempDir()
+
+			encrypted, mapping := newBuffer(), newBuffer()
+			if _, err := bob.Step1(input(data.String()), encrypted.writer, mapping.writer); err != nil {
+				t.Fatalf("bob step1: %v", err)
+			}
+
+			// Индексы идут подряд в порядке файла и не совпадают с номерами строк
+			encryptedReader, mappingReader := encrypted.reader(t), mapping.reader(t)
+			unchanged := 0
+			for i := range rows {
+				record, err := encryptedReader.Read()
+				if err != nil {
+					t.Fatalf("запись %d: %v", i, err)
+				}
+				mappingRecord, err := mappingReader.Read()
+				if err != nil {
+					t.Fatalf("запись маппинга %d: %v", i, err)
+				}
+
+				index := fmt.Sprint(i)
+				if record[0] != index || mappingRecord[0] != index {
+					t.Fatalf("запись %d: индексы %q и %q", i, record[0], mappingRecord[0])
+				}
+				if mappingRecord[1] == "b"+index {
+					unchanged++
+				}
+			}
+			if unchanged == rows {
+				t.Error("строки не переставлены")
+			}
+		})
+	}
+}
+
+func lines(t *testing.T, b *buffer) int {
+	t.Helper()
+	b.reader(t)
+	return strings.Count(b.String(), "\n")
+}
+
+func TestPadding(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		mode        string
+		memoryLimit int64
+	}{
+		{name: "standard", mode: psi.ModeStandard},
+		{name: "standard/external", mode: psi.ModeStandard, memoryLimit: 1024},
+		{name: "labeled", mode: psi.ModeLabeled},
+		{name: "labeled/external", mode: psi.ModeLabeled, memoryLimit: 1024},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob.MemoryLimit = tc.memoryLimit
+			bob.TempDir = t.TempDir()
+			bob.PadBucket = 16
+
+			alice, err := psi.NewAliceSession(bob.HMACKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice.MemoryLimit = tc.memoryLimit
+			alice.TempDir = t.TempDir()
+			alice.PadTo = 10
+
+			bobEncrypted, bobMapping := newBuffer(), newBuffer()
+			stats, err := bob.Step1(input(bobInput), bobEncrypted.writer, bobMapping.writer)
+			if err != nil {
+				t.Fatalf("bob step1: %v", err)
+			}
+			if stats.Records != 4 || stats.Padded != 12 {
+				t.Errorf("bob step1: ожидается 4 записи и 12 фиктивных, получено %+v", stats)
+			}
+			if n := lines(t, bobEncrypted); n != 16 {
+				t.Errorf("bob step1: ожидается 16 передаваемых записей, получено %d", n)
+			}
+			if n := lines(t, bobMapping); n != 4 {
+				t.Errorf("bob step1: ожидается 4 записи маппинга, получено %d", n)
+			}
+
+			bobEncryptedA := newBuffer()
+			if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+				t.Fatalf("alice reencrypt: %v", err)
+			}
+
+			aliceEncrypted, mapping := newBuffer(), newBuffer()
+			stats, err = alice.Step1(input(aliceInput), aliceEncrypted.writer, mapping.writer)
+			if err != nil {
+				t.Fatalf("alice step1: %v", err)
+			}
+			if stats.Records != 4 || stats.Padded != 6 {
+				t.Errorf("alice step1: ожидается 4 записи и 6 фиктивных, получено %+v", stats)
+			}
+			if n := lines(t, aliceEncrypted); n != 10 {
+				t.Errorf("alice step1: ожидается 10 передаваемых записей, получено %d", n)
+			}
+
+			bobFinal, output := newBuffer(), newBuffer()
+			var bobStats psi.Stats
+			if tc.mode == psi.ModeLabeled {
+				labels := newBuffer()
+				bobStats, err = bob.Step2Labeled(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer, labels.writer)
+				if err != nil {
+					t.Fatalf("bob step2: %v", err)
+				}
+				// Метки пишутся и для фиктивных записей, но не учитываются
+				if bobStats.Labels != 4 {
+					t.Errorf("bob step2: ожидается 4 метки, получено %+v", bobStats)
+				}
+				if n := lines(t, labels); n != 16 {
+					t.Errorf("bob step2: ожидается 16 меток в файле, получено %d", n)
+				}
+				stats, err = alice.Step2Labeled(mapping.reader(t), bobFinal.reader(t), labels.reader(t), output.writer)
+			} else {
+				bobStats, err = bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer)
+				if err != nil {
+					t.Fatalf("bob step2: %v", err)
+				}
+				if bobStats.Records != 10 || bobStats.Matched != 3 {
+					t.Errorf("bob step2: ожидается 10 записей и 3 совпадения, получено %+v", bobStats)
+				}
+				stats, err = alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer)
+			}
+			if err != nil {
+				t.Fatalf("alice step2: %v", err)
+			}
+			if stats.Records != 4 || stats.Matched != 3 {
+				t.Errorf("alice step2: ожидается 4 записи и 3 совпадения, получено %+v", stats)
+			}
+
+			output.reader(t)
+			for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+				aUserID, bUserID, _ := strings.Cut(line, "\t")
+				if expected[aUserID] != bUserID {
+					t.Errorf("неверное совпадение %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestPaddingCardinality(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.PadTo = 100
+
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.PadBucket = 8
+
+	bobEncrypted := newBuffer()
+	if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, newBuffer().writer); err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+
+	bobEncryptedA := newBuffer()
+	if _, err := alice.ReencryptBobCardinality(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+		t.Fatalf("alice reencrypt: %v", err)
+	}
+
+	aliceEncrypted := newBuffer()
+	stats, err := alice.Step1Cardinality(input(aliceInput), aliceEncrypted.writer)
+	if err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+	if stats.Padded != 4 {
+		t.Errorf("alice step1: ожидается 4 фиктивных записи, получено %+v", stats)
+	}
+
+	stats, err = bob.Step2Cardinality(bobEncryptedA.reader(t), aliceEncrypted.reader(t))
+	if err != nil {
+		t.Fatalf("bob step2: %v", err)
+	}
+	if stats.Records != 8 || stats.Matched != 3 {
+		t.Errorf("ожидается 8 записей и 3 совпадения, получено %+v", stats)
+	}
+}
+
+func TestPaddingNegative(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.PadTo = -1
+
+	if _, err := bob.Step1(input(bobInput), newBuffer().writer, newBuffer().writer); err == nil {
+		t.Error("ожидается ошибка для отрицательного дополнения")
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		memoryLimit int64
+	}{
+		{name: "memory"},
+		{name: "external", memoryLimit: 1 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob.MemoryLimit = tc.memoryLimit
+			bob.TempDir = t.TempDir()
+
+			alice, err := psi.NewAliceSession(bob.HMACKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice.MemoryLimit = tc.memoryLimit
+			alice.TempDir = t.TempDir()
+
+			bobEncrypted := newBuffer()
+			if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, newBuffer().writer); err != nil {
+				t.Fatalf("bob step1: %v", err)
+			}
+
+			bobEncryptedA := newBuffer()
+			if _, err := alice.ReencryptBobCardinality(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+				t.Fatalf("alice reencrypt: %v", err)
+			}
+
+			aliceEncrypted := newBuffer()
+			if _, err := alice.Step1Cardinality(input(aliceInput+aliceInput), aliceEncrypted.writer); err != nil {
+				t.Fatalf("alice step1: %v", err)
+			}
+
+			// Bob не должен получить ни индексов, ни a_user_id
+			aliceEncrypted.reader(t)
+			for _, line := range strings.Split(strings.TrimSpace(aliceEncrypted.String()), "\n") {
+				if strings.Contains(line, "\t") {
+					t.Fatalf("запись alice содержит больше одного поля: %q", line)
+				}
+			}
+
+			stats, err := bob.Step2Cardinality(bobEncryptedA.reader(t), aliceEncrypted.reader(t))
+			if err != nil {
+				t.Fatalf("bob step2: %v", err)
+			}
+			if stats.Records != 8 || stats.Matched != 6 {
+				t.Errorf("ожидается 8 записей и 6 совпадений, получено %+v", stats)
+			}
+		})
+	}
+}
+
+func TestSum(t *testing.T) {
+	const aliceValues = "+79991234567\t1000\n+79991234570\t250\n+79991234569\t5\n+79990000000\t777\n+79991234567\t1\n"
+
+	for _, tc := range []struct {
+		name        string
+		memoryLimit int64
+	}{
+		{name: "memory"},
+		{name: "external", memoryLimit: 1 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob.MemoryLimit = tc.memoryLimit
+			bob.TempDir = t.TempDir()
+
+			alice, err := psi.NewAliceSession(bob.HMACKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice.MemoryLimit = tc.memoryLimit
+			alice.TempDir = t.TempDir()
+			alice.PadTo = 16
+
+			bobEncrypted := newBuffer()
+			if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, newBuffer().writer); err != nil {
+				t.Fatalf("bob step1: %v", err)
+			}
+
+			bobEncryptedA := newBuffer()
+			if _, err := alice.ReencryptBobCardinality(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+				t.Fatalf("alice reencrypt: %v", err)
+			}
+
+			aliceEncrypted := newBuffer()
+			if _, err := alice.Step1Sum(input(aliceValues), aliceEncrypted.writer); err != nil {
+				t.Fatalf("alice step1: %v", err)
+			}
+
+			// Открытый ключ передается bob в виде байтов
+			sumKey, err := psi.NewSumPublicKey(alice.SumKey.PublicKey().Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats, ciphertext, err := bob.Step2Sum(bobEncryptedA.reader(t), aliceEncrypted.reader(t), sumKey)
+			if err != nil {
+				t.Fatalf("bob step2: %v", err)
+			}
+			if stats.Records != 16 || stats.Matched != 4 {
+				t.Errorf("ожидается 16 записей и 4 совпадения, получено %+v", stats)
+			}
+
+			sum, err := alice.DecryptSum(ciphertext, 1<<20)
+			if err != nil {
+				t.Fatalf("расшифровка суммы: %v", err)
+			}
+			if sum != 1256 {
+				t.Errorf("ожидается сумма 1256, получено %d", sum)
+			}
+		})
+	}
+}
+
+func TestSumInvalidValue(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = alice.Step1Sum(input("+79991234567\t10\n+79991234570\t-5\n"), newBuffer().writer)
+	var rowErr *psi.RowError
+	if !errors.Is(err, psi.ErrInvalidValue) || !errors.As(err, &rowErr) || rowErr.Row != 1 {
+		t.Errorf("ожидается ErrInvalidValue в строке 1, получено %v", err)
+	}
+
+	// Данные режима cardinality не принимаются как данные режима sum
+	aliceEncrypted := newBuffer()
+	if _, err := alice.Step1Cardinality(input(aliceInput), aliceEncrypted.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+	_, _, err = bob.Step2Sum(input(""), aliceEncrypted.reader(t), alice.SumKey.PublicKey())
+	if !errors.Is(err, psi.ErrModeMismatch) {
+		t.Errorf("ожидается ErrModeMismatch, получено %v", err)
+	}
+}
+
+func TestCardinalityModeMismatch(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobEncrypted := newBuffer()
+	if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, newBuffer().writer); err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+
+	bobEncryptedA := newBuffer()
+	if _, err := alice.ReencryptBobCardinality(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+		t.Fatalf("alice reencrypt: %v", err)
+	}
+
+	// Alice выполнила обычный step1: точки с индексами
+	aliceEncrypted, mapping := newBuffer(), newBuffer()
+	if _, err := alice.Step1(input(aliceInput), aliceEncrypted.writer, mapping.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+
+	_, err = bob.Step2Cardinality(bobEncryptedA.reader(t), aliceEncrypted.reader(t))
+	if !errors.Is(err, psi.ErrModeMismatch) {
+		t.Errorf("ожидается ErrModeMismatch, получено %v", err)
+	}
+
+	bob.HMACKey.IDTypes = []string{psi.IDTypePhone, psi.IDTypeEmail}
+	if _, err := bob.Step2Cardinality(input(""), input("")); !errors.Is(err, psi.ErrCardinalityColumns) {
+		t.Errorf("ожидается ErrCardinalityColumns, получено %v", err)
+	}
+}
+
+func TestMultiIDPriority(t *testing.T) {
+	const (
+		bobMulti = "+79991234567\tuser1@example.com\tb1\n" +
+			"+79991234568\tshared@example.com\tb2\n" +
+			"\tonly@example.com\tb3\n"
+		// a3 совпадает с b2 по телефону и с b1 по email
+		aliceMulti = "+79991234567\tother@example.com\ta1\n" +
+			"+79990000000\tonly@example.com\ta2\n" +
+			"+79991234568\tuser1@example.com\ta3\n" +
+			"+79990000001\t\ta4\n"
+	)
+
+	for _, tc := range []struct {
+		name        string
+		mode        string
+		memoryLimit int64
+		priority    []string
+		expected    string
+	}{
+		{name: "standard", mode: psi.ModeStandard,
+			expected: "a1\tb1\tphone\na2\tb3\temail\na3\tb2\tphone\n"},
+		{name: "standard/email-first", mode: psi.ModeStandard, priority: []string{psi.IDTypeEmail},
+			expected: "a1\tb1\tphone\na2\tb3\temail\na3\tb1\temail\n"},
+		{name: "standard/external", mode: psi.ModeStandard, memoryLimit: 1 << 20, priority: []string{psi.IDTypeEmail, psi.IDTypePhone},
+			expected: "a1\tb1\tphone\na2\tb3\temail\na3\tb1\temail\n"},
+		{name: "labeled", mode: psi.ModeLabeled,
+			expected: "a1\tb1\tphone\na2\tb3\temail\na3\tb2\tphone\n"},
+		{name: "labeled/external", mode: psi.ModeLabeled, memoryLimit: 1 << 20, priority: []string{psi.IDTypeEmail},
+			expected: "a1\tb1\tphone\na2\tb3\temail\na3\tb1\temail\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob.HMACKey.IDTypes = []string{psi.IDTypePhone, psi.IDTypeEmail}
+			bob.MemoryLimit = tc.memoryLimit
+			bob.TempDir = t.TempDir()
+
+			alice, err := psi.NewAliceSession(bob.HMACKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice.Priority = tc.priority
+			alice.MemoryLimit = tc.memoryLimit
+			alice.TempDir = t.TempDir()
+
+			bobEncrypted, bobMapping := newBuffer(), newBuffer()
+			if _, err := bob.Step1(input(bobMulti), bobEncrypted.writer, bobMapping.writer); err != nil {
+				t.Fatalf("bob step1: %v", err)
+			}
+
+			bobEncryptedA := newBuffer()
+			if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+				t.Fatalf("alice reencrypt: %v", err)
+			}
+
+			aliceEncrypted, mapping := newBuffer(), newBuffer()
+			if _, err := alice.Step1(input(aliceMulti), aliceEncrypted.writer, mapping.writer); err != nil {
+				t.Fatalf("alice step1: %v", err)
+			}
+
+			bobFinal, output := newBuffer(), newBuffer()
+			var stats psi.Stats
+			if tc.mode == psi.ModeLabeled {
+				labels := newBuffer()
+				if _, err := bob.Step2Labeled(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer, labels.writer); err != nil {
+					t.Fatalf("bob step2: %v", err)
+				}
+				stats, err = alice.Step2Labeled(mapping.reader(t), bobFinal.reader(t), labels.reader(t), output.writer)
+			} else {
+				if _, err := bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+					t.Fatalf("bob step2: %v", err)
+				}
+				stats, err = alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer)
+			}
+			if err != nil {
+				t.Fatalf("alice step2: %v", err)
+			}
+
+			// Строки alice переставлены на шаге 1, поэтому порядок вывода случаен
+			output.reader(t)
+			lines := strings.SplitAfter(output.String(), "\n")
+			slices.Sort(lines)
+			if got := strings.Join(lines, ""); got != tc.expected {
+				t.Errorf("получено:\n%s\nожидалось:\n%s", got, tc.expected)
+			}
+			if stats.Matched != 3 || stats.MatchedBy[psi.IDTypePhone]+stats.MatchedBy[psi.IDTypeEmail] != 3 {
+				t.Errorf("ожидается 3 совпадения, получено %+v", stats)
+			}
+		})
+	}
+}
+
+func TestOutputMode(t *testing.T) {
+	const (
+		matched   = "a_user_id_123\tb_user_001\na_user_id_456\tb_user_004\na_user_id_789\tb_user_003\n"
+		unmatched = "a_user_id_000\t\n"
+	)
+
+	for _, tc := range []struct {
+		name        string
+		mode        string
+		bobOutput   psi.OutputMode
+		aliceOutput psi.OutputMode
+		expected    string
+	}{
+		{name: "default", mode: psi.ModeStandard, expected: matched},
+		{name: "all", mode: psi.ModeStandard, aliceOutput: psi.OutputAll, expected: unmatched + matched},
+		{name: "unmatched", mode: psi.ModeStandard, aliceOutput: psi.OutputUnmatched, expected: unmatched},
+		// bob не передает несовпавшие записи, alice восстанавливает их по маппингу
+		{name: "bob-matched/all", mode: psi.ModeStandard, bobOutput: psi.OutputMatched, aliceOutput: psi.OutputAll, expected: unmatched + matched},
+		{name: "bob-matched/unmatched", mode: psi.ModeStandard, bobOutput: psi.OutputMatched, aliceOutput: psi.OutputUnmatched, expected: unmatched},
+		{name: "labeled/all", mode: psi.ModeLabeled, aliceOutput: psi.OutputAll, expected: unmatched + matched},
+		{name: "labeled/unmatched", mode: psi.ModeLabeled, aliceOutput: psi.OutputUnmatched, expected: unmatched},
+	} {
+		for _, memoryLimit := range []int64{0, 1 << 20} {
+			t.Run(fmt.Sprintf("%s/memory_limit=%d", tc.name, memoryLimit), func(t *testing.T) {
+				bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bob.Output = tc.bobOutput
+				bob.MemoryLimit = memoryLimit
+				bob.TempDir = t.TempDir()
+
+				alice, err := psi.NewAliceSession(bob.HMACKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				alice.Output = tc.aliceOutput
+				alice.MemoryLimit = memoryLimit
+				alice.TempDir = t.TempDir()
+
+				bobEncrypted, bobMapping := newBuffer(), newBuffer()
+				if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, bobMapping.writer); err != nil {
+					t.Fatalf("bob step1: %v", err)
+				}
+
+				bobEncryptedA := newBuffer()
+				if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+					t.Fatalf("alice reencrypt: %v", err)
+				}
+
+				aliceEncrypted, mapping := newBuffer(), newBuffer()
+				if _, err := alice.Step1(input(aliceInput), aliceEncrypted.writer, mapping.writer); err != nil {
+					t.Fatalf("alice step1: %v", err)
+				}
+
+				bobFinal, output := newBuffer(), newBuffer()
+				var bobStats, stats psi.Stats
+				if tc.mode == psi.ModeLabeled {
+					labels := newBuffer()
+					if _, err := bob.Step2Labeled(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer, labels.writer); err != nil {
+						t.Fatalf("bob step2: %v", err)
+					}
+					stats, err = alice.Step2Labeled(mapping.reader(t), bobFinal.reader(t), labels.reader(t), output.writer)
+				} else {
+					if bobStats, err = bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+						t.Fatalf("bob step2: %v", err)
+					}
+					stats, err = alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer)
+				}
+				if err != nil {
+					t.Fatalf("alice step2: %v", err)
+				}
+
+				if tc.bobOutput == psi.OutputMatched {
+					if got := lines(t, bobFinal); got != bobStats.Matched {
+						t.Errorf("bob_final: ожидается %d совпавших записей, получено %d", bobStats.Matched, got)
+					}
+				}
+
+				output.reader(t)
+				got := strings.SplitAfter(output.String(), "\n")
+				slices.Sort(got)
+				if strings.Join(got, "") != tc.expected {
+					t.Errorf("получено:\n%s\nожидалось:\n%s", strings.Join(got, ""), tc.expected)
+				}
+				if stats.Records != 4 || stats.Matched != 3 {
+					t.Errorf("ожидается 4 записи и 3 совпадения, получено %+v", stats)
+				}
+			})
+		}
+	}
+}
+
+func TestOutputModeMultiID(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.HMACKey.IDTypes = []string{psi.IDTypePhone, psi.IDTypeEmail}
+
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Output = psi.OutputAll
+
+	bobEncrypted, bobMapping := newBuffer(), newBuffer()
+	if _, err := bob.Step1(input("+79991234567\tuser1@example.com\tb1\n"), bobEncrypted.writer, bobMapping.writer); err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+
+	bobEncryptedA := newBuffer()
+	if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+		t.Fatalf("alice reencrypt: %v", err)
+	}
+
+	// У a1 совпадает только email, у a2 не совпадает ни один идентификатор
+	aliceEncrypted, mapping := newBuffer(), newBuffer()
+	if _, err := alice.Step1(input("+79990000000\tuser1@example.com\ta1\n+79990000001\tother@example.com\ta2\n"), aliceEncrypted.writer, mapping.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+
+	bobFinal, output := newBuffer(), newBuffer()
+	if _, err := bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+		t.Fatalf("bob step2: %v", err)
+	}
+	if _, err := alice.Step2(mapping.reader(t), bobFinal.reader(t), output.writer); err != nil {
+		t.Fatalf("alice step2: %v", err)
+	}
+
+	output.reader(t)
+	got := strings.SplitAfter(output.String(), "\n")
+	slices.Sort(got)
+	if expected := "a1\tb1\temail\na2\t\t\n"; strings.Join(got, "") != expected {
+		t.Errorf("получено:\n%s\nожидалось:\n%s", strings.Join(got, ""), expected)
+	}
+}
+
+func TestOutputModeBob(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob.Output = psi.OutputUnmatched
+	if _, err := bob.Step2(input(""), input(""), input(""), newBuffer().writer); err == nil {
+		t.Error("ожидается ошибка для режима вывода unmatched у bob")
+	}
+
+	bob.Output = psi.OutputMatched
+	if _, err := bob.Step2Labeled(input(""), input(""), input(""), newBuffer().writer, newBuffer().writer); err == nil {
+		t.Error("ожидается ошибка для режима вывода matched у bob в режиме labeled")
+	}
+
+	if _, err := psi.ParseOutputMode("none"); err == nil {
+		t.Error("ожидается ошибка для неизвестного режима вывода")
+	}
+}
+
+func TestMultiIDValidation(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.ProtocolV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.HMACKey.IDTypes = []string{psi.IDTypePhone, psi.IDTypeEmail}
+	if _, err := bob.Step1(input("+79991234567\tuser@example.com\tb\n"), newBuffer().writer, newBuffer().writer); !errors.Is(err, psi.ErrUnsupportedVersion) {
+		t.Errorf("несколько колонок требуют v3, получено %v", err)
+	}
+
+	if err := psi.ValidateIDTypes([]string{psi.IDTypeEmail, psi.IDTypeEmail}, psi.LatestProtocolVersion); err == nil {
+		t.Error("ожидалась ошибка для повторяющегося типа")
+	}
+
+	alice := psi.AliceSession{HMACKey: psi.HMACKey{IDTypes: []string{psi.IDTypePhone, psi.IDTypeEmail}}, Priority: []string{psi.IDTypeMAID}}
+	if _, err := alice.Step2(input(""), input(""), newBuffer().writer); err == nil {
+		t.Error("ожидалась ошибка для типа в Priority, которого нет среди колонок")
+	}
+
+	// Строка без идентификаторов отклоняется
+	bob, _ = psi.NewBobSession(psi.LatestProtocolVersion)
+	bob.HMACKey.IDTypes = []string{psi.IDTypePhone, psi.IDTypeEmail}
+	if _, err := bob.Step1(input("\t\tb\n"), newBuffer().writer, newBuffer().writer); !errors.Is(err, psi.ErrEmptyID) {
+		t.Errorf("ожидалась ErrEmptyID, получено %v", err)
+	}
+}
+
+func TestIDTypeDomainSeparation(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.HMACKey.IDTypes = []string{psi.IDTypeRaw}
+
+	// Тот же ключ K, но другой тип идентификатора
+	maidKey := bob.HMACKey
+	maidKey.IDTypes = []string{psi.IDTypeMAID}
+	alice, err := psi.NewAliceSession(maidKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.ECDHKey = bob.ECDHKey
+
+	const record = "6d92078a-8246-4ba4-ae5b-76104861e7dc\tuser\n"
+
+	bobEncrypted := newBuffer()
+	if _, err := bob.Step1(input(record), bobEncrypted.writer, newBuffer().writer); err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+	aliceEncrypted, mapping := newBuffer(), newBuffer()
+	if _, err := alice.Step1(input(record), aliceEncrypted.writer, mapping.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+
+	bobEncrypted.writer.Close()
+	aliceEncrypted.writer.Close()
+	if bobEncrypted.Len() == 0 || bobEncrypted.String() == aliceEncrypted.String() {
+		t.Error("одинаковые значения разных типов не должны давать одинаковый хеш")
+	}
+}
+
+func TestIDTypeRequiresV3(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.ProtocolV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.HMACKey.IDTypes = []string{psi.IDTypeEmail}
+
+	if _, err := bob.Step1(input("user@example.com\tb\n"), newBuffer().writer, newBuffer().writer); !errors.Is(err, psi.ErrUnsupportedVersion) {
+		t.Errorf("ожидалась ErrUnsupportedVersion, получено %v", err)
+	}
+
+	bob.HMACKey.IDTypes = []string{"passport"}
+	if _, err := bob.Step1(input(bobInput), newBuffer().writer, newBuffer().writer); !errors.Is(err, psi.ErrUnknownIDType) {
+		t.Errorf("ожидалась ErrUnknownIDType, получено %v", err)
+	}
+}
+
+func TestRejectError(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := errors.New("stop")
+	bob.Reject = func(*psi.RowError, []string) error { return stop }
+
+	if _, err := bob.Step1(input("invalid\tb\n"), newBuffer().writer, newBuffer().writer); !errors.Is(err, stop) {
+		t.Errorf("ожидалась ошибка RejectFunc, получено %v", err)
+	}
+}
+
+func TestInvalidRecord(t *testing.T) {
+	alice, err := psi.NewAliceSession(psi.HMACKey{Key: make([]byte, 32), Version: psi.LatestProtocolVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = alice.ReencryptBob(input("0\n"), newBuffer().writer)
+	if !errors.Is(err, psi.ErrInvalidRecord) {
+		t.Errorf("ожидалась ErrInvalidRecord, получено %v", err)
+	}
+
+	_, err = alice.ReencryptBob(input("0\t04ff\n"), newBuffer().writer)
+	if !errors.Is(err, psi.ErrInvalidPoint) {
+		t.Errorf("ожидалась ErrInvalidPoint, получено %v", err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	if _, err := psi.NewBobSession(99); !errors.Is(err, psi.ErrUnsupportedVersion) {
+		t.Errorf("ожидалась ErrUnsupportedVersion, получено %v", err)
+	}
+}
+
+func TestVerifiableEncryption(t *testing.T) {
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobEncrypted, bobMapping := newBuffer(), newBuffer()
+	if _, err := bob.Step1(input(bobInput), bobEncrypted.writer, bobMapping.writer); err != nil {
+		t.Fatalf("bob step1: %v", err)
+	}
+
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobEncryptedA, aliceEncrypted, aliceMapping := newBuffer(), newBuffer(), newBuffer()
+	if _, err := alice.ReencryptBob(bobEncrypted.reader(t), bobEncryptedA.writer); err != nil {
+		t.Fatalf("alice reencrypt: %v", err)
+	}
+	if _, err := alice.Step1(input(aliceInput), aliceEncrypted.writer, aliceMapping.writer); err != nil {
+		t.Fatalf("alice step1: %v", err)
+	}
+
+	aliceProofs, err := psi.ProveEncryption(alice.ECDHKey, input(bobEncrypted.String()), bobEncryptedA.reader(t))
+	if err != nil {
+		t.Fatalf("ошибка построения доказательств alice: %v", err)
+	}
+	if err := psi.VerifyEncryption(aliceProofs, input(bobEncrypted.String()), input(bobEncryptedA.String()), true); err != nil {
+		t.Fatalf("доказательства alice отклонены: %v", err)
+	}
+
+	// Первая запись bob зашифрована другим ключом
+	records := strings.SplitAfter(strings.TrimSuffix(bobEncryptedA.String(), "\n"), "\n")
+	other, _ := psi.GenerateECDHKey()
+	substituted := newBuffer()
+	otherAlice := &psi.AliceSession{ECDHKey: other}
+	if _, err := otherAlice.ReencryptBob(input(strings.SplitAfter(bobEncrypted.String(), "\n")[0]), substituted.writer); err != nil {
+		t.Fatal(err)
+	}
+	substituted.reader(t)
+
+	for name, tampered := range map[string]string{
+		"другой ключ":         substituted.String() + strings.Join(records[1:], ""),
+		"пропущенная запись":  strings.Join(records[1:], ""),
+		"повторенная запись":  strings.Join(records, "") + "\n" + records[0],
+		"записи переставлены": records[1] + records[0] + strings.Join(records[2:], ""),
+	} {
+		err := psi.VerifyEncryption(aliceProofs, input(bobEncrypted.String()), input(tampered), true)
+		if !errors.Is(err, psi.ErrInvalidProof) {
+			t.Errorf("%s: ожидается ErrInvalidProof, получено %v", name, err)
+		}
+	}
+
+	bobFinal := newBuffer()
+	if _, err := bob.Step2(bobMapping.reader(t), bobEncryptedA.reader(t), aliceEncrypted.reader(t), bobFinal.writer); err != nil {
+		t.Fatalf("bob step2: %v", err)
+	}
+	bobProofs, err := psi.ProveEncryption(bob.ECDHKey, input(aliceEncrypted.String()), bobFinal.reader(t))
+	if err != nil {
+		t.Fatalf("ошибка построения доказательств bob: %v", err)
+	}
+	// Bob возвращает только совпавшие записи alice
+	if err := psi.VerifyEncryption(bobProofs, input(aliceEncrypted.String()), input(bobFinal.String()), false); err != nil {
+		t.Fatalf("доказательства bob отклонены: %v", err)
+	}
+	if err := psi.VerifyEncryption(aliceProofs, input(aliceEncrypted.String()), input(bobFinal.String()), false); !errors.Is(err, psi.ErrInvalidProof) {
+		t.Errorf("доказательства другой стороны: ожидается ErrInvalidProof, получено %v", err)
+	}
+}
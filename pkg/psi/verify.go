@@ -0,0 +1,25 @@
+package psi
+
+import (
+	"github.com/pkositsyn/psi/internal/crypto"
+	"github.com/pkositsyn/psi/internal/protocol"
+)
+
+// DLEQProofs - доказательства DLEQ того, что все точки файла зашифрованы
+// одним ключом с открытым ключом PublicKey
+type DLEQProofs = crypto.DLEQProofs
+
+// ProveEncryption строит доказательства для output - точек input, к которым
+// сторона применила key с сохранением индексов: H(phone_b)^B^A после
+// AliceSession.ReencryptBob или результата BobSession.Step2 и Step2Labeled.
+// Результат Step2Labeled зашифрован ключом BobSession.LabelKey, а не ECDHKey
+func ProveEncryption(key *ECDHKey, input, output RecordReader) (DLEQProofs, error) {
+	return protocol.ProveEncryption(input, output, key)
+}
+
+// VerifyEncryption проверяет доказательства другой стороны до следующего шага.
+// complete требует, чтобы output содержал каждую запись input, как после
+// ReencryptBob. При подмене возвращает ошибку, для которой errors.Is(err, ErrInvalidProof)
+func VerifyEncryption(proofs DLEQProofs, input, output RecordReader, complete bool) error {
+	return protocol.VerifyEncryption(input, output, proofs, complete)
+}
@@ -1,13 +1,16 @@
 package tests
 
 import (
+	"crypto/elliptic"
+	"encoding/hex"
 	"fmt"
+	"math/big"
 	"math/rand"
 	"testing"
 
-	"github.com/pkositsyn/psi/internal/commands"
 	"github.com/pkositsyn/psi/internal/crypto"
 	psio "github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/protocol"
 )
 
 func generateRandomPhone() string {
@@ -25,7 +28,7 @@ func generateBobData(n int) string {
 func generateAliceData(n int) string {
 	result := ""
 	for i := 0; i < n; i++ {
-		result += fmt.Sprintf("puid_%06d\t%s\n", i, generateRandomPhone())
+		result += fmt.Sprintf("%s\tpuid_%06d\n", generateRandomPhone(), i)
 	}
 	return result
 }
@@ -56,10 +59,12 @@ func benchmarkBobStep1(b *testing.B, n int) {
 		reader := psio.NewTSVReader(newMemReadCloser(input))
 		output := newMemWriteCloser()
 		writer := psio.NewTSVWriter(output)
+		writerMapping := psio.NewTSVWriter(newMemWriteCloser())
 
-		commands.ProcessBobStep1(reader, writer, keyK, keyB, 128)
+		protocol.ProcessBobStep1(reader, writer, writerMapping, keyK, keyB, crypto.LatestProtocolVersion, crypto.PointUncompressed, protocol.InputConfig{}, protocol.ExternalConfig{}, protocol.Padding{}, 128)
 
 		writer.Close()
+		writerMapping.Close()
 		reader.Close()
 	}
 }
@@ -83,7 +88,7 @@ func benchmarkAliceStep1Bob(b *testing.B, n int) {
 	keyB, _ := crypto.GenerateECDHKey()
 	keyA, _ := crypto.GenerateECDHKey()
 
-	bobEncrypted := partnerStep1(keyK, keyB, bobInput)
+	bobEncrypted, _ := partnerStep1(keyK, keyB, bobInput)
 
 	b.ResetTimer()
 	for b.Loop() {
@@ -91,7 +96,7 @@ func benchmarkAliceStep1Bob(b *testing.B, n int) {
 		outputPartner := newMemWriteCloser()
 		writerPartner := psio.NewTSVWriter(outputPartner)
 
-		commands.ProcessBobDataStep1(readerPartner, writerPartner, keyA, 128)
+		protocol.ProcessBobDataStep1(readerPartner, writerPartner, keyA, crypto.PointUncompressed, 128)
 
 		writerPartner.Close()
 		readerPartner.Close()
@@ -121,10 +126,12 @@ func benchmarkAliceStep1Alice(b *testing.B, n int) {
 		readerPassport := psio.NewTSVReader(newMemReadCloser(aliceInput))
 		outputPassport := newMemWriteCloser()
 		writerPassport := psio.NewTSVWriter(outputPassport)
+		writerMapping := psio.NewTSVWriter(newMemWriteCloser())
 
-		commands.ProcessAliceDataStep1(readerPassport, writerPassport, keyK, keyA, 128)
+		protocol.ProcessAliceDataStep1(readerPassport, writerPassport, writerMapping, keyK, keyA, crypto.LatestProtocolVersion, crypto.PointUncompressed, protocol.InputConfig{}, protocol.ExternalConfig{}, protocol.Padding{}, 128)
 
 		writerPassport.Close()
+		writerMapping.Close()
 		readerPassport.Close()
 	}
 }
@@ -153,30 +160,72 @@ func benchmarkBobStep2(b *testing.B, n int) {
 	keyB, _ := crypto.GenerateECDHKey()
 	keyA, _ := crypto.GenerateECDHKey()
 
-	partnerStep1Output := partnerStep1(keyK, keyB, bobInput)
-	bobEncryptedY, aliceEncrypted := passportStep1(keyK, keyA, partnerStep1Output, aliceInput)
+	partnerStep1Output, bobMapping := partnerStep1(keyK, keyB, bobInput)
+	bobEncryptedY, aliceEncrypted, _ := passportStep1(keyK, keyA, partnerStep1Output, aliceInput)
 
 	b.ResetTimer()
 	for b.Loop() {
 		readerPartnerEnc := psio.NewTSVReader(newMemReadCloser(bobEncryptedY))
-		bobEncMap, _ := commands.LoadIndexedData(readerPartnerEnc)
+		bobEncMap, _ := protocol.LoadIndexedData(readerPartnerEnc)
 		readerPartnerEnc.Close()
 
-		readerOriginal := psio.NewTSVReader(newMemReadCloser(bobInput))
-		originalData, _ := commands.LoadOriginalData(readerOriginal)
-		readerOriginal.Close()
+		readerMapping := psio.NewTSVReader(newMemReadCloser(bobMapping))
+		mappingData, _ := protocol.LoadBobMapping(readerMapping)
+		readerMapping.Close()
 
 		readerPassport := psio.NewTSVReader(newMemReadCloser(aliceEncrypted))
 		output := newMemWriteCloser()
 		writer := psio.NewTSVWriter(output)
 
-		commands.ProcessBobStep2(readerPassport, writer, keyB, bobEncMap, originalData, 128)
+		protocol.ProcessBobStep2(readerPassport, writer, keyB, bobEncMap, mappingData, crypto.PointUncompressed, protocol.OutputAll, 128)
 
 		writer.Close()
 		readerPassport.Close()
 	}
 }
 
+// Лимит памяти внешних бенчмарков заметно меньше объема данных,
+// чтобы сортировка сбрасывала прогоны на диск
+const benchmarkMemoryLimit = 1 << 20
+
+func BenchmarkBobStep2External_10000(b *testing.B) {
+	benchmarkBobStep2External(b, 10000)
+}
+
+func BenchmarkBobStep2External_100000(b *testing.B) {
+	benchmarkBobStep2External(b, 100000)
+}
+
+func benchmarkBobStep2External(b *testing.B, n int) {
+	bobInput := generateBobData(n)
+	aliceInput := generateAliceData(n)
+
+	keyK, _ := crypto.GenerateHMACKey()
+	keyB, _ := crypto.GenerateECDHKey()
+	keyA, _ := crypto.GenerateECDHKey()
+
+	partnerStep1Output, bobMapping := partnerStep1(keyK, keyB, bobInput)
+	bobEncryptedY, aliceEncrypted, _ := passportStep1(keyK, keyA, partnerStep1Output, aliceInput)
+
+	config := protocol.ExternalConfig{MemoryLimit: benchmarkMemoryLimit, TempDir: b.TempDir()}
+
+	b.ResetTimer()
+	for b.Loop() {
+		readerPartnerEnc := psio.NewTSVReader(newMemReadCloser(bobEncryptedY))
+		readerMapping := psio.NewTSVReader(newMemReadCloser(bobMapping))
+		readerPassport := psio.NewTSVReader(newMemReadCloser(aliceEncrypted))
+		output := newMemWriteCloser()
+		writer := psio.NewTSVWriter(output)
+
+		protocol.ProcessBobStep2External(readerPassport, writer, keyB, readerPartnerEnc, readerMapping, config, crypto.PointUncompressed, protocol.OutputAll, 128)
+
+		writer.Close()
+		readerPassport.Close()
+		readerMapping.Close()
+		readerPartnerEnc.Close()
+	}
+}
+
 func BenchmarkAliceStep2_100(b *testing.B) {
 	benchmarkAliceStep2(b, 100)
 }
@@ -197,28 +246,118 @@ func benchmarkAliceStep2(b *testing.B, n int) {
 	keyB, _ := crypto.GenerateECDHKey()
 	keyA, _ := crypto.GenerateECDHKey()
 
-	partnerStep1Output := partnerStep1(keyK, keyB, bobInput)
-	bobEncryptedY, aliceEncrypted := passportStep1(keyK, keyA, partnerStep1Output, aliceInput)
-	bobFinal := partnerStep2(keyB, bobInput, aliceEncrypted, bobEncryptedY)
+	partnerStep1Output, bobMapping := partnerStep1(keyK, keyB, bobInput)
+	bobEncryptedY, aliceEncrypted, aliceMapping := passportStep1(keyK, keyA, partnerStep1Output, aliceInput)
+	bobFinal := partnerStep2(keyB, bobMapping, aliceEncrypted, bobEncryptedY)
 
 	b.ResetTimer()
 	for b.Loop() {
 		readerPartner := psio.NewTSVReader(newMemReadCloser(bobFinal))
-		partnerData, _ := commands.LoadBobFinalData(readerPartner)
+		partnerData, _ := protocol.LoadBobFinalData(readerPartner)
 		readerPartner.Close()
 
-		readerPassport := psio.NewTSVReader(newMemReadCloser(aliceEncrypted))
+		readerPassport := psio.NewTSVReader(newMemReadCloser(aliceMapping))
 		output := newMemWriteCloser()
 		writer := psio.NewTSVWriter(output)
 
-		commands.ProcessAliceStep2(readerPassport, writer, partnerData)
+		protocol.ProcessAliceStep2(readerPassport, writer, partnerData, nil)
 
 		writer.Close()
 		readerPassport.Close()
 	}
 }
 
-func partnerStep1(keyK []byte, keyB *crypto.ECDHKey, input string) string {
+func BenchmarkAliceStep2External_10000(b *testing.B) {
+	benchmarkAliceStep2External(b, 10000)
+}
+
+func BenchmarkAliceStep2External_100000(b *testing.B) {
+	benchmarkAliceStep2External(b, 100000)
+}
+
+func benchmarkAliceStep2External(b *testing.B, n int) {
+	bobInput := generateBobData(n)
+	aliceInput := generateAliceData(n)
+
+	keyK, _ := crypto.GenerateHMACKey()
+	keyB, _ := crypto.GenerateECDHKey()
+	keyA, _ := crypto.GenerateECDHKey()
+
+	partnerStep1Output, bobMapping := partnerStep1(keyK, keyB, bobInput)
+	bobEncryptedY, aliceEncrypted, aliceMapping := passportStep1(keyK, keyA, partnerStep1Output, aliceInput)
+	bobFinal := partnerStep2(keyB, bobMapping, aliceEncrypted, bobEncryptedY)
+
+	config := protocol.ExternalConfig{MemoryLimit: benchmarkMemoryLimit, TempDir: b.TempDir()}
+
+	b.ResetTimer()
+	for b.Loop() {
+		readerPartner := psio.NewTSVReader(newMemReadCloser(bobFinal))
+		readerPassport := psio.NewTSVReader(newMemReadCloser(aliceMapping))
+		output := newMemWriteCloser()
+		writer := psio.NewTSVWriter(output)
+
+		protocol.ProcessAliceStep2External(readerPassport, writer, readerPartner, config, nil)
+
+		writer.Close()
+		readerPassport.Close()
+		readerPartner.Close()
+	}
+}
+
+// Умножение точки на ключ в сравнении с прежней реализацией на crypto/elliptic
+// и big.Int. Go 1.27, одно ядро, go test -bench ECDHApply -benchmem:
+//
+//	BenchmarkECDHApply/nistec      60300 ns/op     544 B/op     5 allocs/op
+//	BenchmarkECDHApply/elliptic    61300 ns/op    1520 B/op    20 allocs/op
+//
+// Начиная с Go 1.19 crypto/elliptic для P-256 сам вызывает nistec, поэтому
+// по времени реализации равны. nistec нужен не ради скорости: crypto/elliptic
+// с big.Int не гарантирует постоянного времени и устарел, а crypto/ecdh
+// отдает только x-координату общего секрета, тогда как протоколу нужна
+// точка целиком для перешифрования, сжатия и DLEQ
+func BenchmarkECDHApply(b *testing.B) {
+	keyK, _ := crypto.GenerateHMACKey()
+	key, _ := crypto.GenerateECDHKey()
+	point, _ := crypto.HashToGroup(crypto.ProtocolV2, nil, keyK, "phone", []byte(generateRandomPhone()))
+
+	b.Run("nistec", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := crypto.ECDHApply(key, point); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("elliptic", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ellipticECDHApply(key, point); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// ellipticECDHApply повторяет ECDHApply до перехода на nistec
+func ellipticECDHApply(key *crypto.ECDHKey, data string) (string, error) {
+	inputBytes, err := hex.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+
+	curve := elliptic.P256()
+	x := new(big.Int).SetBytes(inputBytes[1:33])
+	y := new(big.Int).SetBytes(inputBytes[33:65])
+	if !curve.IsOnCurve(x, y) {
+		return "", crypto.ErrInvalidPoint
+	}
+
+	rx, ry := curve.ScalarMult(x, y, key.Bytes())
+	return hex.EncodeToString(elliptic.Marshal(curve, rx, ry)), nil
+}
+
+func partnerStep1(keyK []byte, keyB *crypto.ECDHKey, input string) (string, string) {
 	reader := psio.NewTSVReader(newMemReadCloser(input))
 	defer reader.Close()
 
@@ -226,13 +365,18 @@ func partnerStep1(keyK []byte, keyB *crypto.ECDHKey, input string) string {
 	writer := psio.NewTSVWriter(output)
 	defer writer.Close()
 
-	commands.ProcessBobStep1(reader, writer, keyK, keyB, 512)
+	outputMapping := newMemWriteCloser()
+	writerMapping := psio.NewTSVWriter(outputMapping)
+	defer writerMapping.Close()
+
+	protocol.ProcessBobStep1(reader, writer, writerMapping, keyK, keyB, crypto.LatestProtocolVersion, crypto.PointUncompressed, protocol.InputConfig{}, protocol.ExternalConfig{}, protocol.Padding{}, 512)
 
 	writer.Close()
-	return output.String()
+	writerMapping.Close()
+	return output.String(), outputMapping.String()
 }
 
-func passportStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput string) (string, string) {
+func passportStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput string) (string, string, string) {
 	readerPartner := psio.NewTSVReader(newMemReadCloser(bobEncrypted))
 	defer readerPartner.Close()
 
@@ -240,7 +384,7 @@ func passportStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput s
 	writerPartner := psio.NewTSVWriter(outputPartner)
 	defer writerPartner.Close()
 
-	commands.ProcessBobDataStep1(readerPartner, writerPartner, keyA, 128)
+	protocol.ProcessBobDataStep1(readerPartner, writerPartner, keyA, crypto.PointUncompressed, 128)
 	writerPartner.Close()
 
 	readerPassport := psio.NewTSVReader(newMemReadCloser(aliceInput))
@@ -250,20 +394,25 @@ func passportStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput s
 	writerPassport := psio.NewTSVWriter(outputPassport)
 	defer writerPassport.Close()
 
-	commands.ProcessAliceDataStep1(readerPassport, writerPassport, keyK, keyA, 128)
+	outputMapping := newMemWriteCloser()
+	writerMapping := psio.NewTSVWriter(outputMapping)
+	defer writerMapping.Close()
+
+	protocol.ProcessAliceDataStep1(readerPassport, writerPassport, writerMapping, keyK, keyA, crypto.LatestProtocolVersion, crypto.PointUncompressed, protocol.InputConfig{}, protocol.ExternalConfig{}, protocol.Padding{}, 128)
 	writerPassport.Close()
+	writerMapping.Close()
 
-	return outputPartner.String(), outputPassport.String()
+	return outputPartner.String(), outputPassport.String(), outputMapping.String()
 }
 
-func partnerStep2(keyB *crypto.ECDHKey, originalInput, aliceEncrypted, bobEncryptedY string) string {
+func partnerStep2(keyB *crypto.ECDHKey, bobMapping, aliceEncrypted, bobEncryptedY string) string {
 	readerPartnerEnc := psio.NewTSVReader(newMemReadCloser(bobEncryptedY))
 	defer readerPartnerEnc.Close()
-	bobEncMap, _ := commands.LoadIndexedData(readerPartnerEnc)
+	bobEncMap, _ := protocol.LoadIndexedData(readerPartnerEnc)
 
-	readerOriginal := psio.NewTSVReader(newMemReadCloser(originalInput))
-	defer readerOriginal.Close()
-	originalData, _ := commands.LoadOriginalData(readerOriginal)
+	readerMapping := psio.NewTSVReader(newMemReadCloser(bobMapping))
+	defer readerMapping.Close()
+	mappingData, _ := protocol.LoadBobMapping(readerMapping)
 
 	readerPassport := psio.NewTSVReader(newMemReadCloser(aliceEncrypted))
 	defer readerPassport.Close()
@@ -272,7 +421,7 @@ func partnerStep2(keyB *crypto.ECDHKey, originalInput, aliceEncrypted, bobEncryp
 	writer := psio.NewTSVWriter(output)
 	defer writer.Close()
 
-	commands.ProcessBobStep2(readerPassport, writer, keyB, bobEncMap, originalData, 512)
+	protocol.ProcessBobStep2(readerPassport, writer, keyB, bobEncMap, mappingData, crypto.PointUncompressed, protocol.OutputAll, 512)
 
 	writer.Close()
 	return output.String()
@@ -0,0 +1,241 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkositsyn/psi/internal/manifest"
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+// psiBinary собирает утилиту один раз для всех тестов командной строки
+var psiBinary = sync.OnceValues(func() (string, error) {
+	dir, err := os.MkdirTemp("", "psi-cli")
+	if err != nil {
+		return "", err
+	}
+	binary := filepath.Join(dir, "psi")
+	if out, err := exec.Command("go", "build", "-o", binary, "github.com/pkositsyn/psi/cmd/psi").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ошибка сборки psi: %v\n%s", err, out)
+	}
+	return binary, nil
+})
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if binary, err := psiBinary(); err == nil {
+		os.RemoveAll(filepath.Dir(binary))
+	}
+	os.Exit(code)
+}
+
+// runPSI запускает psi в каталоге dir и возвращает стандартный вывод и stderr
+func runPSI(t *testing.T, dir string, stdin []byte, args ...string) ([]byte, string, error) {
+	t.Helper()
+
+	binary, err := psiBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	return stdout.Bytes(), stderr.String(), err
+}
+
+// mustRunPSI запускает psi и останавливает тест при ошибке
+func mustRunPSI(t *testing.T, dir string, stdin []byte, args ...string) []byte {
+	t.Helper()
+
+	stdout, stderr, err := runPSI(t, dir, stdin, args...)
+	if err != nil {
+		t.Fatalf("psi %s: %v\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return stdout
+}
+
+const (
+	cliBobData   = "+79991234567\tb_user_001\n+79991234568\tb_user_002\n+79991234569\tb_user_003\n+79991234570\tb_user_004\n"
+	cliAliceData = "+79991234567\ta_user_id_123\n+79991234570\ta_user_id_456\n+79991234569\ta_user_id_789\n+79990000000\ta_user_id_000\n"
+)
+
+func writeCLIData(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bob_data.tsv"), []byte(cliBobData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "alice_data.tsv"), []byte(cliAliceData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCLIStdioManifest(t *testing.T) {
+	dir := writeCLIData(t)
+
+	// Все передаваемые файлы идут через каналы, манифесты включены
+	bobEncrypted := mustRunPSI(t, dir, []byte(cliBobData), "bob-step1", "-i", "-", "-e", "-", "--output-compression", "none")
+	aliceEncrypted := mustRunPSI(t, dir, bobEncrypted, "alice-step1", "--in-encrypted", "-", "--out-encrypted-alice", "-", "--output-compression", "gzip")
+	bobFinal := mustRunPSI(t, dir, aliceEncrypted, "bob-step2", "--in-alice-enc", "-", "--output", "-")
+	aliceFinal := mustRunPSI(t, dir, bobFinal, "alice-step2", "--in-bob", "-", "--output", "-")
+
+	lines := strings.Split(strings.TrimSpace(string(aliceFinal)), "\n")
+	slices.Sort(lines)
+	expected := []string{"a_user_id_123\tb_user_001", "a_user_id_456\tb_user_004", "a_user_id_789\tb_user_003"}
+	if !slices.Equal(lines, expected) {
+		t.Errorf("получено %q, ожидалось %q", lines, expected)
+	}
+	for _, filename := range []string{"bob_step1_manifest.json", "alice_step1_manifest.json", "bob_step2_manifest.json", "alice_step2_manifest.json"} {
+		if _, err := os.Stat(filepath.Join(dir, filename)); err != nil {
+			t.Errorf("манифест не создан: %v", err)
+		}
+	}
+
+	t.Run("измененный поток", func(t *testing.T) {
+		lines := strings.SplitAfter(string(bobEncrypted), "\n")
+		lines[0], lines[1] = lines[1], lines[0]
+
+		_, stderr, err := runPSI(t, dir, []byte(strings.Join(lines, "")), "alice-step1", "--in-encrypted", "-", "--out-manifest", "tampered_manifest.json")
+		if err == nil || !strings.Contains(stderr, "стандартный ввод отклонен") {
+			t.Errorf("измененный поток принят: %v\n%s", err, stderr)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "tampered_manifest.json")); err == nil {
+			t.Error("манифест создан для отклоненного потока")
+		}
+	})
+}
+
+func TestCLIManifestRejected(t *testing.T) {
+	dir := writeCLIData(t)
+	mustRunPSI(t, dir, nil, "bob-step1")
+	// Манифест первого запуска alice устаревает после второго
+	mustRunPSI(t, dir, nil, "alice-step1", "--out-manifest", "alice_stale_manifest.json")
+	mustRunPSI(t, dir, nil, "alice-step1")
+
+	aliceManifest, err := manifest.Load(filepath.Join(dir, "alice_step1_manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKey := aliceManifest.PublicKey
+
+	other := writeCLIData(t)
+	mustRunPSI(t, other, nil, "bob-step1")
+	mustRunPSI(t, other, nil, "alice-step1")
+
+	// Тот же манифест, переподписанный чужим ключом: в нем ключ bob и сессия
+	_, forgedKey, _ := ed25519.GenerateKey(nil)
+	if err := aliceManifest.Save(filepath.Join(dir, "resigned_manifest.json"), forgedKey); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "alice_encrypted.tsv.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(filepath.Join(dir, "alice_tampered.tsv.gz"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"устаревший манифест", []string{"--in-manifest", "alice_stale_manifest.json"}},
+		{"манифест другого шага", []string{"--in-manifest", "bob_step1_manifest.json"}},
+		{"переподписанный манифест", []string{"--in-manifest", "resigned_manifest.json"}},
+		{"измененный файл", []string{"--in-alice-enc", "alice_tampered.tsv.gz"}},
+		{"другая сессия", []string{
+			"--in-manifest", filepath.Join(other, "alice_step1_manifest.json"),
+			"--in-alice-enc", filepath.Join(other, "alice_encrypted.tsv.gz"),
+			"--in-bob-enc", filepath.Join(other, "bob_encrypted_a.tsv.gz"),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"bob-step2", "--peer-public-key", aliceKey, "--output", "rejected.tsv.gz", "--out-manifest", "rejected_manifest.json"}, tc.args...)
+			_, stderr, err := runPSI(t, dir, nil, args...)
+			if err == nil || !strings.Contains(stderr, manifest.ErrMismatch.Error()) {
+				t.Errorf("манифест принят: %v\n%s", err, stderr)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "rejected_manifest.json")); err == nil {
+				t.Error("манифест создан после отклонения")
+			}
+		})
+	}
+
+	t.Run("ключ alice не задан", func(t *testing.T) {
+		_, stderr, err := runPSI(t, dir, nil, "bob-step2")
+		if err != nil || !strings.Contains(stderr, "--peer-public-key") {
+			t.Errorf("нет предупреждения о непроверенном ключе: %v\n%s", err, stderr)
+		}
+	})
+
+	t.Run("ключ alice задан", func(t *testing.T) {
+		_, stderr, err := runPSI(t, dir, nil, "bob-step2", "--peer-public-key", aliceKey)
+		if err != nil || strings.Contains(stderr, "Предупреждение") {
+			t.Errorf("ошибка или предупреждение с заданным ключом: %v\n%s", err, stderr)
+		}
+	})
+}
+
+func TestCLIRejectFile(t *testing.T) {
+	dir := t.TempDir()
+	// Строка 1 - невалидный телефон, строка 2 - лишнее поле
+	data := "+79991234567\tb_user_001\nabc\tb_user_002\n+79991234569\tb_user_003\textra\n+79991234570\tb_user_004\n"
+	if err := os.WriteFile(filepath.Join(dir, "bob_data.tsv"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, err := runPSI(t, dir, nil, "bob-step1", "--on-invalid", "reject-file", "--reject-output", "rejected.tsv")
+	if err != nil {
+		t.Fatalf("bob-step1: %v\n%s", err, stderr)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "rejected.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := readRecords(t, string(content))
+	expected := []struct {
+		row    string
+		reason error
+		fields []string
+	}{
+		{"1", psi.ErrInvalidPhone, []string{"abc", "b_user_002"}},
+		{"2", psi.ErrInvalidRecord, []string{"+79991234569", "b_user_003", "extra"}},
+	}
+	if len(rejected) != len(expected) {
+		t.Fatalf("ожидается %d отклоненных строк, получено %q", len(expected), rejected)
+	}
+	for i, e := range expected {
+		record := rejected[i]
+		if len(record) < 2 || record[0] != e.row || !strings.HasPrefix(record[1], e.reason.Error()) || !slices.Equal(record[2:], e.fields) {
+			t.Errorf("строка %d: получено %q, ожидалось %s \t %q... \t %q", i, record, e.row, e.reason, e.fields)
+		}
+	}
+
+	for _, line := range []string{
+		"Предупреждение: пропущено строк с ошибками: 2",
+		"Пропущено строк: 2 (невалидный идентификатор: 1, неверное число полей: 1)",
+		"Отклоненные строки: rejected.tsv",
+	} {
+		if !strings.Contains(stderr, line) {
+			t.Errorf("в выводе нет %q:\n%s", line, stderr)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+// Номер +79991234567 повторяется у обеих сторон, +79991234570 - у bob с одним b_user_id
+const (
+	duplicatesBobInput   = "+79991234567\tb_1\n+79991234568\tb_2\n+79991234567\tb_3\n+79991234569\tb_4\n+79991234570\tb_5\n+79991234570\tb_5\n"
+	duplicatesAliceInput = "+79991234567\ta_1\n+79991234569\ta_2\n+79991234567\ta_3\n+79991234570\ta_4\n"
+)
+
+type duplicatesRun struct {
+	bobPolicy, alicePolicy psi.DuplicatePolicy
+	memoryLimit            int64
+	labeled                bool
+}
+
+// runDuplicatesProtocol выполняет протокол с политиками повторов сторон и
+// возвращает отсортированные пары a_user_id \t b_user_id и статистику шага 1
+func runDuplicatesProtocol(t *testing.T, run duplicatesRun) ([]string, psi.Stats, psi.Stats) {
+	t.Helper()
+
+	bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Duplicates = run.bobPolicy
+	bob.MemoryLimit = run.memoryLimit
+	bob.TempDir = t.TempDir()
+
+	alice, err := psi.NewAliceSession(bob.HMACKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Duplicates = run.alicePolicy
+	alice.MemoryLimit = run.memoryLimit
+	alice.TempDir = t.TempDir()
+
+	reader := func(data string) psi.RecordReader {
+		return psi.NewTSVReader(newMemReadCloser(data))
+	}
+	step := func(name string, fn func(writers ...psi.RecordWriter) error, count int) []string {
+		t.Helper()
+		outputs := make([]*memWriteCloser, count)
+		writers := make([]*psi.TSVWriter, count)
+		records := make([]psi.RecordWriter, count)
+		for i := range outputs {
+			outputs[i] = newMemWriteCloser()
+			writers[i] = psi.NewTSVWriter(outputs[i])
+			records[i] = writers[i]
+		}
+		if err := fn(records...); err != nil {
+			t.Fatalf("ошибка %s: %v", name, err)
+		}
+		results := make([]string, count)
+		for i, writer := range writers {
+			writer.Close()
+			results[i] = outputs[i].String()
+		}
+		return results
+	}
+
+	var bobStats, aliceStats psi.Stats
+	bobStep1 := step("bob step1", func(w ...psi.RecordWriter) (err error) {
+		bobStats, err = bob.Step1(reader(duplicatesBobInput), w[0], w[1])
+		return err
+	}, 2)
+	bobEncryptedA := step("перешифрования bob", func(w ...psi.RecordWriter) error {
+		_, err := alice.ReencryptBob(reader(bobStep1[0]), w[0])
+		return err
+	}, 1)[0]
+	aliceStep1 := step("alice step1", func(w ...psi.RecordWriter) (err error) {
+		aliceStats, err = alice.Step1(reader(duplicatesAliceInput), w[0], w[1])
+		return err
+	}, 2)
+
+	var output string
+	if run.labeled {
+		bobStep2 := step("bob step2", func(w ...psi.RecordWriter) error {
+			_, err := bob.Step2Labeled(reader(bobStep1[1]), reader(bobEncryptedA), reader(aliceStep1[0]), w[0], w[1])
+			return err
+		}, 2)
+		output = step("alice step2", func(w ...psi.RecordWriter) error {
+			_, err := alice.Step2Labeled(reader(aliceStep1[1]), reader(bobStep2[0]), reader(bobStep2[1]), w[0])
+			return err
+		}, 1)[0]
+	} else {
+		bobFinal := step("bob step2", func(w ...psi.RecordWriter) error {
+			_, err := bob.Step2(reader(bobStep1[1]), reader(bobEncryptedA), reader(aliceStep1[0]), w[0])
+			return err
+		}, 1)[0]
+
+		// Повторы у bob идут записями с тем же индексом, по b_user_id в каждой,
+		// и доказательства DLEQ для них строятся как для одной записи
+		for _, record := range readRecords(t, bobFinal) {
+			if len(record) != 3 {
+				t.Errorf("в записи bob_final %q ожидается 3 поля", record)
+			}
+		}
+		proofs, err := psi.ProveEncryption(bob.ECDHKey, reader(aliceStep1[0]), reader(bobFinal))
+		if err != nil {
+			t.Fatalf("ошибка построения доказательств: %v", err)
+		}
+		if err := psi.VerifyEncryption(proofs, reader(aliceStep1[0]), reader(bobFinal), false); err != nil {
+			t.Errorf("доказательства отклонены: %v", err)
+		}
+
+		output = step("alice step2", func(w ...psi.RecordWriter) error {
+			_, err := alice.Step2(reader(aliceStep1[1]), reader(bobFinal), w[0])
+			return err
+		}, 1)[0]
+	}
+
+	var pairs []string
+	for _, record := range readRecords(t, output) {
+		pairs = append(pairs, strings.Join(record, "\t"))
+	}
+	slices.Sort(pairs)
+	return pairs, bobStats, aliceStats
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	tests := []struct {
+		name                   string
+		bobPolicy, alicePolicy psi.DuplicatePolicy
+		expected               []string
+	}{
+		{
+			// Повтор у обеих сторон дает все пары, каждая строка bob - отдельную
+			name:        "all",
+			bobPolicy:   psi.DuplicatesAll,
+			alicePolicy: psi.DuplicatesAll,
+			expected:    []string{"a_1\tb_1", "a_1\tb_3", "a_2\tb_4", "a_3\tb_1", "a_3\tb_3", "a_4\tb_5", "a_4\tb_5"},
+		},
+		{
+			name:     "default",
+			expected: []string{"a_1\tb_1", "a_1\tb_3", "a_2\tb_4", "a_3\tb_1", "a_3\tb_3", "a_4\tb_5", "a_4\tb_5"},
+		},
+		{
+			name:        "first",
+			bobPolicy:   psi.DuplicatesFirst,
+			alicePolicy: psi.DuplicatesFirst,
+			expected:    []string{"a_1\tb_1", "a_2\tb_4", "a_4\tb_5"},
+		},
+		{
+			name:        "last",
+			bobPolicy:   psi.DuplicatesLast,
+			alicePolicy: psi.DuplicatesLast,
+			expected:    []string{"a_2\tb_4", "a_3\tb_3", "a_4\tb_5"},
+		},
+		{
+			name:        "bob_first_alice_all",
+			bobPolicy:   psi.DuplicatesFirst,
+			alicePolicy: psi.DuplicatesAll,
+			expected:    []string{"a_1\tb_1", "a_2\tb_4", "a_3\tb_1", "a_4\tb_5"},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, memoryLimit := range []int64{0, 1 << 10} {
+			for _, labeled := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/memory_limit=%d/labeled=%t", tt.name, memoryLimit, labeled), func(t *testing.T) {
+					result, _, _ := runDuplicatesProtocol(t, duplicatesRun{
+						bobPolicy:   tt.bobPolicy,
+						alicePolicy: tt.alicePolicy,
+						memoryLimit: memoryLimit,
+						labeled:     labeled,
+					})
+					if !slices.Equal(result, tt.expected) {
+						t.Errorf("ожидается %q, получено %q", tt.expected, result)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestDuplicateReport(t *testing.T) {
+	_, bobStats, aliceStats := runDuplicatesProtocol(t, duplicatesRun{bobPolicy: psi.DuplicatesFirst, alicePolicy: psi.DuplicatesAll})
+
+	expectedBob := psi.DuplicateReport{IDs: 2, Repeats: 2, Dropped: 2, ByType: map[string]int{"phone": 2}}
+	if report := bobStats.Duplicates; report.IDs != expectedBob.IDs || report.Repeats != expectedBob.Repeats ||
+		report.Dropped != expectedBob.Dropped || report.ByType["phone"] != expectedBob.ByType["phone"] {
+		t.Errorf("bob: ожидается %+v, получено %+v", expectedBob, report)
+	}
+	if bobStats.Records != 6 {
+		t.Errorf("bob: ожидается 6 прочитанных строк, получено %d", bobStats.Records)
+	}
+
+	expectedAlice := psi.DuplicateReport{IDs: 1, Repeats: 1, ByType: map[string]int{"phone": 1}}
+	if report := aliceStats.Duplicates; report.IDs != expectedAlice.IDs || report.Repeats != expectedAlice.Repeats ||
+		report.Dropped != expectedAlice.Dropped || report.ByType["phone"] != expectedAlice.ByType["phone"] {
+		t.Errorf("alice: ожидается %+v, получено %+v", expectedAlice, report)
+	}
+}
+
+func TestDuplicatesError(t *testing.T) {
+	for _, memoryLimit := range []int64{0, 1 << 10} {
+		t.Run(fmt.Sprintf("memory_limit=%d", memoryLimit), func(t *testing.T) {
+			bob, err := psi.NewBobSession(psi.LatestProtocolVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob.Duplicates = psi.DuplicatesError
+			bob.MemoryLimit = memoryLimit
+			bob.TempDir = t.TempDir()
+
+			output, mapping := newMemWriteCloser(), newMemWriteCloser()
+			_, err = bob.Step1(psi.NewTSVReader(newMemReadCloser(duplicatesBobInput)), psi.NewTSVWriter(output), psi.NewTSVWriter(mapping))
+			if !errors.Is(err, psi.ErrDuplicateID) {
+				t.Fatalf("ожидается ErrDuplicateID, получено %v", err)
+			}
+
+			var rowErr *psi.RowError
+			if !errors.As(err, &rowErr) || rowErr.Row != 2 {
+				t.Errorf("ожидается ошибка строки 2, получено %v", err)
+			}
+		})
+	}
+}
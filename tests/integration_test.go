@@ -2,13 +2,16 @@ package tests
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 
-	"github.com/pkositsyn/psi/internal/commands"
 	"github.com/pkositsyn/psi/internal/crypto"
 	psio "github.com/pkositsyn/psi/internal/io"
+	"github.com/pkositsyn/psi/internal/protocol"
 )
 
 type memReadCloser struct {
@@ -111,23 +114,23 @@ func runPSIProtocol(t *testing.T, bobInput, aliceInput string) string {
 		t.Fatalf("ошибка генерации ECDH ключа B: %v", err)
 	}
 
-	bobStep1Output := bobStep1(keyK, keyB, bobInput)
+	bobStep1Output, bobMapping := bobStep1(keyK, keyB, bobInput)
 
 	keyA, err := crypto.GenerateECDHKey()
 	if err != nil {
 		t.Fatalf("ошибка генерации ECDH ключа A: %v", err)
 	}
 
-	bobEncryptedA, aliceEncrypted := aliceStep1(keyK, keyA, bobStep1Output, aliceInput)
+	bobEncryptedA, aliceEncrypted, aliceMapping := aliceStep1(keyK, keyA, bobStep1Output, aliceInput)
 
-	bobFinal := bobStep2(keyB, bobInput, aliceEncrypted, bobEncryptedA)
+	bobFinal := bobStep2(keyB, bobMapping, aliceEncrypted, bobEncryptedA)
 
-	aliceFinal := aliceStep2Helper(aliceEncrypted, bobFinal)
+	aliceFinal := aliceStep2Helper(aliceMapping, bobFinal)
 
 	return aliceFinal
 }
 
-func bobStep1(keyK []byte, keyB *crypto.ECDHKey, input string) string {
+func bobStep1(keyK []byte, keyB *crypto.ECDHKey, input string) (string, string) {
 	reader := psio.NewTSVReader(newMemReadCloser(input))
 	defer reader.Close()
 
@@ -135,13 +138,18 @@ func bobStep1(keyK []byte, keyB *crypto.ECDHKey, input string) string {
 	writer := psio.NewTSVWriter(output)
 	defer writer.Close()
 
-	commands.ProcessBobStep1(reader, writer, keyK, keyB, 128)
+	outputMapping := newMemWriteCloser()
+	writerMapping := psio.NewTSVWriter(outputMapping)
+	defer writerMapping.Close()
+
+	protocol.ProcessBobStep1(reader, writer, writerMapping, keyK, keyB, crypto.LatestProtocolVersion, crypto.PointUncompressed, protocol.InputConfig{}, protocol.ExternalConfig{}, protocol.Padding{}, 128)
 
 	writer.Close()
-	return output.String()
+	writerMapping.Close()
+	return output.String(), outputMapping.String()
 }
 
-func aliceStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput string) (string, string) {
+func aliceStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput string) (string, string, string) {
 	readerBob := psio.NewTSVReader(newMemReadCloser(bobEncrypted))
 	defer readerBob.Close()
 
@@ -149,7 +157,7 @@ func aliceStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput stri
 	writerBob := psio.NewTSVWriter(outputBob)
 	defer writerBob.Close()
 
-	commands.ProcessBobDataStep1(readerBob, writerBob, keyA, 128)
+	protocol.ProcessBobDataStep1(readerBob, writerBob, keyA, crypto.PointUncompressed, 128)
 	writerBob.Close()
 
 	readerAlice := psio.NewTSVReader(newMemReadCloser(aliceInput))
@@ -159,20 +167,25 @@ func aliceStep1(keyK []byte, keyA *crypto.ECDHKey, bobEncrypted, aliceInput stri
 	writerAlice := psio.NewTSVWriter(outputAlice)
 	defer writerAlice.Close()
 
-	commands.ProcessAliceDataStep1(readerAlice, writerAlice, keyK, keyA, 128)
+	outputMapping := newMemWriteCloser()
+	writerMapping := psio.NewTSVWriter(outputMapping)
+	defer writerMapping.Close()
+
+	protocol.ProcessAliceDataStep1(readerAlice, writerAlice, writerMapping, keyK, keyA, crypto.LatestProtocolVersion, crypto.PointUncompressed, protocol.InputConfig{}, protocol.ExternalConfig{}, protocol.Padding{}, 128)
 	writerAlice.Close()
+	writerMapping.Close()
 
-	return outputBob.String(), outputAlice.String()
+	return outputBob.String(), outputAlice.String(), outputMapping.String()
 }
 
-func bobStep2(keyB *crypto.ECDHKey, originalInput, aliceEncrypted, bobEncryptedA string) string {
+func bobStep2(keyB *crypto.ECDHKey, bobMapping, aliceEncrypted, bobEncryptedA string) string {
 	readerBobEnc := psio.NewTSVReader(newMemReadCloser(bobEncryptedA))
 	defer readerBobEnc.Close()
-	bobEncMap, _ := commands.LoadIndexedData(readerBobEnc)
+	bobEncMap, _ := protocol.LoadIndexedData(readerBobEnc)
 
-	readerOriginal := psio.NewTSVReader(newMemReadCloser(originalInput))
-	defer readerOriginal.Close()
-	originalData, _ := commands.LoadOriginalData(readerOriginal)
+	readerMapping := psio.NewTSVReader(newMemReadCloser(bobMapping))
+	defer readerMapping.Close()
+	mappingData, _ := protocol.LoadBobMapping(readerMapping)
 
 	readerAlice := psio.NewTSVReader(newMemReadCloser(aliceEncrypted))
 	defer readerAlice.Close()
@@ -181,30 +194,347 @@ func bobStep2(keyB *crypto.ECDHKey, originalInput, aliceEncrypted, bobEncryptedA
 	writer := psio.NewTSVWriter(output)
 	defer writer.Close()
 
-	commands.ProcessBobStep2(readerAlice, writer, keyB, bobEncMap, originalData, 128)
+	protocol.ProcessBobStep2(readerAlice, writer, keyB, bobEncMap, mappingData, crypto.PointUncompressed, protocol.OutputAll, 128)
 
 	writer.Close()
 	return output.String()
 }
 
-func aliceStep2Helper(aliceEncrypted, bobFinal string) string {
+func aliceStep2Helper(aliceMapping, bobFinal string) string {
 	readerBob := psio.NewTSVReader(newMemReadCloser(bobFinal))
 	defer readerBob.Close()
-	bobData, _ := commands.LoadBobFinalData(readerBob)
+	bobData, _ := protocol.LoadBobFinalData(readerBob)
 
-	readerAlice := psio.NewTSVReader(newMemReadCloser(aliceEncrypted))
+	readerAlice := psio.NewTSVReader(newMemReadCloser(aliceMapping))
 	defer readerAlice.Close()
 
 	output := newMemWriteCloser()
 	writer := psio.NewTSVWriter(output)
 	defer writer.Close()
 
-	commands.ProcessAliceStep2(readerAlice, writer, bobData)
+	protocol.ProcessAliceStep2(readerAlice, writer, bobData, nil)
 
 	writer.Close()
 	return output.String()
 }
 
+func TestPSIAliceUserIDsNotTransferred(t *testing.T) {
+	bobInput := "+79991234567\tb_user_001\n+79991234568\tb_user_002\n"
+	aliceInput := "+79991234567\ta_user_id_123\n+79991234570\ta_user_id_456\n"
+
+	keyK, _ := crypto.GenerateHMACKey()
+	keyB, _ := crypto.GenerateECDHKey()
+	keyA, _ := crypto.GenerateECDHKey()
+
+	bobEncrypted, bobMapping := bobStep1(keyK, keyB, bobInput)
+	bobEncryptedA, aliceEncrypted, aliceMapping := aliceStep1(keyK, keyA, bobEncrypted, aliceInput)
+
+	if strings.Contains(aliceEncrypted, "a_user_id") {
+		t.Fatal("файл для передачи bob не должен содержать a_user_id")
+	}
+
+	reader := psio.NewTSVReader(newMemReadCloser(aliceEncrypted))
+	defer reader.Close()
+	for {
+		record, err := reader.Read()
+		if err == psio.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ошибка чтения alice_encrypted: %v", err)
+		}
+		if len(record) != 2 {
+			t.Fatalf("ожидается 2 поля в alice_encrypted, получено %d", len(record))
+		}
+	}
+
+	bobFinal := bobStep2(keyB, bobMapping, aliceEncrypted, bobEncryptedA)
+
+	validateResult(t, aliceStep2Helper(aliceMapping, bobFinal), map[string]string{
+		"a_user_id_123": "b_user_001",
+	})
+}
+
+func TestPSILegacyAliceEncryptedMapping(t *testing.T) {
+	bobInput := "+79991234567\tb_user_001\n+79991234568\tb_user_002\n"
+	aliceInput := "+79991234567\ta_user_id_123\n+79991234568\ta_user_id_456\n"
+
+	keyK, _ := crypto.GenerateHMACKey()
+	keyB, _ := crypto.GenerateECDHKey()
+	keyA, _ := crypto.GenerateECDHKey()
+
+	bobEncrypted, bobMapping := bobStep1(keyK, keyB, bobInput)
+	bobEncryptedA, aliceEncrypted, aliceMapping := aliceStep1(keyK, keyA, bobEncrypted, aliceInput)
+
+	// Собираем файл старого формата: index \t H(phone_a)^A \t a_user_id
+	encrypted := readRecords(t, aliceEncrypted)
+	mapping := make(map[string]string)
+	for _, record := range readRecords(t, aliceMapping) {
+		mapping[record[0]] = record[1]
+	}
+
+	var legacy strings.Builder
+	for _, record := range encrypted {
+		legacy.WriteString(record[0] + "\t" + record[1] + "\t" + mapping[record[0]] + "\n")
+	}
+
+	bobFinal := bobStep2(keyB, bobMapping, legacy.String(), bobEncryptedA)
+
+	validateResult(t, aliceStep2Helper(legacy.String(), bobFinal), map[string]string{
+		"a_user_id_123": "b_user_001",
+		"a_user_id_456": "b_user_002",
+	})
+}
+
+func TestPSILabeledMode(t *testing.T) {
+	bobInput := "+79991234567\tb_user_001\n+79991234568\tb_user_002\n+79991234569\tb_user_003\n"
+	aliceInput := "+79991234567\ta_user_id_123\n+79991234570\ta_user_id_456\n+79991234569\ta_user_id_789\n"
+
+	keyK, _ := crypto.GenerateHMACKey()
+	keyB, _ := crypto.GenerateECDHKey()
+	keyA, _ := crypto.GenerateECDHKey()
+
+	bobEncrypted, bobMapping := bobStep1(keyK, keyB, bobInput)
+	bobEncryptedA, aliceEncrypted, aliceMapping := aliceStep1(keyK, keyA, bobEncrypted, aliceInput)
+
+	readerBobEnc := psio.NewTSVReader(newMemReadCloser(bobEncryptedA))
+	bobEncMap, _ := protocol.LoadIndexedData(readerBobEnc)
+	readerMapping := psio.NewTSVReader(newMemReadCloser(bobMapping))
+	mappingData, _ := protocol.LoadBobMapping(readerMapping)
+
+	labelsOutput := newMemWriteCloser()
+	labelsWriter := psio.NewTSVWriter(labelsOutput)
+	keyC, _ := crypto.GenerateECDHKey()
+	keyBC, _ := crypto.MultiplyKeys(keyB, keyC)
+	labelsCount, err := protocol.WriteBobLabels(labelsWriter, bobEncMap, mappingData, keyC, 128)
+	if err != nil {
+		t.Fatalf("ошибка создания меток: %v", err)
+	}
+	labelsWriter.Close()
+
+	if labelsCount != 3 {
+		t.Errorf("ожидается 3 метки, получено %d", labelsCount)
+	}
+	if strings.Contains(labelsOutput.String(), "b_user") {
+		t.Fatal("метки не должны содержать b_user_id в открытом виде")
+	}
+
+	bobFinalOutput := newMemWriteCloser()
+	bobFinalWriter := psio.NewTSVWriter(bobFinalOutput)
+	if _, err := protocol.ProcessBobStep2Labeled(psio.NewTSVReader(newMemReadCloser(aliceEncrypted)), bobFinalWriter, keyBC, crypto.PointUncompressed, 128); err != nil {
+		t.Fatalf("ошибка bob step2: %v", err)
+	}
+	bobFinalWriter.Close()
+
+	for _, record := range readRecords(t, bobFinalOutput.String()) {
+		if len(record) != 2 {
+			t.Fatalf("в режиме labeled bob не должен передавать b_user_id, получено %d полей", len(record))
+		}
+	}
+
+	bobData, _ := protocol.LoadBobFinalData(psio.NewTSVReader(newMemReadCloser(bobFinalOutput.String())))
+	labels, _ := protocol.LoadBobLabels(psio.NewTSVReader(newMemReadCloser(labelsOutput.String())))
+
+	output := newMemWriteCloser()
+	writer := psio.NewTSVWriter(output)
+	count, matched, err := protocol.ProcessAliceStep2Labeled(psio.NewTSVReader(newMemReadCloser(aliceMapping)), writer, bobData, labels, nil)
+	if err != nil {
+		t.Fatalf("ошибка alice step2: %v", err)
+	}
+	writer.Close()
+
+	if count != 3 || matched != 2 {
+		t.Errorf("ожидается 3 записи и 2 совпадения, получено %d и %d", count, matched)
+	}
+
+	validateResult(t, output.String(), map[string]string{
+		"a_user_id_123": "b_user_001",
+		"a_user_id_789": "b_user_003",
+	})
+}
+
+// Alice вычисляет H(phone_b)^B^A для всех записей bob на шаге 1, но без
+// ключа C не находит по ним ни одной метки
+func TestPSILabeledHidesUnmatchedLabels(t *testing.T) {
+	bobInput := "+79991234567\tb_user_001\n+79991234568\tb_user_002\n"
+	aliceInput := "+79991234567\ta_user_id_123\n"
+
+	keyK, _ := crypto.GenerateHMACKey()
+	keyB, _ := crypto.GenerateECDHKey()
+	keyA, _ := crypto.GenerateECDHKey()
+	keyC, _ := crypto.GenerateECDHKey()
+
+	bobEncrypted, bobMapping := bobStep1(keyK, keyB, bobInput)
+	bobEncryptedA, _, _ := aliceStep1(keyK, keyA, bobEncrypted, aliceInput)
+
+	bobEncMap, _ := protocol.LoadIndexedData(psio.NewTSVReader(newMemReadCloser(bobEncryptedA)))
+	mappingData, _ := protocol.LoadBobMapping(psio.NewTSVReader(newMemReadCloser(bobMapping)))
+
+	labelsOutput := newMemWriteCloser()
+	labelsWriter := psio.NewTSVWriter(labelsOutput)
+	if _, err := protocol.WriteBobLabels(labelsWriter, bobEncMap, mappingData, keyC, 128); err != nil {
+		t.Fatalf("ошибка создания меток: %v", err)
+	}
+	labelsWriter.Close()
+
+	labels, _ := protocol.LoadBobLabels(psio.NewTSVReader(newMemReadCloser(labelsOutput.String())))
+	if len(labels) != 2 {
+		t.Fatalf("ожидается 2 метки, получено %d", len(labels))
+	}
+
+	for point := range bobEncMap {
+		tag, err := crypto.LabelTag(point)
+		if err != nil {
+			t.Fatalf("ошибка вычисления тега: %v", err)
+		}
+		if _, found := labels[tag]; found {
+			t.Fatal("тег метки не должен вычисляться из H(phone_b)^B^A")
+		}
+
+		for _, encryptedLabel := range labels {
+			if _, err := crypto.DecryptLabel(point, encryptedLabel); err == nil {
+				t.Fatal("метка не должна расшифровываться по H(phone_b)^B^A")
+			}
+		}
+	}
+}
+
+func TestPSIExternalMatchesInMemory(t *testing.T) {
+	var bobInput, aliceInput strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&bobInput, "+7999%07d\tb_%d\n", i, i)
+		fmt.Fprintf(&aliceInput, "+7999%07d\ta_%d\n", i*2, i)
+	}
+
+	keyK, _ := crypto.GenerateHMACKey()
+	keyB, _ := crypto.GenerateECDHKey()
+	keyA, _ := crypto.GenerateECDHKey()
+
+	bobEncrypted, bobMapping := bobStep1(keyK, keyB, bobInput.String())
+	bobEncryptedA, aliceEncrypted, aliceMapping := aliceStep1(keyK, keyA, bobEncrypted, aliceInput.String())
+
+	// Лимит меньше объема данных: сортировка сбрасывает прогоны на диск
+	config := protocol.ExternalConfig{MemoryLimit: 4096, TempDir: t.TempDir()}
+	reader := func(data string) *psio.TSVReader {
+		return psio.NewTSVReader(newMemReadCloser(data))
+	}
+
+	t.Run("standard", func(t *testing.T) {
+		expected := aliceStep2Helper(aliceMapping, bobStep2(keyB, bobMapping, aliceEncrypted, bobEncryptedA))
+
+		bobFinal := newMemWriteCloser()
+		bobWriter := psio.NewTSVWriter(bobFinal)
+		count, matched, err := protocol.ProcessBobStep2External(reader(aliceEncrypted), bobWriter, keyB, reader(bobEncryptedA), reader(bobMapping), config, crypto.PointUncompressed, protocol.OutputAll, 128)
+		if err != nil {
+			t.Fatalf("ошибка bob step2: %v", err)
+		}
+		bobWriter.Close()
+
+		if count != 500 || matched != 250 {
+			t.Errorf("bob: ожидается 500 записей и 250 совпадений, получено %d и %d", count, matched)
+		}
+
+		output := newMemWriteCloser()
+		writer := psio.NewTSVWriter(output)
+		count, matched, err = protocol.ProcessAliceStep2External(reader(aliceMapping), writer, reader(bobFinal.String()), config, nil)
+		if err != nil {
+			t.Fatalf("ошибка alice step2: %v", err)
+		}
+		writer.Close()
+
+		if count != 500 || matched != 250 {
+			t.Errorf("alice: ожидается 500 записей и 250 совпадений, получено %d и %d", count, matched)
+		}
+
+		assertSameRecords(t, output.String(), expected)
+	})
+
+	t.Run("labeled", func(t *testing.T) {
+		keyC, _ := crypto.GenerateECDHKey()
+		keyBC, _ := crypto.MultiplyKeys(keyB, keyC)
+
+		labels := newMemWriteCloser()
+		labelsWriter := psio.NewTSVWriter(labels)
+		labelsCount, err := protocol.WriteBobLabelsExternal(labelsWriter, reader(bobEncryptedA), reader(bobMapping), keyC, config, 128)
+		if err != nil {
+			t.Fatalf("ошибка создания меток: %v", err)
+		}
+		labelsWriter.Close()
+
+		if labelsCount != 500 {
+			t.Errorf("ожидается 500 меток, получено %d", labelsCount)
+		}
+
+		bobFinal := newMemWriteCloser()
+		bobWriter := psio.NewTSVWriter(bobFinal)
+		if _, err := protocol.ProcessBobStep2Labeled(reader(aliceEncrypted), bobWriter, keyBC, crypto.PointUncompressed, 128); err != nil {
+			t.Fatalf("ошибка bob step2: %v", err)
+		}
+		bobWriter.Close()
+
+		bobData, _ := protocol.LoadBobFinalData(reader(bobFinal.String()))
+		labelsData, _ := protocol.LoadBobLabels(reader(labels.String()))
+
+		expected := newMemWriteCloser()
+		expectedWriter := psio.NewTSVWriter(expected)
+		protocol.ProcessAliceStep2Labeled(reader(aliceMapping), expectedWriter, bobData, labelsData, nil)
+		expectedWriter.Close()
+
+		output := newMemWriteCloser()
+		writer := psio.NewTSVWriter(output)
+		count, matched, err := protocol.ProcessAliceStep2LabeledExternal(reader(aliceMapping), writer, reader(bobFinal.String()), reader(labels.String()), config, nil)
+		if err != nil {
+			t.Fatalf("ошибка alice step2: %v", err)
+		}
+		writer.Close()
+
+		if count != 500 || matched != 250 {
+			t.Errorf("ожидается 500 записей и 250 совпадений, получено %d и %d", count, matched)
+		}
+
+		assertSameRecords(t, output.String(), expected.String())
+	})
+
+	if entries, _ := os.ReadDir(config.TempDir); len(entries) != 0 {
+		t.Errorf("временные файлы не удалены: %d", len(entries))
+	}
+}
+
+// assertSameRecords сравнивает наборы записей без учета порядка
+func assertSameRecords(t *testing.T, actual, expected string) {
+	t.Helper()
+
+	join := func(data string) []string {
+		var lines []string
+		for _, record := range readRecords(t, data) {
+			lines = append(lines, strings.Join(record, "\t"))
+		}
+		slices.Sort(lines)
+		return lines
+	}
+
+	if !slices.Equal(join(actual), join(expected)) {
+		t.Error("результат отличается от обработки в памяти")
+	}
+}
+
+func readRecords(t *testing.T, data string) [][]string {
+	reader := psio.NewTSVReader(newMemReadCloser(data))
+	defer reader.Close()
+
+	var records [][]string
+	for {
+		record, err := reader.Read()
+		if err == psio.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("ошибка чтения записей: %v", err)
+		}
+		records = append(records, record)
+	}
+}
+
 func TestPSIInvalidPhoneFormat(t *testing.T) {
 	invalidPartnerData := "79991234567\tb_user_001\n+79991234568\tb_user_002\n"
 
@@ -218,7 +548,7 @@ func TestPSIInvalidPhoneFormat(t *testing.T) {
 	writer := psio.NewTSVWriter(output)
 	defer writer.Close()
 
-	_, err := commands.ProcessBobStep1(reader, writer, keyK, keyB, 512)
+	_, _, err := protocol.ProcessBobStep1(reader, writer, psio.NewTSVWriter(newMemWriteCloser()), keyK, keyB, crypto.LatestProtocolVersion, crypto.PointUncompressed, protocol.InputConfig{}, protocol.ExternalConfig{}, protocol.Padding{}, 512)
 	if err == nil {
 		t.Fatal("ожидалась ошибка валидации телефона, но её не было")
 	}
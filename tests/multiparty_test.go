@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+// runMultiPartyProtocol выполняет протокол для len(inputs) сторон, сторона 0 -
+// получатель. Набор каждой стороны проходит по кольцу через все остальные стороны.
+// Возвращает отсортированные user_id пересечения
+func runMultiPartyProtocol(t *testing.T, inputs []string, memoryLimit int64) []string {
+	t.Helper()
+
+	hmacKey, err := psi.GenerateHMACKey(psi.LatestProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parties := make([]*psi.PartySession, len(inputs))
+	for i := range parties {
+		parties[i], err = psi.NewPartySession(hmacKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parties[i].MemoryLimit = memoryLimit
+		parties[i].TempDir = t.TempDir()
+	}
+
+	sets := make([]string, len(inputs))
+	mapping := newMemWriteCloser()
+	mappingWriter := psi.NewTSVWriter(mapping)
+	for i, party := range parties {
+		output := newMemWriteCloser()
+		writer := psi.NewTSVWriter(output)
+
+		// Маппинг создает только получатель
+		var partyMapping psi.RecordWriter
+		if i == 0 {
+			partyMapping = mappingWriter
+		}
+
+		if _, err := party.Step1(psi.NewTSVReader(newMemReadCloser(inputs[i])), writer, partyMapping); err != nil {
+			t.Fatalf("ошибка шага 1 стороны %d: %v", i, err)
+		}
+		writer.Close()
+		sets[i] = output.String()
+	}
+	mappingWriter.Close()
+
+	for hop := 1; hop < len(parties); hop++ {
+		for i := range sets {
+			output := newMemWriteCloser()
+			writer := psi.NewTSVWriter(output)
+			if _, err := parties[(i+hop)%len(parties)].Reencrypt(psi.NewTSVReader(newMemReadCloser(sets[i])), writer); err != nil {
+				t.Fatalf("ошибка перешифрования набора %d: %v", i, err)
+			}
+			writer.Close()
+			sets[i] = output.String()
+		}
+	}
+
+	for i, set := range sets {
+		fields := 1
+		if i == 0 {
+			fields = 2
+		}
+		for _, record := range readRecords(t, set) {
+			if len(record) != fields {
+				t.Fatalf("в наборе стороны %d ожидается %d полей, получено %d", i, fields, len(record))
+			}
+		}
+	}
+
+	others := make([]psi.RecordReader, 0, len(sets)-1)
+	for _, set := range sets[1:] {
+		others = append(others, psi.NewTSVReader(newMemReadCloser(set)))
+	}
+
+	output := newMemWriteCloser()
+	writer := psi.NewTSVWriter(output)
+	stats, err := parties[0].Intersect(psi.NewTSVReader(newMemReadCloser(sets[0])), psi.NewTSVReader(newMemReadCloser(mapping.String())), others, writer)
+	if err != nil {
+		t.Fatalf("ошибка вычисления пересечения: %v", err)
+	}
+	writer.Close()
+
+	var result []string
+	for _, record := range readRecords(t, output.String()) {
+		result = append(result, record[0])
+	}
+	slices.Sort(result)
+
+	if stats.Matched != len(result) {
+		t.Errorf("Stats.Matched = %d, записано %d", stats.Matched, len(result))
+	}
+	return result
+}
+
+func TestMultiPartyThreeParties(t *testing.T) {
+	inputs := []string{
+		"+79990000001\tr_1\n+79990000002\tr_2\n+79990000003\tr_3\n+79990000004\tr_4\n+79990000005\tr_5\n",
+		"+79990000003\tp1_3\n+79990000001\tp1_1\n+79990000002\tp1_2\n+79990000006\tp1_6\n",
+		"+79990000002\tp2_2\n+79990000007\tp2_7\n+79990000004\tp2_4\n+79990000003\tp2_3\n",
+	}
+
+	result := runMultiPartyProtocol(t, inputs, 0)
+	if expected := []string{"r_2", "r_3"}; !slices.Equal(result, expected) {
+		t.Errorf("ожидается %v, получено %v", expected, result)
+	}
+}
+
+func TestMultiPartyFourParties(t *testing.T) {
+	inputs := []string{
+		"+79990000001\tr_1\n+79990000002\tr_2\n+79990000003\tr_3\n+79990000004\tr_4\n+79990000005\tr_5\n",
+		"+79990000003\tp1_3\n+79990000001\tp1_1\n+79990000002\tp1_2\n+79990000006\tp1_6\n",
+		"+79990000002\tp2_2\n+79990000007\tp2_7\n+79990000004\tp2_4\n+79990000003\tp2_3\n",
+		"+79990000008\tp3_8\n+79990000003\tp3_3\n+79990000001\tp3_1\n",
+	}
+
+	for _, memoryLimit := range []int64{0, 1 << 10} {
+		t.Run(fmt.Sprintf("memory_limit=%d", memoryLimit), func(t *testing.T) {
+			result := runMultiPartyProtocol(t, inputs, memoryLimit)
+			if expected := []string{"r_3"}; !slices.Equal(result, expected) {
+				t.Errorf("ожидается %v, получено %v", expected, result)
+			}
+		})
+	}
+}
+
+func TestMultiPartyLarge(t *testing.T) {
+	// Сторона i содержит номера, кратные i+1: пересечение четырех сторон -
+	// номера получателя, кратные 12
+	inputs := make([]string, 4)
+	for i := range inputs {
+		var input strings.Builder
+		for n := 0; n < 600; n += i + 1 {
+			fmt.Fprintf(&input, "+7999%07d\tu_%d\n", n, n)
+		}
+		inputs[i] = input.String()
+	}
+
+	var expected []string
+	for n := 0; n < 600; n += 12 {
+		expected = append(expected, fmt.Sprintf("u_%d", n))
+	}
+	slices.Sort(expected)
+
+	result := runMultiPartyProtocol(t, inputs, 0)
+	if !slices.Equal(result, expected) {
+		t.Errorf("ожидается %d совпадений, получено %d", len(expected), len(result))
+	}
+}
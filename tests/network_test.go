@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkositsyn/psi/internal/transport/transporttest"
+	"github.com/pkositsyn/psi/pkg/psi"
+)
+
+type networkResult struct {
+	output  string
+	count   int
+	matched int
+	err     error
+}
+
+func runNetworkProtocol(t *testing.T, bobInput, aliceInput, bobMode, aliceMode string) (networkResult, error) {
+	return runNetworkConfigs(t, bobInput, aliceInput, psi.NetworkConfig{Mode: bobMode}, psi.NetworkConfig{Mode: aliceMode})
+}
+
+func runNetworkConfigs(t *testing.T, bobInput, aliceInput string, bobConfig, aliceConfig psi.NetworkConfig) (networkResult, error) {
+	server, client := transporttest.Pipe(t, transporttest.NewCertificates(t))
+
+	bobErrCh := make(chan error, 1)
+	go func() {
+		openInput := func() (psi.RecordReadCloser, error) {
+			return psi.NewTSVReader(strings.NewReader(bobInput)), nil
+		}
+		_, err := psi.RunBobNetwork(server, openInput, bobConfig)
+		bobErrCh <- err
+	}()
+
+	var output strings.Builder
+	writer := psi.NewTSVWriter(&output)
+	reader := psi.NewTSVReader(strings.NewReader(aliceInput))
+
+	aliceConfig.TempDir = t.TempDir()
+	stats, err := psi.RunAliceNetwork(client, reader, writer, aliceConfig)
+	writer.Close()
+	client.Close()
+
+	return networkResult{output.String(), stats.Records, stats.Matched, err}, <-bobErrCh
+}
+
+func TestNetworkProtocol(t *testing.T) {
+	bobInput := "+79991234567\tb_user_001\n+79991234568\tb_user_002\n+79991234569\tb_user_003\n+79991234570\tb_user_004\n"
+	aliceInput := "+79991234567\ta_user_id_123\n+79991234570\ta_user_id_456\n+79991234569\ta_user_id_789\n+79990000000\ta_user_id_000\n"
+
+	for _, mode := range []string{"standard", "labeled"} {
+		t.Run(mode, func(t *testing.T) {
+			result, bobErr := runNetworkProtocol(t, bobInput, aliceInput, mode, mode)
+			if bobErr != nil {
+				t.Fatalf("ошибка на стороне bob: %v", bobErr)
+			}
+			if result.err != nil {
+				t.Fatalf("ошибка на стороне alice: %v", result.err)
+			}
+
+			if result.count != 4 || result.matched != 3 {
+				t.Errorf("ожидается 4 записи и 3 совпадения, получено %d и %d", result.count, result.matched)
+			}
+
+			validateResult(t, result.output, map[string]string{
+				"a_user_id_123": "b_user_001",
+				"a_user_id_456": "b_user_004",
+				"a_user_id_789": "b_user_003",
+			})
+		})
+	}
+}
+
+func TestNetworkProtocolLarge(t *testing.T) {
+	// Объем больше буферов соединения: проверяем отсутствие взаимной блокировки
+	var bob, alice strings.Builder
+	expected := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&bob, "+7999%07d\tb_%d\n", i, i)
+		if i%2 == 0 {
+			fmt.Fprintf(&alice, "+7999%07d\ta_%d\n", i, i)
+			expected[fmt.Sprintf("a_%d", i)] = fmt.Sprintf("b_%d", i)
+		} else {
+			fmt.Fprintf(&alice, "+7888%07d\ta_%d\n", i, i)
+		}
+	}
+
+	result, bobErr := runNetworkProtocol(t, bob.String(), alice.String(), "standard", "standard")
+	if bobErr != nil {
+		t.Fatalf("ошибка на стороне bob: %v", bobErr)
+	}
+	if result.err != nil {
+		t.Fatalf("ошибка на стороне alice: %v", result.err)
+	}
+
+	validateResult(t, result.output, expected)
+}
+
+func TestNetworkProtocolModeMismatch(t *testing.T) {
+	bobInput := "+79991234567\tb_user_001\n"
+	aliceInput := "+79991234567\ta_user_id_123\n"
+
+	result, bobErr := runNetworkProtocol(t, bobInput, aliceInput, "standard", "labeled")
+	if result.err == nil {
+		t.Fatal("ожидалась ошибка на стороне alice")
+	}
+
+	if !errors.Is(result.err, psi.ErrModeMismatch) {
+		t.Errorf("ожидалась ErrModeMismatch, получено %v", result.err)
+	}
+
+	var remote *psi.RemoteError
+	if !errors.As(bobErr, &remote) {
+		t.Fatalf("bob должен получить ошибку от alice, получено %v", bobErr)
+	}
+}
+
+func TestNetworkProtocolMinVersion(t *testing.T) {
+	bobInput := "+79991234567\tb_user_001\n"
+	aliceInput := "+79991234567\ta_user_id_123\n"
+	bobConfig := psi.NetworkConfig{Version: psi.ProtocolV1}
+
+	result, bobErr := runNetworkConfigs(t, bobInput, aliceInput, bobConfig, psi.NetworkConfig{})
+	if !errors.Is(result.err, psi.ErrUnsupportedVersion) {
+		t.Fatalf("alice должна отклонить версию 1, получено %v", result.err)
+	}
+	var remote *psi.RemoteError
+	if !errors.As(bobErr, &remote) {
+		t.Fatalf("bob должен получить ошибку от alice, получено %v", bobErr)
+	}
+
+	// Alice, явно допускающая версию 1, выполняет протокол
+	result, bobErr = runNetworkConfigs(t, bobInput, aliceInput, bobConfig, psi.NetworkConfig{Version: psi.ProtocolV1})
+	if bobErr != nil || result.err != nil {
+		t.Fatalf("ожидается успешное выполнение, получено bob: %v, alice: %v", bobErr, result.err)
+	}
+	validateResult(t, result.output, map[string]string{"a_user_id_123": "b_user_001"})
+}